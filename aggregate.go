@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// aggregateRE matches the expression form of aggregate, e.g.
+	// sum by (datname, state)
+	aggregateRE = regexp.MustCompile(`^\s*(\w+)\s*(?:by\s*\(([^)]*)\))?\s*$`)
+	// descHelpRE extracts the quoted help from the string representation of
+	// a metric descriptor
+	descHelpRE = regexp.MustCompile(`help: ("(?:[^"\\]|\\.)*")`)
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (a *Aggregate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err == nil {
+		match := aggregateRE.FindStringSubmatch(expr)
+		if match == nil {
+			return fmt.Errorf("invalid aggregate %q, must be like sum by (label, ...)", expr)
+		}
+		*a = Aggregate{Function: match[1]}
+		for _, label := range strings.Split(match[2], ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				a.By = append(a.By, label)
+			}
+		}
+		return nil
+	}
+	type plain Aggregate
+	if err := unmarshal((*plain)(a)); err != nil {
+		return fmt.Errorf("aggregate must be an expression or a map with function, by and keep_series: %v", err)
+	}
+	return nil
+}
+
+func (a *Aggregate) validate() error {
+	switch a.Function {
+	case aggregationSum, aggregationAvg, aggregationMax, aggregationMin:
+	default:
+		return fmt.Errorf("unknown function %q, must be one of %s, %s, %s or %s", a.Function, aggregationSum, aggregationAvg, aggregationMax, aggregationMin)
+	}
+	for _, label := range a.By {
+		if !validLabelNameRE.MatchString(label) {
+			return fmt.Errorf("invalid label name %q", label)
+		}
+	}
+	return nil
+}
+
+// aggregateGroup is an aggregated series
+type aggregateGroup struct {
+	name        string
+	help        string
+	labelNames  []string
+	labelValues []string
+	value       float64
+	count       int
+	counter     bool // all series are counters
+}
+
+// apply returns the metrics with the gauges and counters combined into the
+// aggregated series. Histograms and summaries are returned as they are.
+func (a *Aggregate) apply(metrics []prometheus.Metric) []prometheus.Metric {
+	var result []prometheus.Metric
+	var order []string
+	groups := make(map[string]*aggregateGroup)
+	for _, m := range metrics {
+		name, pb, ok := metricSample(m)
+		if !ok || (pb.Gauge == nil && pb.Counter == nil && pb.Untyped == nil) {
+			result = append(result, m)
+			continue
+		}
+		if a.KeepSeries {
+			result = append(result, m)
+			name += "_" + a.Function
+		}
+		value := sampleValues(pb)[""]
+		labelNames, labelValues := a.groupLabels(pb.GetLabel())
+		key := name + "\xff" + strings.Join(labelValues, "\xff")
+		grp, found := groups[key]
+		if !found {
+			grp = &aggregateGroup{
+				name:        name,
+				help:        descHelp(m.Desc()),
+				labelNames:  labelNames,
+				labelValues: labelValues,
+				value:       value,
+				count:       1,
+				counter:     pb.Counter != nil,
+			}
+			groups[key] = grp
+			order = append(order, key)
+			continue
+		}
+		switch a.Function {
+		case aggregationMax:
+			if value > grp.value {
+				grp.value = value
+			}
+		case aggregationMin:
+			if value < grp.value {
+				grp.value = value
+			}
+		case aggregationSum, aggregationAvg:
+			grp.value += value
+		}
+		grp.count++
+		grp.counter = grp.counter && pb.Counter != nil
+	}
+	for _, key := range order {
+		grp := groups[key]
+		value := grp.value
+		if a.Function == aggregationAvg {
+			value /= float64(grp.count)
+		}
+		// only sums of counters are monotonic
+		valueType := prometheus.GaugeValue
+		if grp.counter && a.Function == aggregationSum {
+			valueType = prometheus.CounterValue
+		}
+		desc := prometheus.NewDesc(grp.name, grp.help, grp.labelNames, nil)
+		m, err := prometheus.NewConstMetric(desc, valueType, value, grp.labelValues...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(desc, err)
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// groupLabels returns the sorted names and values of the labels of the
+// aggregated series, sql_job and the By labels present in the series.
+func (a *Aggregate) groupLabels(labels []*dto.LabelPair) ([]string, []string) {
+	sorted := make([]*dto.LabelPair, 0, len(a.By)+1)
+	for _, l := range labels {
+		if l.GetName() == "sql_job" || containsString(a.By, l.GetName()) {
+			sorted = append(sorted, l)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	names := make([]string, 0, len(sorted))
+	values := make([]string, 0, len(sorted))
+	for _, l := range sorted {
+		names = append(names, l.GetName())
+		values = append(values, l.GetValue())
+	}
+	return names, values
+}
+
+// descHelp returns the help of the metric descriptor.
+func descHelp(desc *prometheus.Desc) string {
+	match := descHelpRE.FindStringSubmatch(desc.String())
+	if match == nil {
+		return ""
+	}
+	help, err := strconv.Unquote(match[1])
+	if err != nil {
+		return ""
+	}
+	return help
+}
+
+// queryMetrics returns the current metrics of the query and its further
+// result sets on all connections, aggregated if the job aggregates its series.
+// Only the queries and result sets matching are included, all if match is
+// nil.
+func (j *Job) queryMetrics(q *Query, match func(*Query) bool) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	for _, q := range append([]*Query{q}, q.ResultSets...) {
+		if q == nil || (match != nil && !match(q)) {
+			continue
+		}
+		q.Lock()
+		for conn := range q.metrics {
+			metrics = append(metrics, q.freshMetrics(conn)...)
+		}
+		q.Unlock()
+	}
+	if j.Aggregate == nil {
+		return metrics
+	}
+	return j.Aggregate.apply(metrics)
+}
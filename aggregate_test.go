@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+// metricsCollector exports a fixed set of metrics
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+func TestAggregate_UnmarshalYAML(t *testing.T) {
+	for _, tc := range []struct {
+		yaml     string
+		expected Aggregate
+		err      string
+	}{
+		{yaml: `sum by (datname, state)`, expected: Aggregate{Function: "sum", By: []string{"datname", "state"}}},
+		{yaml: `max`, expected: Aggregate{Function: "max"}},
+		{
+			yaml:     "{function: avg, by: [datname], keep_series: true}",
+			expected: Aggregate{Function: "avg", By: []string{"datname"}, KeepSeries: true},
+		},
+		{yaml: `sum without (host)`, err: `invalid aggregate "sum without (host)", must be like sum by (label, ...)`},
+	} {
+		var a Aggregate
+		err := yaml.Unmarshal([]byte(tc.yaml), &a)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.yaml, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.yaml, err)
+			continue
+		}
+		if diff := pretty.Compare(tc.expected, a); diff != "" {
+			t.Errorf("%s: unexpected aggregate (-want +got):\n\n%s", tc.yaml, diff)
+		}
+	}
+}
+
+func TestAggregate_apply(t *testing.T) {
+	gauge := prometheus.NewDesc("sql_connections", "Connections", []string{"host", "datname"}, prometheus.Labels{"sql_job": "shards"})
+	counter := prometheus.NewDesc("sql_commits_total", "Commits", []string{"host", "datname"}, prometheus.Labels{"sql_job": "shards"})
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(gauge, prometheus.GaugeValue, 10, "shard1", "app"),
+		prometheus.MustNewConstMetric(gauge, prometheus.GaugeValue, 20, "shard2", "app"),
+		prometheus.MustNewConstMetric(gauge, prometheus.GaugeValue, 5, "shard1", "other"),
+		prometheus.MustNewConstMetric(counter, prometheus.CounterValue, 100, "shard1", "app"),
+		prometheus.MustNewConstMetric(counter, prometheus.CounterValue, 200, "shard2", "app"),
+	}
+
+	a := &Aggregate{Function: aggregationSum, By: []string{"datname"}}
+	expected := `
+# HELP sql_commits_total Commits
+# TYPE sql_commits_total counter
+sql_commits_total{datname="app",sql_job="shards"} 300
+# HELP sql_connections Connections
+# TYPE sql_connections gauge
+sql_connections{datname="app",sql_job="shards"} 30
+sql_connections{datname="other",sql_job="shards"} 5
+`
+	if err := testutil.CollectAndCompare(metricsCollector(a.apply(metrics)), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	a = &Aggregate{Function: aggregationMax, KeepSeries: true}
+	expected = `
+# HELP sql_connections Connections
+# TYPE sql_connections gauge
+sql_connections{datname="app",host="shard1",sql_job="shards"} 10
+sql_connections{datname="app",host="shard2",sql_job="shards"} 20
+sql_connections{datname="other",host="shard1",sql_job="shards"} 5
+# HELP sql_connections_max Connections
+# TYPE sql_connections_max gauge
+sql_connections_max{sql_job="shards"} 20
+`
+	if err := testutil.CollectAndCompare(metricsCollector(a.apply(metrics[:3])), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
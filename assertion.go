@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	operandRows = iota
+	operandValue
+	operandNumber
+)
+
+// comparisons are the operators of assertions, two character operators
+// first so they are matched before their prefixes
+var comparisons = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// operand is a side of the comparison of an assertion: the number of rows,
+// the value of a column or a number.
+type operand struct {
+	kind   int
+	column string
+	number float64
+}
+
+// condition is a parsed assertion expression.
+type condition struct {
+	left, right operand
+	op          string
+}
+
+// parseCondition parses an assertion expression of the form
+// <operand> <operator> <operand>, where the operands are rows, value("column")
+// or a number.
+func parseCondition(expr string) (*condition, error) {
+	idx, op := -1, ""
+	quote := rune(0)
+	for i, r := range expr {
+		if quote != 0 {
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if r == '"' || r == '\'' {
+			quote = r
+			continue
+		}
+		for _, c := range comparisons {
+			if strings.HasPrefix(expr[i:], c) {
+				idx, op = i, c
+				break
+			}
+		}
+		if idx >= 0 {
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("expected a comparison with one of %s", strings.Join(comparisons, " "))
+	}
+	left, err := parseOperand(expr[:idx])
+	if err != nil {
+		return nil, err
+	}
+	right, err := parseOperand(expr[idx+len(op):])
+	if err != nil {
+		return nil, err
+	}
+	return &condition{left: left, right: right, op: op}, nil
+}
+
+func parseOperand(s string) (operand, error) {
+	s = strings.TrimSpace(s)
+	if s == "rows" {
+		return operand{kind: operandRows}, nil
+	}
+	if strings.HasPrefix(s, "value(") && strings.HasSuffix(s, ")") {
+		column := strings.TrimSpace(s[len("value(") : len(s)-1])
+		if len(column) >= 2 && (column[0] == '"' || column[0] == '\'') && column[len(column)-1] == column[0] {
+			column = column[1 : len(column)-1]
+		}
+		if column == "" {
+			return operand{}, fmt.Errorf("value requires a column")
+		}
+		return operand{kind: operandValue, column: column}, nil
+	}
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return operand{}, fmt.Errorf("invalid operand %q, must be rows, value(\"column\") or a number", s)
+	}
+	return operand{kind: operandNumber, number: number}, nil
+}
+
+// perRow reports whether the condition uses column values, which are
+// checked on every row.
+func (c *condition) perRow() bool {
+	return c.left.kind == operandValue || c.right.kind == operandValue
+}
+
+// holds evaluates the condition on a row of a result with the number of rows.
+func (c *condition) holds(q *Query, rows int, res map[string]interface{}) (bool, error) {
+	left, err := c.left.value(q, rows, res)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.right.value(q, rows, res)
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "<":
+		return left < right, nil
+	case "<=":
+		return left <= right, nil
+	case ">":
+		return left > right, nil
+	case ">=":
+		return left >= right, nil
+	case "==":
+		return left == right, nil
+	default:
+		return left != right, nil
+	}
+}
+
+func (o operand) value(q *Query, rows int, res map[string]interface{}) (float64, error) {
+	switch o.kind {
+	case operandRows:
+		return float64(rows), nil
+	case operandValue:
+		if _, found := res[o.column]; !found {
+			return 0, fmt.Errorf("column %q not found", o.column)
+		}
+		return q.parseValue(res, o.column)
+	default:
+		return o.number, nil
+	}
+}
+
+// name returns the name of the assertion in metrics and logs.
+func (a *Assertion) name() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Expr
+}
+
+// checkAssertions evaluates the assertions of the query on the result rows of
+// a run. Assertions on column values have to hold for every row, failed ones
+// are logged and exported as sql_exporter_assertion_failed.
+func (q *Query) checkAssertions(conn *connection, count int, rows []map[string]interface{}) {
+	for _, a := range q.Expect {
+		if a == nil || a.cond == nil {
+			continue
+		}
+		var err error
+		ok := true
+		if a.cond.perRow() {
+			for _, res := range rows {
+				if ok, err = a.cond.holds(q, count, res); err == errNullSkipped {
+					ok, err = true, nil
+				} else if !ok || err != nil {
+					break
+				}
+			}
+		} else {
+			ok, err = a.cond.holds(q, count, nil)
+		}
+		failed := 0.0
+		if !ok || err != nil {
+			failed = 1.0
+			assertionFailures.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name, a.name()).Inc()
+			level.Warn(q.log).Log("msg", "Assertion failed", "assertion", a.name(), "rows", count, "err", err, "host", conn.host, "db", conn.database)
+		}
+		failedAssertions.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name, a.name()).Set(failed)
+	}
+}
+
+// perRowAssertions reports whether any assertion of the query checks column
+// values, requiring the result rows to be kept.
+func (q *Query) perRowAssertions() bool {
+	for _, a := range q.Expect {
+		if a != nil && a.cond != nil && a.cond.perRow() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func Test_parseCondition(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected *condition
+		err      string
+	}{
+		{
+			expr:     "rows > 0",
+			expected: &condition{left: operand{kind: operandRows}, op: ">", right: operand{kind: operandNumber}},
+		},
+		{
+			expr: `value("count") <= 100`,
+			expected: &condition{
+				left:  operand{kind: operandValue, column: "count"},
+				op:    "<=",
+				right: operand{kind: operandNumber, number: 100},
+			},
+		},
+		{
+			expr: "value('a<b')!=value('c')",
+			expected: &condition{
+				left:  operand{kind: operandValue, column: "a<b"},
+				op:    "!=",
+				right: operand{kind: operandValue, column: "c"},
+			},
+		},
+		{expr: "rows", err: "expected a comparison with one of <= >= == != < >"},
+		{expr: "count > 0", err: `invalid operand "count", must be rows, value("column") or a number`},
+		{expr: "value() > 0", err: "value requires a column"},
+	} {
+		cond, err := parseCondition(tc.expr)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.expr, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if diff := pretty.Compare(tc.expected, cond); diff != "" {
+			t.Errorf("%s: unexpected condition (-want +got):\n\n%s", tc.expr, diff)
+		}
+	}
+}
+
+func TestAssertions_UnmarshalYAML(t *testing.T) {
+	var q Query
+	if err := yaml.Unmarshal([]byte(`expect: rows > 0`), &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Expect) != 1 || q.Expect[0].Expr != "rows > 0" {
+		t.Errorf("unexpected assertions %v", q.Expect)
+	}
+	q = Query{}
+	buf := `
+expect:
+- rows > 0
+- name: small
+  expr: value("count") < 100
+`
+	if err := yaml.Unmarshal([]byte(buf), &q); err != nil {
+		t.Fatal(err)
+	}
+	expected := Assertions{{Expr: "rows > 0"}, {Name: "small", Expr: `value("count") < 100`}}
+	if diff := pretty.Compare(expected, q.Expect); diff != "" {
+		t.Errorf("unexpected assertions (-want +got):\n\n%s", diff)
+	}
+}
+
+func Test_queryAssertions(t *testing.T) {
+	runSQLiteQuery(t, &Query{
+		Name:   "checked",
+		Help:   "Checked",
+		Labels: Labels{{Name: "name", Column: "name"}},
+		Values: Values{{Column: "count"}},
+		Query:  "SELECT 'a' AS name, 10 AS count UNION ALL SELECT 'b', 200",
+		Expect: Assertions{
+			{Expr: "rows >= 2"},
+			{Name: "small", Expr: `value("count") < 100`},
+			{Name: "missing", Expr: `value("other") > 0`},
+		},
+	})
+	expected := `
+# HELP sql_exporter_assertion_failed Whether the assertion failed on the last run of the query
+# TYPE sql_exporter_assertion_failed gauge
+sql_exporter_assertion_failed{assertion="missing",database=":memory:",driver="sqlite",host=":memory:",query="checked",sql_job="test",user=""} 1
+sql_exporter_assertion_failed{assertion="rows >= 2",database=":memory:",driver="sqlite",host=":memory:",query="checked",sql_job="test",user=""} 0
+sql_exporter_assertion_failed{assertion="small",database=":memory:",driver="sqlite",host=":memory:",query="checked",sql_job="test",user=""} 1
+`
+	if err := testutil.CollectAndCompare(failedAssertions, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	authTypeCommand = "command"
+	authTypeVault   = "vault"
+	authTypeAWSIAM  = "aws_iam"
+
+	defaultTokenTTL      = 15 * time.Minute
+	defaultRefreshBefore = 5 * time.Minute
+)
+
+// tokens is shared by all jobs so connections to the same instance reuse
+// the same token instead of issuing a new one on every (re)connect.
+var tokens = newTokenCache()
+
+// tokenProvider issues short lived credentials of a connection, e.g. IAM
+// database authentication tokens used as password or database credentials
+// issued by Vault.
+type tokenProvider interface {
+	// key identifies the token for the given connection. Connections with
+	// the same key share a token.
+	key(conn *connection) string
+	// token issues new credentials and returns their expiry.
+	token(conn *connection) (credentials, time.Time, error)
+}
+
+// leaseRenewer is implemented by providers whose credentials can be renewed
+// instead of issuing new ones.
+type leaseRenewer interface {
+	// renew extends the lease of the credentials and returns the new expiry.
+	renew(creds credentials) (time.Time, error)
+}
+
+// credentials are issued by a token provider.
+type credentials struct {
+	user      string // replaces the user of the connection, if set
+	password  string
+	cleartext bool   // tokens must be sent in clear text to MySQL
+	lease     string // id of a renewable lease
+}
+
+func (a *Auth) validate() error {
+	if a.TokenTTL < 0 || a.RefreshBefore < 0 {
+		return fmt.Errorf("token_ttl and refresh_before must not be negative")
+	}
+	// otherwise every connect would issue a new token
+	if ttl, refreshBefore := a.tokenTTL(), a.refreshBefore(); refreshBefore >= ttl {
+		return fmt.Errorf("refresh_before (%s) must be shorter than the token lifetime (%s)", refreshBefore, ttl)
+	}
+	return nil
+}
+
+// tokenTTL returns the lifetime of the issued tokens. The lifetime of
+// dynamic Vault credentials is only known once they're issued.
+func (a *Auth) tokenTTL() time.Duration {
+	if a.Type == authTypeAWSIAM {
+		return rdsTokenTTL
+	}
+	if a.TokenTTL <= 0 {
+		return defaultTokenTTL
+	}
+	return a.TokenTTL
+}
+
+// refreshBefore returns how long before their expiry tokens are refreshed.
+func (a *Auth) refreshBefore() time.Duration {
+	if a.RefreshBefore <= 0 {
+		return defaultRefreshBefore
+	}
+	return a.RefreshBefore
+}
+
+// newTokenProvider returns the provider for the given auth configuration.
+func newTokenProvider(auth *Auth) (tokenProvider, error) {
+	switch auth.Type {
+	case authTypeCommand, "":
+		if len(auth.TokenCommand) == 0 {
+			return nil, fmt.Errorf("auth type %q requires a token_command", authTypeCommand)
+		}
+		return &commandTokenProvider{command: auth.TokenCommand, ttl: auth.TokenTTL}, nil
+	case authTypeVault:
+		if auth.Vault == nil || auth.Vault.Path == "" {
+			return nil, fmt.Errorf("auth type %q requires a vault path", authTypeVault)
+		}
+		return newVaultProvider(auth.Vault, auth.TokenTTL)
+	case authTypeAWSIAM:
+		return newAWSIAMTokenProvider(auth.AWS)
+	default:
+		return nil, fmt.Errorf("unknown auth type %q", auth.Type)
+	}
+}
+
+// commandTokenProvider runs an external command, e.g.
+// `gcloud sql generate-login-token`, and uses its output as token. The
+// connection details are passed to the command as environment variables.
+type commandTokenProvider struct {
+	command []string
+	ttl     time.Duration
+}
+
+func (p *commandTokenProvider) key(conn *connection) string {
+	return strings.Join(append([]string{authTypeCommand, conn.driver, conn.address, conn.user}, p.command...), "\xff")
+}
+
+func (p *commandTokenProvider) token(conn *connection) (credentials, time.Time, error) {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SQL_EXPORTER_DRIVER="+conn.driver,
+		"SQL_EXPORTER_HOST="+conn.address,
+		"SQL_EXPORTER_DATABASE="+conn.database,
+		"SQL_EXPORTER_USER="+conn.user,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return credentials{}, time.Time{}, fmt.Errorf("token command failed: %v", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return credentials{}, time.Time{}, fmt.Errorf("token command returned an empty token")
+	}
+	ttl := p.ttl
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	return credentials{password: token, cleartext: true}, time.Now().Add(ttl), nil
+}
+
+// tokenCache caches tokens until shortly before they expire. Tokens which
+// were used since they have been issued are refreshed proactively in the
+// background so reconnects don't have to wait for the token issuance.
+type tokenCache struct {
+	mtx    sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+type cachedToken struct {
+	sync.Mutex
+	value  credentials
+	expiry time.Time
+	used   bool
+	timer  *time.Timer
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*cachedToken)}
+}
+
+// get returns a valid token for the connection, issuing a new one if
+// necessary.
+func (c *tokenCache) get(p tokenProvider, conn *connection, refreshBefore time.Duration) (credentials, time.Time, error) {
+	key := p.key(conn)
+	c.mtx.Lock()
+	t, found := c.tokens[key]
+	if !found {
+		t = &cachedToken{}
+		c.tokens[key] = t
+	}
+	c.mtx.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+	t.used = true
+	if t.value.password != "" && time.Now().Before(t.expiry.Add(-refreshBefore)) {
+		return t.value, t.expiry, nil
+	}
+	if err := t.refresh(p, conn, refreshBefore); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+	return t.value, t.expiry, nil
+}
+
+// refresh renews the lease of the token or issues a new one and schedules
+// the next proactive refresh. Must be called with the lock held.
+func (t *cachedToken) refresh(p tokenProvider, conn *connection, refreshBefore time.Duration) error {
+	if r, ok := p.(leaseRenewer); ok && t.value.lease != "" && time.Now().Before(t.expiry) {
+		// leases can't be renewed beyond their max TTL, new credentials are
+		// issued once the renewed lease is too short
+		expiry, err := r.renew(t.value)
+		if err == nil && time.Now().Before(expiry.Add(-refreshBefore)) {
+			t.expiry, t.used = expiry, false
+			t.schedule(p, conn, refreshBefore)
+			return nil
+		}
+	}
+	value, expiry, err := p.token(conn)
+	if err != nil {
+		return err
+	}
+	t.value, t.expiry, t.used = value, expiry, false
+	t.schedule(p, conn, refreshBefore)
+	return nil
+}
+
+// schedule schedules the next proactive refresh of the token. Must be called
+// with the lock held.
+func (t *cachedToken) schedule(p tokenProvider, conn *connection, refreshBefore time.Duration) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(time.Until(t.expiry.Add(-refreshBefore)), func() {
+		t.Lock()
+		defer t.Unlock()
+		// tokens nobody asked for since the last refresh are left to expire
+		if !t.used {
+			return
+		}
+		// on errors the token is issued again on the next get
+		t.refresh(p, conn, refreshBefore)
+	})
+}
+
+// withPassword returns the DSN with the password replaced. Tokens are usually
+// sent in clear text, which MySQL only allows if cleartext is set.
+func withPassword(driver, dsn, password string, cleartext bool) (string, error) {
+	return withCredentials(driver, dsn, "", password, cleartext)
+}
+
+// withCredentials returns the DSN with the password and, unless empty, the
+// user replaced.
+func withCredentials(driver, dsn, user, password string, cleartext bool) (string, error) {
+	if driver == "mysql" {
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil {
+			return "", err
+		}
+		if user != "" {
+			cfg.User = user
+		}
+		cfg.Passwd = password
+		if cleartext {
+			cfg.AllowCleartextPasswords = true
+		}
+		return "mysql://" + cfg.FormatDSN(), nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if user == "" && u.User != nil {
+		user = u.User.Username()
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String(), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTokenProvider issues numbered tokens expiring after the ttl and renews
+// leases if renewable is set.
+type fakeTokenProvider struct {
+	sync.Mutex
+	ttl       time.Duration
+	renewable bool
+	issued    int
+	renewed   int
+}
+
+func (p *fakeTokenProvider) key(conn *connection) string {
+	return conn.address
+}
+
+func (p *fakeTokenProvider) token(conn *connection) (credentials, time.Time, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.issued++
+	creds := credentials{password: fmt.Sprintf("token-%d", p.issued)}
+	if p.renewable {
+		creds.lease = creds.password
+	}
+	return creds, time.Now().Add(p.ttl), nil
+}
+
+func (p *fakeTokenProvider) renew(creds credentials) (time.Time, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.renewed++
+	return time.Now().Add(p.ttl), nil
+}
+
+func (p *fakeTokenProvider) counts() (int, int) {
+	p.Lock()
+	defer p.Unlock()
+	return p.issued, p.renewed
+}
+
+func Test_tokenCache(t *testing.T) {
+	conn := &connection{address: "db"}
+
+	// valid tokens are reused
+	p := &fakeTokenProvider{ttl: time.Hour}
+	cache := newTokenCache()
+	for i := 0; i < 3; i++ {
+		creds, _, err := cache.get(p, conn, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.password != "token-1" {
+			t.Errorf("expected the cached token, got %q", creds.password)
+		}
+	}
+	if issued, _ := p.counts(); issued != 1 {
+		t.Errorf("expected a single token to be issued, got %d", issued)
+	}
+
+	// tokens expiring within refresh_before are issued again
+	p = &fakeTokenProvider{ttl: time.Minute}
+	cache = newTokenCache()
+	for i := 1; i <= 2; i++ {
+		if creds, _, err := cache.get(p, conn, 2*time.Minute); err != nil || creds.password != fmt.Sprintf("token-%d", i) {
+			t.Errorf("expected token %d, got %q, %v", i, creds.password, err)
+		}
+	}
+
+	// used tokens are refreshed in the background, unused ones expire
+	p = &fakeTokenProvider{ttl: 200 * time.Millisecond}
+	cache = newTokenCache()
+	for i := 0; i < 2; i++ {
+		if _, _, err := cache.get(p, conn, 150*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if issued, _ := p.counts(); issued != 2 {
+		t.Errorf("expected the used token to be refreshed once, got %d tokens", issued)
+	}
+
+	// renewable leases are renewed instead
+	p = &fakeTokenProvider{ttl: time.Hour, renewable: true}
+	cache = newTokenCache()
+	if _, _, err := cache.get(p, conn, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	token := cache.tokens[p.key(conn)]
+	token.Lock()
+	token.expiry = time.Now().Add(30 * time.Second)
+	token.Unlock()
+	creds, expiry, err := cache.get(p, conn, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued, renewed := p.counts(); issued != 1 || renewed != 1 || creds.password != "token-1" {
+		t.Errorf("expected the lease to be renewed, got %d issued and %d renewed", issued, renewed)
+	}
+	if time.Until(expiry) < 50*time.Minute {
+		t.Errorf("expected the expiry of the renewed lease, got %s", expiry)
+	}
+}
+
+func TestAuth_validate(t *testing.T) {
+	for _, tc := range []struct {
+		auth  Auth
+		valid bool
+	}{
+		{auth: Auth{}, valid: true},
+		{auth: Auth{TokenTTL: time.Hour, RefreshBefore: 10 * time.Minute}, valid: true},
+		{auth: Auth{Type: authTypeAWSIAM, RefreshBefore: 10 * time.Minute}, valid: true},
+		{auth: Auth{TokenTTL: 10 * time.Minute, RefreshBefore: 10 * time.Minute}},
+		{auth: Auth{TokenTTL: 2 * time.Minute}},
+		{auth: Auth{Type: authTypeAWSIAM, RefreshBefore: 15 * time.Minute}},
+		{auth: Auth{RefreshBefore: -time.Minute}},
+	} {
+		if err := tc.auth.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: unexpected error %v", tc.auth, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+)
+
+// rdsTokenTTL is the lifetime of RDS IAM authentication tokens
+const rdsTokenTTL = 15 * time.Minute
+
+// rdsDefaultPorts are used for hosts without port, the port is part of the
+// signed token
+var rdsDefaultPorts = map[string]string{
+	"mysql":    "3306",
+	"postgres": "5432",
+}
+
+// awsIAMTokenProvider issues IAM authentication tokens of RDS and Aurora
+// databases, signed with the AWS credentials of the exporter.
+type awsIAMTokenProvider struct {
+	region        string
+	sessionRegion string // region of the environment or shared config
+	roleARN       string
+	creds         *awscredentials.Credentials
+}
+
+func newAWSIAMTokenProvider(cfg *AWSAuth) (*awsIAMTokenProvider, error) {
+	if cfg == nil {
+		cfg = &AWSAuth{}
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	p := &awsIAMTokenProvider{
+		region:        cfg.Region,
+		sessionRegion: aws.StringValue(sess.Config.Region),
+		roleARN:       cfg.RoleARN,
+		creds:         sess.Config.Credentials,
+	}
+	if cfg.RoleARN != "" {
+		p.creds = stscreds.NewCredentials(sess, cfg.RoleARN, func(arp *stscreds.AssumeRoleProvider) {
+			if cfg.ExternalID != "" {
+				arp.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+	}
+	return p, nil
+}
+
+func (p *awsIAMTokenProvider) key(conn *connection) string {
+	return strings.Join([]string{authTypeAWSIAM, p.region, p.roleARN, conn.driver, conn.address, conn.user}, "\xff")
+}
+
+func (p *awsIAMTokenProvider) token(conn *connection) (credentials, time.Time, error) {
+	port, found := rdsDefaultPorts[conn.driver]
+	if !found {
+		return credentials{}, time.Time{}, fmt.Errorf("IAM authentication isn't supported for %s", conn.driver)
+	}
+	endpoint := conn.address
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, port)
+	}
+	// the region of the host name takes precedence over the default region
+	// of the environment, so databases in other regions can be reached
+	region := p.region
+	if region == "" {
+		region = rdsRegion(endpoint)
+	}
+	if region == "" {
+		region = p.sessionRegion
+	}
+	if region == "" {
+		return credentials{}, time.Time{}, fmt.Errorf("no AWS region configured for %s", conn.address)
+	}
+	issued := time.Now()
+	token, err := rdsutils.BuildAuthToken(endpoint, region, conn.user, p.creds)
+	if err != nil {
+		return credentials{}, time.Time{}, fmt.Errorf("failed to build RDS auth token: %v", err)
+	}
+	// MySQL requires the token to be sent in clear text
+	return credentials{password: token, cleartext: true}, issued.Add(rdsTokenTTL), nil
+}
+
+// rdsRegion returns the region of an RDS endpoint, e.g. eu-west-1 for
+// db.abc123.eu-west-1.rds.amazonaws.com:5432, or an empty string for other
+// hosts.
+func rdsRegion(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i > 0; i-- {
+		if labels[i] == "rds" {
+			return labels[i-1]
+		}
+	}
+	return ""
+}
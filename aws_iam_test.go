@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func Test_rdsRegion(t *testing.T) {
+	for endpoint, region := range map[string]string{
+		"db.abc123.eu-west-1.rds.amazonaws.com:5432":         "eu-west-1",
+		"cluster.cluster-abc123.us-east-2.rds.amazonaws.com": "us-east-2",
+		"db.abc123.cn-north-1.rds.amazonaws.com.cn:3306":     "cn-north-1",
+		"localhost:5432": "",
+		"proxy.proxy-abc123.ap-southeast-1.rds.amazonaws.com:5432": "ap-southeast-1",
+	} {
+		if got := rdsRegion(endpoint); got != region {
+			t.Errorf("rdsRegion(%q) = %q, want %q", endpoint, got, region)
+		}
+	}
+}
+
+func Test_awsIAMTokenProvider(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_REGION":            "us-east-1",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	auth := &Auth{}
+	if err := yaml.Unmarshal([]byte("aws_iam"), auth); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newTokenProvider(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &connection{driver: "postgres", address: "db.abc123.eu-west-1.rds.amazonaws.com", user: "monitor"}
+	creds, _, err := p.token(conn)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	prefix := "db.abc123.eu-west-1.rds.amazonaws.com:5432?Action=connect&DBUser=monitor"
+	if !strings.HasPrefix(creds.password, prefix) || !strings.Contains(creds.password, "%2Feu-west-1%2Frds-db%2Faws4_request") {
+		t.Errorf("unexpected token %q", creds.password)
+	}
+	if !creds.cleartext {
+		t.Errorf("expected the token to be sent in clear text")
+	}
+
+	conn.driver = "sqlserver"
+	if _, _, err := p.token(conn); err == nil {
+		t.Errorf("expected error for unsupported driver")
+	}
+}
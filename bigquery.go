@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// The BigQuery client isn't a database/sql driver, so the exporter ships a
+// minimal read only driver on top of it. Connections are given as
+// bigquery://project/dataset?credentials_file=/path/key.json&location=EU
+func init() {
+	sql.Register("bigquery", &bigqueryDriver{})
+}
+
+type maximumBytesBilledKey struct{}
+
+// withMaximumBytesBilled limits the bytes billed for BigQuery queries
+// executed with the returned context.
+func withMaximumBytesBilled(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, maximumBytesBilledKey{}, limit)
+}
+
+type bigqueryDriver struct{}
+
+// bigqueryConfig is the parsed connection URL.
+type bigqueryConfig struct {
+	project            string
+	dataset            string
+	location           string
+	credentialsFile    string
+	maximumBytesBilled int64
+}
+
+func parseBigQueryDSN(dsn string) (*bigqueryConfig, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "bigquery" || u.Host == "" {
+		return nil, fmt.Errorf("bigquery connections must be of the form bigquery://project/dataset")
+	}
+	cfg := &bigqueryConfig{
+		project:         u.Host,
+		dataset:         strings.Trim(u.Path, "/"),
+		location:        u.Query().Get("location"),
+		credentialsFile: u.Query().Get("credentials_file"),
+	}
+	if limit := u.Query().Get("maximum_bytes_billed"); limit != "" {
+		if cfg.maximumBytesBilled, err = strconv.ParseInt(limit, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid maximum_bytes_billed %q: %v", limit, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (d *bigqueryDriver) Open(dsn string) (driver.Conn, error) {
+	cfg, err := parseBigQueryDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	var opts []option.ClientOption
+	// without a credentials file the application default credentials are
+	// used, e.g. GOOGLE_APPLICATION_CREDENTIALS or the metadata server
+	if cfg.credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.credentialsFile))
+	}
+	client, err := bigquery.NewClient(context.Background(), cfg.project, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &bigqueryConn{client: client, cfg: cfg}, nil
+}
+
+type bigqueryConn struct {
+	client *bigquery.Client
+	cfg    *bigqueryConfig
+}
+
+func (c *bigqueryConn) Prepare(query string) (driver.Stmt, error) {
+	return &bigqueryStmt{conn: c, query: query}, nil
+}
+
+func (c *bigqueryConn) Close() error {
+	return c.client.Close()
+}
+
+func (c *bigqueryConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("bigquery: transactions are not supported")
+}
+
+// query prepares the query with the settings of the connection. Args are
+// bound to the positional ? parameters.
+func (c *bigqueryConn) query(ctx context.Context, query string, args []driver.NamedValue) *bigquery.Query {
+	q := c.client.Query(query)
+	q.DefaultProjectID = c.cfg.project
+	q.DefaultDatasetID = c.cfg.dataset
+	q.Location = c.cfg.location
+	q.MaxBytesBilled = c.cfg.maximumBytesBilled
+	if limit, ok := ctx.Value(maximumBytesBilledKey{}).(int64); ok && limit > 0 {
+		q.MaxBytesBilled = limit
+	}
+	for _, arg := range args {
+		q.Parameters = append(q.Parameters, bigquery.QueryParameter{Name: arg.Name, Value: arg.Value})
+	}
+	return q
+}
+
+func (c *bigqueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	it, err := c.query(ctx, query, args).Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := &bigqueryRows{it: it}
+	// the schema is only known after fetching the first page
+	if rows.err = it.Next(&rows.next); rows.err != nil && rows.err != iterator.Done {
+		return nil, rows.err
+	}
+	for _, field := range it.Schema {
+		rows.columns = append(rows.columns, field.Name)
+	}
+	return rows, nil
+}
+
+func (c *bigqueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	job, err := c.query(ctx, query, args).Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type bigqueryStmt struct {
+	conn  *bigqueryConn
+	query string
+}
+
+func (s *bigqueryStmt) Close() error  { return nil }
+func (s *bigqueryStmt) NumInput() int { return -1 }
+
+func (s *bigqueryStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *bigqueryStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, 0, len(args))
+	for i, arg := range args {
+		named = append(named, driver.NamedValue{Ordinal: i + 1, Value: arg})
+	}
+	return named
+}
+
+// valueIterator is implemented by *bigquery.RowIterator.
+type valueIterator interface {
+	Next(dst interface{}) error
+}
+
+type bigqueryRows struct {
+	it      valueIterator
+	columns []string
+	next    []bigquery.Value
+	err     error
+}
+
+func (r *bigqueryRows) Columns() []string {
+	return r.columns
+}
+
+func (r *bigqueryRows) Close() error {
+	return nil
+}
+
+func (r *bigqueryRows) Next(dest []driver.Value) error {
+	if r.err == iterator.Done {
+		return io.EOF
+	}
+	if r.err != nil {
+		return r.err
+	}
+	for i := range dest {
+		if i < len(r.next) {
+			dest[i] = bigqueryValue(r.next[i])
+		}
+	}
+	r.next = nil
+	r.err = r.it.Next(&r.next)
+	return nil
+}
+
+// bigqueryValue converts the BigQuery types which aren't valid driver values.
+func bigqueryValue(v bigquery.Value) driver.Value {
+	switch val := v.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time:
+		return val
+	case *big.Rat:
+		// NUMERIC and BIGNUMERIC values
+		f, _ := val.Float64()
+		return f
+	case fmt.Stringer:
+		// civil dates and times
+		return val.String()
+	default:
+		return fmt.Sprint(val)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/kylelemons/godebug/pretty"
+	"google.golang.org/api/iterator"
+)
+
+func Test_parseBigQueryDSN(t *testing.T) {
+	cfg, err := parseBigQueryDSN("bigquery://project/dataset?location=EU&maximum_bytes_billed=1000")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if cfg.project != "project" || cfg.dataset != "dataset" || cfg.location != "EU" || cfg.maximumBytesBilled != 1000 {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if _, err := parseBigQueryDSN("bigquery:///dataset"); err == nil {
+		t.Errorf("expected error for missing project")
+	}
+}
+
+// fakeValueIterator returns the rows, then the error or iterator.Done.
+type fakeValueIterator struct {
+	rows [][]bigquery.Value
+	err  error
+}
+
+func (it *fakeValueIterator) Next(dst interface{}) error {
+	if len(it.rows) == 0 {
+		if it.err != nil {
+			return it.err
+		}
+		return iterator.Done
+	}
+	*dst.(*[]bigquery.Value) = it.rows[0]
+	it.rows = it.rows[1:]
+	return nil
+}
+
+func Test_bigqueryRows(t *testing.T) {
+	it := &fakeValueIterator{rows: [][]bigquery.Value{
+		{"a", int64(1)},
+		{"b", nil},
+	}}
+	rows := &bigqueryRows{it: it, columns: []string{"name", "value"}}
+	rows.err = it.Next(&rows.next)
+
+	var got [][]driver.Value
+	for {
+		dest := make([]driver.Value, len(rows.Columns()))
+		if err := rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, dest)
+	}
+	if diff := pretty.Compare([][]driver.Value{{"a", int64(1)}, {"b", nil}}, got); diff != "" {
+		t.Errorf("unexpected rows (-want +got):\n\n%s", diff)
+	}
+
+	// errors fetching the next page fail the rows
+	failure := errors.New("page failed")
+	it = &fakeValueIterator{rows: [][]bigquery.Value{{"a", int64(1)}}, err: failure}
+	rows = &bigqueryRows{it: it, columns: []string{"name", "value"}}
+	rows.err = it.Next(&rows.next)
+	dest := make([]driver.Value, 2)
+	if err := rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Next(dest); err != failure {
+		t.Errorf("expected the error of the iterator, got %v", err)
+	}
+}
+
+func Test_bigqueryValue(t *testing.T) {
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, tc := range []struct {
+		in       bigquery.Value
+		expected driver.Value
+	}{
+		{in: nil, expected: nil},
+		{in: int64(42), expected: int64(42)},
+		{in: 2.5, expected: 2.5},
+		{in: true, expected: true},
+		{in: "text", expected: "text"},
+		{in: []byte("bytes"), expected: []byte("bytes")},
+		{in: ts, expected: ts},
+		{in: big.NewRat(5, 4), expected: 1.25},
+		{in: civil.Date{Year: 2021, Month: 3, Day: 4}, expected: "2021-03-04"},
+		{in: civil.Time{Hour: 5, Minute: 6, Second: 7}, expected: "05:06:07"},
+		{in: civil.DateTime{Date: civil.Date{Year: 2021, Month: 3, Day: 4}, Time: civil.Time{Hour: 5}}, expected: "2021-03-04T05:00:00"},
+		{in: []bigquery.Value{int64(1), int64(2)}, expected: "[1 2]"},
+	} {
+		got := bigqueryValue(tc.in)
+		if diff := pretty.Compare(tc.expected, got); diff != "" {
+			t.Errorf("%#v: unexpected value (-want +got):\n\n%s", tc.in, diff)
+		}
+		if _, err := driver.DefaultParameterConverter.ConvertValue(got); err != nil {
+			t.Errorf("%#v: converted to an invalid driver value: %v", tc.in, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// validate checks the generator settings, prometheus.LinearBuckets and
+// ExponentialBuckets panic on invalid ones.
+func (b *BucketsFrom) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.ColumnPrefix == "" {
+		return fmt.Errorf("buckets_from requires a column_prefix")
+	}
+	if b.Linear != nil && b.Exponential != nil {
+		return fmt.Errorf("buckets_from must have only one of linear or exponential")
+	}
+	if g := b.Linear; g != nil && (g.Count < 1 || g.Width <= 0) {
+		return fmt.Errorf("linear buckets require a positive count and width")
+	}
+	if g := b.Exponential; g != nil && (g.Count < 1 || g.Start <= 0 || g.Factor <= 1) {
+		return fmt.Errorf("exponential buckets require a positive count and start and a factor above 1")
+	}
+	return nil
+}
+
+// bounds returns the generated bucket bounds, nil without generator.
+func (b *BucketsFrom) bounds() []float64 {
+	switch {
+	case b.Linear != nil:
+		return prometheus.LinearBuckets(b.Linear.Start, b.Linear.Width, b.Linear.Count)
+	case b.Exponential != nil:
+		return prometheus.ExponentialBuckets(b.Exponential.Start, b.Exponential.Factor, b.Exponential.Count)
+	}
+	return nil
+}
+
+// bucketColumn returns the name of the column of the bucket bound, e.g.
+// le_0_5 for 0.5.
+func bucketColumn(prefix string, bound float64) string {
+	return prefix + strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", 1)
+}
+
+// buckets returns the given buckets along with the ones derived from the
+// column names of the row.
+func (hv *HistValue) buckets(res map[string]interface{}) []*Bucket {
+	if hv.BucketsFrom == nil {
+		return hv.Buckets
+	}
+	buckets := append([]*Bucket{}, hv.Buckets...)
+	prefix := hv.BucketsFrom.ColumnPrefix
+	if bounds := hv.BucketsFrom.bounds(); bounds != nil {
+		for _, bound := range bounds {
+			buckets = append(buckets, &Bucket{
+				Name:  bucketColumn(prefix, bound),
+				Value: strconv.FormatFloat(bound, 'g', -1, 64),
+			})
+		}
+		return buckets
+	}
+	columns := make([]string, 0, len(res))
+	for column := range res {
+		if strings.HasPrefix(column, prefix) && column != hv.Count && column != hv.Sum {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		// unparsable bounds fail the histogram like invalid configured ones
+		buckets = append(buckets, &Bucket{
+			Name:  column,
+			Value: strings.Replace(strings.TrimPrefix(column, prefix), "_", ".", 1),
+		})
+	}
+	return buckets
+}
+
+// accumulateBuckets turns the counts of each bucket into cumulative counts
+// of all observations up to the bound of the bucket.
+func accumulateBuckets(buckets map[float64]uint64) {
+	bounds := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	var total uint64
+	for _, bound := range bounds {
+		total += buckets[bound]
+		buckets[bound] = total
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_bucketsFrom(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		bucketsFrom *BucketsFrom
+		query       string
+	}{
+		{
+			name:        "prefix",
+			bucketsFrom: &BucketsFrom{ColumnPrefix: "le_"},
+			query:       "SELECT 1 AS le_0_5, 3 AS le_1, 4 AS le_2, 5 AS le_inf, 5 AS count, 6.5 AS sum",
+		},
+		{
+			name:        "linear",
+			bucketsFrom: &BucketsFrom{ColumnPrefix: "le_", Linear: &BucketGenerator{Start: 0.5, Width: 0.5, Count: 2}},
+			query:       "SELECT 1 AS le_0_5, 3 AS le_1, 99 AS le_7, 5 AS count, 6.5 AS sum",
+		},
+		{
+			name:        "exponential",
+			bucketsFrom: &BucketsFrom{ColumnPrefix: "le_", Exponential: &BucketGenerator{Start: 0.5, Factor: 2, Count: 2}},
+			query:       "SELECT 1 AS le_0_5, 3 AS le_1, 5 AS count, 6.5 AS sum",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := runSQLiteQuery(t, &Query{
+				Name:       "latency_seconds",
+				Help:       "Latency",
+				Type:       metricTypeHist,
+				HistValues: []*HistValue{{Count: "count", Sum: "sum", BucketsFrom: tc.bucketsFrom}},
+				Query:      tc.query,
+			})
+			expected := `
+# HELP sql_latency_seconds Latency
+# TYPE sql_latency_seconds histogram
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="0.5"} 1
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="1"} 3
+`
+			if tc.name == "prefix" {
+				expected += `sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="2"} 4
+`
+			}
+			expected += `sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="+Inf"} 5
+sql_latency_seconds_sum{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 6.5
+sql_latency_seconds_count{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 5
+`
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_latency_seconds"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestBucketsFrom_validate(t *testing.T) {
+	for _, tc := range []struct {
+		bucketsFrom *BucketsFrom
+		err         string
+	}{
+		{bucketsFrom: nil},
+		{bucketsFrom: &BucketsFrom{ColumnPrefix: "le_"}},
+		{bucketsFrom: &BucketsFrom{}, err: "buckets_from requires a column_prefix"},
+		{
+			bucketsFrom: &BucketsFrom{ColumnPrefix: "le_", Linear: &BucketGenerator{Width: 1, Count: 1}, Exponential: &BucketGenerator{Start: 1, Factor: 2, Count: 1}},
+			err:         "buckets_from must have only one of linear or exponential",
+		},
+		{bucketsFrom: &BucketsFrom{ColumnPrefix: "le_", Linear: &BucketGenerator{Count: 3}}, err: "linear buckets require a positive count and width"},
+		{bucketsFrom: &BucketsFrom{ColumnPrefix: "le_", Exponential: &BucketGenerator{Start: 1, Factor: 1, Count: 3}}, err: "exponential buckets require a positive count and start and a factor above 1"},
+	} {
+		err := tc.bucketsFrom.validate()
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func Test_bucketsCumulative(t *testing.T) {
+	cumulative := false
+	registry := runSQLiteQuery(t, &Query{
+		Name: "latency_seconds",
+		Help: "Latency",
+		Type: metricTypeHist,
+		HistValues: []*HistValue{{
+			Count:             "count",
+			Sum:               "sum",
+			Buckets:           []*Bucket{{Name: "le_2", Value: "2"}, {Name: "le_1", Value: "1"}, {Name: "le_0_5", Value: "0.5"}},
+			BucketsCumulative: &cumulative,
+		}},
+		Query: "SELECT 1 AS le_0_5, 2 AS le_1, 1 AS le_2, 5 AS count, 6.5 AS sum",
+	})
+	expected := `
+# HELP sql_latency_seconds Latency
+# TYPE sql_latency_seconds histogram
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="0.5"} 1
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="1"} 3
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="2"} 4
+sql_latency_seconds_bucket{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user="",le="+Inf"} 5
+sql_latency_seconds_sum{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 6.5
+sql_latency_seconds_count{col="",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_latency_seconds"); err != nil {
+		t.Error(err)
+	}
+}
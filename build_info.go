@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/version"
+)
+
+// readBuildInfo returns the build info of the binary, replaced by tests
+var readBuildInfo = debug.ReadBuildInfo
+
+// setBuildInfo fills in the version and the revision of sql_exporter_build_info
+// from the build info of the binary, unless they were set by promu, e.g. for
+// binaries built by go install.
+func setBuildInfo() {
+	info, ok := readBuildInfo()
+	if !ok {
+		return
+	}
+	if version.Version == "" && info.Main.Version != "(devel)" {
+		version.Version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && version.Revision == "" {
+			version.Revision = setting.Value
+		}
+	}
+}
+
+// unregisterRuntimeCollectors removes the Go runtime and the process
+// collectors, which are registered by default, from the registerer.
+func unregisterRuntimeCollectors(r prometheus.Registerer, goMetrics, processMetrics bool) {
+	if !goMetrics {
+		r.Unregister(collectors.NewGoCollector())
+	}
+	if !processMetrics {
+		r.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+}
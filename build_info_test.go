@@ -0,0 +1,104 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/version"
+)
+
+// metricNames returns the names of the metrics gathered from the registry.
+func metricNames(t *testing.T, registry *prometheus.Registry) []string {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(families))
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	return names
+}
+
+func hasPrefix(names []string, prefix string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_unregisterRuntimeCollectors(t *testing.T) {
+	// the collectors registered by default
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if !hasPrefix(metricNames(t, registry), "go_") {
+		t.Fatalf("expected the Go runtime metrics")
+	}
+
+	unregisterRuntimeCollectors(registry, true, true)
+	if !hasPrefix(metricNames(t, registry), "go_") {
+		t.Errorf("expected the enabled Go runtime metrics to stay")
+	}
+	unregisterRuntimeCollectors(registry, false, false)
+	if names := metricNames(t, registry); hasPrefix(names, "go_") || hasPrefix(names, "process_") {
+		t.Errorf("expected the runtime and process metrics to be removed, got %v", names)
+	}
+}
+
+func Test_setBuildInfo(t *testing.T) {
+	defer func(v, r string) {
+		readBuildInfo = debug.ReadBuildInfo
+		version.Version, version.Revision = v, r
+	}(version.Version, version.Revision)
+
+	revision := []debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}}
+	for _, tc := range []struct {
+		name             string
+		info             *debug.BuildInfo
+		ok               bool
+		version          string
+		revision         string
+		expectedVersion  string
+		expectedRevision string
+	}{
+		{
+			name:             "go install",
+			info:             &debug.BuildInfo{Main: debug.Module{Version: "v0.5.1"}, Settings: revision},
+			ok:               true,
+			expectedVersion:  "v0.5.1",
+			expectedRevision: "abc123",
+		},
+		{
+			name:             "local build",
+			info:             &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}, Settings: revision},
+			ok:               true,
+			expectedRevision: "abc123",
+		},
+		{
+			name:             "promu",
+			info:             &debug.BuildInfo{Main: debug.Module{Version: "v0.5.1"}, Settings: revision},
+			ok:               true,
+			version:          "0.5.0",
+			revision:         "def456",
+			expectedVersion:  "0.5.0",
+			expectedRevision: "def456",
+		},
+		{
+			name: "no build info",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			readBuildInfo = func() (*debug.BuildInfo, bool) { return tc.info, tc.ok }
+			version.Version, version.Revision = tc.version, tc.revision
+			setBuildInfo()
+			if version.Version != tc.expectedVersion || version.Revision != tc.expectedRevision {
+				t.Errorf("expected version %q and revision %q, got %q and %q", tc.expectedVersion, tc.expectedRevision, version.Version, version.Revision)
+			}
+		})
+	}
+}
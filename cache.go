@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cacheTypeRedis     = "redis"
+	cacheTypeMemcached = "memcached"
+
+	// cachePollInterval is the interval at which replicas waiting for
+	// another replica to execute a query check for the result
+	cachePollInterval = 500 * time.Millisecond
+	// defaultResultCacheTTL is the default maximum age of cached results
+	defaultResultCacheTTL = 30 * time.Second
+)
+
+var (
+	// results is the optional result cache shared by exporter replicas
+	results    resultCache
+	resultsTTL time.Duration
+	resultsMtx sync.RWMutex
+
+	resultCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sql_exporter_result_cache_requests_total",
+			Help: "Requests to the shared result cache by result (hit, miss, wait)",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(resultCacheRequests)
+}
+
+// resultCache stores query results so multiple exporter replicas serve
+// consistent values and only one of them executes each query per interval.
+type resultCache interface {
+	// get returns the value for key, if any.
+	get(key string) ([]byte, bool, error)
+	// set stores the value for the given time.
+	set(key string, value []byte, ttl time.Duration) error
+	// lock acquires the key for the given time. It returns false if the key
+	// is held by another replica.
+	lock(key string, ttl time.Duration) (bool, error)
+}
+
+// sharedResultCache returns the configured result cache, nil if there is
+// none, along with the maximum age of its results.
+func sharedResultCache() (resultCache, time.Duration) {
+	resultsMtx.RLock()
+	defer resultsMtx.RUnlock()
+	return results, resultsTTL
+}
+
+// setSharedResultCache replaces the result cache.
+func setSharedResultCache(cache resultCache, ttl time.Duration) {
+	resultsMtx.Lock()
+	defer resultsMtx.Unlock()
+	results = cache
+	resultsTTL = ttl
+}
+
+// newResultCache returns the cache for the given config, nil if no cache is
+// configured.
+func newResultCache(cfg *ResultCache) (resultCache, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("result cache requires an address")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("result cache ttl must not be negative")
+	}
+	switch cfg.Type {
+	case cacheTypeRedis:
+		return &redisCache{
+			pool: &redis.Pool{
+				MaxIdle:     2,
+				IdleTimeout: 5 * time.Minute,
+				Dial: func() (redis.Conn, error) {
+					return redis.Dial("tcp", cfg.Address,
+						redis.DialPassword(cfg.Password),
+						redis.DialDatabase(cfg.Database),
+						redis.DialConnectTimeout(5*time.Second),
+					)
+				},
+			},
+		}, nil
+	case cacheTypeMemcached:
+		return &memcachedCache{client: memcache.New(cfg.Address)}, nil
+	default:
+		return nil, fmt.Errorf("unknown result cache type %q", cfg.Type)
+	}
+}
+
+type redisCache struct {
+	pool *redis.Pool
+}
+
+func (c *redisCache) get(key string) ([]byte, bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) set(key string, value []byte, ttl time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (c *redisCache) lock(key string, ttl time.Duration) (bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", key, "1", "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type memcachedCache struct {
+	client *memcache.Client
+}
+
+func (c *memcachedCache) get(key string) ([]byte, bool, error) {
+	item, err := c.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
+}
+
+func (c *memcachedCache) set(key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(&memcache.Item{Key: key, Value: value, Expiration: memcachedExpiration(ttl)})
+}
+
+func (c *memcachedCache) lock(key string, ttl time.Duration) (bool, error) {
+	err := c.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: memcachedExpiration(ttl)})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// memcachedExpiration converts the ttl to seconds, memcached doesn't support
+// a finer resolution.
+func memcachedExpiration(ttl time.Duration) int32 {
+	seconds := int32(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// cacheKey identifies the result of a query on a connection. The key is
+// hashed since the connection URL may contain credentials.
+func (q *Query) cacheKey(conn *connection) string {
+	h := sha256.New()
+	// render errors fail the query before the result is cached
+	query, _ := q.text(conn)
+	for _, part := range []string{q.jobName, q.Name, query, conn.url} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	for _, p := range q.Params {
+		h.Write([]byte(p.source()))
+		h.Write([]byte{0})
+	}
+	return "sql_exporter:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedColumn is a column value with its type retained, so cached results
+// are processed exactly like results fetched from the database.
+type cachedColumn struct {
+	Kind   string    `json:"k"`
+	String string    `json:"s,omitempty"`
+	Int    int64     `json:"i,omitempty"`
+	Uint   uint64    `json:"u,omitempty"`
+	Float  float64   `json:"f,omitempty"`
+	Bool   bool      `json:"b,omitempty"`
+	Time   time.Time `json:"t,omitempty"`
+}
+
+func encodeColumn(v interface{}) cachedColumn {
+	switch val := v.(type) {
+	case nil:
+		return cachedColumn{Kind: "null"}
+	case []uint8:
+		return cachedColumn{Kind: "bytes", String: string(val)}
+	case string:
+		return cachedColumn{Kind: "string", String: val}
+	case int:
+		return cachedColumn{Kind: "int", Int: int64(val)}
+	case int32:
+		return cachedColumn{Kind: "int", Int: int64(val)}
+	case int64:
+		return cachedColumn{Kind: "int", Int: val}
+	case uint:
+		return cachedColumn{Kind: "uint", Uint: uint64(val)}
+	case uint32:
+		return cachedColumn{Kind: "uint", Uint: uint64(val)}
+	case uint64:
+		return cachedColumn{Kind: "uint", Uint: val}
+	case float32:
+		return cachedColumn{Kind: "float", Float: float64(val)}
+	case float64:
+		return cachedColumn{Kind: "float", Float: val}
+	case bool:
+		return cachedColumn{Kind: "bool", Bool: val}
+	case time.Time:
+		return cachedColumn{Kind: "time", Time: val}
+	default:
+		return cachedColumn{Kind: "string", String: fmt.Sprint(val)}
+	}
+}
+
+func (c cachedColumn) decode() interface{} {
+	switch c.Kind {
+	case "bytes":
+		return []uint8(c.String)
+	case "string":
+		return c.String
+	case "int":
+		return c.Int
+	case "uint":
+		return c.Uint
+	case "float":
+		return c.Float
+	case "bool":
+		return c.Bool
+	case "time":
+		return c.Time
+	default:
+		return nil
+	}
+}
+
+// cachedRows iterates over a result read from the cache.
+type cachedRows struct {
+	rows []map[string]cachedColumn
+	next int
+}
+
+func decodeRows(buf []byte) (*cachedRows, error) {
+	rows := &cachedRows{}
+	if err := json.Unmarshal(buf, &rows.rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (r *cachedRows) Next() bool {
+	r.next++
+	return r.next <= len(r.rows)
+}
+
+func (r *cachedRows) MapScan(dest map[string]interface{}) error {
+	for column, value := range r.rows[r.next-1] {
+		dest[column] = value.decode()
+	}
+	return nil
+}
+
+func (r *cachedRows) Err() error {
+	return nil
+}
+
+func (r *cachedRows) Close() error {
+	return nil
+}
+
+// recordingRows records all rows scanned from the database so they can be
+// stored in the cache afterwards. The timestamps are localized before, since
+// the cache doesn't keep whether they had zone information.
+type recordingRows struct {
+	resultRows
+	localize func(map[string]interface{})
+	rows     []map[string]cachedColumn
+	err      error
+}
+
+// Err records the error of the iteration, e.g. a timeout or a dropped
+// connection, so the partial result isn't stored.
+func (r *recordingRows) Err() error {
+	err := r.resultRows.Err()
+	if err != nil {
+		r.err = err
+	}
+	return err
+}
+
+func (r *recordingRows) MapScan(dest map[string]interface{}) error {
+	if err := r.resultRows.MapScan(dest); err != nil {
+		r.err = err
+		return err
+	}
+	r.localize(dest)
+	row := make(map[string]cachedColumn, len(dest))
+	for column, value := range dest {
+		row[column] = encodeColumn(value)
+	}
+	r.rows = append(r.rows, row)
+	return nil
+}
+
+// resultCacheTTL returns how long the results of the query are cached, the
+// ttl of the cache but at most the interval of the query, so cached results
+// are never older than the results of the replica running the query itself.
+func (q *Query) resultCacheTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = defaultResultCacheTTL
+	}
+	if q.interval > 0 && q.interval < ttl {
+		ttl = q.interval
+	}
+	return ttl
+}
+
+// cachedResultRows returns the rows of the query from the shared cache. If the
+// result isn't cached yet, the replica holding the lock executes the query
+// while the others wait for the result.
+func (q *Query) cachedResultRows(ctx context.Context, results resultCache, ttl time.Duration, conn *connection) (resultRows, func(complete bool), error) {
+	key := q.cacheKey(conn)
+	ttl = q.resultCacheTTL(ttl)
+	lockTTL := ttl
+	if q.ServerTimeout > 0 && q.ServerTimeout < lockTTL {
+		lockTTL = q.ServerTimeout
+	}
+	deadline := time.Now().Add(lockTTL)
+	for {
+		if buf, found, err := results.get(key); err != nil {
+			level.Warn(q.log).Log("msg", "Failed to read from result cache", "err", err)
+			break
+		} else if found {
+			rows, err := decodeRows(buf)
+			if err != nil {
+				level.Warn(q.log).Log("msg", "Failed to decode cached result", "err", err)
+				break
+			}
+			resultCacheRequests.WithLabelValues("hit").Inc()
+			return rows, func(bool) {}, nil
+		}
+		locked, err := results.lock(key+":lock", lockTTL)
+		if err != nil {
+			level.Warn(q.log).Log("msg", "Failed to lock result cache", "err", err)
+			break
+		}
+		if locked {
+			resultCacheRequests.WithLabelValues("miss").Inc()
+			rows, done, err := q.queryRows(ctx, conn)
+			if err != nil {
+				return nil, nil, err
+			}
+			rec := &recordingRows{resultRows: rows, localize: func(res map[string]interface{}) { q.localizeTimes(conn, res) }}
+			return rec, func(complete bool) {
+				done()
+				// partial results of failed or aborted runs aren't shared
+				if !complete || rec.err != nil {
+					return
+				}
+				buf, err := json.Marshal(rec.rows)
+				if err == nil {
+					err = results.set(key, buf, ttl)
+				}
+				if err != nil {
+					level.Warn(q.log).Log("msg", "Failed to store result in cache", "err", err)
+				}
+			}, nil
+		}
+		// another replica is executing the query right now
+		if time.Now().After(deadline) {
+			break
+		}
+		resultCacheRequests.WithLabelValues("wait").Inc()
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(cachePollInterval):
+		}
+	}
+	// fall back to executing the query if the cache isn't usable
+	rows, done, err := q.queryRows(ctx, conn)
+	return rows, func(bool) { done() }, err
+}
+
+// localResults deduplicates the executions of identical queries on the same
+// connection within this exporter, see Query.CacheTTL.
+var localResults = &localResultCache{entries: make(map[string]*localResult)}
+
+var localResultCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sql_exporter_local_result_cache_requests_total",
+		Help: "Requests to the local result cache of queries with a cache_ttl by result (hit, miss)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(localResultCacheRequests)
+}
+
+type localResultCache struct {
+	sync.Mutex
+	entries map[string]*localResult
+}
+
+// localResult is the result of a single execution. ready is closed once the
+// execution finished, rows and err must not be read before.
+type localResult struct {
+	ready   chan struct{}
+	rows    []map[string]cachedColumn
+	err     error
+	expires time.Time
+}
+
+func (r *localResult) expired(now time.Time) bool {
+	select {
+	case <-r.ready:
+		return now.After(r.expires)
+	default:
+		// still running
+		return false
+	}
+}
+
+// localCacheKey identifies identical queries on the same connection and
+// user, regardless of the job and name of the query.
+func (q *Query) localCacheKey(conn *connection) string {
+	query, _ := q.text(conn)
+	parts := []string{query, conn.url, q.User}
+	for _, p := range q.Params {
+		parts = append(parts, p.source())
+	}
+	parts = append(parts, q.SetupSQL...)
+	if q.Procedure != nil {
+		parts = append(parts, q.Procedure.Name)
+	}
+	if q.MaxRows > 0 {
+		// the result is cut after max_rows
+		parts = append(parts, fmt.Sprintf("limit:%d", q.MaxRows))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// localResultRows returns the rows of the query from the local cache. Queries
+// started while an identical query is running wait for its result instead of
+// executing the query again. The result is reused for the cache_ttl of the
+// query which executed it.
+func (q *Query) localResultRows(ctx context.Context, conn *connection) (resultRows, func(), error) {
+	key := q.localCacheKey(conn)
+	now := time.Now()
+	localResults.Lock()
+	for k, r := range localResults.entries {
+		if r.expired(now) {
+			delete(localResults.entries, k)
+		}
+	}
+	entry, found := localResults.entries[key]
+	if !found {
+		entry = &localResult{ready: make(chan struct{})}
+		localResults.entries[key] = entry
+	}
+	localResults.Unlock()
+
+	if found {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-entry.ready:
+		}
+		if entry.err != nil {
+			return nil, nil, entry.err
+		}
+		localResultCacheRequests.WithLabelValues("hit").Inc()
+		return &cachedRows{rows: entry.rows}, func() {}, nil
+	}
+
+	localResultCacheRequests.WithLabelValues("miss").Inc()
+	entry.rows, entry.err = q.fetchRows(ctx, conn)
+	entry.expires = time.Now().Add(q.CacheTTL)
+	close(entry.ready)
+	if entry.err != nil {
+		// failures are only shared with the queries waiting for them
+		localResults.Lock()
+		if localResults.entries[key] == entry {
+			delete(localResults.entries, key)
+		}
+		localResults.Unlock()
+		return nil, nil, entry.err
+	}
+	return &cachedRows{rows: entry.rows}, func() {}, nil
+}
+
+// fetchRows executes the query and reads all rows of the result. Like a run
+// of the query it stops reading once the heap exceeds max-memory, and after
+// max_rows, keeping a single row more so the run notices the exceeded limit.
+func (q *Query) fetchRows(ctx context.Context, conn *connection) ([]map[string]cachedColumn, error) {
+	rows, done, err := q.queryRows(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer rows.Close()
+	var result []map[string]cachedColumn
+	for rows.Next() {
+		if q.MaxRows > 0 && len(result) > q.MaxRows {
+			break
+		}
+		if err := checkMemory(len(result) + 1); err != nil {
+			return nil, err
+		}
+		res := make(map[string]interface{})
+		if err := rows.MapScan(res); err != nil {
+			return nil, err
+		}
+		// the cache doesn't keep whether the timestamps had zone information
+		q.localizeTimes(conn, res)
+		row := make(map[string]cachedColumn, len(res))
+		for column, value := range res {
+			row[column] = encodeColumn(value)
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
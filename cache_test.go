@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeResultCache is an in-memory resultCache recording the ttl of the values.
+type fakeResultCache struct {
+	sync.Mutex
+	values map[string][]byte
+	ttls   map[string]time.Duration
+	// locked makes lock fail as if another replica executed the query, which
+	// stores its result on the first attempt.
+	locked []byte
+}
+
+func newFakeResultCache() *fakeResultCache {
+	return &fakeResultCache{values: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (c *fakeResultCache) get(key string) ([]byte, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	value, found := c.values[key]
+	return value, found, nil
+}
+
+func (c *fakeResultCache) set(key string, value []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] = value
+	c.ttls[key] = ttl
+	return nil
+}
+
+func (c *fakeResultCache) lock(key string, ttl time.Duration) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.locked != nil {
+		c.values[key[:len(key)-len(":lock")]] = c.locked
+		return false, nil
+	}
+	if _, found := c.values[key]; found {
+		return false, nil
+	}
+	c.values[key] = []byte("1")
+	return true, nil
+}
+
+// cachedRowsJSON returns a cached result with a single value column.
+func cachedRowsJSON(t *testing.T, value int64) []byte {
+	buf, err := json.Marshal([]map[string]cachedColumn{{"value": encodeColumn(value)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// gaugeValue returns the value of the gauge.
+func gaugeValue(t *testing.T, m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetGauge().GetValue()
+}
+
+func Test_cachedResultRows(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cached   []byte
+		locked   []byte
+		expected float64
+	}{
+		{name: "miss", expected: 1},
+		{name: "hit", cached: cachedRowsJSON(t, 7), expected: 7},
+		{name: "wait", locked: cachedRowsJSON(t, 9), expected: 9},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &Query{Name: "cached", Help: "Cached", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value"}
+			job := &Job{
+				Name:        "cache",
+				Interval:    5 * time.Minute,
+				Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+				Queries:     []*Query{q},
+			}
+			if err := job.Init(log.NewNopLogger(), nil); err != nil {
+				t.Fatal(err)
+			}
+			job.initConnections()
+			defer job.closeConnections()
+			conn := job.conns[0]
+			if err := conn.connect(job); err != nil {
+				t.Fatal(err)
+			}
+
+			cache := newFakeResultCache()
+			cache.locked = tc.locked
+			if tc.cached != nil {
+				cache.values[q.cacheKey(conn)] = tc.cached
+			}
+			setSharedResultCache(cache, 0)
+			defer setSharedResultCache(nil, 0)
+
+			if err := q.Run(conn); err != nil {
+				t.Fatal(err)
+			}
+			if len(q.metrics[conn]) != 1 {
+				t.Fatalf("expected a single metric, got %d", len(q.metrics[conn]))
+			}
+			if got := gaugeValue(t, q.metrics[conn][0]); got != tc.expected {
+				t.Errorf("expected value %v, got %v", tc.expected, got)
+			}
+			if tc.cached == nil && tc.locked == nil {
+				if ttl := cache.ttls[q.cacheKey(conn)]; ttl != defaultResultCacheTTL {
+					t.Errorf("expected the result to be cached for %s, got %s", defaultResultCacheTTL, ttl)
+				}
+			}
+		})
+	}
+}
+
+func Test_cachedResultRows_partial(t *testing.T) {
+	const series = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 3) "
+	for _, tc := range []struct {
+		name    string
+		query   string
+		maxRows int
+		cached  bool
+	}{
+		{name: "complete", query: series + "SELECT x AS value FROM c", cached: true},
+		// abs fails with an integer overflow on the last row
+		{name: "failing", query: series + "SELECT CASE WHEN x = 3 THEN abs(-9223372036854775808) ELSE x END AS value FROM c"},
+		{name: "truncated", query: series + "SELECT x AS value FROM c", maxRows: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &Query{Name: "partial", Help: "Partial", Values: Values{{Column: "value"}}, Query: tc.query, MaxRows: tc.maxRows}
+			job := &Job{
+				Name:        "cache",
+				Interval:    5 * time.Minute,
+				Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+				Queries:     []*Query{q},
+			}
+			if err := job.Init(log.NewNopLogger(), nil); err != nil {
+				t.Fatal(err)
+			}
+			job.initConnections()
+			defer job.closeConnections()
+			conn := job.conns[0]
+			if err := conn.connect(job); err != nil {
+				t.Fatal(err)
+			}
+
+			cache := newFakeResultCache()
+			setSharedResultCache(cache, 0)
+			defer setSharedResultCache(nil, 0)
+
+			err := q.Run(conn)
+			// the truncation is counted, which other tests don't expect
+			defer func() {
+				queryLimits.mtx.Lock()
+				defer queryLimits.mtx.Unlock()
+				delete(queryLimits.values, strings.Join([]string{conn.driver, conn.host, conn.database, conn.user, job.Name, q.Name, "rows"}, "\xff"))
+			}()
+			if failed := tc.name == "failing"; failed != (err != nil) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, found := cache.values[q.cacheKey(conn)]; found != tc.cached {
+				t.Errorf("expected the result to be cached: %v, got %v", tc.cached, found)
+			}
+		})
+	}
+}
+
+func TestQuery_resultCacheTTL(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{interval: 5 * time.Minute, expected: defaultResultCacheTTL},
+		{interval: 5 * time.Minute, ttl: 2 * time.Minute, expected: 2 * time.Minute},
+		{interval: 10 * time.Second, ttl: time.Minute, expected: 10 * time.Second},
+		{interval: 10 * time.Second, expected: 10 * time.Second},
+		{ttl: time.Minute, expected: time.Minute},
+	} {
+		q := &Query{interval: tc.interval}
+		if got := q.resultCacheTTL(tc.ttl); got != tc.expected {
+			t.Errorf("interval %s, ttl %s: expected %s, got %s", tc.interval, tc.ttl, tc.expected, got)
+		}
+	}
+}
+
+func Test_cachedColumn(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	in := map[string]interface{}{
+		"null":   nil,
+		"bytes":  []uint8("abc"),
+		"string": "abc",
+		"int":    int64(-3),
+		"uint":   uint64(3),
+		"float":  2.5,
+		"bool":   true,
+		"time":   now,
+	}
+	row := make(map[string]cachedColumn, len(in))
+	for column, value := range in {
+		row[column] = encodeColumn(value)
+	}
+	buf, err := json.Marshal([]map[string]cachedColumn{row})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := decodeRows(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal("expected a row")
+	}
+	out := make(map[string]interface{})
+	if err := rows.MapScan(out); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(in, out); diff != "" {
+		t.Errorf("unexpected columns (-want +got):\n\n%s", diff)
+	}
+	if rows.Next() {
+		t.Error("expected a single row")
+	}
+}
+
+func Test_newResultCache(t *testing.T) {
+	for _, cfg := range []*ResultCache{
+		{Type: cacheTypeRedis},
+		{Type: "etcd", Address: "etcd:2379"},
+		{Type: cacheTypeRedis, Address: "redis:6379", TTL: -time.Second},
+	} {
+		if _, err := newResultCache(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+	if cache, err := newResultCache(nil); cache != nil || err != nil {
+		t.Errorf("expected no cache without config, got %v, %v", cache, err)
+	}
+}
+
+func Test_memcachedExpiration(t *testing.T) {
+	for ttl, expected := range map[time.Duration]int32{
+		100 * time.Millisecond: 1,
+		30 * time.Second:       30,
+		90 * time.Second:       90,
+	} {
+		if got := memcachedExpiration(ttl); got != expected {
+			t.Errorf("%s: expected %d, got %d", ttl, expected, got)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// trackedSeries counts the series exported by all queries
+	trackedSeries = newSeriesTracker()
+
+	// descNameRE extracts the metric name from the string representation of
+	// a descriptor, which has no accessor for it
+	descNameRE = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+	seriesCountDesc = prometheus.NewDesc(
+		"sql_exporter_series_count",
+		"Number of series exported by metric family",
+		[]string{"family"},
+		nil,
+	)
+	seriesLimitDesc = prometheus.NewDesc(
+		"sql_exporter_series_limit_reached",
+		"Whether new series are dropped because the series_limit is reached",
+		nil,
+		nil,
+	)
+	seriesDroppedDesc = prometheus.NewDesc(
+		"sql_exporter_series_dropped_total",
+		"Number of series dropped because the series_limit was reached",
+		nil,
+		nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(trackedSeries)
+}
+
+// seriesOwner identifies the metrics of a query on a connection.
+type seriesOwner struct {
+	query *Query
+	conn  *connection
+}
+
+// seriesTracker counts the unique label sets per metric family of all
+// queries. Once the limit is reached, series not exported before are
+// dropped, while the existing series keep being updated.
+type seriesTracker struct {
+	sync.Mutex
+	limit   int // 0 disables the limit
+	total   int
+	dropped float64
+	reached bool
+	owners  map[seriesOwner]map[uint64]string // family by series hash
+	counts  map[string]int                    // series by family
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		owners: make(map[seriesOwner]map[uint64]string),
+		counts: make(map[string]int),
+	}
+}
+
+// setLimit changes the maximum number of series, 0 disables the limit.
+func (t *seriesTracker) setLimit(limit int) {
+	t.Lock()
+	defer t.Unlock()
+	t.limit = limit
+}
+
+// track replaces the series of the owner by the given metrics and returns
+// the ones within the limit.
+func (t *seriesTracker) track(owner seriesOwner, metrics []prometheus.Metric) []prometheus.Metric {
+	t.Lock()
+	defer t.Unlock()
+	previous := t.owners[owner]
+	t.remove(owner)
+	current := make(map[uint64]string, len(metrics))
+	// filtered in place, large results aren't held twice
+	kept := metrics[:0]
+	reached := false
+	for _, m := range metrics {
+		family, hash, ok := seriesKey(m)
+		if !ok {
+			kept = append(kept, m)
+			continue
+		}
+		if _, found := current[hash]; !found {
+			_, existing := previous[hash]
+			if !existing && t.limit > 0 && t.total >= t.limit {
+				reached = true
+				t.dropped++
+				continue
+			}
+			current[hash] = family
+			t.counts[family]++
+			t.total++
+		}
+		kept = append(kept, m)
+	}
+	t.owners[owner] = current
+	t.reached = reached || (t.limit > 0 && t.total >= t.limit)
+	return kept
+}
+
+// forget removes the series of the owner.
+func (t *seriesTracker) forget(owner seriesOwner) {
+	t.Lock()
+	defer t.Unlock()
+	t.remove(owner)
+	t.reached = t.limit > 0 && t.total >= t.limit
+}
+
+// remove drops the series of the owner from the counts. Must be called with
+// the lock held.
+func (t *seriesTracker) remove(owner seriesOwner) {
+	for _, family := range t.owners[owner] {
+		t.counts[family]--
+		if t.counts[family] <= 0 {
+			delete(t.counts, family)
+		}
+		t.total--
+	}
+	delete(t.owners, owner)
+}
+
+// Describe implements prometheus.Collector
+func (t *seriesTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seriesCountDesc
+	ch <- seriesLimitDesc
+	ch <- seriesDroppedDesc
+}
+
+// Collect implements prometheus.Collector
+func (t *seriesTracker) Collect(ch chan<- prometheus.Metric) {
+	t.Lock()
+	defer t.Unlock()
+	for family, count := range t.counts {
+		ch <- prometheus.MustNewConstMetric(seriesCountDesc, prometheus.GaugeValue, float64(count), family)
+	}
+	reached := 0.0
+	if t.reached {
+		reached = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(seriesLimitDesc, prometheus.GaugeValue, reached)
+	ch <- prometheus.MustNewConstMetric(seriesDroppedDesc, prometheus.CounterValue, t.dropped)
+}
+
+// seriesKey returns the metric family of the metric along with a hash of its
+// name and labels.
+func seriesKey(m prometheus.Metric) (string, uint64, bool) {
+	match := descNameRE.FindStringSubmatch(m.Desc().String())
+	if match == nil {
+		return "", 0, false
+	}
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return "", 0, false
+	}
+	labels := pb.GetLabel()
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	h := fnv.New64a()
+	h.Write([]byte(match[1]))
+	for _, l := range labels {
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetName()))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetValue()))
+	}
+	return match[1], h.Sum64(), true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_seriesTracker(t *testing.T) {
+	desc := prometheus.NewDesc("sql_users", "Users", []string{"name"}, nil)
+	metrics := func(names ...string) []prometheus.Metric {
+		var m []prometheus.Metric
+		for _, name := range names {
+			m = append(m, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, name))
+		}
+		return m
+	}
+	tracker := newSeriesTracker()
+	tracker.setLimit(3)
+	a, b := seriesOwner{query: &Query{}}, seriesOwner{query: &Query{}}
+
+	if got := tracker.track(a, metrics("a", "b")); len(got) != 2 {
+		t.Errorf("expected 2 series within the limit, got %d", len(got))
+	}
+	// only one more series fits
+	if got := tracker.track(b, metrics("c", "d")); len(got) != 1 {
+		t.Errorf("expected 1 series within the limit, got %d", len(got))
+	}
+	// existing series are kept at the limit, new ones are dropped
+	if got := tracker.track(a, metrics("a", "b", "e")); len(got) != 2 {
+		t.Errorf("expected the existing series to be kept, got %d", len(got))
+	}
+	expected := `
+# HELP sql_exporter_series_count Number of series exported by metric family
+# TYPE sql_exporter_series_count gauge
+sql_exporter_series_count{family="sql_users"} 3
+# HELP sql_exporter_series_dropped_total Number of series dropped because the series_limit was reached
+# TYPE sql_exporter_series_dropped_total counter
+sql_exporter_series_dropped_total 2
+# HELP sql_exporter_series_limit_reached Whether new series are dropped because the series_limit is reached
+# TYPE sql_exporter_series_limit_reached gauge
+sql_exporter_series_limit_reached 1
+`
+	if err := testutil.CollectAndCompare(tracker, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	tracker.forget(b)
+	if got := tracker.track(a, metrics("a", "b", "e")); len(got) != 3 {
+		t.Errorf("expected series of forgotten owners to free the limit, got %d", len(got))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	// validMetricNameRE matches valid metric names, see
+	// github.com/prometheus/common/model.MetricNameRE
+	validMetricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	// validLabelNameRE matches valid label names, see
+	// github.com/prometheus/common/model.LabelNameRE
+	validLabelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// CheckConfig parses and validates the config without connecting to any
+// database. It returns all problems found instead of only the first one. The
+// path may be a directory or glob pattern as for Read.
+func CheckConfig(path string) []error {
+	f, err := readConfigFiles(path)
+	if err != nil {
+		return []error{err}
+	}
+	return f.check()
+}
+
+func checkConfig(r io.Reader) []error {
+	f, err := decodeConfig(r, ".", map[string]bool{})
+	if err != nil {
+		return []error{err}
+	}
+	return f.check()
+}
+
+func (f File) check() []error {
+	var problems []error
+	if f.SeriesLimit < 0 {
+		problems = append(problems, fmt.Errorf("series_limit must not be negative"))
+	}
+	if err := f.resolveConnectionRefs(); err != nil {
+		problems = append(problems, err)
+	}
+	f.applyDefaults()
+	for name, cc := range f.Connections {
+		if cc == nil {
+			continue
+		}
+		if err := cc.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("connection %q: %v", name, err))
+		}
+	}
+	if f.RemoteWrite != nil {
+		if err := f.RemoteWrite.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("remote_write: %v", err))
+		}
+	}
+	if f.OTLP != nil {
+		if err := f.OTLP.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("otlp: %v", err))
+		}
+	}
+	if f.Notifications != nil {
+		if err := f.Notifications.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("notifications: %v", err))
+		}
+	}
+	if f.Policy != nil {
+		if err := f.Policy.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("policy: %v", err))
+		} else {
+			problems = append(problems, f.policyViolations()...)
+		}
+	}
+	if f.ExporterMetrics != nil {
+		if _, _, err := keepLabels(exporterMetricLabels, f.ExporterMetrics.Labels); err != nil {
+			problems = append(problems, fmt.Errorf("exporter_metrics: %v", err))
+		}
+	}
+	names := make(map[string]bool, len(f.Jobs))
+	for _, job := range f.Jobs {
+		if job == nil {
+			continue
+		}
+		if names[job.Name] {
+			problems = append(problems, fmt.Errorf("job %q is defined more than once", job.Name))
+		}
+		names[job.Name] = true
+		for _, err := range job.check(f.Queries) {
+			problems = append(problems, fmt.Errorf("job %q: %v", job.Name, err))
+		}
+	}
+	for name, module := range f.Modules {
+		if module == nil {
+			continue
+		}
+		for _, err := range module.check(f.Queries) {
+			problems = append(problems, fmt.Errorf("module %q: %v", name, err))
+		}
+	}
+	return problems
+}
+
+// check returns the problems of the job, including the ones which are
+// silently fixed or skipped at runtime.
+func (j *Job) check(queries map[string]string) []error {
+	var problems []error
+	if err := j.validate(); err != nil {
+		problems = append(problems, err)
+	}
+	prefix := j.metricPrefix()
+	for k := range j.StaticLabels {
+		if !validLabelNameRE.MatchString(k) {
+			problems = append(problems, fmt.Errorf("invalid static label name %q", k))
+		}
+	}
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		for _, err := range q.check(prefix, queries) {
+			problems = append(problems, fmt.Errorf("query %q: %v", q.Name, err))
+		}
+	}
+	return problems
+}
+
+func (q *Query) check(prefix string, queries map[string]string) []error {
+	var problems []error
+	if !validMetricNameRE.MatchString(prefix + q.Name) {
+		problems = append(problems, fmt.Errorf("invalid metric name %q", prefix+q.Name))
+	}
+	switch {
+	case q.Query != "":
+	case q.QueryRef == "":
+		problems = append(problems, fmt.Errorf("query is empty"))
+	default:
+		if _, found := queries[q.QueryRef]; !found {
+			problems = append(problems, fmt.Errorf("query_ref %q doesn't exist", q.QueryRef))
+		}
+	}
+	query := q.Query
+	if query == "" {
+		query = queries[q.QueryRef]
+	}
+	if q.Template {
+		if _, err := parseQueryTemplate(q.Name, query, queries); err != nil {
+			problems = append(problems, fmt.Errorf("invalid query template: %v", err))
+		}
+	}
+	for _, label := range q.Labels {
+		if !validLabelNameRE.MatchString(label.Name) || strings.HasPrefix(label.Name, "__") {
+			problems = append(problems, fmt.Errorf("invalid label name %q", label.Name))
+		}
+		if label.Template != "" {
+			if _, err := template.New(label.Name).Parse(label.Template); err != nil {
+				problems = append(problems, fmt.Errorf("invalid template for label %q: %v", label.Name, err))
+			}
+		}
+		if label.Regex != "" {
+			if _, err := regexp.Compile(label.Regex); err != nil {
+				problems = append(problems, fmt.Errorf("invalid regex for label %q: %v", label.Name, err))
+			}
+		}
+	}
+	for k := range q.StaticLabels {
+		if !validLabelNameRE.MatchString(k) {
+			problems = append(problems, fmt.Errorf("invalid static label name %q", k))
+		}
+	}
+	if q.Exemplar != nil {
+		for k := range q.Exemplar.Labels {
+			if !validLabelNameRE.MatchString(k) {
+				problems = append(problems, fmt.Errorf("invalid exemplar label name %q", k))
+			}
+		}
+	}
+	for _, a := range q.Expect {
+		if a == nil {
+			continue
+		}
+		if _, err := parseCondition(a.Expr); err != nil {
+			problems = append(problems, fmt.Errorf("invalid assertion %q: %v", a.Expr, err))
+		}
+	}
+	for _, hv := range q.HistValues {
+		for _, b := range hv.Buckets {
+			if _, err := strconv.ParseFloat(b.Value, 64); err != nil {
+				problems = append(problems, fmt.Errorf("histogram %q: invalid bucket value %q", hv.Name, b.Value))
+			}
+		}
+	}
+	for _, sv := range q.SummaryValues {
+		for _, qt := range sv.Quantiles {
+			if _, err := strconv.ParseFloat(qt.Value, 64); err != nil {
+				problems = append(problems, fmt.Errorf("summary %q: invalid quantile value %q", sv.Name, qt.Value))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_checkConfig(t *testing.T) {
+	if problems := checkConfig(strings.NewReader(testPostgresGuageConfigYAML)); len(problems) > 0 {
+		t.Errorf("got unexpected problems: %v", problems)
+	}
+
+	in := `
+jobs:
+- name: "broken"
+  connections:
+  - 'postgres://postgres@localhost/postgres?sslmode=disable'
+  queries:
+  - name: "running-queries"
+    labels:
+      - "dat.name"
+    values:
+      - "count"
+    query_ref: "missing"
+  - name: "durations"
+    type: "histogram"
+    hist_values:
+      - count: "count"
+        sum: "sum"
+        buckets:
+          - name: "b100"
+            value: "0.1s"
+    query: "SELECT 1"
+`
+	problems := checkConfig(strings.NewReader(in))
+	expected := []string{
+		`invalid metric name "sql_running-queries"`,
+		`query_ref "missing" doesn't exist`,
+		`invalid label name "dat.name"`,
+		`invalid bucket value "0.1s"`,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.Contains(problem.Error(), expected[i]) {
+			t.Errorf("expected problem %q, got %q", expected[i], problem)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultCloudWatchBatchSize = 20
+	defaultCloudWatchRateLimit = 10
+	// cloudWatchMaxBatchSize and cloudWatchMaxDimensions are limits of the
+	// PutMetricData API
+	cloudWatchMaxBatchSize  = 1000
+	cloudWatchMaxDimensions = 30
+	// cloudWatchTimeout limits each PutMetricData request
+	cloudWatchTimeout = 30 * time.Second
+)
+
+func (c *CloudWatch) validate() error {
+	if c.Namespace == "" {
+		return fmt.Errorf("namespace is required")
+	}
+	if c.BatchSize < 0 || c.BatchSize > cloudWatchMaxBatchSize {
+		return fmt.Errorf("batch_size must be between 1 and %d", cloudWatchMaxBatchSize)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative")
+	}
+	if len(c.Dimensions) > cloudWatchMaxDimensions {
+		return fmt.Errorf("at most %d dimensions are supported", cloudWatchMaxDimensions)
+	}
+	return nil
+}
+
+// cloudWatchClient returns the CloudWatch client, created on first use with
+// the AWS credentials of the exporter.
+func (c *CloudWatch) cloudWatchClient() (cloudwatchiface.CloudWatchAPI, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	cfg := aws.NewConfig()
+	if c.Region != "" {
+		cfg = cfg.WithRegion(c.Region)
+	}
+	if c.Endpoint != "" {
+		cfg = cfg.WithEndpoint(c.Endpoint)
+	}
+	if c.RoleARN != "" {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(sess, c.RoleARN))
+	}
+	c.client = cloudwatch.New(sess, cfg)
+	return c.client, nil
+}
+
+// emitCloudWatch sends the current metrics of all queries of the job to
+// CloudWatch, in batches limited to the configured request rate, until the
+// context is cancelled. Histograms and summaries are sent as their sum and
+// count.
+func (j *Job) emitCloudWatch(ctx context.Context) {
+	c := j.CloudWatch
+	if c == nil {
+		return
+	}
+	client, err := c.cloudWatchClient()
+	if err != nil {
+		level.Warn(j.log).Log("msg", "Failed to create CloudWatch client", "err", err)
+		return
+	}
+	batchSize := c.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultCloudWatchBatchSize
+	}
+	rateLimit := c.RateLimit
+	if rateLimit == 0 {
+		rateLimit = defaultCloudWatchRateLimit
+	}
+	pause := time.Duration(float64(time.Second) / rateLimit)
+
+	now := time.Now()
+	var data []*cloudwatch.MetricDatum
+	for _, m := range j.currentMetrics() {
+		data = append(data, c.datums(m, now)...)
+	}
+	for start := 0; start < len(data); start += batchSize {
+		if start > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pause):
+			}
+		}
+		end := start + batchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, cloudWatchTimeout)
+		_, err := client.PutMetricDataWithContext(reqCtx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(c.Namespace),
+			MetricData: data[start:end],
+		})
+		cancel()
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Failed to send metrics to CloudWatch", "namespace", c.Namespace, "err", err)
+		}
+	}
+}
+
+// datums converts the metric to CloudWatch metric data. The labels are sent
+// as dimensions, empty labels are dropped since CloudWatch rejects them.
+func (c *CloudWatch) datums(m prometheus.Metric, timestamp time.Time) []*cloudwatch.MetricDatum {
+	family, pb, ok := metricSample(m)
+	if !ok {
+		return nil
+	}
+	var dimensions []*cloudwatch.Dimension
+	for _, l := range pb.GetLabel() {
+		if l.GetValue() == "" || (len(c.Dimensions) > 0 && !containsString(c.Dimensions, l.GetName())) {
+			continue
+		}
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String(l.GetName()), Value: aws.String(l.GetValue())})
+	}
+	if len(dimensions) > cloudWatchMaxDimensions {
+		dimensions = dimensions[:cloudWatchMaxDimensions]
+	}
+	values := sampleValues(pb)
+	suffixes := make([]string, 0, len(values))
+	for suffix := range values {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	var data []*cloudwatch.MetricDatum
+	for _, suffix := range suffixes {
+		value := values[suffix]
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String(family + suffix),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(timestamp),
+			Value:      aws.Float64(value),
+			Unit:       aws.String(cloudwatch.StandardUnitNone),
+		})
+	}
+	return data
+}
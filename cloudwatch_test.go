@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/go-kit/kit/log"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+	// blocked makes the requests hang until they are cancelled, each
+	// request is announced on the channel
+	blocked chan struct{}
+}
+
+func (f *fakeCloudWatch) PutMetricDataWithContext(ctx aws.Context, in *cloudwatch.PutMetricDataInput, _ ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+	f.inputs = append(f.inputs, in)
+	if f.blocked != nil {
+		f.blocked <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatch_datums(t *testing.T) {
+	desc := prometheus.NewDesc("sql_orders", "Orders", []string{"host", "state", "user"}, prometheus.Labels{"sql_job": "shop"})
+	m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 42, "db1", "paid", "")
+	now := time.Unix(1500, 0)
+
+	c := &CloudWatch{Namespace: "SQL/Business", Dimensions: []string{"sql_job", "state", "user"}}
+	expected := []*cloudwatch.MetricDatum{{
+		MetricName: aws.String("sql_orders"),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("sql_job"), Value: aws.String("shop")},
+			{Name: aws.String("state"), Value: aws.String("paid")},
+		},
+		Timestamp: aws.Time(now),
+		Value:     aws.Float64(42),
+		Unit:      aws.String(cloudwatch.StandardUnitNone),
+	}}
+	if diff := pretty.Compare(expected, c.datums(m, now)); diff != "" {
+		t.Errorf("unexpected datums (-want +got):\n\n%s", diff)
+	}
+}
+
+func TestJob_emitCloudWatch(t *testing.T) {
+	fake := &fakeCloudWatch{}
+	job := &Job{
+		Name:        "cloudwatch",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{{
+			Name:   "answer",
+			Help:   "The answer",
+			Values: Values{{Column: "a"}, {Column: "b"}, {Column: "c"}},
+			Query:  "SELECT 1 AS a, 2 AS b, 3 AS c",
+		}},
+		CloudWatch: &CloudWatch{Namespace: "SQL", BatchSize: 2, RateLimit: 1000, client: fake},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	job.sinks.Wait()
+	if len(fake.inputs) != 2 || len(fake.inputs[0].MetricData) != 2 || len(fake.inputs[1].MetricData) != 1 {
+		t.Fatalf("expected the three values in batches of two, got %v", fake.inputs)
+	}
+	if aws.StringValue(fake.inputs[0].Namespace) != "SQL" {
+		t.Errorf("unexpected namespace %q", aws.StringValue(fake.inputs[0].Namespace))
+	}
+}
+
+func TestJob_emitSinks(t *testing.T) {
+	fake := &fakeCloudWatch{blocked: make(chan struct{}, 1)}
+	job := &Job{
+		Name:        "cloudwatch",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT 42 AS value"}},
+		CloudWatch:  &CloudWatch{Namespace: "SQL", client: fake},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+
+	// the runs don't wait for the hanging sink, which is skipped while it's
+	// still sending
+	for i := 0; i < 2; i++ {
+		if err := job.runOnce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-fake.blocked
+	job.cancel()
+	job.sinks.Wait()
+	if len(fake.inputs) != 1 {
+		t.Errorf("expected a single request, got %d", len(fake.inputs))
+	}
+}
+
+func TestCloudWatch_validate(t *testing.T) {
+	for _, tc := range []struct {
+		c   CloudWatch
+		err string
+	}{
+		{c: CloudWatch{Namespace: "SQL"}},
+		{c: CloudWatch{}, err: "namespace is required"},
+		{c: CloudWatch{Namespace: "SQL", BatchSize: 1001}, err: "batch_size must be between 1 and 1000"},
+		{c: CloudWatch{Namespace: "SQL", RateLimit: -1}, err: "rate_limit must not be negative"},
+	} {
+		err := tc.c.validate()
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
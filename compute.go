@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	computeDelta = "delta"
+	computeRate  = "rate"
+)
+
+// computeModes are the computations of values between runs
+var computeModes = []string{computeDelta, computeRate}
+
+// computeKey identifies a series of a computed value on a connection
+type computeKey struct {
+	conn   *connection
+	series string
+}
+
+// computedSample is the value of a series in the previous run
+type computedSample struct {
+	value float64
+	time  time.Time
+}
+
+// compute returns the difference of the value to the previous run of the
+// series, or its per-second rate, and remembers the value for the next run.
+// A value lower than the previous one is a reset of the underlying counter,
+// the difference is the value itself then. The first run of a series has
+// nothing to compare to and returns false.
+func (q *Query) compute(conn *connection, v *Value, labels []string, value float64) (float64, bool) {
+	key := computeKey{conn: conn, series: v.Column + "\x00" + strings.Join(labels, "\x00")}
+	now := time.Now()
+	q.Lock()
+	if q.computed == nil {
+		q.computed = make(map[computeKey]computedSample)
+	}
+	previous, found := q.computed[key]
+	q.computed[key] = computedSample{value: value, time: now}
+	q.Unlock()
+	if !found {
+		return 0, false
+	}
+	delta := value - previous.value
+	if delta < 0 {
+		delta = value
+	}
+	if v.Compute != computeRate {
+		return delta, true
+	}
+	elapsed := now.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return delta / elapsed, true
+}
+
+// pruneComputed forgets the series of the connection which were not part of
+// the run started at the given time, so vanished series don't pile up.
+func (q *Query) pruneComputed(conn *connection, started time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	for key, sample := range q.computed {
+		if key.conn == conn && sample.time.Before(started) {
+			delete(q.computed, key)
+		}
+	}
+}
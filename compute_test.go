@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_computeDelta(t *testing.T) {
+	q := &Query{
+		Name:   "commits",
+		Help:   "Commits since the previous run",
+		Labels: Labels{{Name: "db", Column: "db"}},
+		Values: Values{{Column: "commits", Compute: computeDelta}},
+		Query:  "SELECT 'app' AS db, 0 AS commits",
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(job)
+
+	for _, tc := range []struct {
+		commits  string
+		expected string
+	}{
+		// the first run has nothing to compare to
+		{commits: "10"},
+		{commits: "25", expected: "15"},
+		// a reset of the counter
+		{commits: "5", expected: "5"},
+	} {
+		q.Query = "SELECT 'app' AS db, " + tc.commits + " AS commits"
+		if err := q.Run(conn); err != nil {
+			t.Fatal(err)
+		}
+		expected := ""
+		if tc.expected != "" {
+			expected = `
+# HELP sql_commits Commits since the previous run
+# TYPE sql_commits gauge
+sql_commits{col="commits",database=":memory:",db="app",driver="sqlite",host=":memory:",sql_job="test",user=""} ` + tc.expected + "\n"
+		}
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_commits"); err != nil {
+			t.Errorf("commits %s: %v", tc.commits, err)
+		}
+	}
+}
+
+func TestQuery_computeRate(t *testing.T) {
+	q := &Query{}
+	conn := &connection{}
+	v := &Value{Column: "commits", Compute: computeRate}
+	labels := []string{"app"}
+	if _, ok := q.compute(conn, v, labels, 100); ok {
+		t.Fatal("expected no rate on the first run")
+	}
+	key := computeKey{conn: conn, series: "commits\x00app"}
+	q.computed[key] = computedSample{value: 100, time: time.Now().Add(-10 * time.Second)}
+	rate, ok := q.compute(conn, v, labels, 150)
+	if !ok || math.Abs(rate-5) > 0.01 {
+		t.Errorf("expected a rate of 5/s, got %v", rate)
+	}
+
+	q.pruneComputed(conn, time.Now())
+	if len(q.computed) != 0 {
+		t.Errorf("expected the series to be pruned, got %v", q.computed)
+	}
+}
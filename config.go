@@ -1,83 +1,1639 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
+	"text/template/parse"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	"github.com/go-kit/kit/log"
 	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+	monitoring "google.golang.org/api/monitoring/v3"
 	"gopkg.in/yaml.v2"
 )
 
-var (
-	failedScrapes = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "sql_exporter_last_scrape_failed",
-			Help: "Failed scrapes",
-		},
-		[]string{"driver", "host", "database", "user", "sql_job", "query"},
-	)
-)
+// Read attempts to parse the given config and return a file
+// object. Fills in any referenced environment variables as needed. The path
+// may also be a directory or a glob pattern, the config files found are
+// merged.
+func Read(path string) (File, error) {
+	return ReadJobs(path, nil)
+}
 
-func init() {
-	prometheus.MustRegister(failedScrapes)
+// ReadJobs reads the config like Read, keeping only the jobs with the given
+// names. All enabled jobs are kept if no names are given.
+func ReadJobs(path string, jobs []string) (File, error) {
+	f, err := readConfigFiles(path)
+	if err != nil {
+		return f, err
+	}
+	return f.prepare(jobs)
 }
 
-// Read attempts to parse the given config and return a file
-// object. Fills in any referenced environment variables as needed.
-func Read(path string) (File, error) {
+func parseConfig(r io.Reader) (File, error) {
+	return parseConfigJobs(r, nil)
+}
+
+func parseConfigJobs(r io.Reader, jobs []string) (File, error) {
+	f, err := decodeConfig(r, ".", map[string]bool{})
+	if err != nil {
+		return f, err
+	}
+	return f.prepare(jobs)
+}
+
+// readConfigFiles reads and merges the config files found at the path,
+// including the files they include.
+func readConfigFiles(path string) (File, error) {
+	paths, err := configFiles(path)
+	if err != nil {
+		return File{}, err
+	}
+	if len(paths) == 0 {
+		return File{}, fmt.Errorf("no config files found at %s", path)
+	}
+	f := File{}
+	seen := map[string]bool{}
+	for _, p := range paths {
+		other, err := readConfigFile(p, seen)
+		if err != nil {
+			return f, err
+		}
+		if err := f.merge(other); err != nil {
+			return f, fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	return f, nil
+}
+
+// configFiles returns the YAML files of a directory, the files matching a
+// glob pattern or just the path of a single file.
+func configFiles(path string) ([]string, error) {
+	if hasGlobMeta(path) {
+		return filepath.Glob(path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if ext := filepath.Ext(e.Name()); !e.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			paths = append(paths, filepath.Join(path, e.Name()))
+		}
+	}
+	return paths, nil
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+func readConfigFile(path string, seen map[string]bool) (File, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return File{}, err
+	}
+	if seen[abs] {
+		return File{}, fmt.Errorf("%s is read more than once", path)
+	}
+	seen[abs] = true
 	fh, err := os.Open(path)
 	if err != nil {
 		return File{}, err
 	}
 	defer fh.Close()
-	return parseConfig(fh)
+	f, err := decodeConfig(fh, filepath.Dir(path), seen)
+	if err != nil {
+		return f, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
 }
 
-func parseConfig(r io.Reader) (File, error) {
+// decodeConfig unmarshals a single config file and merges the files it
+// includes. Included paths are relative to dir. seen holds the absolute paths
+// of the files read so far, so include cycles are detected.
+func decodeConfig(r io.Reader, dir string, seen map[string]bool) (File, error) {
 	f := File{}
 
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
 		return f, err
 	}
-	buf = []byte(os.ExpandEnv(string(buf)))
+	buf = []byte(os.Expand(string(buf), expandEnv))
+	if buf, err = applyEnvironment(buf, configEnvironment); err != nil {
+		return f, err
+	}
+	if buf, err = includePacks(buf); err != nil {
+		return f, err
+	}
 
 	if err := yaml.Unmarshal(buf, &f); err != nil {
 		return f, err
 	}
+	for _, results := range f.Mocks {
+		for _, result := range results {
+			if result != nil && result.File != "" && !filepath.IsAbs(result.File) {
+				result.File = filepath.Join(dir, result.File)
+			}
+		}
+	}
+	includes := f.Include
+	f.Include = nil
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		paths, err := configFiles(pattern)
+		if err != nil {
+			return f, fmt.Errorf("include %s: %v", pattern, err)
+		}
+		for _, p := range paths {
+			other, err := readConfigFile(p, seen)
+			if err != nil {
+				return f, err
+			}
+			if err := f.merge(other); err != nil {
+				return f, fmt.Errorf("%s: %v", p, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// merge adds the jobs, queries and modules of another config file. The other
+// settings may only be set in one of the files.
+func (f *File) merge(o File) error {
+	f.Jobs = append(f.Jobs, o.Jobs...)
+	for name, query := range o.Queries {
+		if _, found := f.Queries[name]; found {
+			return fmt.Errorf("query %q is defined more than once", name)
+		}
+		if f.Queries == nil {
+			f.Queries = make(map[string]string, len(o.Queries))
+		}
+		f.Queries[name] = query
+	}
+	for name, cc := range o.Connections {
+		if _, found := f.Connections[name]; found {
+			return fmt.Errorf("connection %q is defined more than once", name)
+		}
+		if f.Connections == nil {
+			f.Connections = make(map[string]*ConnectionConfig, len(o.Connections))
+		}
+		f.Connections[name] = cc
+	}
+	for name, mock := range o.Mocks {
+		if _, found := f.Mocks[name]; found {
+			return fmt.Errorf("mock %q is defined more than once", name)
+		}
+		if f.Mocks == nil {
+			f.Mocks = make(map[string][]*MockResult, len(o.Mocks))
+		}
+		f.Mocks[name] = mock
+	}
+	for name, module := range o.Modules {
+		if _, found := f.Modules[name]; found {
+			return fmt.Errorf("module %q is defined more than once", name)
+		}
+		if f.Modules == nil {
+			f.Modules = make(map[string]*Job, len(o.Modules))
+		}
+		f.Modules[name] = module
+	}
+	if o.ExporterMetrics != nil {
+		if f.ExporterMetrics != nil {
+			return fmt.Errorf("exporter_metrics is set more than once")
+		}
+		f.ExporterMetrics = o.ExporterMetrics
+	}
+	if o.ResultCache != nil {
+		if f.ResultCache != nil {
+			return fmt.Errorf("result_cache is set more than once")
+		}
+		f.ResultCache = o.ResultCache
+	}
+	if o.RemoteWrite != nil {
+		if f.RemoteWrite != nil {
+			return fmt.Errorf("remote_write is set more than once")
+		}
+		f.RemoteWrite = o.RemoteWrite
+	}
+	if o.OTLP != nil {
+		if f.OTLP != nil {
+			return fmt.Errorf("otlp is set more than once")
+		}
+		f.OTLP = o.OTLP
+	}
+	if o.Notifications != nil {
+		if f.Notifications != nil {
+			return fmt.Errorf("notifications is set more than once")
+		}
+		f.Notifications = o.Notifications
+	}
+	if o.Policy != nil {
+		if f.Policy != nil {
+			return fmt.Errorf("policy is set more than once")
+		}
+		f.Policy = o.Policy
+	}
+	if o.BuiltinLabels != nil {
+		if f.BuiltinLabels != nil {
+			return fmt.Errorf("builtin_labels is set more than once")
+		}
+		f.BuiltinLabels = o.BuiltinLabels
+	}
+	if o.MetricPrefix != nil {
+		if f.MetricPrefix != nil {
+			return fmt.Errorf("metric_prefix is set more than once")
+		}
+		f.MetricPrefix = o.MetricPrefix
+	}
+	if o.SeriesLimit != 0 {
+		if f.SeriesLimit != 0 {
+			return fmt.Errorf("series_limit is set more than once")
+		}
+		f.SeriesLimit = o.SeriesLimit
+	}
+	return nil
+}
+
+// prepare filters the jobs by name, see enabledJobs, and completes and
+// validates the decoded config.
+func (f File) prepare(jobs []string) (File, error) {
+	var err error
+	if f.Jobs, err = f.enabledJobs(jobs); err != nil {
+		return f, err
+	}
+	if err := f.resolveConnectionRefs(); err != nil {
+		return f, err
+	}
+	f.applyDefaults()
+	if err := f.validate(); err != nil {
+		return f, err
+	}
+	if err := f.resolveConnections(); err != nil {
+		return f, err
+	}
+	if err := setMocks(f.Mocks); err != nil {
+		return f, err
+	}
 	return f, nil
 }
 
+// enabledJobs returns the enabled jobs which are selected by name, if any
+// names are given, with their disabled queries removed. The queries of the
+// modules are filtered as well. Selecting an unknown or disabled job is an
+// error.
+func (f File) enabledJobs(names []string) ([]*Job, error) {
+	for _, name := range names {
+		var selected *Job
+		for _, job := range f.Jobs {
+			if job != nil && job.Name == name {
+				selected = job
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("selected job %q doesn't exist", name)
+		}
+		if !selected.isEnabled() {
+			return nil, fmt.Errorf("selected job %q is disabled", name)
+		}
+	}
+	jobs := make([]*Job, 0, len(f.Jobs))
+	for _, job := range f.Jobs {
+		if job == nil || !job.isEnabled() {
+			continue
+		}
+		if len(names) > 0 && !containsString(names, job.Name) {
+			continue
+		}
+		job.Queries = enabledQueries(job.Queries)
+		jobs = append(jobs, job)
+	}
+	for _, module := range f.Modules {
+		if module != nil {
+			module.Queries = enabledQueries(module.Queries)
+		}
+	}
+	return jobs, nil
+}
+
+func enabledQueries(queries []*Query) []*Query {
+	enabled := make([]*Query, 0, len(queries))
+	for _, q := range queries {
+		if q == nil || q.isEnabled() {
+			enabled = append(enabled, q)
+		}
+	}
+	return enabled
+}
+
+// isEnabled returns whether the job is run, which is the default.
+func (j *Job) isEnabled() bool {
+	return j.Enabled == nil || *j.Enabled
+}
+
+// isEnabled returns whether the query is run, which is the default.
+func (q *Query) isEnabled() bool {
+	return q.Enabled == nil || *q.Enabled
+}
+
+// resolveConnectionRefs replaces the connections of the jobs and modules
+// referencing a shared connection by a copy of it. The pool settings and the
+// alias of the referencing connection take precedence.
+func (f File) resolveConnectionRefs() error {
+	jobs := append([]*Job{}, f.Jobs...)
+	for _, module := range f.Modules {
+		jobs = append(jobs, module)
+	}
+	for _, job := range jobs {
+		if job == nil {
+			continue
+		}
+		for i, cc := range job.Connections {
+			resolved, err := f.resolveConnectionRef(cc)
+			if err != nil {
+				return fmt.Errorf("job %q: connection %d: %v", job.Name, i, err)
+			}
+			job.Connections[i] = resolved
+		}
+		if tq := job.TargetsQuery; tq != nil {
+			resolved, err := f.resolveConnectionRef(tq.Connection)
+			if err != nil {
+				return fmt.Errorf("job %q: targets_query: %v", job.Name, err)
+			}
+			tq.Connection = resolved
+		}
+	}
+	return nil
+}
+
+// resolveConnectionRef returns a copy of the shared connection referenced by
+// the connection, or the connection itself if it has no ref.
+func (f File) resolveConnectionRef(cc *ConnectionConfig) (*ConnectionConfig, error) {
+	if cc == nil || cc.Ref == "" {
+		return cc, nil
+	}
+	if cc.URL != "" || cc.Driver != "" {
+		return nil, fmt.Errorf("must not have an url or a driver along with ref")
+	}
+	shared, found := f.Connections[cc.Ref]
+	if !found || shared == nil {
+		return nil, fmt.Errorf("connection %q doesn't exist", cc.Ref)
+	}
+	resolved := *shared
+	// the members are resolved per job, so they must not be shared
+	resolved.Failover = make([]*ConnectionConfig, 0, len(shared.Failover))
+	for _, member := range shared.Failover {
+		if member != nil {
+			copied := *member
+			member = &copied
+		}
+		resolved.Failover = append(resolved.Failover, member)
+	}
+	resolved.Pool = shared.Pool.merge(cc.Pool)
+	resolved.Dial = shared.Dial.merge(cc.Dial)
+	if cc.Alias != "" {
+		resolved.Alias = cc.Alias
+	}
+	if cc.PasswordFile != "" {
+		resolved.PasswordFile = cc.PasswordFile
+	}
+	return &resolved, nil
+}
+
+// resolveConnections assembles the connection URLs and fills in the secrets
+// referenced by them. As the secrets are read whenever the config is loaded,
+// rotated secrets are picked up on reload.
+func (f File) resolveConnections() error {
+	for _, job := range f.Jobs {
+		if job == nil {
+			continue
+		}
+		if err := job.resolveConnections(true); err != nil {
+			return fmt.Errorf("job %q: %v", job.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolveConnections assembles the URLs of structured connections, renders
+// the connection URL templates and applies the password files of the
+// connections. Templates are only rendered if templates is set, i.e. the URLs
+// come from the config and can be trusted with reading files.
+func (j *Job) resolveConnections(templates bool) error {
+	connections := j.Connections
+	if j.TargetsQuery != nil && j.TargetsQuery.Connection != nil {
+		connections = append(append([]*ConnectionConfig{}, connections...), j.TargetsQuery.Connection)
+	}
+	for _, cc := range connections {
+		if cc == nil {
+			continue
+		}
+		passwordFile := cc.PasswordFile
+		if passwordFile == "" {
+			passwordFile = j.PasswordFile
+		}
+		if err := cc.resolve(passwordFile, templates); err != nil {
+			return err
+		}
+	}
+	for _, q := range j.Queries {
+		if q == nil || q.User == "" {
+			continue
+		}
+		q.password = q.Password
+		if q.PasswordFile != "" {
+			password, err := readSecretFile(q.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("query %q: %v", q.Name, err)
+			}
+			q.password = password
+		}
+	}
+	return nil
+}
+
+// resolve resolves a single connection, or the members of a failover group,
+// using the given password file.
+func (cc *ConnectionConfig) resolve(passwordFile string, templates bool) error {
+	if len(cc.Failover) > 0 {
+		for _, member := range cc.Failover {
+			if member == nil {
+				continue
+			}
+			memberPasswordFile := member.PasswordFile
+			if memberPasswordFile == "" {
+				memberPasswordFile = passwordFile
+			}
+			if err := member.resolve(memberPasswordFile, templates); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if cc.URL == "" && cc.Driver != "" {
+		url, err := cc.buildURL()
+		if err != nil {
+			return fmt.Errorf("connection to %q: %v", cc.Host+cc.Socket, err)
+		}
+		cc.URL = url
+	}
+	if templates && strings.Contains(cc.URL, "{{") {
+		url, err := renderSecretTemplate(cc.URL)
+		if err != nil {
+			return fmt.Errorf("connection %q: %v", redactDSN(cc.URL), redactError(err))
+		}
+		cc.URL = url
+	}
+	if passwordFile == "" {
+		return nil
+	}
+	password, err := readSecretFile(passwordFile)
+	if err != nil {
+		return fmt.Errorf("connection %q: %v", redactDSN(cc.URL), redactError(err))
+	}
+	dsn := cc.URL
+	if isDNSSRV(dsn) {
+		// the password is set in the URL of the driver
+		dsn = dnsSRVDSN(dsn)
+	}
+	driver := ""
+	if strings.HasPrefix(dsn, "mysql://") {
+		driver = "mysql"
+	}
+	url, err := withPassword(driver, dsn, password, false)
+	if err != nil {
+		return fmt.Errorf("connection %q: %v", redactDSN(cc.URL), redactError(err))
+	}
+	if isDNSSRV(cc.URL) && !isDNSSRV(url) {
+		url = dnsSRVScheme + "+" + url
+	}
+	cc.URL = url
+	return nil
+}
+
+// renderSecretTemplate renders a connection URL template. The file function
+// returns the content of the given file, e.g. {{ file "/run/secrets/db" }}.
+// The content is URL escaped, so e.g. passwords containing @ or / don't
+// corrupt the URL, unless the template is the whole URL or the URL is a
+// mysql DSN, which isn't unescaped by the driver.
+func renderSecretTemplate(text string) (string, error) {
+	dsn := text
+	if isDNSSRV(dsn) {
+		dsn = dnsSRVDSN(dsn)
+	}
+	escape := escapeURLComponent
+	if strings.HasPrefix(dsn, "mysql://") {
+		escape = func(s string) string { return s }
+	}
+	tmpl, err := template.New("dsn").Funcs(template.FuncMap{
+		"file": func(path string) (string, error) {
+			secret, err := readSecretFile(path)
+			return escape(secret), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	if nodes := tmpl.Tree.Root.Nodes; len(nodes) == 1 && nodes[0].Type() == parse.NodeAction {
+		// the file contains the whole URL
+		escape = func(s string) string { return s }
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// escapeURLComponent percent-encodes all but the unreserved characters of
+// RFC 3986, so the result can be inserted into any part of an URL.
+func escapeURLComponent(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+// readSecretFile returns the content of the file without surrounding
+// whitespace, so secrets may end with a newline.
+func readSecretFile(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// expandEnv returns the value of the environment variable. Positional
+// parameters like $1 are kept, they are used as placeholders by some drivers.
+func expandEnv(name string) string {
+	if _, err := strconv.Atoi(name); err == nil {
+		return "$" + name
+	}
+	return os.Getenv(name)
+}
+
+// applyDefaults copies the global settings to the jobs and modules which
+// don't override them.
+func (f File) applyDefaults() {
+	jobs := append([]*Job{}, f.Jobs...)
+	for _, module := range f.Modules {
+		jobs = append(jobs, module)
+	}
+	for _, job := range jobs {
+		if job == nil {
+			continue
+		}
+		for k, v := range f.BuiltinLabels {
+			if _, found := job.BuiltinLabels[k]; found {
+				continue
+			}
+			if job.BuiltinLabels == nil {
+				job.BuiltinLabels = make(map[string]string, len(f.BuiltinLabels))
+			}
+			job.BuiltinLabels[k] = v
+		}
+		if job.MetricPrefix == nil {
+			job.MetricPrefix = f.MetricPrefix
+		}
+		if job.Notifications == nil {
+			job.Notifications = f.Notifications
+		}
+		job.policy = f.Policy
+	}
+}
+
+// validate checks the config for settings which can't work at runtime.
+func (f File) validate() error {
+	if f.SeriesLimit < 0 {
+		return fmt.Errorf("series_limit must not be negative")
+	}
+	if f.RemoteWrite != nil {
+		if err := f.RemoteWrite.validate(); err != nil {
+			return fmt.Errorf("remote_write: %v", err)
+		}
+	}
+	if f.OTLP != nil {
+		if err := f.OTLP.validate(); err != nil {
+			return fmt.Errorf("otlp: %v", err)
+		}
+	}
+	if f.Notifications != nil {
+		if err := f.Notifications.validate(); err != nil {
+			return fmt.Errorf("notifications: %v", err)
+		}
+	}
+	if f.Policy != nil {
+		if err := f.Policy.validate(); err != nil {
+			return fmt.Errorf("policy: %v", err)
+		}
+	}
+	for name, cc := range f.Connections {
+		if cc == nil {
+			continue
+		}
+		if cc.Ref != "" {
+			return fmt.Errorf("connection %q must not reference another connection", name)
+		}
+		if err := cc.validate(); err != nil {
+			return fmt.Errorf("connection %q: %v", name, err)
+		}
+	}
+	names := make(map[string]bool, len(f.Jobs))
+	for _, job := range f.Jobs {
+		if job == nil {
+			continue
+		}
+		if names[job.Name] {
+			return fmt.Errorf("job %q is defined more than once", job.Name)
+		}
+		names[job.Name] = true
+		if err := job.validate(); err != nil {
+			return fmt.Errorf("job %q: %v", job.Name, err)
+		}
+	}
+	for name, module := range f.Modules {
+		if module == nil {
+			continue
+		}
+		if err := module.validate(); err != nil {
+			return fmt.Errorf("module %q: %v", name, err)
+		}
+	}
+	if strictPolicy {
+		if violations := f.policyViolations(); len(violations) > 0 {
+			msgs := make([]string, 0, len(violations))
+			for _, v := range violations {
+				msgs = append(msgs, v.Error())
+			}
+			return fmt.Errorf("policy violated: %s", strings.Join(msgs, "; "))
+		}
+	}
+	return nil
+}
+
+func (r *RemoteWrite) validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if _, err := url.Parse(r.URL); err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if r.TLS != nil && r.TLS.Mode != "" && r.TLS.Mode != "require" && r.TLS.Mode != "verify-full" {
+		return fmt.Errorf("tls mode %q is not supported, must be require or verify-full", r.TLS.Mode)
+	}
+	for k := range r.ExternalLabels {
+		if !validLabelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid external label name %q", k)
+		}
+	}
+	return nil
+}
+
+func (o *OTLP) validate() error {
+	if o.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	switch o.Protocol {
+	case "", otlpProtocolHTTP:
+		u, err := url.Parse(o.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("endpoint of protocol http must be an http or https url")
+		}
+	case otlpProtocolGRPC:
+	default:
+		return fmt.Errorf("unknown protocol %q, must be %s or %s", o.Protocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+	if o.TLS != nil && o.TLS.Mode != "" && o.TLS.Mode != "require" && o.TLS.Mode != "verify-full" {
+		return fmt.Errorf("tls mode %q is not supported, must be require or verify-full", o.TLS.Mode)
+	}
+	return nil
+}
+
+func (j *Job) validate() error {
+	if j.Mode != "" && j.Mode != jobModeInterval && j.Mode != jobModePull {
+		return fmt.Errorf("unknown mode %q, must be %s or %s", j.Mode, jobModeInterval, jobModePull)
+	}
+	if j.KeepAliveCheck < 0 {
+		return fmt.Errorf("keepalive_check must not be negative")
+	}
+	if j.KeepAliveCheck > 0 && !j.KeepAlive {
+		return fmt.Errorf("keepalive_check requires keepalive")
+	}
+	if err := j.Dial.validate(); err != nil {
+		return err
+	}
+	if tq := j.TargetsQuery; tq != nil {
+		if tq.Query == "" || tq.Connection == nil {
+			return fmt.Errorf("targets_query requires a connection and a query")
+		}
+		if isDNSSRV(tq.Connection.URL) {
+			return fmt.Errorf("targets_query connection must not be resolved by DNS SRV")
+		}
+		if err := tq.Connection.validate(); err != nil {
+			return fmt.Errorf("targets_query connection: %v", err)
+		}
+		if tq.RefreshInterval < 0 {
+			return fmt.Errorf("targets_query refresh_interval must not be negative")
+		}
+	}
+	if sd := j.KubernetesSD; sd != nil {
+		if err := sd.validate(); err != nil {
+			return fmt.Errorf("kubernetes_sd: %v", err)
+		}
+	}
+	if j.Auth != nil {
+		if err := j.Auth.validate(); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if j.StatsD != nil {
+		if err := j.StatsD.validate(); err != nil {
+			return fmt.Errorf("statsd: %v", err)
+		}
+	}
+	if j.Expose != nil {
+		if err := j.Expose.validate(); err != nil {
+			return fmt.Errorf("expose: %v", err)
+		}
+	}
+	if j.Graphite != nil {
+		if err := j.Graphite.validate(); err != nil {
+			return fmt.Errorf("graphite: %v", err)
+		}
+	}
+	if j.CloudWatch != nil {
+		if err := j.CloudWatch.validate(); err != nil {
+			return fmt.Errorf("cloudwatch: %v", err)
+		}
+	}
+	if j.GCPMonitoring != nil {
+		if err := j.GCPMonitoring.validate(); err != nil {
+			return fmt.Errorf("gcp_monitoring: %v", err)
+		}
+	}
+	if j.Notifications != nil {
+		if err := j.Notifications.validate(); err != nil {
+			return fmt.Errorf("notifications: %v", err)
+		}
+	}
+	if j.Aggregate != nil {
+		if err := j.Aggregate.validate(); err != nil {
+			return fmt.Errorf("aggregate: %v", err)
+		}
+	}
+	if j.Cron != "" {
+		if j.Interval != 0 {
+			return fmt.Errorf("interval and cron are mutually exclusive")
+		}
+		if j.Mode == jobModePull {
+			return fmt.Errorf("cron can't be used in %s mode", jobModePull)
+		}
+		if _, err := cron.ParseStandard(j.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression %q: %v", j.Cron, err)
+		}
+	}
+	if _, err := parseLogLevel(j.LogLevel); err != nil {
+		return err
+	}
+	if j.Splay < 0 || j.Jitter < 0 {
+		return fmt.Errorf("splay and jitter must not be negative")
+	}
+	if j.OnNullValue != "" && !containsString(onNullValues, j.OnNullValue) {
+		return fmt.Errorf("unknown on_null_value %q, must be one of %s", j.OnNullValue, strings.Join(onNullValues, ", "))
+	}
+	if j.OnNullLabel != "" && !containsString(onNullLabels, j.OnNullLabel) {
+		return fmt.Errorf("unknown on_null_label %q, must be one of %s", j.OnNullLabel, strings.Join(onNullLabels, ", "))
+	}
+	if j.Retries < 0 || j.RetryBackoff < 0 {
+		return fmt.Errorf("retries and retry_backoff must not be negative")
+	}
+	for k, name := range j.BuiltinLabels {
+		if !isBuiltinLabel(k) {
+			return fmt.Errorf("unknown built-in label %q, must be one of %s", k, strings.Join(builtinLabels, ", "))
+		}
+		if LabelNameRE.MatchString(name) {
+			return fmt.Errorf("built-in label %q has invalid name %q", k, name)
+		}
+	}
+	for k := range j.TargetLabels {
+		if !validLabelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid target label name %q", k)
+		}
+		if k == "sql_job" || containsString(targetInfoLabels, k) {
+			return fmt.Errorf("target label %q is reserved", k)
+		}
+	}
+	for i, cc := range j.Connections {
+		if cc == nil {
+			continue
+		}
+		if err := cc.validate(); err != nil {
+			return fmt.Errorf("connection %d: %v", i, err)
+		}
+	}
+	builtinKeys, builtinNames := j.builtinLabelNames()
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		if q.CacheTTL < 0 {
+			return fmt.Errorf("query %q: cache_ttl must not be negative", q.Name)
+		}
+		if (q.Retries != nil && *q.Retries < 0) || q.RetryBackoff < 0 {
+			return fmt.Errorf("query %q: retries and retry_backoff must not be negative", q.Name)
+		}
+		if q.RunOn != "" && !containsString(runOnRoles, q.RunOn) {
+			return fmt.Errorf("query %q has unknown run_on %q, must be one of %s", q.Name, q.RunOn, strings.Join(runOnRoles, ", "))
+		}
+		if q.OnNullValue != "" && !containsString(onNullValues, q.OnNullValue) {
+			return fmt.Errorf("query %q has unknown on_null_value %q, must be one of %s", q.Name, q.OnNullValue, strings.Join(onNullValues, ", "))
+		}
+		if q.OnNullLabel != "" && !containsString(onNullLabels, q.OnNullLabel) {
+			return fmt.Errorf("query %q has unknown on_null_label %q, must be one of %s", q.Name, q.OnNullLabel, strings.Join(onNullLabels, ", "))
+		}
+		if q.MaxRows < 0 || q.MaxSeries < 0 {
+			return fmt.Errorf("query %q: max_rows and max_series must not be negative", q.Name)
+		}
+		if q.OnLimit != "" && !containsString(onLimitActions, q.OnLimit) {
+			return fmt.Errorf("query %q has unknown on_limit %q, must be one of %s", q.Name, q.OnLimit, strings.Join(onLimitActions, ", "))
+		}
+		if q.LimitPushdown {
+			switch {
+			case q.MaxRows == 0:
+				return fmt.Errorf("query %q: limit_pushdown requires max_rows", q.Name)
+			case q.Procedure != nil || len(q.ResultSets) > 0:
+				return fmt.Errorf("query %q: limit_pushdown can't be used with a procedure or result_sets", q.Name)
+			}
+		}
+		if q.Exemplar != nil {
+			if q.Type != metricTypeCounter && q.Type != metricTypeHist {
+				return fmt.Errorf("query %q: exemplars require type counter or histogram", q.Name)
+			}
+			if len(q.Exemplar.Labels) == 0 {
+				return fmt.Errorf("query %q: exemplar requires labels", q.Name)
+			}
+		}
+		if q.User == "" && (q.Password != "" || q.PasswordFile != "") {
+			return fmt.Errorf("query %q: password and password_file require a user", q.Name)
+		}
+		if q.Password != "" && q.PasswordFile != "" {
+			return fmt.Errorf("query %q: password and password_file are mutually exclusive", q.Name)
+		}
+		if len(q.ResultSets) > 0 {
+			if err := q.validateResultSets(); err != nil {
+				return fmt.Errorf("query %q: %v", q.Name, err)
+			}
+		}
+		if q.Procedure != nil {
+			if err := q.Procedure.validate(); err != nil {
+				return fmt.Errorf("query %q: procedure %v", q.Name, err)
+			}
+			if q.Query != "" || q.QueryRef != "" {
+				return fmt.Errorf("query %q: procedure and query are mutually exclusive", q.Name)
+			}
+		}
+		if q.Type != "" && !isMetricType(q.Type) {
+			return fmt.Errorf("query %q has unknown type %q, must be one of %s", q.Name, q.Type, strings.Join(metricTypes, ", "))
+		}
+		reserved := append(append([]string{"sql_job"}, builtinNames...), q.Labels.Names()...)
+		for _, static := range []map[string]string{j.StaticLabels, q.StaticLabels} {
+			for k := range static {
+				name := LabelNameRE.ReplaceAllString(k, "_")
+				for _, r := range reserved {
+					if name == r {
+						return fmt.Errorf("query %q: static label %q conflicts with a label of the query", q.Name, k)
+					}
+				}
+			}
+		}
+		// without the col label the metrics of multiple values collide
+		if !containsString(builtinKeys, "col") && (q.Type == metricTypeAuto || len(q.Values)+len(q.HistValues)+len(q.SummaryValues) > 1) {
+			return fmt.Errorf("query %q has multiple values and requires the col label", q.Name)
+		}
+		queryType := q.Type
+		if queryType == "" {
+			queryType = metricTypeGauge
+		}
+		valueNames := map[string]string{}
+		for _, v := range q.Values {
+			if v.Column == "" {
+				return fmt.Errorf("query %q has a value without column", q.Name)
+			}
+			// a metric family has a single help text
+			if v.Help != "" && v.Help != q.Help && v.Name == "" {
+				return fmt.Errorf("query %q: value %q with its own help requires its own name", q.Name, v.Column)
+			}
+			if v.Name != "" {
+				if v.Name == q.Name {
+					return fmt.Errorf("query %q: value %q must not be named like the query", q.Name, v.Column)
+				}
+				if other, found := valueNames[v.Name]; found {
+					return fmt.Errorf("query %q: values %q and %q have the same name %q", q.Name, other, v.Column, v.Name)
+				}
+				valueNames[v.Name] = v.Column
+			}
+			if v.Type != "" && v.Type != metricTypeGauge && v.Type != metricTypeCounter {
+				return fmt.Errorf("query %q: value %q must be of type gauge or counter", q.Name, v.Column)
+			}
+			// metrics of different types can't share a metric family
+			if v.Type != "" && v.Type != queryType && v.Name == "" {
+				return fmt.Errorf("query %q: value %q with its own type requires its own name", q.Name, v.Column)
+			}
+			if v.As != "" && !containsString(valueConversions, v.As) {
+				return fmt.Errorf("query %q: value %q has unknown conversion %q, must be one of %s", q.Name, v.Column, v.As, strings.Join(valueConversions, ", "))
+			}
+			if v.Compute != "" {
+				if !containsString(computeModes, v.Compute) {
+					return fmt.Errorf("query %q: value %q has unknown compute %q, must be one of %s", q.Name, v.Column, v.Compute, strings.Join(computeModes, ", "))
+				}
+				if v.Type == metricTypeCounter {
+					return fmt.Errorf("query %q: value %q with compute is exported as gauge", q.Name, v.Column)
+				}
+				if queryType != metricTypeGauge && v.Name == "" {
+					return fmt.Errorf("query %q: value %q with compute is a gauge and requires its own name", q.Name, v.Column)
+				}
+			}
+		}
+		if (q.MetricNameColumn == "") != (q.ValueColumn == "") {
+			return fmt.Errorf("query %q must have both metric_name_column and value_column", q.Name)
+		}
+		if q.MetricNameColumn != "" && q.Type != "" && q.Type != metricTypeGauge && q.Type != metricTypeCounter {
+			return fmt.Errorf("query %q with metric_name_column must be of type gauge or counter", q.Name)
+		}
+		if q.MetricNameLabel != "" {
+			if q.MetricNameColumn == "" {
+				return fmt.Errorf("query %q: metric_name_label requires metric_name_column", q.Name)
+			}
+			if !validLabelNameRE.MatchString(q.MetricNameLabel) || containsString(reserved, q.MetricNameLabel) {
+				return fmt.Errorf("query %q: metric_name_label %q must be a valid label name distinct from the other labels", q.Name, q.MetricNameLabel)
+			}
+		}
+		if q.Type == metricTypeState {
+			if q.StateColumn == "" || len(q.States) == 0 {
+				return fmt.Errorf("query %q of type stateset requires state_column and states", q.Name)
+			}
+			// the state is exported in a label named after the query
+			if !validLabelNameRE.MatchString(q.Name) || containsString(reserved, q.Name) {
+				return fmt.Errorf("query %q: the name of stateset queries must be a valid label name distinct from the other labels", q.Name)
+			}
+			for i, s := range q.States {
+				if containsString(q.States[:i], s) {
+					return fmt.Errorf("query %q: state %q is given more than once", q.Name, s)
+				}
+			}
+		}
+		for _, hv := range q.HistValues {
+			if err := hv.BucketsFrom.validate(); err != nil {
+				return fmt.Errorf("query %q: %v", q.Name, err)
+			}
+			if hv.Native == nil {
+				continue
+			}
+			if hv.Native.Schema < nativeSchemaMin || hv.Native.Schema > nativeSchemaMax {
+				return fmt.Errorf("query %q: native histogram schema %d must be between %d and %d", q.Name, hv.Native.Schema, nativeSchemaMin, nativeSchemaMax)
+			}
+			if hv.Native.ZeroThreshold < 0 {
+				return fmt.Errorf("query %q: native histogram zero_threshold must not be negative", q.Name)
+			}
+		}
+		for _, p := range q.Params {
+			sources := 0
+			for _, source := range []string{p.Value, p.Env, p.Query} {
+				if source != "" {
+					sources++
+				}
+			}
+			if sources > 1 {
+				return fmt.Errorf("query %q: param %q must have only one of value, env or query", q.Name, p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isMetricType(t string) bool {
+	return containsString(metricTypes, t)
+}
+
+func isBuiltinLabel(l string) bool {
+	return containsString(builtinLabels, l)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
 // File is a collection of jobs
 type File struct {
-	Jobs    []*Job            `yaml:"jobs"`
-	Queries map[string]string `yaml:"queries"`
+	Jobs            []*Job            `yaml:"jobs"`
+	Queries         map[string]string `yaml:"queries"`
+	ExporterMetrics *ExporterMetrics  `yaml:"exporter_metrics"`
+	ResultCache     *ResultCache      `yaml:"result_cache"`
+	Modules         map[string]*Job   `yaml:"modules"` // query modules used by /probe
+	// BuiltinLabels renames or, if empty, drops the built-in labels of all jobs
+	BuiltinLabels map[string]string `yaml:"builtin_labels"`
+	// MetricPrefix is prepended to the query metric names, defaults to sql_.
+	// An empty prefix turns it off.
+	MetricPrefix *string `yaml:"metric_prefix"`
+	// RemoteWrite pushes the metrics to a Prometheus remote_write endpoint
+	RemoteWrite *RemoteWrite `yaml:"remote_write"`
+	// OTLP pushes the metrics to an OpenTelemetry collector
+	OTLP *OTLP `yaml:"otlp"`
+	// Notifications are sent on repeated query failures of all jobs without
+	// their own notifications
+	Notifications *Notifications `yaml:"notifications"`
+	// Policy restricts the statements of all jobs and modules
+	Policy *Policy `yaml:"policy"`
+	// Connections are shared connections, jobs reference them by name
+	Connections map[string]*ConnectionConfig `yaml:"connections"`
+	// SeriesLimit is the maximum number of series exported by all queries,
+	// new series are dropped once it's reached. 0 disables the limit.
+	SeriesLimit int `yaml:"series_limit"`
+	// Include lists further config files, directories or glob patterns,
+	// relative to the including file, which are merged into this one
+	Include []string `yaml:"include"`
+	// Mocks are the databases of the mock driver by name, jobs connect to
+	// them as mock://<name>
+	Mocks map[string][]*MockResult `yaml:"mocks"`
+}
+
+// MockResult answers the queries of a mock database it matches. The queries
+// are answered by the first matching result.
+type MockResult struct {
+	Match   string                   `yaml:"match"`   // regular expression of the queries, matches all queries if empty
+	Columns []string                 `yaml:"columns"` // order of the columns, defaults to the sorted columns of the rows
+	Rows    []map[string]interface{} `yaml:"rows"`
+	File    string                   `yaml:"file"`  // CSV or JSON file with the rows, relative to the config file
+	Error   string                   `yaml:"error"` // the queries fail with the error instead
+	Delay   time.Duration            `yaml:"delay"` // delays the answer, e.g. to exceed the query timeout
+	matchRE *regexp.Regexp
+}
+
+// RemoteWrite configures pushing the metrics to a Prometheus remote_write
+// endpoint, in addition to serving them for scrapes.
+type RemoteWrite struct {
+	URL            string            `yaml:"url"`             // url of the remote_write endpoint
+	Interval       time.Duration     `yaml:"interval"`        // interval of the pushes, defaults to 1m
+	Timeout        time.Duration     `yaml:"timeout"`         // timeout of a push, defaults to 30s
+	ExternalLabels map[string]string `yaml:"external_labels"` // labels added to all series
+	BasicAuth      *BasicAuth        `yaml:"basic_auth"`
+	TLS            *TLSConfig        `yaml:"tls"` // only require and verify-full are supported
+	// DisableScrape serves only the metrics of the exporter itself on the
+	// metrics path, the metrics of the jobs are pushed instead
+	DisableScrape bool `yaml:"disable_scrape"`
+}
+
+// OTLP configures pushing the metrics as OpenTelemetry metrics, in addition
+// to serving them for scrapes.
+type OTLP struct {
+	Endpoint           string            `yaml:"endpoint"`            // url for http, host:port for grpc
+	Protocol           string            `yaml:"protocol"`            // http (default) or grpc
+	Interval           time.Duration     `yaml:"interval"`            // interval of the pushes, defaults to 1m
+	Timeout            time.Duration     `yaml:"timeout"`             // timeout of a push, defaults to 30s
+	Headers            map[string]string `yaml:"headers"`             // e.g. the API key of the vendor
+	ResourceAttributes map[string]string `yaml:"resource_attributes"` // service.name defaults to sql_exporter
+	Insecure           bool              `yaml:"insecure"`            // use grpc without TLS
+	TLS                *TLSConfig        `yaml:"tls"`                 // only require and verify-full are supported
+}
+
+// Notifications posts a JSON message to a webhook once a query failed a
+// number of consecutive times on a connection, e.g. to a Slack incoming
+// webhook, to report misconfigurations of the exporter right away.
+type Notifications struct {
+	WebhookURL string            `yaml:"webhook_url"` // url the message is posted to
+	Failures   int               `yaml:"failures"`    // consecutive failures before notifying, defaults to 3
+	Timeout    time.Duration     `yaml:"timeout"`     // timeout of a post, defaults to 10s
+	Headers    map[string]string `yaml:"headers"`     // e.g. an authorization header
+	// SendResolved notifies once the failing query succeeds again
+	SendResolved bool `yaml:"send_resolved"`
+}
+
+// Policy restricts the statements the exporter runs, e.g. to deny writes,
+// so the query set can be certified. Statements matching a deny rule or, if
+// there are allow rules, none of them violate the policy.
+type Policy struct {
+	Allow []*PolicyRule `yaml:"allow,omitempty"`
+	Deny  []*PolicyRule `yaml:"deny,omitempty"`
+}
+
+// PolicyRule matches statements by keyword, given as plain string, or by
+// regex.
+type PolicyRule struct {
+	Keyword string `yaml:"keyword,omitempty"` // a word outside of comments and quotes, case insensitive
+	Regex   string `yaml:"regex,omitempty"`   // matched against the statement, e.g. (?i)pg_sleep
+	re      *regexp.Regexp
+}
+
+// BasicAuth configures HTTP basic authentication.
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"` // file containing the password
+}
+
+// ResultCache configures a cache shared by multiple exporter replicas
+type ResultCache struct {
+	Type     string `yaml:"type"`     // redis or memcached
+	Address  string `yaml:"address"`  // host:port of the cache server
+	Password string `yaml:"password"` // redis only
+	Database int    `yaml:"database"` // redis only
+	// TTL is the maximum age of cached results, at most the interval of the
+	// job. It defaults to 30s.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// ExporterMetrics controls the cardinality of the exporter internal metrics
+type ExporterMetrics struct {
+	Labels      []string `yaml:"labels"`      // subset of driver, host, database, user, sql_job and query
+	Aggregation string   `yaml:"aggregation"` // how series with dropped labels are combined: max, min, sum or avg
 }
 
 // Job is a collection of connections and queries
 type Job struct {
-	log         log.Logger
-	conns       []*connection
-	Name        string        `yaml:"name"`      // name of this job
-	KeepAlive   bool          `yaml:"keepalive"` // keep connection between runs?
-	Interval    time.Duration `yaml:"interval"`  // interval at which this job is run
-	Connections []string      `yaml:"connections"`
-	Queries     []*Query      `yaml:"queries"`
-	StartupSQL  []string      `yaml:"startup_sql"` // SQL executed on startup
+	sync.Mutex     `yaml:"-"`
+	log            log.Logger
+	conns          []*connection
+	scrapeMtx      sync.Mutex
+	scraping       chan struct{} // closed once the running scrape finished
+	ctx            context.Context
+	cancel         context.CancelFunc
+	queryCtx       context.Context // cancelled on shutdown to abort running queries
+	cancelQueries  context.CancelFunc
+	done           chan struct{} // closed once the run loop returned
+	targetsConn    *connection   // connection of the targets query
+	lastDiscovery  map[string]time.Time
+	discovered     map[string][]*ConnectionConfig
+	targetInfoDesc *prometheus.Desc
+	sinks          sync.WaitGroup      // running sends of the metrics to the sinks
+	emitting       int32               // 1 while the metrics are sent to the sinks
+	fingerprint    string              // of the config, set before the job is run
+	Name           string              `yaml:"name"`            // name of this job
+	Enabled        *bool               `yaml:"enabled"`         // disabled jobs are skipped, defaults to true
+	KeepAlive      bool                `yaml:"keepalive"`       // keep connection between runs?
+	KeepAliveCheck time.Duration       `yaml:"keepalive_check"` // interval of the ping and DNS checks of kept connections
+	Interval       time.Duration       `yaml:"interval"`        // interval at which this job is run
+	Cron           string              `yaml:"cron"`            // cron expression at which this job is run, instead of the interval
+	Splay          time.Duration       `yaml:"splay"`           // maximum random offset of all runs
+	Jitter         time.Duration       `yaml:"jitter"`          // maximum random delay added to each run
+	Connections    []*ConnectionConfig `yaml:"connections"`
+	Pool           `yaml:",inline"`    // default pool settings of the connections
+	Dial           `yaml:",inline"`    // default dial settings of the connections
+	Queries        []*Query            `yaml:"queries"`
+	StartupSQL     StartupSQL          `yaml:"startup_sql"`    // SQL executed on startup
+	Mode           string              `yaml:"mode"`           // interval (default) or pull
+	QueryTimeout   time.Duration       `yaml:"query_timeout"`  // default timeout of the queries
+	Retries        int                 `yaml:"retries"`        // default retries of failed queries
+	RetryBackoff   time.Duration       `yaml:"retry_backoff"`  // default initial delay of the retries
+	Timezone       string              `yaml:"timezone"`       // timezone used for schedules and timestamps without zone
+	TargetLabels   map[string]string   `yaml:"target_labels"`  // resource attributes added to the target_info series
+	Auth           *Auth               `yaml:"auth"`           // token based authentication for all connections
+	PasswordFile   string              `yaml:"password_file"`  // file containing the password of all connections
+	StaticLabels   map[string]string   `yaml:"static_labels"`  // labels added to all metrics of the job
+	BuiltinLabels  map[string]string   `yaml:"builtin_labels"` // renames or drops the built-in labels
+	MetricPrefix   *string             `yaml:"metric_prefix"`  // prepended to the query metric names, empty turns off an inherited prefix
+	LogLevel       string              `yaml:"log_level"`      // overrides the global log level for the job
+	OnNullValue    string              `yaml:"on_null_value"`  // default NULL value policy of the queries
+	OnNullLabel    string              `yaml:"on_null_label"`  // default NULL label policy of the queries
+	TargetsQuery   *TargetsQuery       `yaml:"targets_query"`  // discovers additional connections from a database
+	KubernetesSD   *KubernetesSD       `yaml:"kubernetes_sd"`  // discovers additional connections from Kubernetes
+	StatsD         *StatsD             `yaml:"statsd"`         // sends the metrics to a StatsD agent after each run
+	Graphite       *Graphite           `yaml:"graphite"`       // sends the metrics to Graphite after each run
+	CloudWatch     *CloudWatch         `yaml:"cloudwatch"`     // sends the metrics to AWS CloudWatch after each run
+	GCPMonitoring  *GCPMonitoring      `yaml:"gcp_monitoring"` // sends the metrics to Google Cloud Monitoring after each run
+	Notifications  *Notifications      `yaml:"notifications"`  // sent on repeated query failures
+	Aggregate      *Aggregate          `yaml:"aggregate"`      // combines the series of all connections
+	Expose         *Expose             `yaml:"expose"`         // serves the metrics on a port or path of their own
+	Vars           map[string]string   `yaml:"vars"`           // variables of the query templates
+	location       *time.Location
+	schedule       cron.Schedule
+	tokenProvider  tokenProvider
+	policy         *Policy
+	registry       *prometheus.Registry
+}
+
+// StatsD sends the metrics of a job to a StatsD or DogStatsD agent after
+// each run, each value as gauge.
+type StatsD struct {
+	Address string            `yaml:"address"` // host:port of the agent, defaults to localhost:8125
+	Format  string            `yaml:"format"`  // dogstatsd (default) sends the labels as tags, statsd drops them
+	Prefix  string            `yaml:"prefix"`  // prepended to the metric names
+	Tags    map[string]string `yaml:"tags"`    // added to all metrics, only used by dogstatsd
+}
+
+// Graphite sends the metrics of a job to a Graphite/Carbon endpoint after
+// each run, using the plaintext protocol.
+type Graphite struct {
+	Address string `yaml:"address"` // host:port of the plaintext Carbon receiver
+	// Path is a Go template over the labels of the metric and its name as
+	// __name__, e.g. `sql.{{.sql_job}}.{{.host}}.{{.__name__}}`. Defaults to
+	// the name followed by the label values.
+	Path string `yaml:"path"`
+}
+
+// CloudWatch sends the metrics of a job to AWS CloudWatch with PutMetricData
+// after each run.
+type CloudWatch struct {
+	Namespace string `yaml:"namespace"` // namespace of the metrics, e.g. SQL/Business
+	Region    string `yaml:"region"`    // defaults to the region of the environment
+	RoleARN   string `yaml:"role_arn"`  // role assumed to send the metrics
+	Endpoint  string `yaml:"endpoint"`  // overrides the CloudWatch endpoint of the region
+	// Dimensions are the labels sent as dimensions, defaults to all labels.
+	// CloudWatch accepts up to 30 dimensions per metric.
+	Dimensions []string `yaml:"dimensions"`
+	// BatchSize is the number of metrics per request, defaults to 20
+	BatchSize int `yaml:"batch_size"`
+	// RateLimit is the maximum number of requests per second, defaults to 10
+	RateLimit float64 `yaml:"rate_limit"`
+	client    cloudwatchiface.CloudWatchAPI
+}
+
+// GCPMonitoring sends the metrics of a job to Google Cloud Monitoring,
+// formerly Stackdriver, as custom metrics after each run.
+type GCPMonitoring struct {
+	ProjectID       string `yaml:"project_id"`       // project the metrics are written to
+	CredentialsFile string `yaml:"credentials_file"` // defaults to the application default credentials
+	Endpoint        string `yaml:"endpoint"`         // overrides the Cloud Monitoring API endpoint
+	// MetricPrefix is prepended to the metric names, defaults to
+	// custom.googleapis.com/
+	MetricPrefix string `yaml:"metric_prefix"`
+	// ResourceType is the monitored resource of the metrics, e.g.
+	// k8s_container or generic_task. Defaults to global.
+	ResourceType string `yaml:"resource_type"`
+	// ResourceLabels are the labels of the monitored resource
+	ResourceLabels map[string]string `yaml:"resource_labels"`
+	// ResourceLabelsFrom maps resource labels to metric labels, which are
+	// moved from the metric to the resource, e.g. the host label to node_id
+	ResourceLabelsFrom map[string]string `yaml:"resource_labels_from"`
+	service            *monitoring.Service
+}
+
+// Aggregate combines the gauge and counter series of the queries of a job
+// across its connections, e.g. of the shards of a logical database, into
+// series with the By labels and sql_job only. It's given as map or as
+// expression like sum by (datname).
+type Aggregate struct {
+	Function string   `yaml:"function"` // sum, avg, max or min
+	By       []string `yaml:"by"`       // labels of the aggregated series
+	// KeepSeries exports the series of the connections as well, the
+	// aggregated series are suffixed with the function then
+	KeepSeries bool `yaml:"keep_series"`
+}
+
+// Expose serves the metrics of a job on a port or path of its own instead of
+// the metrics path, e.g. for tenants which may only scrape their own
+// metrics. Jobs exposed on the same port and path are served together.
+type Expose struct {
+	Port int    `yaml:"port"` // port of a listener of its own, defaults to the port of the exporter
+	Path string `yaml:"path"` // path of the metrics, defaults to the metrics path on a port of its own
+}
+
+// TargetsQuery discovers the connections of a job by a query on a
+// control-plane database, e.g. a table of all tenant databases. The query
+// returns either an url column with the connection URL or the driver, host,
+// port, database and user columns of structured connections.
+type TargetsQuery struct {
+	Connection      *ConnectionConfig `yaml:"connection"`       // the control-plane database
+	Query           string            `yaml:"query"`            // returns a row per target
+	Driver          string            `yaml:"driver"`           // driver of structured targets without driver column
+	RefreshInterval time.Duration     `yaml:"refresh_interval"` // defaults to every run of the job
+}
+
+// KubernetesSD discovers the connections of a job from the endpoints or
+// services in Kubernetes matching the label selector. The connection URL of
+// each target is rendered by the DSN template, e.g.
+// postgres://postgres@{{.Address}}:{{.Port}}/{{.Labels.database}}.
+type KubernetesSD struct {
+	client          *kubernetesClient
+	APIServer       string        `yaml:"api_server"`        // defaults to the cluster the exporter runs in
+	BearerTokenFile string        `yaml:"bearer_token_file"` // defaults to the service account token in the cluster
+	TLS             *TLSConfig    `yaml:"tls"`               // TLS of the API server
+	Namespace       string        `yaml:"namespace"`         // defaults to the namespace of the exporter, all namespaces outside of the cluster
+	Role            string        `yaml:"role"`              // endpoints (default) to discover pods by their EndpointSlices or service
+	LabelSelector   string        `yaml:"label_selector"`    // e.g. app=postgres
+	Port            string        `yaml:"port"`              // name of the database port, defaults to the first port
+	DSN             string        `yaml:"dsn"`               // template of the connection URL
+	RefreshInterval time.Duration `yaml:"refresh_interval"`  // defaults to every run of the job
+}
+
+// Auth configures token based authentication. The issued tokens are used as
+// password of the connections and shared between connections to the same
+// instance.
+type Auth struct {
+	Type          string        `yaml:"type"`           // type of the token provider, defaults to command
+	TokenCommand  []string      `yaml:"token_command"`  // command printing a token to stdout
+	TokenTTL      time.Duration `yaml:"token_ttl"`      // lifetime of tokens issued by the command
+	RefreshBefore time.Duration `yaml:"refresh_before"` // refresh tokens this long before they expire
+	Vault         *VaultAuth    `yaml:"vault"`          // Vault secret of the vault type
+	AWS           *AWSAuth      `yaml:"aws"`            // options of the aws_iam type
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, the auth can be given as type
+// only, e.g. auth: aws_iam
+func (a *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var typ string
+	if err := unmarshal(&typ); err == nil {
+		a.Type = typ
+		return nil
+	}
+	type plain Auth
+	return unmarshal((*plain)(a))
+}
+
+// AWSAuth configures the IAM authentication tokens of RDS and Aurora. The
+// AWS credentials are taken from the environment, the shared config files or
+// the instance role.
+type AWSAuth struct {
+	Region     string `yaml:"region"`      // defaults to the region of the RDS host name
+	RoleARN    string `yaml:"role_arn"`    // role assumed to issue the tokens
+	ExternalID string `yaml:"external_id"` // external id of the assumed role
+}
+
+// VaultAuth reads the credentials of the connections from a HashiCorp Vault
+// secret, either dynamic credentials of the database secrets engine, e.g.
+// database/creds/readonly, or a username and password stored in the KV
+// secrets engine, e.g. secret/data/db. Leases are renewed until they reach
+// their max TTL, then new credentials are issued.
+type VaultAuth struct {
+	Address         string     `yaml:"address"`          // defaults to VAULT_ADDR
+	Path            string     `yaml:"path"`             // path of the secret
+	TokenFile       string     `yaml:"token_file"`       // Vault token, defaults to VAULT_TOKEN
+	KubernetesRole  string     `yaml:"kubernetes_role"`  // logs in with the service account instead of a token
+	KubernetesMount string     `yaml:"kubernetes_mount"` // mount of the Kubernetes auth method, defaults to kubernetes
+	TLS             *TLSConfig `yaml:"tls"`              // TLS of the Vault server
 }
 
 type connection struct {
-	conn     *sqlx.DB
-	url      string
-	driver   string
-	host     string
-	database string
-	user     string
+	conn        *sqlx.DB
+	url         string
+	driver      string
+	host        string
+	database    string
+	user        string
+	address     string // host of the connection URL, host may be an alias
+	tokenExpiry time.Time
+	pool        Pool
+	dial        Dial
+	discovered  bool // found by the targets query of the job
+	naiveUTC    bool // the driver returns timestamps without zone in UTC
+	// failover holds the members of a failover group, the connection takes
+	// over the settings of the active member
+	failover        []*connection
+	primaryCheckSQL string
+	readOnly        bool
+	// checked is the time of the last keepalive check, resolved the
+	// addresses the host resolved to
+	checked  time.Time
+	resolved []string
+	// sessions of queries with their own user, by user
+	sessions map[string]*connection
+}
+
+// ConnectionConfig is a single connection of a job. It can be given as plain
+// connection URL or as a map with the url and per connection settings.
+//
+// Instead of the URL the connection can be given as structured config, which
+// is assembled into the URL expected by the driver.
+type ConnectionConfig struct {
+	URL          string            `yaml:"url,omitempty"`
+	Ref          string            `yaml:"ref,omitempty"`           // name of a shared connection of the connections section
+	Alias        string            `yaml:"alias,omitempty"`         // exported as host label instead of the real host
+	Driver       string            `yaml:"driver,omitempty"`        // driver of a structured connection, e.g. postgres or mysql
+	Host         string            `yaml:"host,omitempty"`          // hostname or address of the server
+	Port         int               `yaml:"port,omitempty"`          // port of the server, defaults to the driver default
+	Socket       string            `yaml:"socket,omitempty"`        // unix socket, or its directory for postgres
+	User         string            `yaml:"user,omitempty"`          // user to connect as
+	Password     string            `yaml:"password,omitempty"`      // password of the user
+	Database     string            `yaml:"database,omitempty"`      // database to connect to
+	Schema       string            `yaml:"schema,omitempty"`        // default schema, snowflake only
+	Account      string            `yaml:"account,omitempty"`       // account identifier, snowflake only
+	Warehouse    string            `yaml:"warehouse,omitempty"`     // warehouse running the queries, snowflake only
+	Role         string            `yaml:"role,omitempty"`          // role of the user, snowflake only
+	TLS          *TLSConfig        `yaml:"tls,omitempty"`           // encryption of the connection
+	Params       map[string]string `yaml:"params,omitempty"`        // additional driver specific parameters
+	PasswordFile string            `yaml:"password_file,omitempty"` // file containing the password, overrides the job setting
+	// Failover is a group of connections tried in order, the queries only run
+	// on the first reachable one passing the PrimaryCheckSQL
+	Failover        []*ConnectionConfig `yaml:"failover,omitempty"`
+	PrimaryCheckSQL string              `yaml:"primary_check_sql,omitempty"` // returns true on the primary, e.g. SELECT NOT pg_is_in_recovery()
+	// ReadOnly runs the queries in read only sessions where the driver
+	// supports it and rejects queries containing writes
+	ReadOnly bool `yaml:"read_only,omitempty"`
+	Pool     `yaml:",inline"`
+	Dial     `yaml:",inline"`
+}
+
+// validate checks that the connection has either an url or a driver, or
+// that it's a failover group of such connections.
+func (c *ConnectionConfig) validate() error {
+	if err := c.Dial.validate(); err != nil {
+		return err
+	}
+	if len(c.Failover) == 0 {
+		if c.PrimaryCheckSQL != "" {
+			return fmt.Errorf("primary_check_sql requires a failover group")
+		}
+		if (c.URL == "") == (c.Driver == "") {
+			return fmt.Errorf("must have either an url or a driver")
+		}
+		if isDNSSRV(c.URL) {
+			if c.Alias != "" {
+				return fmt.Errorf("alias can't be used with DNS SRV, the targets are labeled by their host")
+			}
+			return validateDNSSRV(c.URL)
+		}
+		return nil
+	}
+	if c.URL != "" || c.Driver != "" {
+		return fmt.Errorf("failover group must not have an url or a driver")
+	}
+	for i, member := range c.Failover {
+		if member == nil {
+			return fmt.Errorf("failover member %d is empty", i)
+		}
+		if len(member.Failover) > 0 {
+			return fmt.Errorf("failover member %d must not be a failover group", i)
+		}
+		if isDNSSRV(member.URL) {
+			return fmt.Errorf("failover member %d must not be resolved by DNS SRV", i)
+		}
+		if err := member.validate(); err != nil {
+			return fmt.Errorf("failover member %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (c *ConnectionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*c = ConnectionConfig{URL: url}
+		return nil
+	}
+	// a list of connections is a failover group
+	var failover []*ConnectionConfig
+	if err := unmarshal(&failover); err == nil {
+		*c = ConnectionConfig{Failover: failover}
+		return nil
+	}
+	type plain ConnectionConfig
+	return unmarshal((*plain)(c))
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (c ConnectionConfig) MarshalYAML() (interface{}, error) {
+	if c.Pool == (Pool{}) && c.Dial == (Dial{}) && c.PasswordFile == "" && c.Driver == "" && c.Ref == "" && c.Alias == "" && c.PrimaryCheckSQL == "" && !c.ReadOnly {
+		if len(c.Failover) > 0 {
+			return c.Failover, nil
+		}
+		return c.URL, nil
+	}
+	type plain ConnectionConfig
+	return plain(c), nil
+}
+
+// Pool configures the connection pool of a connection. Zero values keep the
+// defaults, which are tuned to not use up too many connections for mere
+// metrics.
+type Pool struct {
+	MaxOpenConns         int           `yaml:"max_open_conns,omitempty"`         // defaults to 1, negative values mean unlimited
+	MaxIdleConns         int           `yaml:"max_idle_conns,omitempty"`         // defaults to 1, negative values disable idle connections
+	ConnMaxLifetime      time.Duration `yaml:"conn_max_lifetime,omitempty"`      // defaults to twice the job interval
+	ConnMaxIdleTime      time.Duration `yaml:"conn_max_idle_time,omitempty"`     // defaults to no limit
+	MaxConcurrentQueries int           `yaml:"max_concurrent_queries,omitempty"` // defaults to max_open_conns, negative values mean unlimited
+	Serialize            bool          `yaml:"serialize,omitempty"`              // run the queries strictly one at a time
+}
+
+// merge returns the pool settings with the non-zero settings of override
+// applied.
+func (p Pool) merge(override Pool) Pool {
+	if override.MaxOpenConns != 0 {
+		p.MaxOpenConns = override.MaxOpenConns
+	}
+	if override.MaxIdleConns != 0 {
+		p.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.ConnMaxLifetime != 0 {
+		p.ConnMaxLifetime = override.ConnMaxLifetime
+	}
+	if override.ConnMaxIdleTime != 0 {
+		p.ConnMaxIdleTime = override.ConnMaxIdleTime
+	}
+	if override.MaxConcurrentQueries != 0 {
+		p.MaxConcurrentQueries = override.MaxConcurrentQueries
+	}
+	if override.Serialize {
+		p.Serialize = true
+	}
+	return p
+}
+
+// concurrency returns the number of queries run in parallel on a connection,
+// zero means unlimited. By default there are as many as open connections.
+func (p Pool) concurrency() int {
+	limit := 1
+	switch {
+	case p.Serialize:
+		return 1
+	case p.MaxConcurrentQueries != 0:
+		limit = p.MaxConcurrentQueries
+	case p.MaxOpenConns != 0:
+		limit = p.MaxOpenConns
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// apply configures the connection pool of db.
+func (p Pool) apply(db *sqlx.DB, interval time.Duration) {
+	maxOpen, maxIdle, maxLifetime := 1, 1, interval*2
+	if p.MaxOpenConns != 0 {
+		maxOpen = p.MaxOpenConns
+	}
+	if p.MaxIdleConns != 0 {
+		maxIdle = p.MaxIdleConns
+	}
+	if p.ConnMaxLifetime != 0 {
+		maxLifetime = p.ConnMaxLifetime
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(maxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
+
+// Dial configures how the network connections to the database server are
+// established. Zero values keep the defaults of the driver.
+type Dial struct {
+	ConnectTimeout time.Duration `yaml:"connect_timeout,omitempty"` // maximum duration of establishing a connection
+	TCPKeepAlive   time.Duration `yaml:"tcp_keepalive,omitempty"`   // period of the TCP keepalive probes, negative values disable them
+	SourceAddress  string        `yaml:"source_address,omitempty"`  // local IP address the connections are made from
+}
+
+// merge returns the dial settings with the non-zero settings of override
+// applied.
+func (d Dial) merge(override Dial) Dial {
+	if override.ConnectTimeout != 0 {
+		d.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.TCPKeepAlive != 0 {
+		d.TCPKeepAlive = override.TCPKeepAlive
+	}
+	if override.SourceAddress != "" {
+		d.SourceAddress = override.SourceAddress
+	}
+	return d
+}
+
+func (d Dial) validate() error {
+	if d.ConnectTimeout < 0 {
+		return fmt.Errorf("connect_timeout must not be negative")
+	}
+	if d.SourceAddress != "" && net.ParseIP(d.SourceAddress) == nil {
+		return fmt.Errorf("source_address %q is not an IP address", d.SourceAddress)
+	}
+	return nil
 }
 
 // HistValue represents a mapper for prometheus histogram with definitions
@@ -87,6 +1643,56 @@ type HistValue struct {
 	Count   string    `yaml:"count"`
 	Sum     string    `yaml:"sum"`
 	Buckets []*Bucket `yaml:"buckets"`
+	// BucketsCumulative false accumulates per-bucket counts into cumulative
+	// buckets, defaults to true
+	BucketsCumulative *bool `yaml:"buckets_cumulative"`
+	// BucketsFrom adds buckets named by their upper bound
+	BucketsFrom *BucketsFrom `yaml:"buckets_from"`
+	// Native exports the buckets as native histogram as well
+	Native *NativeHistogram `yaml:"native"`
+}
+
+// BucketsFrom derives the buckets of a histogram from the column names,
+// instead of listing every column and bound.
+type BucketsFrom struct {
+	// ColumnPrefix is followed by the upper bound in the names of the bucket
+	// columns, with an underscore as decimal point, e.g. le_0_5 for 0.5 and
+	// le_inf for +Inf. Without a generator, all columns with the prefix are
+	// buckets.
+	ColumnPrefix string `yaml:"column_prefix"`
+	// Linear and Exponential generate the bounds of the bucket columns
+	Linear      *BucketGenerator `yaml:"linear"`
+	Exponential *BucketGenerator `yaml:"exponential"`
+}
+
+// BucketGenerator generates Count bucket bounds from Start, each Width above
+// the previous one for linear and Factor times the previous one for
+// exponential buckets.
+type BucketGenerator struct {
+	Start  float64 `yaml:"start"`
+	Width  float64 `yaml:"width"`
+	Factor float64 `yaml:"factor"`
+	Count  int     `yaml:"count"`
+}
+
+// NativeHistogram configures the exponential buckets of a native histogram.
+type NativeHistogram struct {
+	// Schema is the resolution from -4 (factor 65536 between buckets) to 8
+	// (factor 1.0027), e.g. 0 for buckets at powers of two
+	Schema int32 `yaml:"schema"`
+	// ZeroThreshold is the upper bound of the zero bucket
+	ZeroThreshold float64 `yaml:"zero_threshold"`
+}
+
+// Exemplar attaches a trace of the row to counters and histograms, linking
+// e.g. slow queries to their traces.
+type Exemplar struct {
+	// Labels maps the exemplar labels to columns, e.g. trace_id
+	Labels map[string]string `yaml:"labels"`
+	// Value is the column of the exemplar value, e.g. the duration of the
+	// slowest query. Counters default to their value, histograms to the mean
+	// of their observations.
+	Value string `yaml:"value"`
 }
 
 // Bucket represents mapping of column name to bucket upper bound,
@@ -96,19 +1702,503 @@ type Bucket struct {
 	Value string `yaml:"value"`
 }
 
+// SummaryValue represents a mapper for prometheus summary with definitions
+// for count, sum and series of quantiles.
+type SummaryValue struct {
+	Name      string      `yaml:"name"`
+	Count     string      `yaml:"count"`
+	Sum       string      `yaml:"sum"`
+	Quantiles []*Quantile `yaml:"quantiles"`
+}
+
+// Quantile represents mapping of column name to quantile, such as `"p95"`
+// can be mapped to `"0.95"`.
+type Quantile struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// Label maps an exported label name to the result column holding its value.
+// Instead of a single column a label value can also be built from a Go
+// template over the columns of the row, e.g. `{{.host}}:{{.port}}`. The value
+// can be normalized by transforms, which are applied in the order lowercase,
+// regex and map.
+type Label struct {
+	Name        string
+	Column      string
+	Template    string
+	Lowercase   bool              // lowercase the value
+	Regex       string            // replace all matches of the regex by Replacement
+	Replacement string            // replacement of regex matches, may refer to groups like $1
+	Map         map[string]string // replace raw values by the exported ones, other values are kept
+	tmpl        *template.Template
+	re          *regexp.Regexp
+}
+
+// labelTransforms is the map form of a label, with its source column or
+// template and the transforms of its value.
+type labelTransforms struct {
+	Column      string            `yaml:"column,omitempty"`
+	Template    string            `yaml:"template,omitempty"`
+	Lowercase   bool              `yaml:"lowercase,omitempty"`
+	Regex       string            `yaml:"regex,omitempty"`
+	Replacement string            `yaml:"replacement,omitempty"`
+	Map         map[string]string `yaml:"map,omitempty"`
+}
+
+// transformed reports whether the label has any transforms.
+func (l *Label) transformed() bool {
+	return l.Lowercase || l.Regex != "" || len(l.Map) > 0
+}
+
+// transform applies the transforms of the label to the value.
+func (l *Label) transform(value string) string {
+	if l.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if l.re != nil {
+		value = l.re.ReplaceAllString(value, l.Replacement)
+	}
+	if mapped, found := l.Map[value]; found {
+		value = mapped
+	}
+	return value
+}
+
+// Labels is an ordered list of label definitions. It can be given either as a
+// list of column names, which are exported as labels of the same name, or as a
+// map of label name to source column. Labels with transforms are given as map
+// with the column or template and the transforms.
+type Labels []*Label
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *Labels) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var columns []string
+	if err := unmarshal(&columns); err == nil {
+		*l = make(Labels, 0, len(columns))
+		for _, column := range columns {
+			*l = append(*l, &Label{Name: column, Column: column})
+		}
+		return nil
+	}
+	// use a MapSlice to retain the order of the label definitions
+	var renamed yaml.MapSlice
+	if err := unmarshal(&renamed); err != nil {
+		return fmt.Errorf("labels must be a list of columns or a map of label names to columns: %v", err)
+	}
+	*l = make(Labels, 0, len(renamed))
+	for _, item := range renamed {
+		name, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("label name %v must be a string", item.Key)
+		}
+		if _, ok := item.Value.(string); !ok {
+			var lt labelTransforms
+			buf, err := yaml.Marshal(item.Value)
+			if err != nil {
+				return err
+			}
+			if err := yaml.UnmarshalStrict(buf, &lt); err != nil {
+				return fmt.Errorf("label %q must be a column, template or map with transforms: %v", name, err)
+			}
+			if (lt.Column == "") == (lt.Template == "") {
+				return fmt.Errorf("label %q requires either column or template", name)
+			}
+			*l = append(*l, &Label{
+				Name:        name,
+				Column:      lt.Column,
+				Template:    lt.Template,
+				Lowercase:   lt.Lowercase,
+				Regex:       lt.Regex,
+				Replacement: lt.Replacement,
+				Map:         lt.Map,
+			})
+			continue
+		}
+		column := item.Value.(string)
+		if strings.Contains(column, "{{") {
+			*l = append(*l, &Label{Name: name, Template: column})
+			continue
+		}
+		*l = append(*l, &Label{Name: name, Column: column})
+	}
+	return nil
+}
+
+// Names returns the exported label names in order.
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for _, label := range l {
+		names = append(names, label.Name)
+	}
+	return names
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (l Labels) MarshalYAML() (interface{}, error) {
+	labels := make(yaml.MapSlice, 0, len(l))
+	for _, label := range l {
+		if label.transformed() {
+			labels = append(labels, yaml.MapItem{Key: label.Name, Value: labelTransforms{
+				Column:      label.Column,
+				Template:    label.Template,
+				Lowercase:   label.Lowercase,
+				Regex:       label.Regex,
+				Replacement: label.Replacement,
+				Map:         label.Map,
+			}})
+			continue
+		}
+		source := label.Column
+		if label.Template != "" {
+			source = label.Template
+		}
+		labels = append(labels, yaml.MapItem{Key: label.Name, Value: source})
+	}
+	return labels, nil
+}
+
+// Value is a value column of a query. It may have its own name, help and
+// type, so one query can export several metric families.
+type Value struct {
+	Column string           `yaml:"column"`
+	Name   string           `yaml:"name,omitempty"` // metric name, defaults to the name of the query
+	Help   string           `yaml:"help,omitempty"` // metric help, defaults to the help of the query
+	Type   string           `yaml:"type,omitempty"` // gauge or counter, defaults to the type of the query
+	As     string           `yaml:"as,omitempty"`   // conversion of the column: bool, unix_seconds or unix_millis
+	desc   *prometheus.Desc // descriptor of values with their own name or help
+	// Compute exports the difference to the previous run, delta, or its
+	// per-second rate instead of the value, as gauge
+	Compute string `yaml:"compute,omitempty"`
+}
+
+// Values is an ordered list of value columns. Each value can be given either
+// as column name or as map with the column and its metric name, help and type.
+type Values []*Value
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (v *Value) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var column string
+	if err := unmarshal(&column); err == nil {
+		*v = Value{Column: column}
+		return nil
+	}
+	type plain Value
+	if err := unmarshal((*plain)(v)); err != nil {
+		return fmt.Errorf("value must be a column or a map with column, name, help, type, as and compute: %v", err)
+	}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (v Value) MarshalYAML() (interface{}, error) {
+	if v.Name == "" && v.Help == "" && v.Type == "" && v.As == "" && v.Compute == "" {
+		return v.Column, nil
+	}
+	type plain Value
+	return plain(v), nil
+}
+
+// Procedure is a stored procedure called by a query. The params of the query
+// are passed as its input parameters, followed by the Out parameters, which
+// are exported as the columns of a single row. Procedures without Out
+// parameters return their first result set.
+type Procedure struct {
+	Name string   `yaml:"name"` // name of the procedure, e.g. dbo.monitoring_stats
+	Out  []string `yaml:"out"`  // names of the OUT parameters, in the order of the procedure
+}
+
+// Assertion is a condition on the result of a query, comparing the number of
+// rows or the value of a column in every row to a number, e.g. rows > 0 or
+// value("count") < 100.
+type Assertion struct {
+	Name string `yaml:"name,omitempty"` // defaults to the expression
+	Expr string `yaml:"expr"`
+	cond *condition
+}
+
+// Assertions is a list of assertions. Each assertion can be given either as
+// expression or as map with its name and expression, a single assertion as
+// expression only.
+type Assertions []*Assertion
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (a *Assertions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err == nil {
+		*a = Assertions{{Expr: expr}}
+		return nil
+	}
+	var list []*Assertion
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (a *Assertion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err == nil {
+		*a = Assertion{Expr: expr}
+		return nil
+	}
+	type plain Assertion
+	if err := unmarshal((*plain)(a)); err != nil {
+		return fmt.Errorf("assertion must be an expression or a map with name and expr: %v", err)
+	}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (a Assertion) MarshalYAML() (interface{}, error) {
+	if a.Name == "" {
+		return a.Expr, nil
+	}
+	type plain Assertion
+	return plain(a), nil
+}
+
+// StartupStatement is executed on every new session, on the connections with
+// the WhenDriver driver or all connections if it's empty.
+type StartupStatement struct {
+	SQL        string `yaml:"sql"`
+	WhenDriver string `yaml:"when_driver,omitempty"`
+}
+
+// StartupSQL is an ordered list of startup statements. Each statement can be
+// given either as SQL or as map with the SQL and the driver it's run on.
+type StartupSQL []*StartupStatement
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *StartupStatement) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sql string
+	if err := unmarshal(&sql); err == nil {
+		*s = StartupStatement{SQL: sql}
+		return nil
+	}
+	type plain StartupStatement
+	if err := unmarshal((*plain)(s)); err != nil {
+		return fmt.Errorf("startup_sql must be SQL or a map with sql and when_driver: %v", err)
+	}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (s StartupStatement) MarshalYAML() (interface{}, error) {
+	if s.WhenDriver == "" {
+		return s.SQL, nil
+	}
+	type plain StartupStatement
+	return plain(s), nil
+}
+
+// forDriver returns the statements run on connections of the driver.
+func (s StartupSQL) forDriver(driver string) []string {
+	statements := make([]string, 0, len(s))
+	for _, st := range s {
+		if st != nil && (st.WhenDriver == "" || st.WhenDriver == driver) {
+			statements = append(statements, st.SQL)
+		}
+	}
+	return statements
+}
+
+// Param is a value bound to a placeholder of the query. The value is either
+// static, read from an environment variable or the result of another query on
+// the same connection.
+type Param struct {
+	Name  string `yaml:"-"`
+	Value string `yaml:"value,omitempty"` // static value
+	Env   string `yaml:"env,omitempty"`   // environment variable holding the value
+	Query string `yaml:"query,omitempty"` // query returning the value in the first column of the first row
+}
+
+// source returns a description of where the value of the param comes from.
+func (p *Param) source() string {
+	switch {
+	case p.Env != "":
+		return "env:" + p.Env
+	case p.Query != "":
+		return "query:" + p.Query
+	default:
+		return "value:" + p.Value
+	}
+}
+
+// Params is an ordered list of query params. They are given as a map of param
+// names to either a static value or a map with the source of the value. The
+// params are bound to the placeholders of the query in the given order.
+type Params []*Param
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (p *Params) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// use a MapSlice to retain the order of the params
+	var params yaml.MapSlice
+	if err := unmarshal(&params); err != nil {
+		return fmt.Errorf("params must be a map of param names to values: %v", err)
+	}
+	*p = make(Params, 0, len(params))
+	for _, item := range params {
+		name, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("param name %v must be a string", item.Key)
+		}
+		if value, ok := item.Value.(string); ok {
+			*p = append(*p, &Param{Name: name, Value: value})
+			continue
+		}
+		// decode the source map by round tripping it through YAML
+		buf, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return err
+		}
+		param := &Param{}
+		if err := yaml.UnmarshalStrict(buf, param); err != nil {
+			return fmt.Errorf("param %q: %v", name, err)
+		}
+		param.Name = name
+		*p = append(*p, param)
+	}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (p Params) MarshalYAML() (interface{}, error) {
+	params := make(yaml.MapSlice, 0, len(p))
+	for _, param := range p {
+		if param.Env == "" && param.Query == "" {
+			params = append(params, yaml.MapItem{Key: param.Name, Value: param.Value})
+			continue
+		}
+		params = append(params, yaml.MapItem{Key: param.Name, Value: *param})
+	}
+	return params, nil
+}
+
+// queryRun is the outcome of a single execution of a query
+type queryRun struct {
+	Time     time.Time `json:"time"`
+	Driver   string    `json:"driver"`
+	Host     string    `json:"host"`
+	Database string    `json:"database"`
+	Duration float64   `json:"duration_seconds"`
+	Rows     int       `json:"rows"`
+	Error    string    `json:"error,omitempty"`
+}
+
 // Query is an SQL query that is executed on a connection
 type Query struct {
-	sync.Mutex
+	sync.Mutex `yaml:"-"`
 	log        log.Logger
+	ctx        context.Context
+	history    []queryRun
 	desc       *prometheus.Desc
+	newDesc    func(name string, labels []string) *prometheus.Desc
 	metrics    map[*connection][]prometheus.Metric
+	updated    map[*connection]time.Time // time of the last successful run
+	skipped    map[*connection]time.Time // time the query was last skipped on the connection
+	triggered  int32                     // 1 while the query runs on demand
 	jobName    string
+	interval   time.Duration
+	retries    int // of failed executions, Retries or the default of the job
+	location   *time.Location
+	tmpl       *template.Template
+	vars       map[string]string
+	notify     *Notifications
+	failures   map[string]int
+	computed   map[computeKey]computedSample
+	builtin    []string     // built-in labels added to the metrics
 	Name       string       `yaml:"name"`        // the prometheus metric name
+	Enabled    *bool        `yaml:"enabled"`     // disabled queries are skipped, defaults to true
 	Help       string       `yaml:"help"`        // the prometheus metric help text
 	Type       string       `yaml:"type"`        // the prometheus metric type (guage, histogram, summary, etc)
-	Labels     []string     `yaml:"labels"`      // expose these columns as labels per gauge
-	Values     []string     `yaml:"values"`      // expose each of these as an gauge
+	Labels     Labels       `yaml:"labels"`      // expose these columns as labels per gauge
+	Values     Values       `yaml:"values"`      // expose each of these as an gauge
 	HistValues []*HistValue `yaml:"hist_values"` // list of histogram definitions that map column names to prom histogram fields
-	Query      string       `yaml:"query"`       // a literal query
-	QueryRef   string       `yaml:"query_ref"`   // references an query in the query map
+	// list of summary definitions that map column names to prom summary fields
+	SummaryValues []*SummaryValue `yaml:"summary_values"`
+	Query         string          `yaml:"query"`     // a literal query
+	QueryRef      string          `yaml:"query_ref"` // references an query in the query map
+	// Template renders the query as Go template, see query_template.go
+	Template bool `yaml:"template"`
+	// Params are bound to the placeholders of the query, e.g. $1 or ?
+	Params Params `yaml:"params"`
+	// SetupSQL is executed before the query in the same transaction, e.g. to
+	// fill a temporary table the query reads from
+	SetupSQL []string `yaml:"setup_sql"`
+	// Procedure calls a stored procedure instead of running the query
+	Procedure *Procedure `yaml:"procedure"`
+	// ResultSets define the metrics of the result sets following the first
+	// one, e.g. of procedures or multi-statement queries. Only the metric
+	// definitions of the queries are used.
+	ResultSets []*Query `yaml:"result_sets"`
+	// StaticLabels are added to all metrics of the query
+	StaticLabels map[string]string `yaml:"static_labels"`
+	// MaximumBytesBilled fails BigQuery queries which would bill more bytes
+	MaximumBytesBilled int64 `yaml:"maximum_bytes_billed"`
+	// MetricNameColumn turns each row into a separate metric, named after the
+	// query and the value of the column, with the value of ValueColumn
+	MetricNameColumn string `yaml:"metric_name_column"`
+	ValueColumn      string `yaml:"value_column"`
+	// MetricNameLabel exports the value of MetricNameColumn in this label of
+	// a single metric named after the query instead
+	MetricNameLabel string `yaml:"metric_name_label"`
+	// StateColumn holds the current state of stateset queries, which export
+	// one metric per States, 1 for the current one and 0 for all others
+	StateColumn string   `yaml:"state_column"`
+	States      []string `yaml:"states"`
+	// MaxRows and MaxSeries limit the rows read and the metrics exported.
+	// Results exceeding them are truncated or fail the query, depending on
+	// OnLimit.
+	MaxRows   int    `yaml:"max_rows"`
+	MaxSeries int    `yaml:"max_series"`
+	OnLimit   string `yaml:"on_limit"`
+	// LimitPushdown wraps the query in a LIMIT of the dialect, so the server
+	// doesn't return more than max_rows rows
+	LimitPushdown bool `yaml:"limit_pushdown"`
+	// Exemplar attaches the trace of the row to counter and histogram metrics
+	Exemplar *Exemplar `yaml:"exemplar"`
+	// Expect are assertions on the result checked after each run, e.g.
+	// rows > 0, exported as sql_exporter_assertion_failed
+	Expect Assertions `yaml:"expect"`
+	// Timeout cancels the query if it takes longer, defaults to the query_timeout of the job
+	Timeout time.Duration `yaml:"timeout"`
+	// ServerTimeout limits the execution time of the query on the server
+	ServerTimeout time.Duration `yaml:"server_timeout"`
+	// MaxAge drops the metrics from the export once the last successful run is older
+	MaxAge time.Duration `yaml:"max_age"`
+	// Retries of failed executions due to connection errors or timeouts,
+	// doubling the RetryBackoff after each retry. Both default to the
+	// settings of the job, retries: 0 disables the retries of the job.
+	Retries      *int          `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// CacheTTL shares the result with identical queries, e.g. of other jobs
+	// using the same query_ref, on the same connection for this long
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// RunOn limits the query to servers with the given role, master, replica
+	// or any (default). The role is detected on every run.
+	RunOn string `yaml:"run_on"`
+	// WhenDriver limits the query to connections with the driver, e.g. the
+	// postgres connections of a job with mixed drivers
+	WhenDriver string `yaml:"when_driver"`
+	// OnNullValue handles NULL or missing value columns: skip the metric,
+	// export zero or NaN, or fail the row with an error. By default missing
+	// columns are exported as zero and NULL values fail the metric.
+	OnNullValue string `yaml:"on_null_value"`
+	// OnNullLabel handles NULL or missing label columns: export an empty
+	// label, skip the metric or fail the row with an error. By default
+	// missing columns are exported empty and NULL labels fail the metric.
+	OnNullLabel string `yaml:"on_null_label"`
+	// User runs the query in a separate session with this user, e.g. a
+	// privileged role for pg_stat_statements while the connection uses a
+	// restricted one. The password is given as is or read from a file.
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	password     string // of the user, read from the password file
+	// fixture replaces the results of the database by the result sets of
+	// fixture files while testing the metrics
+	fixture [][]map[string]interface{}
 }
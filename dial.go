@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// dialer returns the dialer of the settings.
+func (d Dial) dialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   d.ConnectTimeout,
+		KeepAlive: d.TCPKeepAlive,
+	}
+	if d.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(d.SourceAddress)}
+	}
+	return dialer
+}
+
+// customDialer tells if the connections need a dialer of their own, the
+// connect timeout alone is applied to the connector.
+func (d Dial) customDialer() bool {
+	return d.TCPKeepAlive != 0 || d.SourceAddress != ""
+}
+
+// connector applies the dial settings to the connector of the driver. The
+// dialer can only be replaced for PostgreSQL, MySQL and SQL Server, the
+// connect timeout is enforced for all drivers.
+func (d Dial) connector(driverName, dsn string, connector driver.Connector) (driver.Connector, error) {
+	if d.customDialer() {
+		switch driverName {
+		case "postgres":
+			connector = &pqConnector{dsn: dsn, dialer: netDialer{d.dialer()}, driver: connector.Driver()}
+		case "sqlserver":
+			c, err := mssql.NewConnector(dsn)
+			if err != nil {
+				return nil, err
+			}
+			c.Dialer = netDialer{d.dialer()}
+			connector = c
+		case "mysql":
+			// the dialer is registered as network of the DSN by mysqlDSN
+		default:
+			return nil, fmt.Errorf("tcp_keepalive and source_address aren't supported by the %s driver", driverName)
+		}
+	}
+	if d.ConnectTimeout > 0 {
+		connector = &timeoutConnector{Connector: connector, timeout: d.ConnectTimeout}
+	}
+	return connector, nil
+}
+
+// mysqlDSN registers the dialer of the settings with the MySQL driver and
+// returns the DSN using it instead of plain TCP.
+func (d Dial) mysqlDSN(dsn string) (string, error) {
+	if !d.customDialer() {
+		return dsn, nil
+	}
+	// the password may contain an @, the address starts after the last one
+	// in front of the database
+	end := strings.LastIndex(dsn, "/")
+	if end < 0 {
+		end = len(dsn)
+	}
+	start := strings.LastIndex(dsn[:end], "@") + 1
+	if !strings.HasPrefix(dsn[start:], "tcp(") {
+		return "", fmt.Errorf("tcp_keepalive and source_address require a TCP connection")
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%d/%s", d.ConnectTimeout, d.TCPKeepAlive, d.SourceAddress)
+	network := fmt.Sprintf("dial%x", h.Sum64())
+	dialer := d.dialer()
+	mysql.RegisterDial(network, func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	})
+	return dsn[:start] + network + dsn[start+len("tcp"):], nil
+}
+
+// netDialer implements the dialer interfaces of the drivers.
+type netDialer struct {
+	*net.Dialer
+}
+
+func (d netDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// pqConnector connects to PostgreSQL using its own dialer.
+type pqConnector struct {
+	dsn    string
+	dialer netDialer
+	driver driver.Driver
+}
+
+func (c *pqConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.dsn)
+}
+
+func (c *pqConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// timeoutConnector gives up connecting after the timeout, also for drivers
+// which don't cancel connecting with the context. A connection established
+// after giving up is closed.
+type timeoutConnector struct {
+	driver.Connector
+	timeout time.Duration
+}
+
+func (c *timeoutConnector) Connect(parent context.Context) (driver.Conn, error) {
+	ctx, cancel := context.WithTimeout(parent, c.timeout)
+	defer cancel()
+	type result struct {
+		conn driver.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := c.Connector.Connect(ctx)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("connecting timed out after %s", c.timeout)
+	}
+}
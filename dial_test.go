@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// blockingConnector never connects until released
+type blockingConnector struct {
+	release chan struct{}
+}
+
+func (c *blockingConnector) Connect(context.Context) (driver.Conn, error) {
+	<-c.release
+	return nil, driver.ErrBadConn
+}
+
+func (c *blockingConnector) Driver() driver.Driver {
+	return nil
+}
+
+func Test_timeoutConnector(t *testing.T) {
+	blocking := &blockingConnector{release: make(chan struct{})}
+	defer close(blocking.release)
+	connector, err := Dial{ConnectTimeout: 10 * time.Millisecond}.connector("sqlite", ":memory:", blocking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := connector.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up after the timeout, took %s", elapsed)
+	}
+
+	if _, err := (Dial{SourceAddress: "10.0.0.1"}).connector("sqlite", ":memory:", blocking); err == nil {
+		t.Errorf("expected the source address to be rejected by the sqlite driver")
+	}
+}
+
+func Test_mysqlDSN(t *testing.T) {
+	dial := Dial{SourceAddress: "10.0.0.1"}
+	dsn, err := dial.mysqlDSN("user:p@ss@tcp(db:3306)/metrics?timeout=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dsn, "user:p@ss@dial") || !strings.HasSuffix(dsn, "(db:3306)/metrics?timeout=5s") {
+		t.Errorf("expected the registered dialer in the DSN, got %q", dsn)
+	}
+	if _, err := dial.mysqlDSN("user@unix(/run/mysqld.sock)/metrics"); err == nil {
+		t.Errorf("expected an error for a socket connection")
+	}
+	if dsn, _ := (Dial{ConnectTimeout: time.Second}).mysqlDSN("tcp(db)/metrics"); dsn != "tcp(db)/metrics" {
+		t.Errorf("expected the DSN to be kept without dialer, got %q", dsn)
+	}
+}
+
+func Test_dialConfig(t *testing.T) {
+	const in = `
+jobs:
+- name: "dial"
+  interval: '5m'
+  connect_timeout: '5s'
+  connections:
+  - url: 'sqlite://:memory:'
+    source_address: 'eth0'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+	if _, err := parseConfig(strings.NewReader(in)); err == nil || !strings.Contains(err.Error(), "not an IP address") {
+		t.Errorf("expected an invalid source address, got %v", err)
+	}
+	f, err := parseConfig(strings.NewReader(strings.Replace(in, "'eth0'", "'127.0.0.1'\n    tcp_keepalive: '30s'", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	expected := Dial{ConnectTimeout: 5 * time.Second, TCPKeepAlive: 30 * time.Second, SourceAddress: "127.0.0.1"}
+	if got := job.conns[0].dial; got != expected {
+		t.Errorf("expected the job defaults merged with the connection settings, got %+v", got)
+	}
+}
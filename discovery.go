@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// discovery is a source of connections of a job
+type discovery struct {
+	name     string
+	interval time.Duration
+	targets  func() ([]*ConnectionConfig, error)
+}
+
+// discoveries returns the configured discoveries of the job.
+func (j *Job) discoveries() []discovery {
+	var discoveries []discovery
+	if j.TargetsQuery != nil {
+		discoveries = append(discoveries, discovery{"targets_query", j.TargetsQuery.RefreshInterval, j.queryTargets})
+	}
+	if j.KubernetesSD != nil {
+		discoveries = append(discoveries, discovery{"kubernetes_sd", j.KubernetesSD.RefreshInterval, j.kubernetesTargets})
+	}
+	for _, cc := range j.Connections {
+		if cc != nil && isDNSSRV(cc.URL) {
+			// SRV records are looked up on every run
+			discoveries = append(discoveries, discovery{"dnssrv", 0, j.dnsSRVTargets})
+			break
+		}
+	}
+	return discoveries
+}
+
+// refreshTargets runs the discoveries of the job which are due and replaces
+// the discovered connections. Connections to targets which are still
+// discovered are kept, the ones of vanished targets are closed and their
+// metrics dropped. A failed discovery keeps its previously discovered
+// targets and doesn't stop the others, its error is returned.
+func (j *Job) refreshTargets() error {
+	discoveries := j.discoveries()
+	if len(discoveries) == 0 {
+		return nil
+	}
+	if j.discovered == nil {
+		j.discovered = make(map[string][]*ConnectionConfig)
+		j.lastDiscovery = make(map[string]time.Time)
+	}
+	refreshed := false
+	var errs []string
+	for _, d := range discoveries {
+		if last, found := j.lastDiscovery[d.name]; found && time.Since(last) < d.interval {
+			continue
+		}
+		configs, err := d.targets()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", d.name, err))
+			continue
+		}
+		j.discovered[d.name] = configs
+		j.lastDiscovery[d.name] = time.Now()
+		refreshed = true
+	}
+	var err error
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	if !refreshed {
+		return err
+	}
+	var configs []*ConnectionConfig
+	for _, d := range discoveries {
+		configs = append(configs, j.discovered[d.name]...)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	previous := make(map[string]*connection)
+	conns := make([]*connection, 0, len(j.conns))
+	for _, conn := range j.conns {
+		if conn.discovered {
+			previous[conn.url] = conn
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	seen := make(map[string]bool, len(configs))
+	for _, cc := range configs {
+		if seen[cc.URL] {
+			continue
+		}
+		seen[cc.URL] = true
+		if conn, found := previous[cc.URL]; found {
+			conns = append(conns, conn)
+			delete(previous, cc.URL)
+			continue
+		}
+		conn, err := cc.newConnection()
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Failed to parse discovered target", "err", err)
+			continue
+		}
+		conn.pool = j.Pool.merge(cc.Pool)
+		conn.dial = j.Dial.merge(cc.Dial)
+		conn.discovered = true
+		conns = append(conns, conn)
+	}
+	for _, conn := range previous {
+		level.Info(j.log).Log("msg", "Target vanished", "host", conn.host, "db", conn.database)
+		conn.closeSessions()
+		conn.close()
+		for _, q := range j.Queries {
+			if q != nil {
+				q.dropMetrics(conn)
+			}
+		}
+		j.forgetMetrics(conn)
+	}
+	j.conns = conns
+	return err
+}
+
+// queryTargets runs the targets query on the control-plane database and
+// returns the resolved connections of the targets.
+func (j *Job) queryTargets() ([]*ConnectionConfig, error) {
+	tq := j.TargetsQuery
+	if j.targetsConn == nil {
+		conn, err := tq.Connection.newConnection()
+		if err != nil {
+			return nil, err
+		}
+		conn.pool = j.Pool.merge(tq.Connection.Pool)
+		conn.dial = j.Dial.merge(tq.Connection.Dial)
+		j.targetsConn = conn
+	}
+	if err := j.targetsConn.connect(j); err != nil {
+		return nil, fmt.Errorf("failed to connect to the targets database: %v", err)
+	}
+	rows, err := j.targetsConn.conn.QueryxContext(j.queryContext(), tq.Query)
+	if err != nil {
+		return nil, fmt.Errorf("targets query failed: %v", err)
+	}
+	defer rows.Close()
+	var configs []*ConnectionConfig
+	for rows.Next() {
+		res := make(map[string]interface{})
+		if err := rows.MapScan(res); err != nil {
+			return nil, err
+		}
+		cc, err := tq.targetConfig(res)
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Skipping discovered target", "err", err)
+			continue
+		}
+		// discovered URLs aren't trusted with reading files
+		if err := cc.resolve(j.PasswordFile, false); err != nil {
+			level.Warn(j.log).Log("msg", "Skipping discovered target", "err", err)
+			continue
+		}
+		configs = append(configs, cc)
+	}
+	return configs, rows.Err()
+}
+
+// targetConfig returns the connection of a row of the targets query.
+func (tq *TargetsQuery) targetConfig(row map[string]interface{}) (*ConnectionConfig, error) {
+	column := func(name string) string {
+		switch v := row[name].(type) {
+		case nil:
+			return ""
+		case []byte:
+			return string(v)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	if url := column("url"); url != "" {
+		return &ConnectionConfig{URL: url}, nil
+	}
+	cc := &ConnectionConfig{
+		Driver:   column("driver"),
+		Host:     column("host"),
+		Database: column("database"),
+		User:     column("user"),
+	}
+	if cc.Driver == "" {
+		cc.Driver = tq.Driver
+	}
+	if port := column("port"); port != "" {
+		var err error
+		if cc.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	if cc.Driver == "" || cc.Host == "" {
+		return nil, fmt.Errorf("row has neither an url nor a driver and host")
+	}
+	return cc, nil
+}
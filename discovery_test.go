@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestJob_refreshTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	control := filepath.Join(dir, "control.db")
+	db, err := sqlx.Open("sqlite", control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE tenants (url TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range []string{"a", "b"} {
+		if _, err := db.Exec("INSERT INTO tenants VALUES (?)", "sqlite://"+filepath.Join(dir, tenant+".db")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := `
+jobs:
+- name: "tenants"
+  interval: '5m'
+  targets_query:
+    connection: 'sqlite://` + control + `'
+    query: 'SELECT url FROM tenants'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+	f, err := parseConfig(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	q := job.Queries[0]
+	if len(job.conns) != 2 || len(q.metrics) != 2 {
+		t.Fatalf("expected metrics of 2 targets, got %d connections and %d results", len(job.conns), len(q.metrics))
+	}
+
+	if _, err := db.Exec("DELETE FROM tenants WHERE url LIKE '%b.db'"); err != nil {
+		t.Fatal(err)
+	}
+	kept := job.conns[0]
+	if err := job.runOnce(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(job.conns) != 1 || job.conns[0] != kept || len(q.metrics) != 1 {
+		t.Errorf("expected the vanished target to be dropped, got %d connections and %d results", len(job.conns), len(q.metrics))
+	}
+	// along with its exporter metrics
+	defer deleteExporterMetrics(func(labelValues []string) bool { return labelValues[4] == "tenants" })
+	durations := 0
+	queryDuration.mtx.Lock()
+	for _, v := range queryDuration.values {
+		if v.labelValues[4] == "tenants" {
+			durations++
+		}
+	}
+	queryDuration.mtx.Unlock()
+	if durations != 1 {
+		t.Errorf("expected the query durations of 1 target, got %d", durations)
+	}
+}
+
+func TestJob_refreshTargets_failure(t *testing.T) {
+	var lookupErr error
+	defer func(lookup func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = lookup
+	}(lookupSRV)
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if lookupErr != nil {
+			return "", nil, lookupErr
+		}
+		return name, []*net.SRV{{Target: "db-1.node.consul.", Port: 5432}}, nil
+	}
+
+	in := `
+jobs:
+- name: "tenants"
+  interval: '5m'
+  targets_query:
+    connection: 'sqlite://:memory:'
+    query: "SELECT 'postgres://user@tenant/app' AS url"
+  connections:
+  - 'dnssrv+postgres://user@db.service.consul/app'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+	f, err := parseConfig(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.closeConnections()
+	hosts := func() []string {
+		var hosts []string
+		for _, conn := range job.conns {
+			if conn.discovered {
+				hosts = append(hosts, conn.host)
+			}
+		}
+		return hosts
+	}
+
+	// the failed SRV lookup doesn't stop the targets query
+	lookupErr = errors.New("no such host")
+	if err := job.refreshTargets(); err == nil || !strings.Contains(err.Error(), "dnssrv") {
+		t.Errorf("expected the failed discovery to be reported, got %v", err)
+	}
+	if diff := pretty.Compare([]string{"tenant"}, hosts()); diff != "" {
+		t.Errorf("unexpected targets (-want +got):\n\n%s", diff)
+	}
+
+	lookupErr = nil
+	if err := job.refreshTargets(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected := []string{"tenant", "db-1.node.consul:5432"}
+	if diff := pretty.Compare(expected, hosts()); diff != "" {
+		t.Errorf("unexpected targets (-want +got):\n\n%s", diff)
+	}
+
+	// the targets of the failed discovery are kept
+	lookupErr = errors.New("no such host")
+	if err := job.refreshTargets(); err == nil {
+		t.Errorf("expected the failed discovery to be reported")
+	}
+	if diff := pretty.Compare(expected, hosts()); diff != "" {
+		t.Errorf("unexpected targets (-want +got):\n\n%s", diff)
+	}
+}
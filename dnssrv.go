@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-sql-driver/mysql"
+)
+
+// dnsSRVScheme prefixes connection URLs whose host is the name of DNS SRV
+// records, e.g. dnssrv+postgres://user@_postgres._tcp.db.example.com/db
+const dnsSRVScheme = "dnssrv"
+
+// lookupSRV resolves SRV records, replaced in tests
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+func isDNSSRV(dsn string) bool {
+	return strings.HasPrefix(dsn, dnsSRVScheme+"://") || strings.HasPrefix(dsn, dnsSRVScheme+"+")
+}
+
+// dnsSRVDSN returns the URL of a DNS SRV connection with the scheme of its
+// driver. The driver is given as dnssrv+postgres:// or taken from the
+// service of the name, e.g. postgres for dnssrv://_postgres._tcp.example.com.
+// The URL is returned unchanged if the driver is unknown.
+func dnsSRVDSN(dsn string) string {
+	if strings.HasPrefix(dsn, dnsSRVScheme+"+") {
+		return strings.TrimPrefix(dsn, dnsSRVScheme+"+")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	service := strings.SplitN(u.Hostname(), ".", 2)[0]
+	if !strings.HasPrefix(service, "_") || len(service) == 1 {
+		return dsn
+	}
+	u.Scheme = service[1:]
+	return u.String()
+}
+
+// validateDNSSRV returns an error if the DNS SRV connection can't be
+// resolved.
+func validateDNSSRV(dsn string) error {
+	driverDSN := dnsSRVDSN(dsn)
+	switch {
+	case strings.HasPrefix(driverDSN, dnsSRVScheme):
+		return fmt.Errorf("unknown driver of %s, use %s+<driver>://", redactDSN(dsn), dnsSRVScheme)
+	case strings.HasPrefix(driverDSN, "sqlite://"):
+		return fmt.Errorf("sqlite connections can't be resolved by DNS SRV")
+	}
+	return nil
+}
+
+// dnsSRVTargets looks up the SRV records of the DNS SRV connections of the
+// job and returns a connection for each target, labeled by the host and port
+// of the target.
+func (j *Job) dnsSRVTargets() ([]*ConnectionConfig, error) {
+	var configs []*ConnectionConfig
+	for _, cc := range j.Connections {
+		if cc == nil || !isDNSSRV(cc.URL) {
+			continue
+		}
+		dsn := dnsSRVDSN(cc.URL)
+		name, err := dsnHostname(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", redactDSN(cc.URL), redactError(err))
+		}
+		_, addrs, err := lookupSRV(j.queryContext(), "", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", name, err)
+		}
+		if len(addrs) == 0 {
+			level.Warn(j.log).Log("msg", "No SRV records found", "name", name)
+		}
+		for _, addr := range addrs {
+			host := net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+			target, err := withHost(dsn, host)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", redactDSN(cc.URL), redactError(err))
+			}
+			configs = append(configs, &ConnectionConfig{URL: target, Pool: cc.Pool, Dial: cc.Dial, ReadOnly: cc.ReadOnly})
+		}
+	}
+	return configs, nil
+}
+
+// dsnHostname returns the host name of the connection URL.
+func dsnHostname(dsn string) (string, error) {
+	if strings.HasPrefix(dsn, "mysql://") {
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil {
+			return "", err
+		}
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return cfg.Addr, nil
+		}
+		return host, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+// withHost returns the connection URL with the host and port replaced.
+func withHost(dsn, host string) (string, error) {
+	if strings.HasPrefix(dsn, "mysql://") {
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil {
+			return "", err
+		}
+		cfg.Addr = host
+		return "mysql://" + cfg.FormatDSN(), nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	u.Host = host
+	return u.String(), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_dnsSRVDSN(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out string
+	}{
+		{"dnssrv+postgres://user@db.service.consul/app", "postgres://user@db.service.consul/app"},
+		{"dnssrv://user@_postgres._tcp.db.example.com/app?sslmode=disable", "postgres://user@_postgres._tcp.db.example.com/app?sslmode=disable"},
+		{"dnssrv+mysql://user@tcp(_mysql._tcp.db.example.com)/app", "mysql://user@tcp(_mysql._tcp.db.example.com)/app"},
+		{"dnssrv://db.service.consul/app", "dnssrv://db.service.consul/app"},
+	} {
+		if got := dnsSRVDSN(tc.in); got != tc.out {
+			t.Errorf("dnsSRVDSN(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestJob_dnsSRVTargets(t *testing.T) {
+	records := map[string][]*net.SRV{
+		"db.service.consul": {
+			{Target: "db-1.node.consul.", Port: 5432},
+			{Target: "db-2.node.consul.", Port: 5433},
+		},
+		"_mysql._tcp.example.com": {
+			{Target: "mysql.example.com.", Port: 3306},
+		},
+	}
+	defer func(lookup func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = lookup
+	}(lookupSRV)
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return name, records[name], nil
+	}
+
+	in := `
+jobs:
+- name: "consul"
+  interval: '5m'
+  connections:
+  - 'postgres://user@static/app'
+  - 'dnssrv+postgres://user@db.service.consul/app?sslmode=disable'
+  - 'dnssrv+mysql://user@tcp(_mysql._tcp.example.com)/app'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+	f, err := parseConfig(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	if err := job.refreshTargets(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	hosts := func() []string {
+		var hosts []string
+		for _, conn := range job.conns {
+			hosts = append(hosts, conn.driver+" "+conn.host)
+		}
+		return hosts
+	}
+	expected := []string{"postgres static", "postgres db-1.node.consul:5432", "postgres db-2.node.consul:5433", "mysql mysql.example.com:3306"}
+	if diff := pretty.Compare(expected, hosts()); diff != "" {
+		t.Errorf("unexpected connections (-want +got):\n\n%s", diff)
+	}
+
+	records["db.service.consul"] = records["db.service.consul"][1:]
+	job.initConnections()
+	if err := job.refreshTargets(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected = []string{"postgres static", "postgres db-2.node.consul:5433", "mysql mysql.example.com:3306"}
+	if diff := pretty.Compare(expected, hosts()); diff != "" {
+		t.Errorf("unexpected connections after re-resolution (-want +got):\n\n%s", diff)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvironment selects the overrides of the environments section of the
+// config files, none are applied if empty.
+var configEnvironment string
+
+// applyEnvironment merges the overrides of the selected environment into the
+// config document and drops the environments section. Maps are merged by key
+// and lists of maps with a name, like jobs and queries, by name. Other values
+// and lists are replaced. Documents without environments are returned as is.
+func applyEnvironment(buf []byte, env string) ([]byte, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		// the error is reported by the decoding of the config
+		return buf, nil
+	}
+	envs, found := doc["environments"]
+	if !found {
+		return buf, nil
+	}
+	delete(doc, "environments")
+	overrides, ok := envs.(map[interface{}]interface{})
+	if !ok && envs != nil {
+		return nil, fmt.Errorf("environments must map environment names to config overrides")
+	}
+	if override, found := overrides[env]; found && env != "" {
+		if _, ok := override.(map[interface{}]interface{}); !ok {
+			return nil, fmt.Errorf("environment %q must be a map of config overrides", env)
+		}
+		doc = mergeYAML(doc, override).(map[interface{}]interface{})
+	}
+	return yaml.Marshal(doc)
+}
+
+// mergeYAML returns the base value with the override merged into it.
+func mergeYAML(base, override interface{}) interface{} {
+	switch o := override.(type) {
+	case map[interface{}]interface{}:
+		b, ok := base.(map[interface{}]interface{})
+		if !ok {
+			return o
+		}
+		for k, v := range o {
+			b[k] = mergeYAML(b[k], v)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !namedItems(b) || !namedItems(o) {
+			return o
+		}
+		index := make(map[interface{}]int, len(b))
+		for i, item := range b {
+			index[item.(map[interface{}]interface{})["name"]] = i
+		}
+		for _, item := range o {
+			name := item.(map[interface{}]interface{})["name"]
+			if i, found := index[name]; found {
+				b[i] = mergeYAML(b[i], item)
+				continue
+			}
+			b = append(b, item)
+		}
+		return b
+	}
+	return override
+}
+
+// namedItems reports whether all items of the list are maps with a name.
+func namedItems(list []interface{}) bool {
+	for _, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+		if _, found := m["name"]; !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const environmentConfig = `
+queries:
+  users: 'SELECT COUNT(*) AS count FROM users'
+jobs:
+- name: base
+  interval: 1m
+  connections: ['postgres://localhost/app']
+  vars:
+    shard: 'dev'
+  queries:
+  - name: users
+    help: Users
+    values: ['count']
+    query_ref: users
+  - name: sessions
+    help: Sessions
+    values: ['count']
+    query: 'SELECT COUNT(*) AS count FROM sessions'
+environments:
+  production:
+    jobs:
+    - name: base
+      interval: 5m
+      connections: ['postgres://primary/app', 'postgres://replica/app']
+      vars:
+        region: 'eu'
+      queries:
+      - name: sessions
+        query: 'SELECT COUNT(*) AS count FROM sessions WHERE active'
+    - name: extra
+      interval: 1m
+      connections: ['postgres://primary/app']
+      queries:
+      - name: orders
+        help: Orders
+        values: ['count']
+        query: 'SELECT COUNT(*) AS count FROM orders'
+`
+
+func Test_applyEnvironment(t *testing.T) {
+	defer func() { configEnvironment = "" }()
+
+	type summary struct {
+		Jobs        []string
+		Interval    time.Duration
+		Connections []string
+		Vars        map[string]string
+		Queries     map[string]string
+	}
+	for _, tc := range []struct {
+		env      string
+		expected summary
+	}{
+		{
+			env: "",
+			expected: summary{
+				Jobs:        []string{"base"},
+				Interval:    time.Minute,
+				Connections: []string{"postgres://localhost/app"},
+				Vars:        map[string]string{"shard": "dev"},
+				Queries: map[string]string{
+					"users":    "SELECT COUNT(*) AS count FROM users",
+					"sessions": "SELECT COUNT(*) AS count FROM sessions",
+				},
+			},
+		},
+		{
+			env: "production",
+			expected: summary{
+				Jobs:        []string{"base", "extra"},
+				Interval:    5 * time.Minute,
+				Connections: []string{"postgres://primary/app", "postgres://replica/app"},
+				Vars:        map[string]string{"shard": "dev", "region": "eu"},
+				Queries: map[string]string{
+					"users":    "SELECT COUNT(*) AS count FROM users",
+					"sessions": "SELECT COUNT(*) AS count FROM sessions WHERE active",
+				},
+			},
+		},
+		{
+			// environments without overrides use the base config
+			env: "staging",
+			expected: summary{
+				Jobs:        []string{"base"},
+				Interval:    time.Minute,
+				Connections: []string{"postgres://localhost/app"},
+				Vars:        map[string]string{"shard": "dev"},
+				Queries: map[string]string{
+					"users":    "SELECT COUNT(*) AS count FROM users",
+					"sessions": "SELECT COUNT(*) AS count FROM sessions",
+				},
+			},
+		},
+	} {
+		t.Run(tc.env, func(t *testing.T) {
+			configEnvironment = tc.env
+			f, err := parseConfig(strings.NewReader(environmentConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := f.Jobs[0]
+			got := summary{Interval: base.Interval, Vars: base.Vars, Queries: map[string]string{}}
+			for _, j := range f.Jobs {
+				got.Jobs = append(got.Jobs, j.Name)
+			}
+			for _, cc := range base.Connections {
+				got.Connections = append(got.Connections, cc.URL)
+			}
+			for _, q := range base.Queries {
+				got.Queries[q.Name] = q.Query
+				if q.Query == "" {
+					got.Queries[q.Name] = f.Queries[q.QueryRef]
+				}
+			}
+			if diff := pretty.Compare(tc.expected, got); diff != "" {
+				t.Errorf("unexpected config: %s", diff)
+			}
+		})
+	}
+}
+
+func Test_applyEnvironment_invalid(t *testing.T) {
+	if _, err := applyEnvironment([]byte("environments: [production]\n"), "production"); err == nil {
+		t.Error("expected an error for a list of environments")
+	}
+	if _, err := applyEnvironment([]byte("environments:\n  production: 1m\n"), "production"); err == nil {
+		t.Error("expected an error for an environment without overrides")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// withExemplar attaches the exemplar of the row to the metric. The value
+// defaults to the given one, histograms put it into the matching bucket.
+// Rows without any exemplar label, e.g. untraced queries, and invalid
+// exemplars export the metric without exemplar.
+func (q *Query) withExemplar(m prometheus.Metric, res map[string]interface{}, value float64) prometheus.Metric {
+	if q.Exemplar == nil {
+		return m
+	}
+	labels := make(prometheus.Labels, len(q.Exemplar.Labels))
+	for name, column := range q.Exemplar.Labels {
+		switch v := res[column].(type) {
+		case nil:
+		case string:
+			labels[name] = v
+		case []uint8:
+			labels[name] = string(v)
+		default:
+			labels[name] = fmt.Sprint(v)
+		}
+		if labels[name] == "" {
+			delete(labels, name)
+		}
+	}
+	if len(labels) == 0 {
+		return m
+	}
+	if q.Exemplar.Value != "" {
+		if res[q.Exemplar.Value] == nil {
+			return m
+		}
+		var err error
+		if value, err = q.parseValue(res, q.Exemplar.Value); err != nil {
+			level.Debug(q.log).Log("msg", "Failed to parse exemplar value", "err", err)
+			return m
+		}
+	}
+	if math.IsNaN(value) {
+		return m
+	}
+	em, err := prometheus.NewMetricWithExemplars(m, prometheus.Exemplar{Value: value, Labels: labels})
+	if err != nil {
+		level.Debug(q.log).Log("msg", "Dropping invalid exemplar", "err", err)
+		return m
+	}
+	return em
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_exemplars(t *testing.T) {
+	counter := &Query{
+		Name:     "calls_total",
+		Help:     "Calls",
+		Type:     metricTypeCounter,
+		Values:   Values{{Column: "calls"}},
+		Exemplar: &Exemplar{Labels: map[string]string{"trace_id": "trace"}},
+		Query:    "SELECT 42 AS calls, 'abc123' AS trace",
+	}
+	hist := &Query{
+		Name: "duration_seconds",
+		Help: "Durations",
+		Type: metricTypeHist,
+		HistValues: []*HistValue{{
+			Count:   "count",
+			Sum:     "sum",
+			Buckets: []*Bucket{{Name: "le_1", Value: "1"}, {Name: "le_10", Value: "10"}},
+		}},
+		Exemplar: &Exemplar{Labels: map[string]string{"trace_id": "trace"}, Value: "slowest"},
+		Query:    "SELECT 3 AS count, 9.5 AS sum, 1 AS le_1, 3 AS le_10, 7.2 AS slowest, 'def456' AS trace",
+	}
+	mean := &Query{
+		Name: "mean_seconds",
+		Help: "Durations",
+		Type: metricTypeHist,
+		HistValues: []*HistValue{{
+			Count:   "count",
+			Sum:     "sum",
+			Buckets: []*Bucket{{Name: "le_1", Value: "1"}, {Name: "le_10", Value: "10"}},
+		}},
+		Exemplar: &Exemplar{Labels: map[string]string{"trace_id": "trace"}},
+		Query:    "SELECT 4 AS count, 10 AS sum, 1 AS le_1, 4 AS le_10, 'ghi789' AS trace",
+	}
+	untraced := &Query{
+		Name:     "untraced_total",
+		Help:     "Untraced",
+		Type:     metricTypeCounter,
+		Values:   Values{{Column: "calls"}},
+		Exemplar: &Exemplar{Labels: map[string]string{"trace_id": "trace"}},
+		Query:    "SELECT 1 AS calls, NULL AS trace",
+	}
+
+	for _, tc := range []struct {
+		q        *Query
+		exemplar func(m *dto.Metric) *dto.Exemplar
+		value    float64
+		traceID  string
+	}{
+		{q: counter, exemplar: func(m *dto.Metric) *dto.Exemplar { return m.GetCounter().GetExemplar() }, value: 42, traceID: "abc123"},
+		{q: hist, exemplar: func(m *dto.Metric) *dto.Exemplar { return m.GetHistogram().GetBucket()[1].GetExemplar() }, value: 7.2, traceID: "def456"},
+		{q: mean, exemplar: func(m *dto.Metric) *dto.Exemplar { return m.GetHistogram().GetBucket()[1].GetExemplar() }, value: 2.5, traceID: "ghi789"},
+		{q: untraced, exemplar: func(m *dto.Metric) *dto.Exemplar { return m.GetCounter().GetExemplar() }},
+	} {
+		t.Run(tc.q.Name, func(t *testing.T) {
+			families, err := runSQLiteQuery(t, tc.q).Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metric *dto.Metric
+			for _, mf := range families {
+				if mf.GetName() == "sql_"+tc.q.Name {
+					metric = mf.GetMetric()[0]
+				}
+			}
+			if metric == nil {
+				t.Fatalf("metric sql_%s not found", tc.q.Name)
+			}
+			e := tc.exemplar(metric)
+			if tc.traceID == "" {
+				if e != nil {
+					t.Errorf("expected no exemplar, got %v", e)
+				}
+				return
+			}
+			if e == nil {
+				t.Fatal("expected an exemplar")
+			}
+			if e.GetValue() != tc.value {
+				t.Errorf("expected exemplar value %v, got %v", tc.value, e.GetValue())
+			}
+			if len(e.GetLabel()) != 1 || e.GetLabel()[0].GetName() != "trace_id" || e.GetLabel()[0].GetValue() != tc.traceID {
+				t.Errorf("expected trace_id %q, got %v", tc.traceID, e.GetLabel())
+			}
+		})
+	}
+}
@@ -1,84 +1,249 @@
 package main
 
 import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sql_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sql_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
 )
 
-// Exporter collects SQL metrics. It implements prometheus.Collector.
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+// Exporter collects SQL metrics. It implements prometheus.Gatherer.
 type Exporter struct {
-	jobs   []*Job
-	logger log.Logger
+	sync.RWMutex
+	configFile string
+	jobNames   []string // of the jobs to run, all enabled jobs if empty
+	cfg        File
+	jobs       []*Job
+	logger     log.Logger
+	pusher     *remoteWriter
+	otlp       *otlpWriter
+	listener   *exposeListener
+	ports      map[int]context.CancelFunc // listeners of the exposed ports
 }
 
-// NewExporter returns a new SQL Exporter for the provided config.
-func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
+// NewExporter returns a new SQL Exporter for the provided config, running
+// the jobs with the given names or all enabled jobs if none are given.
+func NewExporter(logger log.Logger, configFile string, jobs []string) (*Exporter, error) {
 	if configFile == "" {
 		configFile = "config.yml"
 	}
 
+	exp := &Exporter{
+		configFile: configFile,
+		jobNames:   jobs,
+		logger:     logger,
+	}
+	if err := exp.Reload(); err != nil {
+		return nil, err
+	}
+	return exp, nil
+}
+
+// Shutdown stops all jobs and the metric pushers. Running queries get until
+// the context is done to finish before they are cancelled. It returns once
+// the connections of all jobs are closed.
+func (e *Exporter) Shutdown(ctx context.Context) {
+	e.Lock()
+	defer e.Unlock()
+	if e.pusher != nil {
+		e.pusher.stop()
+		e.pusher = nil
+	}
+	if e.otlp != nil {
+		e.otlp.stop()
+		e.otlp = nil
+	}
+	var wg sync.WaitGroup
+	for _, job := range e.jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			job.Shutdown(ctx)
+		}(job)
+	}
+	wg.Wait()
+	e.jobs = nil
+	e.stopPorts()
+}
+
+// Reload re-reads the config file and applies it. Jobs whose config didn't
+// change keep running, removed and changed jobs are stopped and new or changed
+// jobs are started.
+func (e *Exporter) Reload() error {
+	if err := e.reload(); err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
+
+func (e *Exporter) reload() error {
 	// read config
-	cfg, err := Read(configFile)
+	cfg, err := ReadJobs(e.configFile, e.jobNames)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	exp := &Exporter{
-		jobs:   make([]*Job, 0, len(cfg.Jobs)),
-		logger: logger,
+	if err := configureExporterMetrics(cfg.ExporterMetrics); err != nil {
+		return err
 	}
+	trackedSeries.setLimit(cfg.SeriesLimit)
 
-	// dispatch all jobs
-	for _, job := range cfg.Jobs {
-		if job == nil {
-			continue
+	e.Lock()
+	defer e.Unlock()
+
+	if err := e.listener.check(cfg.Jobs); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(cfg.ResultCache, e.cfg.ResultCache) {
+		cache, err := newResultCache(cfg.ResultCache)
+		if err != nil {
+			return err
 		}
-		if err := job.Init(logger, cfg.Queries); err != nil {
-			level.Warn(logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
-			continue
+		var ttl time.Duration
+		if cfg.ResultCache != nil {
+			ttl = cfg.ResultCache.TTL
 		}
-		exp.jobs = append(exp.jobs, job)
-		go job.Run()
+		setSharedResultCache(cache, ttl)
 	}
 
-	return exp, nil
-}
-
-// Describe implements prometheus.Collector
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	for _, job := range e.jobs {
-		if job == nil {
-			continue
-		}
-		for _, query := range job.Queries {
-			if query == nil {
-				continue
+	if !reflect.DeepEqual(cfg.RemoteWrite, e.cfg.RemoteWrite) {
+		var pusher *remoteWriter
+		if cfg.RemoteWrite != nil {
+			if pusher, err = newRemoteWriter(e.logger, cfg.RemoteWrite, e.gatherer()); err != nil {
+				return err
 			}
-			if query.desc == nil {
-				level.Error(e.logger).Log("msg", "Query has no descriptor", "query", query.Name)
-				continue
+		}
+		if e.pusher != nil {
+			e.pusher.stop()
+		}
+		e.pusher = pusher
+		if pusher != nil {
+			pusher.start()
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.OTLP, e.cfg.OTLP) {
+		var writer *otlpWriter
+		if cfg.OTLP != nil {
+			if writer, err = newOTLPWriter(e.logger, cfg.OTLP, e.gatherer()); err != nil {
+				return err
 			}
-			ch <- query.desc
+		}
+		if e.otlp != nil {
+			e.otlp.stop()
+		}
+		e.otlp = writer
+		if writer != nil {
+			writer.start()
 		}
 	}
-}
 
-// Collect implements prometheus.Collector
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	// index the running jobs by their config, so unchanged jobs can be kept.
+	// Running jobs aren't marshalled again, their state changes concurrently.
+	running := make(map[string][]*Job, len(e.jobs))
 	for _, job := range e.jobs {
+		running[job.fingerprint] = append(running[job.fingerprint], job)
+	}
+
+	jobs := make([]*Job, 0, len(cfg.Jobs))
+	started := make([]*Job, 0, len(cfg.Jobs))
+	for _, job := range cfg.Jobs {
 		if job == nil {
 			continue
 		}
-		for _, query := range job.Queries {
-			if query == nil {
-				continue
-			}
-			for _, metrics := range query.metrics {
-				for _, metric := range metrics {
-					ch <- metric
-				}
+		if err := job.Init(e.logger, cfg.Queries); err != nil {
+			level.Warn(e.logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
+			job.release()
+			continue
+		}
+		job.fingerprint = jobFingerprint(job)
+		if old := running[job.fingerprint]; len(old) > 0 {
+			jobs = append(jobs, old[0])
+			running[job.fingerprint] = old[1:]
+			job.release()
+			continue
+		}
+		jobs = append(jobs, job)
+		started = append(started, job)
+	}
+
+	// stop removed and changed jobs
+	stopped := make(map[string]bool)
+	for _, old := range running {
+		for _, job := range old {
+			level.Info(e.logger).Log("msg", "Stopping job", "job", job.Name)
+			job.Stop()
+			stopped[job.Name] = true
+		}
+	}
+	// drop the exporter metrics of the stopped jobs, except of the queries
+	// and connections the new jobs keep running
+	if len(stopped) > 0 {
+		for _, job := range started {
+			job.initConnections()
+		}
+		current := make(map[string]bool)
+		for _, job := range jobs {
+			for key := range job.exporterMetricKeys() {
+				current[key] = true
 			}
 		}
+		deleteExporterMetrics(func(labelValues []string) bool {
+			return stopped[labelValues[4]] && !current[strings.Join(labelValues[:6], "\xff")]
+		})
+	}
+	// dispatch new and changed jobs
+	for _, job := range started {
+		level.Info(e.logger).Log("msg", "Starting job", "job", job.Name)
+		go job.Run()
+	}
+
+	e.cfg = cfg
+	e.jobs = jobs
+	e.updatePorts()
+	return nil
+}
+
+// jobFingerprint identifies the config of an initialized job.
+func jobFingerprint(job *Job) string {
+	buf, err := yaml.Marshal(job)
+	if err != nil {
+		// never considered unchanged
+		return time.Now().String()
+	}
+	// queries violating the policy are skipped, so a job is changed by
+	// changes of the policy as well
+	if job.policy != nil {
+		policy, err := yaml.Marshal(job.policy)
+		if err != nil {
+			return time.Now().String()
+		}
+		buf = append(buf, policy...)
 	}
+	return string(buf)
 }
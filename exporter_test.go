@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testReloadConfigYAML = `
+mocks:
+  app:
+  - match: "slow"
+    delay: '1h'
+    rows:
+    - {value: 1}
+  - match: "fast"
+    rows:
+    - {value: 2}
+jobs:
+- name: "slow"
+  interval: '1h'
+  connections:
+  - 'mock://app/db'
+  queries:
+  - name: "slow"
+    help: "Slow"
+    values:
+      - "value"
+    query: "SELECT value FROM slow"
+- name: "fast"
+  interval: '1h'
+  connections:
+  - 'mock://app/db'
+  queries:
+  - name: "fast"
+    help: "Fast"
+    values:
+      - "value"
+    query: "SELECT value FROM fast"
+`
+
+func TestExporter_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(testReloadConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+
+	e, err := NewExporter(log.NewNopLogger(), configFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		e.Shutdown(ctx)
+	}()
+	e.RLock()
+	slow, fast := e.jobs[0], e.jobs[1]
+	e.RUnlock()
+
+	// changing the slow job replaces it, cancelling its running query
+	changed := strings.Replace(testReloadConfigYAML, `help: "Slow"`, `help: "Slower"`, 1)
+	if err := ioutil.WriteFile(configFile, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-slow.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the replaced job to stop")
+	}
+	if slow.ctx.Err() == nil || slow.queryCtx.Err() == nil {
+		t.Errorf("expected the contexts of the replaced job to be cancelled")
+	}
+
+	e.RLock()
+	defer e.RUnlock()
+	if len(e.jobs) != 2 || e.jobs[0] == slow || e.jobs[0].Queries[0].Help != "Slower" {
+		t.Fatalf("expected the slow job to be replaced, got %+v", e.jobs)
+	}
+	if e.jobs[0].ctx.Err() != nil {
+		t.Errorf("expected the new job to run")
+	}
+	if e.jobs[1] != fast || fast.ctx.Err() != nil {
+		t.Errorf("expected the unchanged job to keep running")
+	}
+}
+
+const testReloadPruneConfigYAML = `
+mocks:
+  app:
+  - match: "value"
+    rows:
+    - {value: 1}
+jobs:
+- name: "kept"
+  mode: 'pull'
+  connections:
+  - 'mock://app/db'
+  queries:
+  - name: "value"
+    help: "Value"
+    values:
+      - "value"
+    query: "SELECT value"
+- name: "changed"
+  mode: 'pull'
+  connections:
+  - 'mock://app/db'
+  queries:
+  - name: "value"
+    help: "Value"
+    values:
+      - "value"
+    query: "SELECT value"
+  - name: "dropped"
+    help: "Dropped"
+    values:
+      - "value"
+    query: "SELECT value"
+- name: "removed"
+  mode: 'pull'
+  connections:
+  - 'mock://app/db'
+  queries:
+  - name: "value"
+    help: "Value"
+    values:
+      - "value"
+    query: "SELECT value"
+`
+
+func TestExporter_ReloadPrunesMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(testReloadPruneConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+
+	e, err := NewExporter(log.NewNopLogger(), configFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Shutdown(context.Background())
+	series := [][]string{
+		{"mock", "app", "db", "", "kept", "value"},
+		{"mock", "app", "db", "", "changed", "value"},
+		{"mock", "app", "db", "", "changed", "dropped"},
+		{"mock", "app", "db", "", "removed", "value"},
+		{"mock", "gone", "db", "", "changed", "value"},
+	}
+	defer deleteExporterMetrics(func(labelValues []string) bool {
+		return containsString([]string{"kept", "changed", "removed"}, labelValues[4])
+	})
+	for _, lvs := range series {
+		failedScrapes.WithLabelValues(lvs...).Set(1)
+		queryDuration.WithLabelValues(lvs...).Observe(1)
+	}
+
+	// the job without the dropped query replaces the changed one
+	changed := strings.Replace(testReloadPruneConfigYAML, `
+  - name: "dropped"
+    help: "Dropped"
+    values:
+      - "value"
+    query: "SELECT value"`, "", 1)
+	changed = changed[:strings.Index(changed, `- name: "removed"`)]
+	if err := ioutil.WriteFile(configFile, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for i, lvs := range series {
+		key := strings.Join(lvs, "\xff")
+		failedScrapes.mtx.Lock()
+		_, gauge := failedScrapes.values[key]
+		failedScrapes.mtx.Unlock()
+		queryDuration.mtx.Lock()
+		_, histogram := queryDuration.values[key]
+		queryDuration.mtx.Unlock()
+		if expected := i < 2; gauge != expected || histogram != expected {
+			t.Errorf("%v: expected the series to be kept %v, got %v and %v", lvs, expected, gauge, histogram)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reservedPaths are served by the exporter itself, so jobs can't be exposed
+// on them on the port of the exporter. Paths ending with / include their
+// subpaths.
+var reservedPaths = []string{"/", "/-/reload", "/api/snapshot", "/metrics.json", "/status", "/jobs/", "/probe", "/healthz"}
+
+func (x *Expose) validate() error {
+	if x.Port < 0 || x.Port > 65535 {
+		return fmt.Errorf("invalid port %d", x.Port)
+	}
+	if x.Path != "" && !strings.HasPrefix(x.Path, "/") {
+		return fmt.Errorf("path %q must start with /", x.Path)
+	}
+	if x.Port == 0 && x.Path == "" {
+		return fmt.Errorf("requires a port or a path")
+	}
+	if x.Port == 0 && isReservedPath(x.Path, reservedPaths) {
+		return fmt.Errorf("path %q is served by the exporter", x.Path)
+	}
+	return nil
+}
+
+// isReservedPath returns whether the path is one of the reserved paths or a
+// subpath of a reserved path ending with /.
+func isReservedPath(path string, reserved []string) bool {
+	for _, r := range reserved {
+		if path == r || (r != "/" && strings.HasSuffix(r, "/") && strings.HasPrefix(path, r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// path returns the path the metrics are served on.
+func (x *Expose) path(metricsPath string) string {
+	if x.Path != "" {
+		return x.Path
+	}
+	return metricsPath
+}
+
+// exposeListener holds the settings of the listeners of the ports the jobs
+// are exposed on.
+type exposeListener struct {
+	web         *WebConfig
+	host        string
+	port        int // port of the exporter
+	metricsPath string
+	opts        promhttp.HandlerOpts
+	grace       time.Duration
+}
+
+// check returns an error if a job is exposed on the port of the exporter or
+// on the paths of its metrics.
+func (l *exposeListener) check(jobs []*Job) error {
+	if l == nil {
+		return nil
+	}
+	metricsPaths := []string{l.metricsPath, strings.TrimSuffix(l.metricsPath, "/") + "/"}
+	for _, job := range jobs {
+		if job == nil || job.Expose == nil {
+			continue
+		}
+		if job.Expose.Port != 0 && job.Expose.Port == l.port {
+			return fmt.Errorf("job %q: expose port %d is the port of the exporter, use a path instead", job.Name, job.Expose.Port)
+		}
+		if job.Expose.Port == 0 && isReservedPath(job.Expose.Path, metricsPaths) {
+			return fmt.Errorf("job %q: expose path %q is served by the exporter", job.Name, job.Expose.Path)
+		}
+	}
+	return nil
+}
+
+// ServeExposed starts listening on the ports the jobs are exposed on, using
+// the host and the web config of the listen address. The listeners follow
+// the config on reloads.
+func (e *Exporter) ServeExposed(web *WebConfig, listenAddress, metricsPath string, opts promhttp.HandlerOpts, grace time.Duration) error {
+	host, portName, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		host = ""
+	}
+	port, _ := strconv.Atoi(portName)
+	listener := &exposeListener{web: web, host: host, port: port, metricsPath: metricsPath, opts: opts, grace: grace}
+	e.Lock()
+	defer e.Unlock()
+	if err := listener.check(e.jobs); err != nil {
+		return err
+	}
+	e.listener = listener
+	e.updatePorts()
+	return nil
+}
+
+// updatePorts starts the listeners of newly exposed ports and stops the ones
+// no job is exposed on anymore. The lock must be held.
+func (e *Exporter) updatePorts() {
+	if e.listener == nil {
+		return
+	}
+	ports := make(map[int]bool)
+	for _, job := range e.jobs {
+		if job != nil && job.Expose != nil && job.Expose.Port > 0 {
+			ports[job.Expose.Port] = true
+		}
+	}
+	for port, stop := range e.ports {
+		if !ports[port] {
+			level.Info(e.logger).Log("msg", "Stopping listener of exposed jobs", "port", port)
+			stop()
+			delete(e.ports, port)
+		}
+	}
+	for port := range ports {
+		if e.ports[port] != nil {
+			continue
+		}
+		if e.ports == nil {
+			e.ports = make(map[int]context.CancelFunc)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		e.ports[port] = cancel
+		addr := net.JoinHostPort(e.listener.host, strconv.Itoa(port))
+		level.Info(e.logger).Log("msg", "Listening for exposed jobs", "listenAddress", addr)
+		go func(port int, handler http.Handler, web *WebConfig, grace time.Duration) {
+			err := web.ListenAndServe(ctx, addr, handler, grace)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			level.Error(e.logger).Log("msg", "Error listening for exposed jobs", "listenAddress", addr, "err", err)
+			// the listener is started again by the next reload. As long as
+			// its context isn't cancelled, the port wasn't replaced.
+			e.Lock()
+			defer e.Unlock()
+			if ctx.Err() == nil {
+				cancel()
+				delete(e.ports, port)
+			}
+		}(port, e.ExposedHandler(port, http.NotFoundHandler()), e.listener.web, e.listener.grace)
+	}
+}
+
+// stopPorts stops the listeners of all exposed ports. The lock must be held.
+func (e *Exporter) stopPorts() {
+	for port, stop := range e.ports {
+		stop()
+		delete(e.ports, port)
+	}
+}
+
+// ExposedHandler serves the metrics of the jobs exposed on the path of the
+// request on the port, 0 being the port of the exporter. Other requests are
+// passed to next.
+func (e *Exporter) ExposedHandler(port int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.RLock()
+		listener := e.listener
+		e.RUnlock()
+		if listener == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gatherers := e.jobGatherers(func(j *Job) bool {
+			return j.Expose != nil && j.Expose.Port == port && j.Expose.path(listener.metricsPath) == r.URL.Path
+		})
+		if len(gatherers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		promhttp.HandlerFor(gatherers, listener.opts).ServeHTTP(w, r)
+	})
+}
+
+// jobGatherers returns the gatherers of the jobs matching, of all jobs if
+// match is nil.
+func (e *Exporter) jobGatherers(match func(*Job) bool) prometheus.Gatherers {
+	e.RLock()
+	defer e.RUnlock()
+	gatherers := make(prometheus.Gatherers, 0, len(e.jobs))
+	for _, job := range e.jobs {
+		if job == nil || match != nil && !match(job) {
+			continue
+		}
+		gatherers = append(gatherers, job.gatherer())
+	}
+	return gatherers
+}
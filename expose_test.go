@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestExpose_validate(t *testing.T) {
+	for _, tc := range []struct {
+		expose Expose
+		valid  bool
+	}{
+		{expose: Expose{Port: 9238}, valid: true},
+		{expose: Expose{Path: "/warehouse"}, valid: true},
+		{expose: Expose{Port: 9238, Path: "/warehouse"}, valid: true},
+		{expose: Expose{}},
+		{expose: Expose{Path: "warehouse"}},
+		{expose: Expose{Port: 70000}},
+		{expose: Expose{Path: "/"}},
+		{expose: Expose{Path: "/-/reload"}},
+		{expose: Expose{Path: "/jobs/warehouse/queries/answer/run"}},
+		{expose: Expose{Port: 9238, Path: "/status"}, valid: true},
+	} {
+		if err := tc.expose.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: unexpected error %v", tc.expose, err)
+		}
+	}
+}
+
+// answerOf tells if the metrics contain the query metric of the job. The
+// metrics of the exporter itself are labeled by the jobs as well.
+func answerOf(metrics, job string) bool {
+	return regexp.MustCompile(fmt.Sprintf(`(?m)^sql_answer\{[^}]*sql_job="%s"`, job)).MatchString(metrics)
+}
+
+func TestExporter_ExposedHandler(t *testing.T) {
+	// reserve a free port for the exposed job
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	var jobs []*Job
+	for name, expose := range map[string]*Expose{
+		"shared":    nil,
+		"warehouse": {Path: "/warehouse"},
+		"tenant":    {Port: port},
+	} {
+		job := &Job{
+			Name:        name,
+			Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+			Queries:     []*Query{{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT 42 AS value"}},
+			Expose:      expose,
+		}
+		if err := job.Init(log.NewNopLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+		job.initConnections()
+		defer job.closeConnections()
+		conn := job.conns[0]
+		if err := conn.connect(job); err != nil {
+			t.Fatal(err)
+		}
+		job.Queries[0].Run(conn)
+		jobs = append(jobs, job)
+	}
+	e := &Exporter{jobs: jobs, logger: log.NewNopLogger()}
+	if err := e.ServeExposed(&WebConfig{}, "127.0.0.1:0", "/metrics", promhttp.HandlerOpts{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		e.Lock()
+		e.stopPorts()
+		e.Unlock()
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.metricsGatherer(), promhttp.HandlerOpts{}))
+	handler := e.ExposedHandler(0, mux)
+	for path, expected := range map[string]string{
+		"/metrics":   "shared",
+		"/warehouse": "warehouse",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body := rec.Body.String()
+		for _, job := range []string{"shared", "warehouse", "tenant"} {
+			if found := answerOf(body, job); found != (job == expected) {
+				t.Errorf("%s: expected only the metrics of job %s, got:\n%s", path, expected, body)
+			}
+		}
+	}
+
+	// the listener of the port is started in the background
+	var body string
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+		if err == nil {
+			buf, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(buf)
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !answerOf(body, "tenant") || answerOf(body, "shared") {
+		t.Errorf("expected only the metrics of the tenant job on its port, got:\n%s", body)
+	}
+}
+
+func TestExposeListener_check(t *testing.T) {
+	l := &exposeListener{port: 9237, metricsPath: "/metrics"}
+	for _, tc := range []struct {
+		expose *Expose
+		valid  bool
+	}{
+		{expose: nil, valid: true},
+		{expose: &Expose{Port: 9238}, valid: true},
+		{expose: &Expose{Path: "/warehouse"}, valid: true},
+		{expose: &Expose{Port: 9238, Path: "/metrics"}, valid: true},
+		{expose: &Expose{Port: 9237}},
+		{expose: &Expose{Path: "/metrics"}},
+		{expose: &Expose{Path: "/metrics/warehouse"}},
+	} {
+		if err := l.check([]*Job{{Name: "exposed", Expose: tc.expose}}); (err == nil) != tc.valid {
+			t.Errorf("%+v: unexpected error %v", tc.expose, err)
+		}
+	}
+}
+
+func TestExporter_updatePorts_bindFailure(t *testing.T) {
+	// the port is taken until the listener is closed
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	e := &Exporter{jobs: []*Job{{Name: "tenant", Expose: &Expose{Port: port}}}, logger: log.NewNopLogger()}
+	if err := e.ServeExposed(&WebConfig{}, "127.0.0.1:0", "/metrics", promhttp.HandlerOpts{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		e.Lock()
+		e.stopPorts()
+		e.Unlock()
+	}()
+	listening := func() bool {
+		e.Lock()
+		defer e.Unlock()
+		return e.ports[port] != nil
+	}
+	for i := 0; i < 50 && listening(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if listening() {
+		t.Fatalf("expected the failed listener of port %d to be removed", port)
+	}
+
+	// the next reload starts the listener again
+	taken.Close()
+	e.Lock()
+	e.updatePorts()
+	e.Unlock()
+	if !listening() {
+		t.Errorf("expected the listener of port %d to be started again", port)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fixtureRows iterates over the result sets of a query read from fixture
+// files instead of a database.
+type fixtureRows struct {
+	sets [][]map[string]interface{}
+	set  int
+	next int
+}
+
+func (r *fixtureRows) Next() bool {
+	r.next++
+	return r.next <= len(r.sets[r.set])
+}
+
+func (r *fixtureRows) MapScan(dest map[string]interface{}) error {
+	for column, value := range r.sets[r.set][r.next-1] {
+		dest[column] = value
+	}
+	return nil
+}
+
+func (r *fixtureRows) NextResultSet() bool {
+	if r.set+1 >= len(r.sets) {
+		return false
+	}
+	r.set++
+	r.next = 0
+	return true
+}
+
+func (r *fixtureRows) Err() error {
+	return nil
+}
+
+func (r *fixtureRows) Close() error {
+	return nil
+}
+
+// readFixture reads the rows of a fixture file, either CSV with a header
+// line or JSON with an array of objects. The values of CSV files are strings,
+// JSON files can have numbers, booleans and nulls as well.
+func readFixture(file string) ([]map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(file) == ".json" {
+		var rows []map[string]interface{}
+		if err := json.Unmarshal(buf, &rows); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return rows, nil
+	}
+	records, err := csv.NewReader(bytes.NewReader(buf)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: missing header line", file)
+	}
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(record))
+		for i, column := range records[0] {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// findFixture reads the fixture of name in dir, a .csv or .json file.
+func findFixture(dir, name string) ([]map[string]interface{}, error) {
+	for _, ext := range []string{".csv", ".json"} {
+		file := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(file); err == nil {
+			return readFixture(file)
+		}
+	}
+	return nil, fmt.Errorf("no fixture %s.csv or %s.json", name, name)
+}
+
+// loadFixtures reads the fixtures of the queries of the job from dir, one
+// file per query named like the query and one per result set named
+// <query>.<result set>.
+func (j *Job) loadFixtures(dir string) error {
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		rows, err := findFixture(dir, q.Name)
+		if err != nil {
+			return err
+		}
+		sets := [][]map[string]interface{}{rows}
+		for _, rs := range q.ResultSets {
+			if rs == nil {
+				continue
+			}
+			rows, err := findFixture(dir, q.Name+"."+rs.Name)
+			if err != nil {
+				return err
+			}
+			sets = append(sets, rows)
+		}
+		q.fixture = sets
+	}
+	return nil
+}
+
+// RunTests runs the queries of the jobs of the config file against fixture
+// results instead of databases and compares the resulting metrics to golden
+// files, e.g. to verify the metrics in CI. The fixtures of a job are read
+// from <dir>/<job>/, its golden file is <dir>/<job>.prom. Jobs without
+// fixtures are skipped. With update, the golden files are written instead.
+func RunTests(logger log.Logger, configFile string, jobs []string, dir string, update bool, w io.Writer) error {
+	if configFile == "" {
+		configFile = "config.yml"
+	}
+	cfg, err := ReadJobs(configFile, jobs)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, job := range cfg.Jobs {
+		if job == nil {
+			continue
+		}
+		fixtures := filepath.Join(dir, job.Name)
+		if _, err := os.Stat(fixtures); err != nil {
+			fmt.Fprintf(w, "SKIP %s: no fixtures in %s\n", job.Name, fixtures)
+			continue
+		}
+		if err := job.runTest(logger, cfg.Queries, fixtures, filepath.Join(dir, job.Name+".prom"), update); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", job.Name, err)
+			failed = append(failed, job.Name)
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", job.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("tests of jobs %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runTest runs the queries of the job on its fixtures and compares the
+// metrics to the golden file. The queries run on every connection of the
+// job without connecting, so the metrics carry the labels of the real
+// connections.
+func (j *Job) runTest(logger log.Logger, queries map[string]string, fixtures, golden string, update bool) error {
+	if err := j.Init(logger, queries); err != nil {
+		return err
+	}
+	if err := j.loadFixtures(fixtures); err != nil {
+		return err
+	}
+	j.initConnections()
+	if len(j.conns) == 0 {
+		return fmt.Errorf("no connections, discovered connections can't be tested")
+	}
+	for _, conn := range j.conns {
+		for _, q := range j.Queries {
+			if q == nil || !q.runsOnDriver(conn.driver) {
+				continue
+			}
+			if err := q.Run(conn); err != nil {
+				return fmt.Errorf("query %s on %s: %v", q.Name, conn.host, err)
+			}
+		}
+	}
+	// the queries already ran, the job must not run them again on collection
+	j.Mode = jobModeInterval
+	registry := prometheus.NewRegistry()
+	if err := j.register(registry); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	var got bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&got, mf); err != nil {
+			return err
+		}
+	}
+	if update {
+		return ioutil.WriteFile(golden, got.Bytes(), 0644)
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return err
+	}
+	if diff := diffLines(string(expected), got.String()); diff != "" {
+		return fmt.Errorf("metrics differ from %s:\n%s", golden, diff)
+	}
+	return nil
+}
+
+// diffLines lists the lines missing from got with - and the unexpected ones
+// with +, empty if both are equal.
+func diffLines(expected, got string) string {
+	count := func(s string) map[string]int {
+		lines := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+			lines[line]++
+		}
+		return lines
+	}
+	have := count(got)
+	want := count(expected)
+	var diff []string
+	for _, line := range strings.Split(strings.TrimSpace(expected), "\n") {
+		if have[line] > 0 {
+			have[line]--
+			continue
+		}
+		diff = append(diff, "- "+line)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+		if want[line] > 0 {
+			want[line]--
+			continue
+		}
+		diff = append(diff, "+ "+line)
+	}
+	return strings.Join(diff, "\n")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testFixtureConfigYAML = `
+jobs:
+- name: "pg"
+  connections:
+  - 'postgres://monitor@db.example.com/postgres?sslmode=disable'
+  queries:
+  - name: "connections"
+    help: "Connections by database"
+    labels:
+      - "datname"
+    values:
+      - "count"
+    query: "SELECT datname, count(*) FROM pg_stat_activity GROUP BY datname"
+  - name: "replication"
+    help: "Replication lag"
+    values:
+      - "lag"
+    query: "SELECT lag FROM replication"
+- name: "untested"
+  connections:
+  - 'sqlite://:memory:'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+
+func Test_RunTests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	testdata := filepath.Join(dir, "testdata")
+	for file, content := range map[string]string{
+		configFile: testFixtureConfigYAML,
+		filepath.Join(testdata, "pg", "connections.csv"):  "datname,count\npostgres,3\napp,12\n",
+		filepath.Join(testdata, "pg", "replication.json"): `[{"lag": 1.5}]`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the golden file is written by the first run
+	var out bytes.Buffer
+	if err := RunTests(log.NewNopLogger(), configFile, nil, testdata, true, &out); err != nil {
+		t.Fatalf("got unexpected error: %v\n%s", err, out.String())
+	}
+	golden, err := ioutil.ReadFile(filepath.Join(testdata, "pg.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`sql_connections{col="count",database="postgres",datname="app",driver="postgres",host="db.example.com",sql_job="pg",user="monitor"} 12`,
+		`sql_replication{col="lag",database="postgres",driver="postgres",host="db.example.com",sql_job="pg",user="monitor"} 1.5`,
+	} {
+		if !strings.Contains(string(golden), expected) {
+			t.Errorf("expected the golden file to contain %s, got:\n%s", expected, golden)
+		}
+	}
+
+	out.Reset()
+	if err := RunTests(log.NewNopLogger(), configFile, nil, testdata, false, &out); err != nil {
+		t.Fatalf("got unexpected error: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "ok   pg") || !strings.Contains(out.String(), "SKIP untested") {
+		t.Errorf("unexpected results:\n%s", out.String())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(testdata, "pg", "connections.csv"), []byte("datname,count\npostgres,3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := RunTests(log.NewNopLogger(), configFile, nil, testdata, false, &out); err == nil {
+		t.Fatalf("expected the changed metrics to fail the test")
+	}
+	if !strings.Contains(out.String(), `datname="app"`) {
+		t.Errorf("expected the missing series in the diff, got:\n%s", out.String())
+	}
+}
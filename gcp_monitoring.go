@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+const (
+	defaultCloudMonitoringPrefix       = "custom.googleapis.com/"
+	defaultCloudMonitoringResourceType = "global"
+	// cloudMonitoringBatchSize is the maximum number of time series per
+	// request of the API
+	cloudMonitoringBatchSize = 200
+	cloudMonitoringTimeout   = 30 * time.Second
+)
+
+func (c *GCPMonitoring) validate() error {
+	if c.ProjectID == "" {
+		return fmt.Errorf("project_id is required")
+	}
+	for resourceLabel := range c.ResourceLabelsFrom {
+		if _, found := c.ResourceLabels[resourceLabel]; found {
+			return fmt.Errorf("resource label %q is given in resource_labels and resource_labels_from", resourceLabel)
+		}
+	}
+	return nil
+}
+
+// monitoringService returns the Cloud Monitoring client, created on first
+// use.
+func (c *GCPMonitoring) monitoringService() (*monitoring.Service, error) {
+	if c.service != nil {
+		return c.service, nil
+	}
+	var opts []option.ClientOption
+	if c.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(c.CredentialsFile))
+	}
+	if c.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(c.Endpoint))
+	}
+	service, err := monitoring.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.service = service
+	return service, nil
+}
+
+// emitGCPMonitoring writes the current metrics of all queries of the job to
+// Cloud Monitoring, each value as gauge, until the context is cancelled.
+// Histograms and summaries are sent as their sum and count.
+func (j *Job) emitGCPMonitoring(ctx context.Context) {
+	c := j.GCPMonitoring
+	if c == nil {
+		return
+	}
+	service, err := c.monitoringService()
+	if err != nil {
+		level.Warn(j.log).Log("msg", "Failed to create Cloud Monitoring client", "err", err)
+		return
+	}
+	now := time.Now()
+	// a request must not contain the same time series more than once, e.g.
+	// of connections only differing in dropped built-in labels
+	var series []*monitoring.TimeSeries
+	index := make(map[string]int)
+	for _, m := range j.currentMetrics() {
+		for _, ts := range c.timeSeries(m, now) {
+			key := timeSeriesKey(ts)
+			if i, found := index[key]; found {
+				series[i] = ts
+				continue
+			}
+			index[key] = len(series)
+			series = append(series, ts)
+		}
+	}
+	name := "projects/" + c.ProjectID
+	for start := 0; start < len(series); start += cloudMonitoringBatchSize {
+		end := start + cloudMonitoringBatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, cloudMonitoringTimeout)
+		_, err := service.Projects.TimeSeries.Create(name, &monitoring.CreateTimeSeriesRequest{
+			TimeSeries: series[start:end],
+		}).Context(reqCtx).Do()
+		cancel()
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Failed to send metrics to Cloud Monitoring", "project", c.ProjectID, "err", err)
+		}
+	}
+}
+
+// timeSeries converts the metric to gauge time series of the configured
+// monitored resource.
+func (c *GCPMonitoring) timeSeries(m prometheus.Metric, timestamp time.Time) []*monitoring.TimeSeries {
+	family, pb, ok := metricSample(m)
+	if !ok {
+		return nil
+	}
+	prefix := c.MetricPrefix
+	if prefix == "" {
+		prefix = defaultCloudMonitoringPrefix
+	}
+	resourceType := c.ResourceType
+	if resourceType == "" {
+		resourceType = defaultCloudMonitoringResourceType
+	}
+	resourceLabels := make(map[string]string, len(c.ResourceLabels)+len(c.ResourceLabelsFrom))
+	for k, v := range c.ResourceLabels {
+		resourceLabels[k] = v
+	}
+	moved := make(map[string]string, len(c.ResourceLabelsFrom))
+	for resourceLabel, metricLabel := range c.ResourceLabelsFrom {
+		moved[metricLabel] = resourceLabel
+	}
+	labels := make(map[string]string, len(pb.GetLabel()))
+	for _, l := range pb.GetLabel() {
+		if resourceLabel, found := moved[l.GetName()]; found {
+			resourceLabels[resourceLabel] = l.GetValue()
+			continue
+		}
+		labels[l.GetName()] = l.GetValue()
+	}
+	end := timestamp.UTC().Format(time.RFC3339Nano)
+	var series []*monitoring.TimeSeries
+	for suffix, value := range sampleValues(pb) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		v := value
+		series = append(series, &monitoring.TimeSeries{
+			Metric:     &monitoring.Metric{Type: prefix + family + suffix, Labels: labels},
+			Resource:   &monitoring.MonitoredResource{Type: resourceType, Labels: resourceLabels},
+			MetricKind: "GAUGE",
+			ValueType:  "DOUBLE",
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{EndTime: end},
+				Value:    &monitoring.TypedValue{DoubleValue: &v},
+			}},
+		})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Metric.Type < series[j].Metric.Type })
+	return series
+}
+
+// timeSeriesKey identifies the time series by its metric and resource.
+func timeSeriesKey(ts *monitoring.TimeSeries) string {
+	parts := []string{ts.Metric.Type, ts.Resource.Type}
+	for _, labels := range []map[string]string{ts.Metric.Labels, ts.Resource.Labels} {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, k+"="+labels[k])
+		}
+		parts = append(parts, "")
+	}
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+func TestGCPMonitoring_timeSeries(t *testing.T) {
+	desc := prometheus.NewDesc("sql_orders", "Orders", []string{"host", "state"}, prometheus.Labels{"sql_job": "shop"})
+	m := prometheus.MustNewConstMetric(desc, prometheus.CounterValue, 42, "db1", "paid")
+	now := time.Unix(1500, 0)
+
+	c := &GCPMonitoring{
+		ProjectID:          "my-project",
+		ResourceType:       "generic_node",
+		ResourceLabels:     map[string]string{"location": "europe-west1", "namespace": "sql"},
+		ResourceLabelsFrom: map[string]string{"node_id": "host"},
+	}
+	value := 42.0
+	expected := []*monitoring.TimeSeries{{
+		Metric: &monitoring.Metric{
+			Type:   "custom.googleapis.com/sql_orders",
+			Labels: map[string]string{"sql_job": "shop", "state": "paid"},
+		},
+		Resource: &monitoring.MonitoredResource{
+			Type:   "generic_node",
+			Labels: map[string]string{"location": "europe-west1", "namespace": "sql", "node_id": "db1"},
+		},
+		MetricKind: "GAUGE",
+		ValueType:  "DOUBLE",
+		Points: []*monitoring.Point{{
+			Interval: &monitoring.TimeInterval{EndTime: "1970-01-01T00:25:00Z"},
+			Value:    &monitoring.TypedValue{DoubleValue: &value},
+		}},
+	}}
+	if diff := pretty.Compare(expected, c.timeSeries(m, now)); diff != "" {
+		t.Errorf("unexpected time series (-want +got):\n\n%s", diff)
+	}
+}
+
+func TestJob_emitGCPMonitoring(t *testing.T) {
+	var requests []monitoring.CreateTimeSeriesRequest
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := monitoring.CreateTimeSeriesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		requests = append(requests, req)
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	service, err := monitoring.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{
+		Name:        "gcp",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{{
+			Name:   "answer",
+			Help:   "The answer",
+			Values: Values{{Column: "a"}, {Column: "b"}},
+			Query:  "SELECT 1 AS a, 2 AS b",
+		}},
+		GCPMonitoring: &GCPMonitoring{ProjectID: "my-project", service: service},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	job.sinks.Wait()
+	if len(requests) != 1 || len(requests[0].TimeSeries) != 2 {
+		t.Fatalf("expected one request with two time series, got %v", requests)
+	}
+	if paths[0] != "/v3/projects/my-project/timeSeries" {
+		t.Errorf("unexpected path %q", paths[0])
+	}
+	if typ := requests[0].TimeSeries[0].Metric.Type; typ != "custom.googleapis.com/sql_answer" {
+		t.Errorf("unexpected metric type %q", typ)
+	}
+}
+
+func TestGCPMonitoring_validate(t *testing.T) {
+	for _, tc := range []struct {
+		c   GCPMonitoring
+		err string
+	}{
+		{c: GCPMonitoring{ProjectID: "my-project"}},
+		{c: GCPMonitoring{}, err: "project_id is required"},
+		{
+			c: GCPMonitoring{
+				ProjectID:          "my-project",
+				ResourceLabels:     map[string]string{"node_id": "db"},
+				ResourceLabelsFrom: map[string]string{"node_id": "host"},
+			},
+			err: `resource label "node_id" is given in resource_labels and resource_labels_from`,
+		},
+	} {
+		err := tc.c.validate()
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// graphiteTimeout limits connecting to and writing to the Carbon endpoint
+const graphiteTimeout = 10 * time.Second
+
+// graphiteNodeRE matches the characters replaced in the nodes of Graphite
+// paths, dots would split the label values into several nodes
+var graphiteNodeRE = regexp.MustCompile(`[^a-zA-Z0-9_:-]`)
+
+func (g *Graphite) validate() error {
+	if g.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if _, _, err := net.SplitHostPort(g.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", g.Address, err)
+	}
+	if g.Path != "" {
+		if _, err := template.New("path").Parse(g.Path); err != nil {
+			return fmt.Errorf("invalid path template: %v", err)
+		}
+	}
+	return nil
+}
+
+// emitGraphite writes the current metrics of all queries of the job to the
+// Carbon endpoint with the plaintext protocol. Histograms and summaries are
+// sent as their sum and count.
+func (j *Job) emitGraphite() {
+	g := j.Graphite
+	if g == nil {
+		return
+	}
+	var tmpl *template.Template
+	if g.Path != "" {
+		var err error
+		if tmpl, err = template.New("path").Option("missingkey=zero").Parse(g.Path); err != nil {
+			level.Warn(j.log).Log("msg", "Invalid Graphite path template", "err", err)
+			return
+		}
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var buf bytes.Buffer
+	for _, m := range j.currentMetrics() {
+		lines, err := graphiteLines(m, tmpl, now)
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Failed to build Graphite path", "err", err)
+			continue
+		}
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", g.Address, graphiteTimeout)
+	if err != nil {
+		level.Warn(j.log).Log("msg", "Failed to connect to Graphite", "address", g.Address, "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		level.Warn(j.log).Log("msg", "Failed to send metrics to Graphite", "address", g.Address, "err", err)
+	}
+}
+
+// graphiteLines formats the metric in the plaintext protocol. The path is
+// built by the template from the labels and the metric name as __name__, by
+// default the metric name followed by the label values in the order of the
+// label names.
+func graphiteLines(m prometheus.Metric, tmpl *template.Template, timestamp string) ([]string, error) {
+	family, pb, ok := metricSample(m)
+	if !ok {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pb.GetLabel())+1)
+	names := make([]string, 0, len(pb.GetLabel()))
+	for _, l := range pb.GetLabel() {
+		labels[l.GetName()] = graphiteNodeRE.ReplaceAllString(l.GetValue(), "_")
+		names = append(names, l.GetName())
+	}
+	sort.Strings(names)
+	var lines []string
+	for suffix, value := range sampleValues(pb) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		name := graphiteNodeRE.ReplaceAllString(family+suffix, "_")
+		var path string
+		if tmpl == nil {
+			nodes := []string{name}
+			for _, n := range names {
+				if labels[n] != "" {
+					nodes = append(nodes, labels[n])
+				}
+			}
+			path = strings.Join(nodes, ".")
+		} else {
+			labels["__name__"] = name
+			var b strings.Builder
+			if err := tmpl.Execute(&b, labels); err != nil {
+				return nil, err
+			}
+			path = b.String()
+		}
+		lines = append(lines, path+" "+strconv.FormatFloat(value, 'g', -1, 64)+" "+timestamp)
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
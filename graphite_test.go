@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_graphiteLines(t *testing.T) {
+	desc := prometheus.NewDesc("sql_users", "Users", []string{"host", "state"}, prometheus.Labels{"sql_job": "app"})
+	m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 42, "db.example.com", "active")
+
+	got, err := graphiteLines(m, nil, "1500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"sql_users.db_example_com.app.active 42 1500"}
+	if diff := pretty.Compare(expected, got); diff != "" {
+		t.Errorf("unexpected lines (-want +got):\n\n%s", diff)
+	}
+
+	tmpl := template.Must(template.New("path").Parse("legacy.{{.sql_job}}.{{.host}}.{{.__name__}}"))
+	if got, err = graphiteLines(m, tmpl, "1500"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"legacy.app.db_example_com.sql_users 42 1500"}
+	if diff := pretty.Compare(expected, got); diff != "" {
+		t.Errorf("unexpected lines (-want +got):\n\n%s", diff)
+	}
+}
+
+func TestJob_emitGraphite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		received <- string(buf)
+	}()
+
+	job := &Job{
+		Name:        "graphite",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{{
+			Name:   "answer",
+			Help:   "The answer",
+			Values: Values{{Column: "value"}},
+			Query:  "SELECT 42 AS value",
+		}},
+		Graphite: &Graphite{
+			Address: listener.Addr().String(),
+			Path:    "sql.{{.sql_job}}.{{.__name__}}",
+		},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !strings.HasPrefix(got, "sql.graphite.sql_answer 42 ") {
+		t.Errorf("unexpected lines %q", got)
+	}
+}
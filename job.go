@@ -1,33 +1,130 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/cenkalti/backoff"
-	_ "github.com/denisenkom/go-mssqldb" // register the MS-SQL driver
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/go-sql-driver/mysql" // register the MySQL driver
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"               // register the PostgreSQL driver
 	_ "github.com/mailru/go-clickhouse" // register the ClickHouse driver
+	_ "github.com/microsoft/go-mssqldb" // register the MS-SQL driver
 	"github.com/prometheus/client_golang/prometheus"
-	_ "github.com/segmentio/go-athena" // register the AWS Athena driver
+	"github.com/robfig/cron/v3"
+	_ "github.com/segmentio/go-athena"     // register the AWS Athena driver
+	_ "github.com/sijms/go-ora/v2"         // register the Oracle driver
+	_ "github.com/snowflakedb/gosnowflake" // register the Snowflake driver
+	_ "modernc.org/sqlite"                 // register the SQLite driver
+)
+
+const (
+	// jobModeInterval runs the queries of a job at its interval and caches
+	// the results until the next run
+	jobModeInterval = "interval"
+	// jobModePull runs the queries of a job on every scrape
+	jobModePull = "pull"
+	// defaultMetricPrefix is prepended to the query metric names unless a
+	// metric_prefix is configured
+	defaultMetricPrefix = "sql_"
 )
 
 var (
 	// MetricNameRE matches any invalid metric name
 	// characters, see github.com/prometheus/common/model.MetricNameRE
 	MetricNameRE = regexp.MustCompile("[^a-zA-Z0-9_:]+")
+	// LabelNameRE matches any invalid label name characters
+	LabelNameRE = regexp.MustCompile("[^a-zA-Z0-9_]")
+	// builtinLabels are added to the labels of each query metric unless
+	// they are dropped by the builtin_labels option
+	builtinLabels = []string{"driver", "host", "database", "user", "col"}
+	// targetInfoLabels are the labels of the target_info series of each
+	// connection, the target_labels of a job must not clash with them
+	targetInfoLabels = []string{"db_system", "server_address", "server_port", "db_name"}
+	// dbSystems maps driver names to the OpenTelemetry db.system values
+	dbSystems = map[string]string{
+		"postgres":   "postgresql",
+		"mysql":      "mysql",
+		"sqlserver":  "mssql",
+		"clickhouse": "clickhouse",
+		"athena":     "athena",
+		"sqlite":     "sqlite",
+		"oracle":     "oracle",
+		"snowflake":  "snowflake",
+		"bigquery":   "bigquery",
+	}
 )
 
+// metricPrefix returns the prefix of the query metric names. An empty
+// metric_prefix turns off the default.
+func (j *Job) metricPrefix() string {
+	if j.MetricPrefix == nil {
+		return defaultMetricPrefix
+	}
+	return *j.MetricPrefix
+}
+
 // Init will initialize the metric descriptors
 func (j *Job) Init(logger log.Logger, queries map[string]string) error {
+	if j.LogLevel != "" {
+		var err error
+		if logger, err = withLogLevel(logger, j.LogLevel); err != nil {
+			return err
+		}
+	}
 	j.log = log.With(logger, "job", j.Name)
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	j.queryCtx, j.cancelQueries = context.WithCancel(context.Background())
+	j.done = make(chan struct{})
+	if j.Timezone != "" {
+		loc, err := time.LoadLocation(j.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %v", j.Timezone, err)
+		}
+		j.location = loc
+	}
+	if j.Cron != "" {
+		schedule, err := cron.ParseStandard(j.Cron)
+		if err != nil {
+			return fmt.Errorf("invalid cron expression %q: %v", j.Cron, err)
+		}
+		j.schedule = schedule
+	}
+	if j.Auth != nil {
+		provider, err := newTokenProvider(j.Auth)
+		if err != nil {
+			return err
+		}
+		j.tokenProvider = provider
+	}
+	// resource attributes are exposed as target_info following the
+	// OpenTelemetry semantic conventions
+	targetLabels := prometheus.Labels{"sql_job": j.Name}
+	for k, v := range j.TargetLabels {
+		targetLabels[k] = v
+	}
+	j.targetInfoDesc = prometheus.NewDesc(
+		"sql_exporter_target_info",
+		"Target metadata of each connection",
+		targetInfoLabels,
+		targetLabels,
+	)
+	if violations := j.policy.jobViolations(j); len(violations) > 0 {
+		return fmt.Errorf("policy violated: %v", violations[0])
+	}
+	builtinKeys, builtinNames := j.builtinLabelNames()
+	prefix := j.metricPrefix()
 	// register each query as an metric
 	for _, q := range j.Queries {
 		if q == nil {
@@ -36,119 +133,685 @@ func (j *Job) Init(logger log.Logger, queries map[string]string) error {
 		}
 		q.log = log.With(j.log, "query", q.Name)
 		q.jobName = j.Name
+		q.interval = j.runInterval()
+		if q.Timeout == 0 {
+			q.Timeout = j.QueryTimeout
+		}
+		q.retries = j.Retries
+		if q.Retries != nil {
+			q.retries = *q.Retries
+		}
+		if q.RetryBackoff == 0 {
+			q.RetryBackoff = j.RetryBackoff
+		}
+		if q.OnNullValue == "" {
+			q.OnNullValue = j.OnNullValue
+		}
+		if q.OnNullLabel == "" {
+			q.OnNullLabel = j.OnNullLabel
+		}
+		q.location = j.location
+		q.ctx = j.queryCtx
+		q.notify = j.Notifications
 		if q.Query == "" && q.QueryRef != "" {
 			if qry, found := queries[q.QueryRef]; found {
 				q.Query = qry
 			}
 		}
-		if q.Query == "" {
+		if q.Query == "" && q.Procedure == nil {
 			level.Warn(q.log).Log("msg", "Skipping empty query")
 			continue
 		}
-		if q.metrics == nil {
-			// we have no way of knowing how many metrics will be returned by the
-			// queries, so we just assume that each query returns at least one metric.
-			// after the each round of collection this will be resized as necessary.
-			q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
-		}
-		// try to satisfy prometheus naming restrictions
-		name := MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
-		help := q.Help
-		// prepare a new metrics descriptor
-		//
-		// the tricky part here is that the *order* of labels has to match the
-		// order of label values supplied to NewConstMetric later
-		q.desc = prometheus.NewDesc(
-			name,
+		if violations := j.policy.queryViolations(q, queries); len(violations) > 0 {
+			level.Warn(q.log).Log("msg", "Skipping query violating the policy", "err", violations[0])
+			continue
+		}
+		q.vars = j.Vars
+		q.tmpl = nil
+		if q.Template {
+			tmpl, err := parseQueryTemplate(q.Name, q.Query, queries)
+			if err != nil {
+				return fmt.Errorf("invalid template of query %q: %v", q.Name, err)
+			}
+			q.tmpl = tmpl
+		}
+		for _, a := range q.Expect {
+			if a == nil {
+				continue
+			}
+			cond, err := parseCondition(a.Expr)
+			if err != nil {
+				return fmt.Errorf("invalid assertion %q of query %q: %v", a.Expr, q.Name, err)
+			}
+			a.cond = cond
+		}
+		keys, names := q.builtinLabelNames(builtinKeys, builtinNames)
+		q.builtin = keys
+		if err := j.initMetrics(q, prefix, names); err != nil {
+			return err
+		}
+		for _, rs := range q.ResultSets {
+			if rs == nil {
+				continue
+			}
+			rs.log = log.With(q.log, "result_set", rs.Name)
+			rs.jobName = j.Name
+			rs.interval = q.interval
+			rs.location = q.location
+			rs.ctx = q.ctx
+			if rs.OnNullValue == "" {
+				rs.OnNullValue = q.OnNullValue
+			}
+			if rs.OnNullLabel == "" {
+				rs.OnNullLabel = q.OnNullLabel
+			}
+			if rs.MaxAge == 0 {
+				rs.MaxAge = q.MaxAge
+			}
+			if rs.StaticLabels == nil {
+				rs.StaticLabels = q.StaticLabels
+			}
+			keys, names := rs.builtinLabelNames(builtinKeys, builtinNames)
+			rs.builtin = keys
+			if err := j.initMetrics(rs, prefix, names); err != nil {
+				return err
+			}
+		}
+	}
+	return j.initRegistry()
+}
+
+// initMetrics compiles the label transforms of the query and prepares its
+// metric descriptors.
+func (j *Job) initMetrics(q *Query, prefix string, builtinNames []string) error {
+	for _, label := range q.Labels {
+		if label.Regex != "" {
+			re, err := regexp.Compile(label.Regex)
+			if err != nil {
+				return fmt.Errorf("invalid regex for label %q of query %q: %v", label.Name, q.Name, err)
+			}
+			label.re = re
+		}
+		if label.Template == "" {
+			continue
+		}
+		tmpl, err := template.New(label.Name).Option("missingkey=zero").Parse(label.Template)
+		if err != nil {
+			return fmt.Errorf("invalid template for label %q of query %q: %v", label.Name, q.Name, err)
+		}
+		label.tmpl = tmpl
+	}
+	if q.metrics == nil {
+		// we have no way of knowing how many metrics will be returned by the
+		// queries, so we just assume that each query returns at least one metric.
+		// after the each round of collection this will be resized as necessary.
+		q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
+		q.updated = make(map[*connection]time.Time, len(j.Queries))
+	}
+	help := q.Help
+	// prepare a new metrics descriptor
+	//
+	// the tricky part here is that the *order* of labels has to match the
+	// order of label values supplied to NewConstMetric later
+	constLabels := q.constLabels(j)
+	newDesc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			// try to satisfy prometheus naming restrictions
+			MetricNameRE.ReplaceAllString(prefix+name, ""),
 			help,
-			append(q.Labels, "driver", "host", "database", "user", "col"),
-			prometheus.Labels{
-				"sql_job": j.Name,
-			},
+			append(append([]string{}, labels...), builtinNames...),
+			constLabels,
 		)
 	}
+	q.newDesc = func(name string, labels []string) *prometheus.Desc {
+		return newDesc(name, help, labels)
+	}
+	q.desc = q.newDesc(q.Name, q.Labels.Names())
+	if q.MetricNameLabel != "" {
+		q.desc = q.newDesc(q.Name, append(q.Labels.Names(), q.MetricNameLabel))
+	}
+	switch q.Type {
+	case metricTypeState:
+		q.desc = q.newDesc(q.Name, append(q.Labels.Names(), q.Name))
+	case metricTypeInfo:
+		q.desc = q.newDesc(infoName(q.Name), q.Labels.Names())
+	}
+	// values with their own name or help are separate metric families
+	for _, v := range q.Values {
+		if v.Name == "" && v.Help == "" {
+			continue
+		}
+		name, valueHelp := q.Name, help
+		if v.Name != "" {
+			name = v.Name
+		}
+		if v.Help != "" {
+			valueHelp = v.Help
+		}
+		v.desc = newDesc(name, valueHelp, q.Labels.Names())
+	}
 	return nil
 }
 
+// builtinLabelNames returns the built-in labels added to the metrics of the
+// job along with their exported names.
+func (j *Job) builtinLabelNames() (keys, names []string) {
+	for _, key := range builtinLabels {
+		name := key
+		if renamed, found := j.BuiltinLabels[key]; found {
+			name = renamed
+		}
+		// an empty name drops the label
+		if name == "" {
+			continue
+		}
+		keys = append(keys, key)
+		names = append(names, name)
+	}
+	return keys, names
+}
+
+// constLabels returns the labels shared by all metrics of the query. Static
+// labels of the query take precedence over the ones of the job.
+func (q *Query) constLabels(j *Job) prometheus.Labels {
+	labels := prometheus.Labels{"sql_job": j.Name}
+	for _, static := range []map[string]string{j.StaticLabels, q.StaticLabels} {
+		for k, v := range static {
+			labels[LabelNameRE.ReplaceAllString(k, "_")] = v
+		}
+	}
+	return labels
+}
+
 // Run prepares and runs the job
 func (j *Job) Run() {
 	if j.log == nil {
 		j.log = log.NewNopLogger()
 	}
 	// if there are no connection URLs for this job it can't be run
-	if j.Connections == nil {
-		level.Error(j.log).Log("msg", "No connections for job", "job", j.Name)
+	if j.Connections == nil && j.TargetsQuery == nil && j.KubernetesSD == nil {
+		level.Error(j.log).Log("msg", "No connections for job")
+		j.closeDone()
 		return
 	}
-	// make space for the connection objects
-	if j.conns == nil {
-		j.conns = make([]*connection, 0, len(j.Connections))
+	j.initConnections()
+	if j.Mode == jobModePull {
+		// queries are run by the exporter on every scrape
+		level.Debug(j.log).Log("msg", "Waiting for scrapes")
+		j.closeDone()
+		return
 	}
-	// parse the connection URLs and create an connection object for each
-	if len(j.conns) < len(j.Connections) {
-		for _, conn := range j.Connections {
-			// MySQL DSNs do not parse cleanly as URLs as of Go 1.12.8+
-			if strings.HasPrefix(conn, "mysql://") {
-				config, err := mysql.ParseDSN(strings.TrimPrefix(conn, "mysql://"))
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to parse MySQL DSN", "url", conn, "err", err)
-				}
 
-				j.conns = append(j.conns, &connection{
-					conn:     nil,
-					url:      conn,
-					driver:   "mysql",
-					host:     config.Addr,
-					database: config.DBName,
-					user:     config.User,
-				})
+	// the splay shifts all runs of the job by a random offset, so jobs with
+	// the same interval or schedule don't hit the databases all at once.
+	// Scheduled jobs wait for their first run, they don't export any metrics
+	// until then.
+	offset := randDuration(j.Splay)
+	planned := j.firstRun(offset)
+	if jobScheduler != nil {
+		// the workers of the scheduler run the job until it's stopped
+		level.Debug(j.log).Log("msg", "Scheduling")
+		jobScheduler.add(j, planned, offset)
+		return
+	}
+	level.Debug(j.log).Log("msg", "Starting")
+
+	// enter the run loop
+	// tries to run each query on each connection at approx the interval
+	defer j.finish()
+	for {
+		// the jitter delays a single run, the next one is planned from the
+		// planned start of this one so the runs don't drift
+		if !j.sleepUntil(planned.Add(randDuration(j.Jitter))) {
+			return
+		}
+		bo := backoff.NewExponentialBackOff()
+		// failed runs are retried until the next planned run at most
+		bo.MaxElapsedTime = j.retryWindow(planned, offset)
+		if err := backoff.Retry(j.runOnce, backoff.WithContext(bo, j.ctx)); err != nil {
+			level.Error(j.log).Log("msg", "Failed to run", "err", err)
+		}
+		planned = j.plannedAfter(planned, offset)
+	}
+}
+
+// firstRun returns the planned start of the first run of the job, shifted by
+// the offset of its splay.
+func (j *Job) firstRun(offset time.Duration) time.Time {
+	now := jobClock.Now()
+	if j.schedule != nil {
+		return j.nextRun(now).Add(offset)
+	}
+	return now.Add(offset)
+}
+
+// plannedAfter returns the planned start of the run following the one
+// planned at planned. Runs missed in the meantime, e.g. by a run taking
+// longer than the interval, are skipped.
+func (j *Job) plannedAfter(planned time.Time, offset time.Duration) time.Time {
+	now := jobClock.Now()
+	if j.schedule != nil {
+		after := planned.Add(-offset)
+		if now.Add(-offset).After(after) {
+			after = now.Add(-offset)
+		}
+		return j.nextRun(after).Add(offset)
+	}
+	if j.Interval <= 0 {
+		return now
+	}
+	next := planned.Add(j.Interval)
+	if next.Before(now) {
+		next = next.Add(now.Sub(next).Truncate(j.Interval) + j.Interval)
+	}
+	return next
+}
+
+// retryWindow returns how long a failed run planned at planned is retried,
+// until the next planned run.
+func (j *Job) retryWindow(planned time.Time, offset time.Duration) time.Duration {
+	window := j.plannedAfter(planned, offset).Sub(jobClock.Now())
+	if window <= 0 {
+		// a MaxElapsedTime of 0 would retry forever
+		return time.Nanosecond
+	}
+	return window
+}
+
+// finish closes the connections of a stopped job and signals that it's done.
+func (j *Job) finish() {
+	j.closeConnections()
+	j.closeDone()
+}
+
+func (j *Job) closeDone() {
+	if j.done != nil {
+		close(j.done)
+	}
+}
+
+// sleepUntil waits for the next run of the job at t. It returns false if the
+// job was stopped in the meantime.
+func (j *Job) sleepUntil(t time.Time) bool {
+	d := t.Sub(jobClock.Now())
+	if d <= 0 {
+		return j.ctx.Err() == nil
+	}
+	level.Debug(j.log).Log("msg", "Sleeping until next run", "sleep", d.String())
+	select {
+	case <-j.ctx.Done():
+		level.Debug(j.log).Log("msg", "Stopped")
+		return false
+	case <-jobClock.After(d):
+		return true
+	}
+}
+
+// clock is the time source of the run loops, which tests replace by a fake.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// jobClock is the clock of the run loops of the jobs
+var jobClock clock = systemClock{}
+
+// randDuration returns a random duration in [0, max).
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// nextRun returns the next time after t the cron schedule of the job is due,
+// evaluated in the timezone of the job.
+func (j *Job) nextRun(t time.Time) time.Time {
+	loc := time.UTC
+	if j.location != nil {
+		loc = j.location
+	}
+	return j.schedule.Next(t.In(loc))
+}
+
+// runInterval returns the interval of the job. For jobs with a cron schedule
+// it's the time between the next two scheduled runs.
+func (j *Job) runInterval() time.Duration {
+	if j.schedule == nil {
+		return j.Interval
+	}
+	next := j.nextRun(time.Now())
+	return j.nextRun(next).Sub(next)
+}
+
+// Stop stops the run loop of the job, cancels its running queries and closes
+// its connections.
+func (j *Job) Stop() {
+	j.release()
+	if jobScheduler != nil {
+		jobScheduler.remove(j)
+	}
+	if j.Mode == jobModePull {
+		j.scrapeMtx.Lock()
+		defer j.scrapeMtx.Unlock()
+		j.closeConnections()
+	}
+}
+
+// release cancels the contexts of the job, e.g. of a job initialized on
+// reload which isn't run because the running job of the same config is kept.
+func (j *Job) release() {
+	if j.cancel != nil {
+		j.cancel()
+	}
+	if j.cancelQueries != nil {
+		j.cancelQueries()
+	}
+}
+
+// Shutdown stops the job like Stop, but gives a running run until the context
+// is done to finish before its queries are cancelled. It returns once the
+// connections of the job are closed.
+func (j *Job) Shutdown(ctx context.Context) {
+	if j.cancel != nil {
+		j.cancel()
+	}
+	if jobScheduler != nil {
+		jobScheduler.remove(j)
+	}
+	finished := make(chan struct{})
+	go func() {
+		if j.done != nil {
+			<-j.done
+		}
+		// wait for a running scrape of pull mode jobs
+		j.scrapeMtx.Lock()
+		j.scrapeMtx.Unlock()
+		// the sinks are cancelled with the context of the job
+		j.sinks.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		level.Warn(j.log).Log("msg", "Cancelling running queries after the grace period")
+		if j.cancelQueries != nil {
+			j.cancelQueries()
+		}
+		<-finished
+	}
+	j.Stop()
+}
+
+// queryContext returns the context of the statements run by the job.
+func (j *Job) queryContext() context.Context {
+	if j.queryCtx == nil {
+		return context.Background()
+	}
+	return j.queryCtx
+}
+
+// closeConnections closes all database connections of the job.
+func (j *Job) closeConnections() {
+	j.Lock()
+	defer j.Unlock()
+	conns := j.conns
+	if j.targetsConn != nil {
+		conns = append(append([]*connection{}, conns...), j.targetsConn)
+	}
+	for _, conn := range conns {
+		for _, q := range j.Queries {
+			trackedSeries.forget(seriesOwner{q, conn})
+			if q == nil {
 				continue
 			}
-			u, err := url.Parse(conn)
+			for _, rs := range q.ResultSets {
+				trackedSeries.forget(seriesOwner{rs, conn})
+			}
+		}
+		conn.closeSessions()
+		if conn.conn == nil {
+			continue
+		}
+		if err := conn.conn.Close(); err != nil {
+			level.Warn(j.log).Log("msg", "Failed to close connection", "host", conn.host, "err", err)
+		}
+		conn.conn = nil
+	}
+}
+
+// forgetMetrics deletes the exporter metrics of the queries of the job on
+// the connection, e.g. of a vanished target.
+func (j *Job) forgetMetrics(conn *connection) {
+	key := strings.Join([]string{conn.driver, conn.host, conn.database, conn.user, j.Name}, "\xff")
+	deleteExporterMetrics(func(labelValues []string) bool {
+		return strings.Join(labelValues[:5], "\xff") == key
+	})
+}
+
+// exporterMetricKeys returns the exporter metric label values of the queries
+// of the job on each of its connections, joined by \xff.
+func (j *Job) exporterMetricKeys() map[string]bool {
+	j.Lock()
+	defer j.Unlock()
+	keys := make(map[string]bool, len(j.conns)*len(j.Queries))
+	for _, conn := range j.conns {
+		for _, q := range j.Queries {
+			if q != nil {
+				keys[strings.Join([]string{conn.driver, conn.host, conn.database, conn.user, j.Name, q.Name}, "\xff")] = true
+			}
+		}
+	}
+	return keys
+}
+
+// Scrape runs all queries of a pull mode job once. A scrape arriving while
+// another one is running waits for it and shares its results, so a slow
+// database isn't hit by overlapping runs.
+func (j *Job) Scrape() {
+	j.Lock()
+	if running := j.scraping; running != nil {
+		j.Unlock()
+		<-running
+		return
+	}
+	running := make(chan struct{})
+	j.scraping = running
+	j.Unlock()
+	defer func() {
+		j.Lock()
+		j.scraping = nil
+		j.Unlock()
+		close(running)
+	}()
+
+	j.scrapeMtx.Lock()
+	defer j.scrapeMtx.Unlock()
+	if j.ctx != nil && j.ctx.Err() != nil {
+		// the job was stopped
+		return
+	}
+	j.initConnections()
+	if err := j.runOnce(); err != nil {
+		level.Error(j.log).Log("msg", "Failed to run", "err", err)
+	}
+}
+
+// initConnections parses the connection URLs and creates a connection object
+// for each.
+func (j *Job) initConnections() {
+	j.Lock()
+	defer j.Unlock()
+	// make space for the connection objects
+	if j.conns == nil {
+		j.conns = make([]*connection, 0, len(j.Connections))
+	}
+	// the connections of DNS SRV records are created by the discovery
+	configs := make([]*ConnectionConfig, 0, len(j.Connections))
+	for _, cc := range j.Connections {
+		if cc != nil && !isDNSSRV(cc.URL) {
+			configs = append(configs, cc)
+		}
+	}
+	static := 0
+	for _, conn := range j.conns {
+		if !conn.discovered {
+			static++
+		}
+	}
+	if static < len(configs) {
+		for _, cc := range configs {
+			newConn, err := cc.newConnection()
 			if err != nil {
-				level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
+				level.Error(j.log).Log("msg", "Failed to parse connection", "err", err)
 				continue
 			}
-			user := ""
-			if u.User != nil {
-				user = u.User.Username()
-			}
-			// we expose some of the connection variables as labels, so we need to
-			// remember them
-			newConn := &connection{
-				conn:     nil,
-				url:      conn,
-				driver:   u.Scheme,
-				host:     u.Host,
-				database: strings.TrimPrefix(u.Path, "/"),
-				user:     user,
-			}
-			if newConn.driver == "athena" {
-				// call go-athena's Open() to ensure conn.db is set,
-				// otherwise API calls will complain about an empty database field:
-				// "InvalidParameter: 1 validation error(s) found. - minimum field size of 1, StartQueryExecutionInput.QueryExecutionContext.Database."
-				newConn.conn, err = sqlx.Open("athena", u.RawQuery)
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to open Athena connection", "connection", conn, "err", err)
-					continue
-				}
+			newConn.pool = j.Pool.merge(cc.Pool)
+			newConn.dial = j.Dial.merge(cc.Dial)
+			for _, member := range newConn.failover {
+				member.pool = newConn.pool
+				member.dial = newConn.dial.merge(member.dial)
 			}
 			j.conns = append(j.conns, newConn)
 		}
 	}
-	level.Debug(j.log).Log("msg", "Starting")
+}
 
-	// enter the run loop
-	// tries to run each query on each connection at approx the interval
-	for {
-		bo := backoff.NewExponentialBackOff()
-		bo.MaxElapsedTime = j.Interval
-		if err := backoff.Retry(j.runOnce, bo); err != nil {
-			level.Error(j.log).Log("msg", "Failed to run", "err", err)
+// newConnection creates the connection object of the config. A failover
+// group gets a member for each of its connections and carries the labels of
+// the first member until connected.
+func (cc *ConnectionConfig) newConnection() (*connection, error) {
+	if len(cc.Failover) == 0 {
+		conn, err := newConnection(cc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", redactDSN(cc.URL), redactError(err))
+		}
+		conn.address = conn.host
+		if cc.Alias != "" {
+			conn.host = cc.Alias
+		}
+		conn.readOnly = cc.ReadOnly
+		conn.dial = cc.Dial
+		return conn, nil
+	}
+	group := &connection{primaryCheckSQL: cc.PrimaryCheckSQL, readOnly: cc.ReadOnly}
+	for _, mc := range cc.Failover {
+		member, err := mc.newConnection()
+		if err != nil {
+			return nil, err
 		}
-		level.Debug(j.log).Log("msg", "Sleeping until next run", "sleep", j.Interval.String())
-		time.Sleep(j.Interval)
+		if cc.Alias != "" {
+			member.host = cc.Alias
+		}
+		member.readOnly = member.readOnly || cc.ReadOnly
+		group.failover = append(group.failover, member)
 	}
+	group.activate(group.failover[0])
+	return group, nil
+}
+
+// newConnection parses the connection URL. We expose some of the connection
+// variables as labels, so we need to remember them.
+func newConnection(conn string) (*connection, error) {
+	// MySQL DSNs do not parse cleanly as URLs as of Go 1.12.8+
+	if strings.HasPrefix(conn, "mysql://") {
+		config, err := mysql.ParseDSN(strings.TrimPrefix(conn, "mysql://"))
+		if err != nil {
+			return nil, err
+		}
+		// timestamps are returned in the zone of the loc parameter, an
+		// explicit one is taken for the zone of the values
+		loc := false
+		if i := strings.LastIndex(conn, "?"); i >= 0 {
+			params, _ := url.ParseQuery(conn[i+1:])
+			_, loc = params["loc"]
+		}
+		return &connection{
+			conn:     nil,
+			url:      conn,
+			driver:   "mysql",
+			host:     config.Addr,
+			database: config.DBName,
+			user:     config.User,
+			naiveUTC: !loc,
+		}, nil
+	}
+	// SQLite connections are files, the path isn't necessarily absolute
+	if strings.HasPrefix(conn, "sqlite://") {
+		path := strings.TrimPrefix(conn, "sqlite://")
+		if i := strings.Index(path, "?"); i >= 0 {
+			path = path[:i]
+		}
+		return &connection{
+			conn:     nil,
+			url:      conn,
+			driver:   "sqlite",
+			host:     path,
+			database: path,
+			naiveUTC: true,
+		}, nil
+	}
+	u, err := url.Parse(conn)
+	if err != nil {
+		return nil, err
+	}
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	newConn := &connection{
+		conn:     nil,
+		url:      conn,
+		driver:   u.Scheme,
+		host:     u.Host,
+		database: strings.TrimPrefix(u.Path, "/"),
+		user:     user,
+	}
+	if newConn.driver == "sqlserver" {
+		// the path is the instance name, the database is a parameter
+		newConn.database = u.Query().Get("database")
+		// datetime and datetime2 columns are returned in UTC,
+		// datetimeoffset columns in a fixed zone
+		newConn.naiveUTC = true
+		if instance := strings.TrimPrefix(u.Path, "/"); instance != "" {
+			newConn.host = u.Host + "/" + instance
+		}
+	}
+	if newConn.driver == "oracle" {
+		// the path is the service name, a SID or a full connect descriptor
+		// can be given as parameters instead
+		if sid := u.Query().Get("SID"); sid != "" {
+			newConn.database = sid
+		}
+		if connStr := u.Query().Get("connStr"); connStr != "" {
+			host, database := oracleDescriptor(connStr)
+			if host != "" {
+				newConn.host = host
+			}
+			if database != "" {
+				newConn.database = database
+			}
+		}
+	}
+	if newConn.driver == "snowflake" {
+		// the path holds the database and optionally the schema
+		newConn.database = strings.SplitN(newConn.database, "/", 2)[0]
+	}
+	if newConn.driver == "athena" {
+		// call go-athena's Open() to ensure conn.db is set,
+		// otherwise API calls will complain about an empty database field:
+		// "InvalidParameter: 1 validation error(s) found. - minimum field size of 1, StartQueryExecutionInput.QueryExecutionContext.Database."
+		newConn.conn, err = sqlx.Open("athena", u.RawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open Athena connection: %v", err)
+		}
+	}
+	return newConn, nil
 }
 
 func (j *Job) runOnceConnection(conn *connection, done chan int) {
@@ -157,6 +820,12 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 		done <- updated
 	}()
 
+	// the queries of a driver may be limited across all jobs
+	if !acquireDriverQuota(j.ctx, conn.driver) {
+		return
+	}
+	defer releaseDriverQuota(conn.driver)
+
 	// connect to DB if not connected already
 	if err := conn.connect(j); err != nil {
 		level.Warn(j.log).Log("msg", "Failed to connect", "err", err)
@@ -164,6 +833,41 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 		return
 	}
 
+	// the role is detected on every run, so the queries follow failovers.
+	// If it's unknown, the queries limited to a role fail.
+	role := ""
+	var roleErr error
+	if j.needsRole() {
+		var err error
+		if role, err = conn.role(j); err != nil {
+			level.Warn(j.log).Log("msg", "Failed to detect the server role", "host", conn.host, "err", err)
+			roleErr = fmt.Errorf("failed to detect the server role: %v", err)
+		}
+	}
+
+	// queries with their own user run in a separate session, which is
+	// connected before the queries start
+	failedSessions := make(map[*Query]bool)
+	for _, q := range j.Queries {
+		if q == nil || q.User == "" || !q.runsOnDriver(conn.driver) {
+			continue
+		}
+		if err := conn.connectSession(j, q); err != nil {
+			level.Warn(q.log).Log("msg", "Failed to connect session", "user", q.User, "err", err)
+			q.markFailed(conn, scrapeErrorConnect)
+			failedSessions[q] = true
+		}
+	}
+
+	// the queries run in parallel, limited by the concurrency of the
+	// connection
+	limit := conn.pool.concurrency()
+	if limit <= 0 {
+		limit = len(j.Queries)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var succeeded int32
 	for _, q := range j.Queries {
 		if q == nil {
 			continue
@@ -173,36 +877,100 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 			level.Warn(q.log).Log("msg", "Skipping query. Collector is nil")
 			continue
 		}
-		level.Debug(q.log).Log("msg", "Running Query")
-		// execute the query on the connection
-		if err := q.Run(conn); err != nil {
-			level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+		if failedSessions[q] {
 			continue
 		}
-		level.Debug(q.log).Log("msg", "Query finished")
-		updated++
+		if !q.runsOnDriver(conn.driver) {
+			// the query is written for the dialect of another driver
+			q.skip(conn)
+			atomic.AddInt32(&succeeded, 1)
+			continue
+		}
+		if !q.runsOn(role) && roleErr != nil {
+			q.markFailed(conn, scrapeErrorQuery)
+			q.recordRun(conn, time.Now(), 0, roleErr)
+			continue
+		}
+		if !q.runsOn(role) {
+			level.Debug(q.log).Log("msg", "Skipping query on this server role", "role", role)
+			q.skip(conn)
+			// skipped queries don't fail the run
+			atomic.AddInt32(&succeeded, 1)
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(q *Query) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			level.Debug(q.log).Log("msg", "Running Query")
+			// execute the query on the connection
+			if err := q.Run(conn); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+				return
+			}
+			level.Debug(q.log).Log("msg", "Query finished")
+			atomic.AddInt32(&succeeded, 1)
+		}(q)
+	}
+	wg.Wait()
+	updated = int(succeeded)
+}
+
+// emitSinks sends the current metrics to the push sinks in the background,
+// so slow sinks don't delay the next run. A run is skipped while the
+// metrics of the previous one are still being sent.
+func (j *Job) emitSinks() {
+	if j.StatsD == nil && j.Graphite == nil && j.CloudWatch == nil && j.GCPMonitoring == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&j.emitting, 0, 1) {
+		level.Warn(j.log).Log("msg", "Skipping sinks, the metrics of the previous run are still being sent")
+		return
 	}
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	j.sinks.Add(1)
+	go func() {
+		defer j.sinks.Done()
+		defer atomic.StoreInt32(&j.emitting, 0)
+		j.emitStatsD()
+		j.emitGraphite()
+		j.emitCloudWatch(ctx)
+		j.emitGCPMonitoring(ctx)
+	}()
 }
 
 func (j *Job) markFailed(conn *connection) {
 	for _, q := range j.Queries {
-		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+		q.markFailed(conn, scrapeErrorConnect)
 	}
 }
 
 func (j *Job) runOnce() error {
-	doneChan := make(chan int, len(j.conns))
+	if err := j.refreshTargets(); err != nil {
+		level.Warn(j.log).Log("msg", "Failed to discover targets", "err", err)
+	}
+	j.Lock()
+	conns := append([]*connection{}, j.conns...)
+	j.Unlock()
+	doneChan := make(chan int, len(conns))
 
 	// execute queries for each connection in parallel
-	for _, conn := range j.conns {
+	for _, conn := range conns {
 		go j.runOnceConnection(conn, doneChan)
 	}
 
 	// connections now run in parallel, wait for and collect results
 	updated := 0
-	for range j.conns {
+	for range conns {
 		updated += <-doneChan
 	}
+	j.emitSinks()
 
 	if updated < 1 {
 		return fmt.Errorf("zero queries ran")
@@ -210,7 +978,97 @@ func (j *Job) runOnce() error {
 	return nil
 }
 
+// Describe implements prometheus.Collector
+func (j *Job) Describe(ch chan<- *prometheus.Desc) {
+	if j.targetInfoDesc != nil {
+		ch <- j.targetInfoDesc
+	}
+	for _, query := range j.Queries {
+		if query == nil {
+			continue
+		}
+		if query.desc == nil {
+			level.Error(j.log).Log("msg", "Query has no descriptor", "query", query.Name)
+			continue
+		}
+		for _, q := range append([]*Query{query}, query.ResultSets...) {
+			// the metrics of unchecked queries are collected by the
+			// uncheckedCollector
+			if q == nil || q.desc == nil || q.unchecked() {
+				continue
+			}
+			ch <- q.desc
+			for _, v := range q.Values {
+				if v.desc != nil {
+					ch <- v.desc
+				}
+			}
+		}
+	}
+}
+
+// Collect implements prometheus.Collector. The metrics of unchecked queries
+// are left out, they are collected by the uncheckedCollector.
+func (j *Job) Collect(ch chan<- prometheus.Metric) {
+	j.collectTargetInfo(ch)
+	j.collectQueries(ch, false)
+}
+
+// collectQueries emits the metrics of the checked or unchecked queries and
+// result sets of the job.
+func (j *Job) collectQueries(ch chan<- prometheus.Metric, unchecked bool) {
+	match := func(q *Query) bool { return q.unchecked() == unchecked }
+	for _, query := range j.Queries {
+		if query == nil {
+			continue
+		}
+		for _, metric := range j.queryMetrics(query, match) {
+			ch <- metric
+		}
+	}
+}
+
+// collectTargetInfo emits one target_info series per connection of the job.
+func (j *Job) collectTargetInfo(ch chan<- prometheus.Metric) {
+	if j.targetInfoDesc == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	for _, conn := range j.conns {
+		address := conn.host
+		if conn.driver == "sqlserver" {
+			// the instance name follows the host and port
+			address = strings.SplitN(address, "/", 2)[0]
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			host, port = address, ""
+		}
+		system, ok := dbSystems[conn.driver]
+		if !ok {
+			system = conn.driver
+		}
+		m, err := prometheus.NewConstMetric(j.targetInfoDesc, prometheus.GaugeValue, 1.0, system, host, port, conn.database)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to create target_info", "err", err)
+			continue
+		}
+		ch <- m
+	}
+}
+
 func (c *connection) connect(job *Job) error {
+	if len(c.failover) > 0 {
+		return c.connectFailover(job)
+	}
+	// connections authenticated with an expired token can't reconnect, so
+	// they are replaced by a connection using a fresh token
+	if c.conn != nil && !c.tokenExpiry.IsZero() && time.Now().After(c.tokenExpiry) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.checkAlive(job)
 	// already connected
 	if c.conn != nil {
 		return nil
@@ -219,31 +1077,186 @@ func (c *connection) connect(job *Job) error {
 	var conn *sqlx.DB
 	var err error
 	dsn := c.url
+	var tokenExpiry time.Time
+	if job.tokenProvider != nil {
+		creds, expiry, err := tokens.get(job.tokenProvider, c, job.Auth.refreshBefore())
+		if err != nil {
+			return fmt.Errorf("failed to get auth token: %v", err)
+		}
+		if dsn, err = withCredentials(c.driver, dsn, creds.user, creds.password, creds.cleartext); err != nil {
+			return err
+		}
+		tokenExpiry = expiry
+	}
+	// the connection is verified by a ping, except for ClickHouse which
+	// connects lazily
+	ping := true
 	switch c.driver {
 	case "mysql":
 		dsn = strings.TrimPrefix(dsn, "mysql://")
-		conn, err = sqlx.Connect(c.driver, dsn)
+	case "sqlite":
+		dsn = strings.TrimPrefix(dsn, "sqlite://")
+	case "snowflake":
+		dsn = strings.TrimPrefix(dsn, "snowflake://")
 	case "clickhouse":
 		// TODO(masroor): support other schemes
 		dsn = fmt.Sprintf("http://%s", strings.TrimPrefix(dsn, "clickhouse://"))
-		conn, err = sqlx.Open(c.driver, dsn)
-	default:
-		conn, err = sqlx.Connect(c.driver, dsn)
+		ping = false
+	}
+	// StartupSQL is executed on every new session of the pool
+	startupSQL := job.StartupSQL.forDriver(c.driver)
+	if c.readOnly {
+		for _, statement := range startupSQL {
+			if err := checkReadOnly(statement); err != nil {
+				return fmt.Errorf("startup sql %q: %v", statement, err)
+			}
+		}
+		if statement := readOnlySessionSQL[c.driver]; statement != "" {
+			startupSQL = append(startupSQL, statement)
+		}
 	}
+	conn, err = openDB(job.log, c.driver, dsn, startupSQL, c.dial)
 	if err != nil {
 		return err
 	}
-	// be nice and don't use up too many connections for mere metrics
-	conn.SetMaxOpenConns(1)
-	conn.SetMaxIdleConns(1)
-	conn.SetConnMaxLifetime(job.Interval * 2)
-
-	// execute StartupSQL
-	for _, query := range job.StartupSQL {
-		level.Debug(job.log).Log("msg", "StartupSQL", "Query:", query)
-		conn.MustExec(query)
+	if ping {
+		if err := conn.Ping(); err != nil {
+			conn.Close()
+			return err
+		}
 	}
+	c.pool.apply(conn, job.runInterval())
 
 	c.conn = conn
+	c.tokenExpiry = tokenExpiry
+	if job.keepAliveCheck() > 0 {
+		c.checked = time.Now()
+		if c.resolved, err = c.resolve(); err != nil {
+			level.Warn(job.log).Log("msg", "Failed to resolve host of the connection", "host", c.host, "err", err)
+		}
+	}
+	return nil
+}
+
+// connectSession connects the session of a query with its own user. The
+// session uses the URL of the connection, so it follows failovers, with the
+// user and password of the query.
+func (c *connection) connectSession(job *Job, q *Query) error {
+	dsn, err := withCredentials(c.driver, c.url, q.User, q.password, false)
+	if err != nil {
+		return err
+	}
+	session := c.sessions[q.User]
+	if session != nil && session.url != dsn {
+		session.close()
+		session = nil
+	}
+	if session == nil {
+		session = &connection{
+			url:      dsn,
+			driver:   c.driver,
+			host:     c.host,
+			database: c.database,
+			user:     q.User,
+			address:  c.address,
+			pool:     c.pool,
+			dial:     c.dial,
+			readOnly: c.readOnly,
+		}
+		if c.sessions == nil {
+			c.sessions = make(map[string]*connection)
+		}
+		c.sessions[q.User] = session
+	}
+	return session.connect(job)
+}
+
+// closeSessions closes the sessions of the queries with their own user.
+func (c *connection) closeSessions() {
+	for user, session := range c.sessions {
+		session.close()
+		delete(c.sessions, user)
+	}
+}
+
+func (c *connection) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// connectFailover connects a failover group to its first reachable member
+// passing the primary check. The active member is checked again on every run,
+// so the group fails over once it's gone or demoted.
+func (c *connection) connectFailover(job *Job) error {
+	if c.conn != nil {
+		expired := !c.tokenExpiry.IsZero() && time.Now().After(c.tokenExpiry)
+		if !expired {
+			err := c.conn.Ping()
+			if err == nil {
+				err = c.checkPrimary(job)
+			}
+			if err == nil {
+				return nil
+			}
+			level.Warn(job.log).Log("msg", "Failover member unavailable", "host", c.host, "err", err)
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	var errs []string
+	for _, member := range c.failover {
+		if err := member.connect(job); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", member.address, err))
+			continue
+		}
+		c.activate(member)
+		// the group owns the connection from now on
+		member.conn = nil
+		if err := c.checkPrimary(job); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", member.address, err))
+			c.conn.Close()
+			c.conn = nil
+			continue
+		}
+		level.Debug(job.log).Log("msg", "Connected to failover member", "host", c.host)
+		return nil
+	}
+	return fmt.Errorf("no failover member available: %s", strings.Join(errs, "; "))
+}
+
+// activate makes the member the active one of the failover group.
+func (c *connection) activate(member *connection) {
+	c.conn = member.conn
+	c.url = member.url
+	c.driver = member.driver
+	c.host = member.host
+	c.database = member.database
+	c.user = member.user
+	c.address = member.address
+	c.tokenExpiry = member.tokenExpiry
+	c.naiveUTC = member.naiveUTC
+}
+
+// checkPrimary runs the primary check of the failover group on the active
+// connection, it must return true.
+func (c *connection) checkPrimary(job *Job) error {
+	if c.primaryCheckSQL == "" {
+		return nil
+	}
+	ctx := job.queryContext()
+	if job.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.QueryTimeout)
+		defer cancel()
+	}
+	var primary bool
+	if err := c.conn.QueryRowxContext(ctx, c.primaryCheckSQL).Scan(&primary); err != nil {
+		return fmt.Errorf("primary check failed: %v", err)
+	}
+	if !primary {
+		return fmt.Errorf("not the primary")
+	}
 	return nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultKeepAliveCheck is the interval of the checks of kept connections
+const defaultKeepAliveCheck = time.Minute
+
+// lookupHost resolves a host name, replaced by tests
+var lookupHost = net.LookupHost
+
+// keepAliveCheck returns the interval at which the kept connections of the
+// job are checked, 0 if they aren't.
+func (j *Job) keepAliveCheck() time.Duration {
+	if !j.KeepAlive {
+		return 0
+	}
+	if j.KeepAliveCheck > 0 {
+		return j.KeepAliveCheck
+	}
+	return defaultKeepAliveCheck
+}
+
+// checkAlive pings the connection and resolves its host again once the check
+// interval of the job passed. The connection is closed if the ping fails or
+// the host resolves to other addresses, e.g. after a failover behind a CNAME
+// or VIP, so it's connected again instead of using a stale server.
+func (c *connection) checkAlive(job *Job) {
+	interval := job.keepAliveCheck()
+	if interval <= 0 || c.conn == nil || time.Since(c.checked) < interval {
+		return
+	}
+	c.checked = time.Now()
+	timeout := job.QueryTimeout
+	if timeout <= 0 {
+		timeout = interval
+	}
+	ctx, cancel := context.WithTimeout(job.queryContext(), timeout)
+	defer cancel()
+	if err := c.conn.PingContext(ctx); err != nil {
+		level.Warn(job.log).Log("msg", "Keepalive check failed, reconnecting", "host", c.host, "db", c.database, "err", err)
+		c.closeSessions()
+		c.close()
+		return
+	}
+	addrs, err := c.resolve()
+	if err != nil {
+		// the connection keeps working while DNS is unavailable
+		level.Warn(job.log).Log("msg", "Failed to resolve host of the connection", "host", c.host, "err", err)
+		return
+	}
+	if c.resolved != nil && !equalStrings(addrs, c.resolved) {
+		level.Info(job.log).Log("msg", "Host resolves to other addresses, reconnecting", "host", c.host, "db", c.database, "addresses", strings.Join(addrs, ","))
+		c.closeSessions()
+		c.close()
+	}
+	c.resolved = addrs
+}
+
+// resolve returns the addresses the host of the connection resolves to, nil
+// for file based and mock databases.
+func (c *connection) resolve() ([]string, error) {
+	if c.driver == "sqlite" || c.driver == "mock" {
+		return nil, nil
+	}
+	return resolveAddress(c.address)
+}
+
+// resolveAddress returns the sorted addresses of the host of the address.
+// IP addresses and empty hosts, e.g. of sockets, aren't resolved and return
+// nil.
+func resolveAddress(address string) ([]string, error) {
+	// the instance name of sqlserver follows the port
+	host := strings.SplitN(address, "/", 2)[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil, nil
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
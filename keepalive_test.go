@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func Test_checkAlive(t *testing.T) {
+	job := &Job{
+		Name:           "keepalive",
+		KeepAlive:      true,
+		KeepAliveCheck: time.Millisecond,
+		Interval:       time.Minute,
+		Connections:    []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:        []*Query{{Name: "one", Help: "One", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value"}},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+
+	// a broken connection is replaced
+	db := conn.conn
+	db.Close()
+	time.Sleep(2 * time.Millisecond)
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	if conn.conn == db {
+		t.Errorf("expected the failed connection to be replaced")
+	}
+
+	// a connection to a host resolving to other addresses is closed
+	defer func() { lookupHost = net.LookupHost }()
+	lookupHost = func(host string) ([]string, error) {
+		if host != "db.example.com" {
+			t.Errorf("unexpected lookup of %q", host)
+		}
+		return []string{"10.0.0.2", "10.0.0.1"}, nil
+	}
+	conn.driver = "postgres"
+	conn.address = "db.example.com:5432"
+	conn.resolved = []string{"10.0.0.1", "10.0.0.2"}
+	time.Sleep(2 * time.Millisecond)
+	conn.checkAlive(job)
+	if conn.conn == nil {
+		t.Fatalf("expected the connection to be kept while the addresses are unchanged")
+	}
+	conn.resolved = []string{"10.0.0.1"}
+	time.Sleep(2 * time.Millisecond)
+	conn.checkAlive(job)
+	if conn.conn != nil {
+		t.Errorf("expected the connection to be closed after the addresses changed")
+	}
+}
+
+func Test_resolveAddress(t *testing.T) {
+	defer func() { lookupHost = net.LookupHost }()
+	lookupHost = func(host string) ([]string, error) {
+		return []string{"10.0.0.2", "10.0.0.1"}, nil
+	}
+	for _, tc := range []struct {
+		address  string
+		expected int
+	}{
+		{address: "db.example.com:5432", expected: 2},
+		{address: "db.example.com:1433/instance", expected: 2},
+		{address: "db", expected: 2},
+		{address: "10.0.0.1:5432", expected: 0},
+		{address: "[::1]:5432", expected: 0},
+		{address: "", expected: 0},
+	} {
+		addrs, err := resolveAddress(tc.address)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.address, err)
+		}
+		if len(addrs) != tc.expected {
+			t.Errorf("%s: expected %d addresses, got %v", tc.address, tc.expected, addrs)
+		}
+		if len(addrs) == 2 && addrs[0] != "10.0.0.1" {
+			t.Errorf("%s: expected sorted addresses, got %v", tc.address, addrs)
+		}
+	}
+}
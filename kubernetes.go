@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	kubernetesRoleEndpoints = "endpoints"
+	kubernetesRoleService   = "service"
+
+	// files of the service account mounted into every pod
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesServiceNameLabel names the service of an EndpointSlice
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+
+	defaultKubernetesTimeout = 30 * time.Second
+)
+
+// kubernetesTarget is a discovered database, it's passed to the DSN template.
+type kubernetesTarget struct {
+	Name      string            // name of the service
+	Namespace string            // namespace of the service
+	Address   string            // IP of the pod, or DNS name of the service
+	Port      int               // port of the database
+	PodName   string            // name of the pod, endpoints role only
+	Labels    map[string]string // labels of the service
+}
+
+func (sd *KubernetesSD) validate() error {
+	if sd.DSN == "" {
+		return fmt.Errorf("dsn is required")
+	}
+	if _, err := template.New("dsn").Parse(sd.DSN); err != nil {
+		return fmt.Errorf("invalid dsn template: %v", err)
+	}
+	if sd.Role != "" && sd.Role != kubernetesRoleEndpoints && sd.Role != kubernetesRoleService {
+		return fmt.Errorf("unknown role %q, must be %s or %s", sd.Role, kubernetesRoleEndpoints, kubernetesRoleService)
+	}
+	if sd.TLS != nil && sd.TLS.Mode != "" && sd.TLS.Mode != "require" && sd.TLS.Mode != "verify-full" {
+		return fmt.Errorf("tls mode %q is not supported, must be require or verify-full", sd.TLS.Mode)
+	}
+	if sd.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must not be negative")
+	}
+	return nil
+}
+
+// kubernetesClient reads objects from the Kubernetes API server.
+type kubernetesClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// newKubernetesClient returns a client for the configured API server, or the
+// one of the cluster the exporter runs in.
+func newKubernetesClient(sd *KubernetesSD) (*kubernetesClient, error) {
+	c := &kubernetesClient{server: sd.APIServer, tokenFile: sd.BearerTokenFile}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if c.server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("api_server is required outside of Kubernetes")
+		}
+		c.server = "https://" + net.JoinHostPort(host, port)
+		if c.tokenFile == "" {
+			c.tokenFile = kubernetesServiceAccountDir + "/token"
+		}
+		pem, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the service account")
+		}
+	}
+	if sd.TLS != nil {
+		u, err := url.Parse(c.server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api_server: %v", err)
+		}
+		if transport.TLSClientConfig, err = sd.TLS.clientConfig(u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	c.client = &http.Client{Transport: transport, Timeout: defaultKubernetesTimeout}
+	return c, nil
+}
+
+// get decodes the object at the path of the API server into v. The token is
+// read on every request, so rotated tokens are picked up.
+func (c *kubernetesClient) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(c.server, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.tokenFile != "" {
+		token, err := readSecretFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubernetesMetadata is the metadata of Kubernetes objects
+type kubernetesMetadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type kubernetesPort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+// targets lists the databases selected by the discovery. The targets are
+// listed instead of watched, since they are only used at the start of each
+// run of the job: a watch would keep a connection to the API server open
+// for changes nobody reads until then. refresh_interval limits the requests
+// of frequent runs.
+func (sd *KubernetesSD) targets(ctx context.Context, c *kubernetesClient) ([]kubernetesTarget, error) {
+	namespace := sd.Namespace
+	if namespace == "" && sd.APIServer == "" {
+		buf, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(buf))
+	}
+	path := "/api/v1/"
+	if sd.Role != kubernetesRoleService {
+		path = "/apis/discovery.k8s.io/v1/"
+	}
+	if namespace != "" {
+		path += "namespaces/" + url.PathEscape(namespace) + "/"
+	}
+	query := url.Values{}
+	if sd.LabelSelector != "" {
+		query.Set("labelSelector", sd.LabelSelector)
+	}
+
+	var targets []kubernetesTarget
+	if sd.Role == kubernetesRoleService {
+		var list struct {
+			Items []struct {
+				Metadata kubernetesMetadata `json:"metadata"`
+				Spec     struct {
+					Ports []kubernetesPort `json:"ports"`
+				} `json:"spec"`
+			} `json:"items"`
+		}
+		if err := c.get(ctx, path+"services", query, &list); err != nil {
+			return nil, err
+		}
+		for _, svc := range list.Items {
+			port, found := sd.selectPort(svc.Spec.Ports)
+			if !found {
+				continue
+			}
+			targets = append(targets, kubernetesTarget{
+				Name:      svc.Metadata.Name,
+				Namespace: svc.Metadata.Namespace,
+				Address:   svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc",
+				Port:      port,
+				Labels:    svc.Metadata.Labels,
+			})
+		}
+		return targets, nil
+	}
+
+	// the EndpointSlices carry the labels of their service
+	var list struct {
+		Items []struct {
+			Metadata  kubernetesMetadata `json:"metadata"`
+			Endpoints []struct {
+				Addresses  []string `json:"addresses"`
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+				TargetRef *struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"targetRef"`
+			} `json:"endpoints"`
+			Ports []kubernetesPort `json:"ports"`
+		} `json:"items"`
+	}
+	if err := c.get(ctx, path+"endpointslices", query, &list); err != nil {
+		return nil, err
+	}
+	for _, slice := range list.Items {
+		port, found := sd.selectPort(slice.Ports)
+		if !found {
+			continue
+		}
+		name := slice.Metadata.Labels[kubernetesServiceNameLabel]
+		if name == "" {
+			name = slice.Metadata.Name
+		}
+		for _, ep := range slice.Endpoints {
+			// pods come and go with their readiness, an unknown readiness
+			// counts as ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			// the addresses of an endpoint are fungible
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			target := kubernetesTarget{
+				Name:      name,
+				Namespace: slice.Metadata.Namespace,
+				Address:   ep.Addresses[0],
+				Port:      port,
+				Labels:    slice.Metadata.Labels,
+			}
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				target.PodName = ep.TargetRef.Name
+			}
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// selectPort returns the port with the configured name, or the first port if
+// no name is configured.
+func (sd *KubernetesSD) selectPort(ports []kubernetesPort) (int, bool) {
+	for _, p := range ports {
+		if sd.Port == "" || p.Name == sd.Port {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// kubernetesTargets returns the connections of the databases discovered in
+// Kubernetes, their URLs are rendered by the DSN template.
+func (j *Job) kubernetesTargets() ([]*ConnectionConfig, error) {
+	sd := j.KubernetesSD
+	if sd.client == nil {
+		c, err := newKubernetesClient(sd)
+		if err != nil {
+			return nil, err
+		}
+		sd.client = c
+	}
+	tmpl, err := template.New("dsn").Option("missingkey=error").Parse(sd.DSN)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := sd.targets(j.queryContext(), sd.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Kubernetes targets: %v", err)
+	}
+	configs := make([]*ConnectionConfig, 0, len(targets))
+	for _, target := range targets {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, target); err != nil {
+			return nil, fmt.Errorf("failed to render the dsn of %s/%s: %v", target.Namespace, target.Name, err)
+		}
+		cc := &ConnectionConfig{URL: buf.String()}
+		// discovered URLs aren't trusted with reading files
+		if err := cc.resolve(j.PasswordFile, false); err != nil {
+			level.Warn(j.log).Log("msg", "Skipping discovered target", "err", err)
+			continue
+		}
+		configs = append(configs, cc)
+	}
+	return configs, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testEndpointSlicesJSON = `{
+  "kind": "EndpointSliceList",
+  "items": [{
+    "metadata": {"name": "db-x7k2p", "namespace": "prod", "labels": {"app": "sqlite", "kubernetes.io/service-name": "db"}},
+    "addressType": "IPv4",
+    "endpoints": [%s, {"addresses": ["10.0.0.9"], "conditions": {"ready": false}, "targetRef": {"kind": "Pod", "name": "db-9"}}],
+    "ports": [{"name": "metrics", "port": 9100}, {"name": "sql", "port": 5432}]
+  }]
+}`
+
+func TestJob_kubernetesTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pods := []string{"db-0", "db-1"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices" || r.URL.Query().Get("labelSelector") != "app=sqlite" {
+			http.NotFound(w, r)
+			return
+		}
+		var endpoints []string
+		for i, pod := range pods {
+			endpoints = append(endpoints, fmt.Sprintf(`{"addresses": ["10.0.0.%d"], "conditions": {"ready": true}, "targetRef": {"kind": "Pod", "name": %q}}`, i+1, pod))
+		}
+		fmt.Fprintf(w, testEndpointSlicesJSON, strings.Join(endpoints, ","))
+	}))
+	defer server.Close()
+
+	in := `
+jobs:
+- name: "pods"
+  interval: '5m'
+  kubernetes_sd:
+    api_server: '` + server.URL + `'
+    bearer_token_file: '` + tokenFile + `'
+    namespace: 'prod'
+    label_selector: 'app=sqlite'
+    port: 'sql'
+    dsn: 'sqlite://` + dir + `/{{.Name}}-{{.PodName}}-{{.Port}}.db'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+	f, err := parseConfig(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	q := job.Queries[0]
+	if len(job.conns) != 2 || len(q.metrics) != 2 {
+		t.Fatalf("expected metrics of 2 pods, got %d connections and %d results", len(job.conns), len(q.metrics))
+	}
+	if job.conns[0].database != filepath.Join(dir, "db-db-0-5432.db") {
+		t.Errorf("unexpected database %q of the first pod", job.conns[0].database)
+	}
+
+	pods = pods[:1]
+	kept := job.conns[0]
+	if err := job.runOnce(); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(job.conns) != 1 || job.conns[0] != kept || len(q.metrics) != 1 {
+		t.Errorf("expected the removed pod to be dropped, got %d connections and %d results", len(job.conns), len(q.metrics))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// logLevels are the recognized log levels, from the lowest to the highest
+// severity
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logLevelKey overrides the level allowed by the levelFilter when it's in the
+// context of a logger, e.g. of a job with its own log_level.
+type logLevelKey struct{}
+
+// newBaseLogger returns a logger writing logfmt or JSON to w.
+func newBaseLogger(w io.Writer, format string) (log.Logger, error) {
+	switch format {
+	case "json":
+		return log.NewJSONLogger(w), nil
+	case "logfmt":
+		return log.NewLogfmtLogger(w), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, must be logfmt or json", format)
+}
+
+// parseLogLevel returns the severity of the level, 0 for an empty level
+// allowing all lines. warning is accepted for warn.
+func parseLogLevel(lvl string) (int, error) {
+	lvl = strings.ToLower(lvl)
+	if lvl == "warning" {
+		lvl = "warn"
+	}
+	if lvl == "" {
+		return 0, nil
+	}
+	for severity, l := range logLevels {
+		if l == lvl {
+			return severity, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", lvl, strings.Join(logLevels, ", "))
+}
+
+// withLevel filters the log lines of the base logger by level and adds the
+// timestamp and caller. An empty level allows all lines.
+func withLevel(base log.Logger, lvl string) (log.Logger, error) {
+	allowed, err := parseLogLevel(lvl)
+	if err != nil {
+		return nil, err
+	}
+	// the caller must be added last, so it's resolved relative to the
+	// Log call of the application
+	return log.With(levelFilter{next: base, allowed: allowed},
+		"ts", log.DefaultTimestampUTC,
+		"caller", log.DefaultCaller,
+	), nil
+}
+
+// withLogLevel returns a logger whose lines are filtered by the given level
+// instead of the level of the logger, see levelFilter.
+func withLogLevel(logger log.Logger, lvl string) (log.Logger, error) {
+	allowed, err := parseLogLevel(lvl)
+	if err != nil {
+		return nil, err
+	}
+	return log.With(logger, logLevelKey{}, allowed), nil
+}
+
+// levelFilter drops the log lines below the allowed severity. The severity
+// is overridden by the logLevelKey in the context of the logger, which is
+// removed from the line. Lines without level are always logged.
+type levelFilter struct {
+	next    log.Logger
+	allowed int
+}
+
+func (l levelFilter) Log(keyvals ...interface{}) error {
+	allowed, severity := l.allowed, -1
+	out := make([]interface{}, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			out = append(out, keyvals[i])
+			break
+		}
+		switch keyvals[i] {
+		case logLevelKey{}:
+			if a, ok := keyvals[i+1].(int); ok {
+				allowed = a
+			}
+			continue
+		case level.Key():
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				severity, _ = parseLogLevel(v.String())
+			}
+		}
+		out = append(out, keyvals[i], keyvals[i+1])
+	}
+	if severity >= 0 && severity < allowed {
+		return nil
+	}
+	return l.next.Log(out...)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestJob_Init_logLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := withLevel(log.NewLogfmtLogger(&buf), "warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verbose := &Job{Name: "verbose", LogLevel: "debug"}
+	quiet := &Job{Name: "quiet", LogLevel: "error"}
+	other := &Job{Name: "other"}
+	for _, job := range []*Job{verbose, quiet, other} {
+		if err := job.Init(logger, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	level.Debug(verbose.log).Log("msg", "verbose debug")
+	level.Warn(quiet.log).Log("msg", "quiet warn")
+	level.Error(quiet.log).Log("msg", "quiet error")
+	level.Info(other.log).Log("msg", "other info")
+	level.Warn(other.log).Log("msg", "other warn")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got %q", lines)
+	}
+	for i, msg := range []string{"verbose debug", "quiet error", "other warn"} {
+		if !strings.Contains(lines[i], `msg="`+msg+`"`) {
+			t.Errorf("expected line %d to be %q, got %q", i, msg, lines[i])
+		}
+		if !strings.Contains(lines[i], "caller=logging_test.go") {
+			t.Errorf("expected the caller of line %d to be the test, got %q", i, lines[i])
+		}
+	}
+	if strings.Contains(buf.String(), "{}") {
+		t.Errorf("expected the log level override to be removed, got %q", buf.String())
+	}
+}
+
+func Test_parseLogLevel(t *testing.T) {
+	for lvl, expected := range map[string]int{"": 0, "debug": 0, "INFO": 1, "warn": 2, "warning": 2, "error": 3} {
+		if got, err := parseLogLevel(lvl); err != nil || got != expected {
+			t.Errorf("%q: expected %d, got %d, %v", lvl, expected, got, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("expected error for unknown log level")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,7 +20,10 @@ import (
 )
 
 func init() {
+	setBuildInfo()
 	prometheus.MustRegister(version.NewCollector("sql_exporter"))
+	// the splay and jitter of the jobs must differ between replicas
+	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
@@ -23,47 +31,203 @@ func main() {
 		showVersion   = flag.Bool("version", false, "Print version information.")
 		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		openMetrics   = flag.Bool("web.enable-open-metrics", false, "Serve the OpenMetrics format to scrapers requesting it, which is required for exemplars.")
+		webConfigFile = flag.String("web.config.file", "", "Path to a web config file enabling TLS and basic auth.")
+		triggerToken  = flag.String("web.query-trigger.token-file", "", "File of the bearer token required to run queries on demand with POST /jobs/{job}/queries/{query}/run. The endpoint is disabled without it.")
 		configFile    = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
+		configEnv     = flag.String("config.environment", os.Getenv("CONFIG_ENV"), "Environment whose overrides of the environments section are merged into the config. Defaults to CONFIG_ENV.")
+		packs         = flag.String("packs.dir", "", "Directory of query packs included by the jobs, which take precedence over the bundled packs.")
+		strict        = flag.Bool("strict-policy", false, "Refuse to load a config with statements violating its policy, instead of skipping them.")
+		configDir     = flag.String("config.dir", "", "Directory of configuration files which are merged, used instead of config.file.")
+		jobs          = flag.String("jobs", "", "Comma separated names of the jobs to run, defaults to all enabled jobs.")
+		snapshotFile  = flag.String("snapshot.file", "", "Fetch a diagnostics snapshot from the exporter running at web.listen-address, write it to this file and exit.")
+		checkConfig   = flag.String("check-config", "", "Validate this configuration file without connecting to any database, print all problems and exit.")
+		dryRun        = flag.Bool("dry-run", false, "Run all queries once, print the resulting metrics to stdout and exit.")
+		logLevel      = flag.String("log.level", os.Getenv("LOGLEVEL"), "Only log messages with the given severity or above, one of debug, info, warn or error. Defaults to LOGLEVEL.")
+		logFormat     = flag.String("log.format", "json", "Output format of the log messages, logfmt or json.")
+		once          = flag.Bool("once", false, "Run all jobs once and exit, with a non-zero code if any query failed.")
+		pushGateway   = flag.String("push.gateway-url", "", "Pushgateway URL the metrics are pushed to in once mode.")
+		pushJob       = flag.String("push.job", "sql_exporter", "Job name of the metrics pushed to the Pushgateway.")
+		maxMem        = flag.String("max-memory", "", "Heap size like 2GiB above which queries are aborted while reading their rows, instead of exhausting the memory. Unlimited by default.")
+		workers       = flag.Int("max-workers", 0, "Number of workers running the jobs, instead of a goroutine per job. Unlimited by default.")
+		driverWorkers = flag.String("max-driver-workers", "", "Comma separated number of connections of a driver queried at once across all jobs, e.g. postgres=10,mysql=5.")
+		shutdownGrace = flag.Duration("shutdown.grace-period", 30*time.Second, "Time running queries and requests get to finish on shutdown before they are cancelled.")
+		noGoMetrics   = flag.Bool("metrics.disable-go", false, "Don't export the go_* metrics of the Go runtime.")
+		noProcMetrics = flag.Bool("metrics.disable-process", false, "Don't export the process_* metrics of the exporter process.")
 	)
 
 	flag.Parse()
 
+	// the test subcommand runs the queries on fixtures instead of databases,
+	// e.g. sql_exporter -config.file config.yml test -dir testdata
+	testCmd := flag.Arg(0) == "test"
+	testFlags := flag.NewFlagSet("test", flag.ExitOnError)
+	testDir := testFlags.String("dir", "testdata", "Directory of the fixtures and golden files of the jobs.")
+	testUpdate := testFlags.Bool("update", false, "Write the golden files instead of comparing the metrics to them.")
+	if testCmd {
+		testFlags.Parse(flag.Args()[1:])
+	}
+
+	if *configDir != "" {
+		*configFile = *configDir
+	}
+	configEnvironment = *configEnv
+	packsDir = *packs
+	strictPolicy = *strict
+	if *maxMem != "" {
+		limit, err := parseByteSize(*maxMem)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid max-memory:", err)
+			os.Exit(1)
+		}
+		setMaxMemory(limit)
+	}
+	var selectedJobs []string
+	if *jobs != "" {
+		selectedJobs = strings.Split(*jobs, ",")
+	}
+	unregisterRuntimeCollectors(prometheus.DefaultRegisterer, !*noGoMetrics, !*noProcMetrics)
+
 	if *showVersion {
 		fmt.Fprintln(os.Stdout, version.Print("sql_exporter"))
 		os.Exit(0)
 	}
 
+	if *checkConfig != "" {
+		problems := CheckConfig(*checkConfig)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, "Config is valid")
+		os.Exit(0)
+	}
+
+	if *snapshotFile != "" {
+		if err := FetchSnapshot(*listenAddress, *snapshotFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Error fetching snapshot:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// init logger
-	logger := log.NewJSONLogger(os.Stdout)
-	// set the allowed log level filter
-	switch strings.ToLower(os.Getenv("LOGLEVEL")) {
-	case "debug":
-		logger = level.NewFilter(logger, level.AllowDebug())
-	case "info":
-		logger = level.NewFilter(logger, level.AllowInfo())
-	case "warn":
-		logger = level.NewFilter(logger, level.AllowWarn())
-	case "error":
-		logger = level.NewFilter(logger, level.AllowError())
-	default:
-		logger = level.NewFilter(logger, level.AllowAll())
-	}
-	logger = log.With(logger,
-		"ts", log.DefaultTimestampUTC,
-		"caller", log.DefaultCaller,
-	)
+	logOutput := os.Stdout
+	if *dryRun || testCmd {
+		// stdout is reserved for the metrics and test results
+		logOutput = os.Stderr
+	}
+	base, err := newBaseLogger(logOutput, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger, err := withLevel(base, *logLevel)
+	if err != nil {
+		// like before the log.level flag, unknown levels log all lines
+		logger, _ = withLevel(base, "")
+		level.Warn(logger).Log("msg", "Logging all messages", "err", err)
+	}
 
 	logger.Log("msg", "Starting sql_exporter", "version_info", version.Info(), "build_context", version.BuildContext())
 
-	exporter, err := NewExporter(logger, *configFile)
+	if *driverWorkers != "" {
+		quotas, err := parseDriverQuotas(*driverWorkers)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid max-driver-workers", "err", err)
+			os.Exit(1)
+		}
+		setDriverQuotas(quotas)
+	}
+
+	if testCmd {
+		if err := RunTests(logger, *configFile, selectedJobs, *testDir, *testUpdate, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Tests failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *dryRun {
+		if err := DryRun(logger, *configFile, selectedJobs, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "Error running queries", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *once {
+		if err := RunOnce(logger, *configFile, selectedJobs, *pushGateway, *pushJob); err != nil {
+			level.Error(logger).Log("msg", "Error running jobs", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	webConfig := &WebConfig{}
+	if *webConfigFile != "" {
+		if webConfig, err = ReadWebConfig(*webConfigFile); err != nil {
+			level.Error(logger).Log("msg", "Error reading web config", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *workers > 0 {
+		jobScheduler = newScheduler(*workers)
+	}
+
+	exporter, err := NewExporter(logger, *configFile, selectedJobs)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error starting exporter", "err", err)
 		os.Exit(1)
 	}
-	prometheus.MustRegister(exporter)
 
-	// setup and start webserver
-	http.Handle(*metricsPath, promhttp.Handler())
+	// setup and start webserver. Every job has a registry of its own, the
+	// metrics of the jobs are merged with the ones of the exporter on scrape
+	// and a job failing to collect only drops its own metrics.
+	handlerOpts := promhttp.HandlerOpts{EnableOpenMetrics: *openMetrics, ErrorHandling: promhttp.ContinueOnError}
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(exporter.metricsGatherer(), handlerOpts)))
+	jobMetricsPath := strings.TrimSuffix(*metricsPath, "/") + "/"
+	http.Handle(jobMetricsPath, exporter.JobMetricsHandler(jobMetricsPath, handlerOpts))
+	// reload the config on SIGHUP and on POST requests to /-/reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := exporter.Reload(); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded config")
+		}
+	}()
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := exporter.Reload(); err != nil {
+			level.Error(logger).Log("msg", "Error reloading config", "err", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		level.Info(logger).Log("msg", "Reloaded config")
+	})
+	http.HandleFunc("/api/snapshot", exporter.SnapshotHandler)
+	http.HandleFunc("/metrics.json", exporter.JSONHandler)
+	http.HandleFunc("/status", exporter.StatusHandler)
+	if *triggerToken != "" {
+		buf, err := ioutil.ReadFile(*triggerToken)
+		if err != nil || strings.TrimSpace(string(buf)) == "" {
+			level.Error(logger).Log("msg", "Error reading the query trigger token", "file", *triggerToken, "err", err)
+			os.Exit(1)
+		}
+		http.Handle("/jobs/", exporter.TriggerHandler(strings.TrimSpace(string(buf))))
+	}
+	http.HandleFunc("/probe", exporter.ProbeHandler)
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -71,14 +235,44 @@ func main() {
 		<body>
 		<h1>SQL Exporter</h1>
 		<p><a href="` + *metricsPath + `">Metrics</a></p>
+		<p><a href="/status">Status</a></p>
 		</body>
 		</html>
 		`))
 	})
+	// jobs exposed on a path of their own are served by the listener of the
+	// exporter, the ones exposed on a port of their own by listeners started
+	// for the ports
+	if err := exporter.ServeExposed(webConfig, *listenAddress, *metricsPath, handlerOpts, *shutdownGrace); err != nil {
+		level.Error(logger).Log("msg", "Error exposing jobs", "err", err)
+		os.Exit(1)
+	}
+
+	// shut down on SIGTERM and SIGINT: the HTTP server stops accepting
+	// requests, the jobs stop scheduling runs and the running requests and
+	// queries are cancelled after the grace period, which both share
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		level.Info(logger).Log("msg", "Shutting down", "signal", sig.String(), "grace_period", shutdownGrace.String())
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancelShutdown()
+		cancel()
+		exporter.Shutdown(shutdownCtx)
+		close(stopped)
+	}()
 
 	level.Info(logger).Log("msg", "Listening", "listenAddress", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
-		level.Error(logger).Log("msg", "Error starting HTTP server:", "err", err)
-		os.Exit(1)
+	if err := webConfig.ListenAndServe(ctx, *listenAddress, exporter.ExposedHandler(0, http.DefaultServeMux), *shutdownGrace); err != nil {
+		if ctx.Err() == nil {
+			level.Error(logger).Log("msg", "Error starting HTTP server:", "err", err)
+			os.Exit(1)
+		}
+		level.Warn(logger).Log("msg", "Error shutting down HTTP server", "err", err)
 	}
+	<-stopped
+	level.Info(logger).Log("msg", "Stopped")
 }
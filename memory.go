@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxMemory is the heap size in bytes above which queries reading their
+// rows are aborted, 0 disables the guard.
+var maxMemory uint64
+
+// memoryCheckRows is the number of rows read between checks of the heap
+// size, reading the memory statistics briefly stops the world.
+const memoryCheckRows = 10000
+
+var maxMemoryBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sql_exporter_max_memory_bytes",
+	Help: "Heap size above which queries are aborted, 0 if there's no limit",
+})
+
+func init() {
+	prometheus.MustRegister(maxMemoryBytes)
+}
+
+// setMaxMemory sets the heap size above which queries are aborted.
+func setMaxMemory(limit uint64) {
+	maxMemory = limit
+	maxMemoryBytes.Set(float64(limit))
+}
+
+// memoryExceeded returns whether the heap is larger than maxMemory.
+func memoryExceeded() bool {
+	if maxMemory == 0 {
+		return false
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc > maxMemory
+}
+
+// memoryLimitError aborts a query reading its rows once the heap exceeds
+// maxMemory.
+type memoryLimitError struct {
+	rows int
+}
+
+func (e memoryLimitError) Error() string {
+	return fmt.Sprintf("query aborted after %d rows, the heap exceeds max-memory of %d bytes", e.rows, maxMemory)
+}
+
+// checkMemory returns a memoryLimitError if the heap is larger than
+// maxMemory after reading the given number of rows. The heap is only checked
+// every memoryCheckRows rows.
+func checkMemory(rows int) error {
+	if rows%memoryCheckRows == 0 && memoryExceeded() {
+		return memoryLimitError{rows: rows}
+	}
+	return nil
+}
+
+// byteUnits are the multipliers of the units of byte sizes
+var byteUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	// the longer suffixes come first, so KiB isn't taken for B
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseByteSize parses a size like 512MiB or 1GB, plain numbers are bytes.
+func parseByteSize(s string) (uint64, error) {
+	number := strings.TrimSpace(s)
+	multiplier := uint64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a number of bytes with an optional unit like MiB or GB", s)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
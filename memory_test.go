@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func Test_parseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected uint64
+		err      bool
+	}{
+		{in: "1024", expected: 1024},
+		{in: "512MiB", expected: 512 << 20},
+		{in: "1.5 GiB", expected: 3 << 29},
+		{in: "2GB", expected: 2000000000},
+		{in: "10B", expected: 10},
+		{in: "lots", err: true},
+		{in: "-1MiB", err: true},
+	} {
+		got, err := parseByteSize(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.in, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %d, got %d", tc.in, tc.expected, got)
+		}
+	}
+}
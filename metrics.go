@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	aggregationMax = "max"
+	aggregationMin = "min"
+	aggregationSum = "sum"
+	aggregationAvg = "avg"
+
+	// types of the errors counted by sql_exporter_scrape_errors_total
+	scrapeErrorConnect = "connect"
+	scrapeErrorQuery   = "query"
+	scrapeErrorParse   = "parse"
+	scrapeErrorTimeout = "timeout"
+	scrapeErrorLimit   = "limit"
+)
+
+var (
+	// exporterMetricLabels are the labels of the exporter internal metrics,
+	// in the order their values are passed to WithLabelValues.
+	exporterMetricLabels = []string{"driver", "host", "database", "user", "sql_job", "query"}
+
+	failedScrapes = newAggregatedVec(
+		"sql_exporter_last_scrape_failed",
+		"Failed scrapes",
+		prometheus.GaugeValue,
+		exporterMetricLabels,
+	)
+	scrapeErrors = newAggregatedVec(
+		"sql_exporter_scrape_errors_total",
+		"Number of failed scrapes by error type",
+		prometheus.CounterValue,
+		exporterMetricLabels,
+	).withFixedLabels("type")
+	queryTimeouts = newAggregatedVec(
+		"sql_exporter_query_timeouts_total",
+		"Number of queries cancelled because they hit the timeout",
+		prometheus.CounterValue,
+		exporterMetricLabels,
+	)
+
+	queryRetries = newAggregatedVec(
+		"sql_exporter_query_retries_total",
+		"Number of retries of failed query executions",
+		prometheus.CounterValue,
+		exporterMetricLabels,
+	)
+
+	staleQueries = newAggregatedVec(
+		"sql_exporter_query_stale",
+		"Whether the metrics of the query are dropped because the last successful run is older than max_age",
+		prometheus.GaugeValue,
+		exporterMetricLabels,
+	)
+
+	queryDuration = newAggregatedHistogramVec(
+		"sql_exporter_query_duration_seconds",
+		"Duration of the query executions",
+		prometheus.ExponentialBuckets(0.005, 4, 8),
+		exporterMetricLabels,
+	)
+	queryRows = newAggregatedVec(
+		"sql_exporter_query_rows_returned",
+		"Number of rows returned by the last successful execution of the query",
+		prometheus.GaugeValue,
+		exporterMetricLabels,
+	)
+	queryLimits = newAggregatedVec(
+		"sql_exporter_query_limit_exceeded_total",
+		"Number of query executions exceeding max_rows, max_series or max-memory",
+		prometheus.CounterValue,
+		exporterMetricLabels,
+	).withFixedLabels("limit")
+	failedAssertions = newAggregatedVec(
+		"sql_exporter_assertion_failed",
+		"Whether the assertion failed on the last run of the query",
+		prometheus.GaugeValue,
+		exporterMetricLabels,
+	).withFixedLabels("assertion")
+	assertionFailures = newAggregatedVec(
+		"sql_exporter_assertion_failures_total",
+		"Number of query runs failing the assertion",
+		prometheus.CounterValue,
+		exporterMetricLabels,
+	).withFixedLabels("assertion")
+
+	// exporterMetrics are all exporter internal metrics whose labels can be
+	// configured
+	exporterMetrics = []exporterMetric{failedScrapes, scrapeErrors, queryTimeouts, queryRetries, staleQueries, queryDuration, queryRows, queryLimits, failedAssertions, assertionFailures}
+)
+
+func init() {
+	for _, m := range exporterMetrics {
+		prometheus.MustRegister(m)
+	}
+}
+
+// configureExporterMetrics applies the configured label set and aggregation
+// to the exporter internal metrics.
+func configureExporterMetrics(cfg *ExporterMetrics) error {
+	labels := exporterMetricLabels
+	aggregation := aggregationMax
+	if cfg != nil {
+		if cfg.Labels != nil {
+			labels = cfg.Labels
+		}
+		if cfg.Aggregation != "" {
+			aggregation = cfg.Aggregation
+		}
+	}
+	for _, m := range exporterMetrics {
+		if err := m.configure(labels, aggregation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exporterMetric is an exporter internal metric with a configurable label
+// set.
+type exporterMetric interface {
+	prometheus.Collector
+	configure(labels []string, aggregation string) error
+	delete(match func(labelValues []string) bool)
+}
+
+// deleteExporterMetrics deletes the series of the exporter internal metrics
+// whose full label values, in the order of exporterMetricLabels, match, e.g.
+// of the connections of a removed job.
+func deleteExporterMetrics(match func(labelValues []string) bool) {
+	for _, m := range exporterMetrics {
+		m.delete(match)
+	}
+}
+
+// keepLabels returns the indexes of the exported labels within labelNames,
+// along with their names in the order of labelNames.
+func keepLabels(labelNames, labels []string) ([]int, []string, error) {
+	keep := make([]int, 0, len(labels))
+	for _, label := range labels {
+		idx := -1
+		for i, name := range labelNames {
+			if name == label {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return nil, nil, fmt.Errorf("unknown label %q, must be one of %s", label, strings.Join(labelNames, ", "))
+		}
+		keep = append(keep, idx)
+	}
+	sort.Ints(keep)
+	names := make([]string, 0, len(keep))
+	for _, idx := range keep {
+		names = append(names, labelNames[idx])
+	}
+	return keep, names, nil
+}
+
+// aggregatedVec is a gauge or counter vector whose exported label set can be
+// reduced at runtime, e.g. to drop the host and user labels on large fleets.
+// Gauge series which collapse into the same exported label set are combined
+// using the configured aggregation, counters are always summed up.
+type aggregatedVec struct {
+	mtx         sync.Mutex
+	name        string
+	help        string
+	valueType   prometheus.ValueType
+	labelNames  []string
+	fixed       []string
+	keep        []int
+	aggregation string
+	desc        *prometheus.Desc
+	values      map[string]*aggregatedValue
+}
+
+type aggregatedValue struct {
+	labelValues []string
+	value       float64
+}
+
+// aggregatedChild is the gauge or counter for a single full label set.
+type aggregatedChild struct {
+	parent      *aggregatedVec
+	labelValues []string
+}
+
+func newAggregatedVec(name, help string, valueType prometheus.ValueType, labelNames []string) *aggregatedVec {
+	g := &aggregatedVec{
+		name:       name,
+		help:       help,
+		valueType:  valueType,
+		labelNames: labelNames,
+		values:     make(map[string]*aggregatedValue),
+	}
+	if err := g.configure(labelNames, aggregationMax); err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// withFixedLabels adds labels which are always exported, regardless of the
+// configured label set. Their values are passed after the configurable ones.
+func (g *aggregatedVec) withFixedLabels(labels ...string) *aggregatedVec {
+	g.labelNames = append(g.labelNames[:len(g.labelNames):len(g.labelNames)], labels...)
+	g.fixed = labels
+	if err := g.configure(g.labelNames[:len(g.labelNames)-len(labels)], g.aggregation); err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// configure sets the exported subset of labels and the aggregation used to
+// combine series.
+func (g *aggregatedVec) configure(labels []string, aggregation string) error {
+	switch aggregation {
+	case aggregationMax, aggregationMin, aggregationSum, aggregationAvg:
+	default:
+		return fmt.Errorf("unknown aggregation %q", aggregation)
+	}
+	keep, names, err := keepLabels(g.labelNames, append(labels[:len(labels):len(labels)], g.fixed...))
+	if err != nil {
+		return err
+	}
+
+	if g.valueType == prometheus.CounterValue {
+		// anything else would break the monotonicity of counters
+		aggregation = aggregationSum
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.keep = keep
+	g.aggregation = aggregation
+	g.desc = prometheus.NewDesc(g.name, g.help, names, nil)
+	return nil
+}
+
+// WithLabelValues returns the child for the given full set of label values.
+func (g *aggregatedVec) WithLabelValues(lvs ...string) *aggregatedChild {
+	return &aggregatedChild{parent: g, labelValues: lvs}
+}
+
+// Set sets the gauge to the given value.
+func (c *aggregatedChild) Set(value float64) {
+	c.update(func(v *aggregatedValue) { v.value = value })
+}
+
+// Inc increments the counter by one.
+func (c *aggregatedChild) Inc() {
+	c.Add(1.0)
+}
+
+// Add adds the given value to the counter.
+func (c *aggregatedChild) Add(value float64) {
+	c.update(func(v *aggregatedValue) { v.value += value })
+}
+
+func (c *aggregatedChild) update(fn func(v *aggregatedValue)) {
+	key := strings.Join(c.labelValues, "\xff")
+	c.parent.mtx.Lock()
+	defer c.parent.mtx.Unlock()
+	v, found := c.parent.values[key]
+	if !found {
+		v = &aggregatedValue{labelValues: c.labelValues}
+		c.parent.values[key] = v
+	}
+	fn(v)
+}
+
+// delete deletes the series whose full label values match.
+func (g *aggregatedVec) delete(match func(labelValues []string) bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for key, v := range g.values {
+		if match(v.labelValues) {
+			delete(g.values, key)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector. The descriptor changes with the
+// configuration, so the collector is registered unchecked.
+func (g *aggregatedVec) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (g *aggregatedVec) Collect(ch chan<- prometheus.Metric) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	type group struct {
+		labelValues []string
+		value       float64
+		count       int
+	}
+	groups := make(map[string]*group, len(g.values))
+	for _, v := range g.values {
+		lvs := make([]string, 0, len(g.keep))
+		for _, idx := range g.keep {
+			lvs = append(lvs, v.labelValues[idx])
+		}
+		key := strings.Join(lvs, "\xff")
+		grp, found := groups[key]
+		if !found {
+			groups[key] = &group{labelValues: lvs, value: v.value, count: 1}
+			continue
+		}
+		switch g.aggregation {
+		case aggregationMax:
+			if v.value > grp.value {
+				grp.value = v.value
+			}
+		case aggregationMin:
+			if v.value < grp.value {
+				grp.value = v.value
+			}
+		case aggregationSum, aggregationAvg:
+			grp.value += v.value
+		}
+		grp.count++
+	}
+	for _, grp := range groups {
+		value := grp.value
+		if g.aggregation == aggregationAvg {
+			value /= float64(grp.count)
+		}
+		ch <- prometheus.MustNewConstMetric(g.desc, g.valueType, value, grp.labelValues...)
+	}
+}
+
+// aggregatedHistogramVec is a histogram vector whose exported label set can
+// be reduced like the one of an aggregatedVec. Histograms which collapse into
+// the same exported label set are merged.
+type aggregatedHistogramVec struct {
+	mtx        sync.Mutex
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	keep       []int
+	desc       *prometheus.Desc
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// aggregatedObserver is the histogram for a single full label set.
+type aggregatedObserver struct {
+	parent      *aggregatedHistogramVec
+	labelValues []string
+}
+
+func newAggregatedHistogramVec(name, help string, buckets []float64, labelNames []string) *aggregatedHistogramVec {
+	h := &aggregatedHistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     make(map[string]*histogramValue),
+	}
+	if err := h.configure(labelNames, aggregationSum); err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// configure sets the exported subset of labels. Histograms are always merged,
+// so the aggregation is ignored.
+func (h *aggregatedHistogramVec) configure(labels []string, aggregation string) error {
+	keep, names, err := keepLabels(h.labelNames, labels)
+	if err != nil {
+		return err
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.keep = keep
+	h.desc = prometheus.NewDesc(h.name, h.help, names, nil)
+	return nil
+}
+
+// WithLabelValues returns the histogram for the given full set of label
+// values.
+func (h *aggregatedHistogramVec) WithLabelValues(lvs ...string) *aggregatedObserver {
+	return &aggregatedObserver{parent: h, labelValues: lvs}
+}
+
+// Observe adds a single observation to the histogram.
+func (o *aggregatedObserver) Observe(value float64) {
+	key := strings.Join(o.labelValues, "\xff")
+	h := o.parent
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	v, found := h.values[key]
+	if !found {
+		v = &histogramValue{labelValues: o.labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// delete deletes the histograms whose full label values match.
+func (h *aggregatedHistogramVec) delete(match func(labelValues []string) bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for key, v := range h.values {
+		if match(v.labelValues) {
+			delete(h.values, key)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector. The descriptor changes with the
+// configuration, so the collector is registered unchecked.
+func (h *aggregatedHistogramVec) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (h *aggregatedHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	groups := make(map[string]*histogramValue, len(h.values))
+	for _, v := range h.values {
+		lvs := make([]string, 0, len(h.keep))
+		for _, idx := range h.keep {
+			lvs = append(lvs, v.labelValues[idx])
+		}
+		key := strings.Join(lvs, "\xff")
+		grp, found := groups[key]
+		if !found {
+			grp = &histogramValue{labelValues: lvs, counts: make([]uint64, len(h.buckets))}
+			groups[key] = grp
+		}
+		for i := range v.counts {
+			grp.counts[i] += v.counts[i]
+		}
+		grp.count += v.count
+		grp.sum += v.sum
+	}
+	for _, grp := range groups {
+		buckets := make(map[float64]uint64, len(h.buckets))
+		for i, upper := range h.buckets {
+			buckets[upper] = grp.counts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(h.desc, grp.count, grp.sum, buckets, grp.labelValues...)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// jsonResult are the latest metrics of a query on a single connection along
+// with its last run
+type jsonResult struct {
+	Job      string       `json:"job"`
+	Query    string       `json:"query"`
+	Driver   string       `json:"driver"`
+	Host     string       `json:"host"`
+	Database string       `json:"database"`
+	Updated  time.Time    `json:"updated"`
+	LastRun  *queryRun    `json:"last_run,omitempty"`
+	Metrics  []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is a single value. Histograms and summaries are split into
+// their sum and count. NaN and infinite values are null.
+type jsonMetric struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     *float64          `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// JSONHandler writes the latest metrics of all queries as JSON, for
+// consumers which don't parse the Prometheus text format. Queries aren't
+// run, pull mode jobs return the results of their last scrape.
+func (e *Exporter) JSONHandler(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(e.jsonResults(), "", "  ")
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to render metrics as JSON", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (e *Exporter) jsonResults() []jsonResult {
+	e.RLock()
+	defer e.RUnlock()
+	results := make([]jsonResult, 0)
+	for _, job := range e.jobs {
+		if job == nil {
+			continue
+		}
+		for _, q := range job.Queries {
+			if q == nil {
+				continue
+			}
+			results = append(results, q.jsonResults(job.Name)...)
+		}
+	}
+	return results
+}
+
+// jsonResults returns the cached metrics of the query by connection.
+func (q *Query) jsonResults(job string) []jsonResult {
+	q.Lock()
+	defer q.Unlock()
+	results := make([]jsonResult, 0, len(q.metrics))
+	for conn := range q.metrics {
+		res := jsonResult{
+			Job:      job,
+			Query:    q.Name,
+			Driver:   conn.driver,
+			Host:     conn.host,
+			Database: conn.database,
+			Updated:  q.updated[conn],
+			Metrics:  make([]jsonMetric, 0, len(q.metrics[conn])),
+		}
+		for i := len(q.history) - 1; i >= 0; i-- {
+			run := q.history[i]
+			if run.Driver == conn.driver && run.Host == conn.host && run.Database == conn.database {
+				res.LastRun = &run
+				break
+			}
+		}
+		for _, m := range q.freshMetrics(conn) {
+			name, pb, ok := metricSample(m)
+			if !ok {
+				continue
+			}
+			labels := make(map[string]string, len(pb.GetLabel()))
+			for _, l := range pb.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			for suffix, value := range sampleValues(pb) {
+				metric := jsonMetric{Name: name + suffix, Labels: labels, Timestamp: res.Updated}
+				if !math.IsNaN(value) && !math.IsInf(value, 0) {
+					v := value
+					metric.Value = &v
+				}
+				res.Metrics = append(res.Metrics, metric)
+			}
+		}
+		sort.Slice(res.Metrics, func(i, j int) bool { return res.Metrics[i].Name < res.Metrics[j].Name })
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Host+"/"+results[i].Database < results[j].Host+"/"+results[j].Database
+	})
+	return results
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestQuery_jsonResults(t *testing.T) {
+	q := &Query{
+		Name:   "users",
+		Help:   "Users",
+		Labels: Labels{{Name: "state", Column: "state"}},
+		Values: Values{{Column: "value"}},
+		Query:  "SELECT 'active' AS state, 42 AS value",
+	}
+	runSQLiteQuery(t, q)
+
+	results := q.jsonResults("test")
+	if len(results) != 1 {
+		t.Fatalf("expected one result, got %d", len(results))
+	}
+	res := results[0]
+	if res.Job != "test" || res.Query != "users" || res.Driver != "sqlite" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if res.LastRun == nil || res.LastRun.Rows != 1 || res.LastRun.Error != "" {
+		t.Errorf("expected the successful last run, got %+v", res.LastRun)
+	}
+	if len(res.Metrics) != 1 {
+		t.Fatalf("expected one metric, got %d", len(res.Metrics))
+	}
+	m := res.Metrics[0]
+	if m.Name != "sql_users" || m.Labels["state"] != "active" || m.Value == nil || *m.Value != 42 {
+		t.Errorf("unexpected metric %+v", m)
+	}
+}
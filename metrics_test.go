@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_aggregatedVec(t *testing.T) {
+	g := newAggregatedVec("test_failed", "Test", prometheus.GaugeValue, exporterMetricLabels)
+	g.WithLabelValues("postgres", "db1", "app", "alice", "job", "q1").Set(1.0)
+	g.WithLabelValues("postgres", "db2", "app", "bob", "job", "q1").Set(0.0)
+	g.WithLabelValues("postgres", "db1", "app", "alice", "job", "q2").Set(0.0)
+
+	if err := g.configure([]string{"sql_job", "query"}, aggregationMax); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected := `
+# HELP test_failed Test
+# TYPE test_failed gauge
+test_failed{query="q1",sql_job="job"} 1
+test_failed{query="q2",sql_job="job"} 0
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collection result:\n%v", err)
+	}
+
+	if err := g.configure([]string{"sql_job"}, aggregationAvg); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected = `
+# HELP test_failed Test
+# TYPE test_failed gauge
+test_failed{sql_job="job"} 0.3333333333333333
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collection result:\n%v", err)
+	}
+
+	if err := g.configure([]string{"instance"}, aggregationMax); err == nil {
+		t.Errorf("expected error for unknown label")
+	}
+}
+
+func Test_aggregatedVecFixedLabels(t *testing.T) {
+	c := newAggregatedVec("test_errors_total", "Test", prometheus.CounterValue, exporterMetricLabels).withFixedLabels("type")
+	c.WithLabelValues("postgres", "db1", "app", "alice", "job", "q1", scrapeErrorQuery).Inc()
+	c.WithLabelValues("postgres", "db2", "app", "bob", "job", "q1", scrapeErrorQuery).Inc()
+	c.WithLabelValues("postgres", "db2", "app", "bob", "job", "q1", scrapeErrorTimeout).Inc()
+
+	if err := c.configure([]string{"query"}, aggregationMax); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected := `
+# HELP test_errors_total Test
+# TYPE test_errors_total counter
+test_errors_total{query="q1",type="query"} 2
+test_errors_total{query="q1",type="timeout"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collection result:\n%v", err)
+	}
+}
+
+func Test_aggregatedHistogramVec(t *testing.T) {
+	h := newAggregatedHistogramVec("test_duration_seconds", "Test", []float64{0.1, 1}, exporterMetricLabels)
+	for _, v := range []float64{0.05, 0.1, 0.5} {
+		h.WithLabelValues("postgres", "db1", "app", "alice", "job", "q1").Observe(v)
+	}
+	h.WithLabelValues("postgres", "db2", "app", "bob", "job", "q1").Observe(2)
+	h.WithLabelValues("postgres", "db1", "app", "alice", "job", "q2").Observe(1)
+
+	expected := `
+# HELP test_duration_seconds Test
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q1",sql_job="job",user="alice",le="0.1"} 2
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q1",sql_job="job",user="alice",le="1"} 3
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q1",sql_job="job",user="alice",le="+Inf"} 3
+test_duration_seconds_sum{database="app",driver="postgres",host="db1",query="q1",sql_job="job",user="alice"} 0.65
+test_duration_seconds_count{database="app",driver="postgres",host="db1",query="q1",sql_job="job",user="alice"} 3
+test_duration_seconds_bucket{database="app",driver="postgres",host="db2",query="q1",sql_job="job",user="bob",le="0.1"} 0
+test_duration_seconds_bucket{database="app",driver="postgres",host="db2",query="q1",sql_job="job",user="bob",le="1"} 0
+test_duration_seconds_bucket{database="app",driver="postgres",host="db2",query="q1",sql_job="job",user="bob",le="+Inf"} 1
+test_duration_seconds_sum{database="app",driver="postgres",host="db2",query="q1",sql_job="job",user="bob"} 2
+test_duration_seconds_count{database="app",driver="postgres",host="db2",query="q1",sql_job="job",user="bob"} 1
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q2",sql_job="job",user="alice",le="0.1"} 0
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q2",sql_job="job",user="alice",le="1"} 1
+test_duration_seconds_bucket{database="app",driver="postgres",host="db1",query="q2",sql_job="job",user="alice",le="+Inf"} 1
+test_duration_seconds_sum{database="app",driver="postgres",host="db1",query="q2",sql_job="job",user="alice"} 1
+test_duration_seconds_count{database="app",driver="postgres",host="db1",query="q2",sql_job="job",user="alice"} 1
+`
+	if err := testutil.CollectAndCompare(h, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collection result:\n%v", err)
+	}
+
+	// histograms collapsing into the same label set are merged
+	if err := h.configure([]string{"query"}, aggregationMax); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected = `
+# HELP test_duration_seconds Test
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{query="q1",le="0.1"} 2
+test_duration_seconds_bucket{query="q1",le="1"} 3
+test_duration_seconds_bucket{query="q1",le="+Inf"} 4
+test_duration_seconds_sum{query="q1"} 2.65
+test_duration_seconds_count{query="q1"} 4
+test_duration_seconds_bucket{query="q2",le="0.1"} 0
+test_duration_seconds_bucket{query="q2",le="1"} 1
+test_duration_seconds_bucket{query="q2",le="+Inf"} 1
+test_duration_seconds_sum{query="q2"} 1
+test_duration_seconds_count{query="q2"} 1
+`
+	if err := testutil.CollectAndCompare(h, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collection result:\n%v", err)
+	}
+
+	if err := h.configure([]string{"instance"}, aggregationSum); err == nil {
+		t.Errorf("expected error for unknown label")
+	}
+}
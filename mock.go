@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The mock driver answers queries with the results defined in the mocks of
+// the config instead of a database, e.g. to run the exporter end to end in
+// CI or while developing a config. Connections are given as
+// mock://name/database.
+func init() {
+	sql.Register("mock", &mockDriver{})
+}
+
+var (
+	// mocks are the mock databases of the config by name
+	mocks    map[string][]*MockResult
+	mocksMtx sync.RWMutex
+)
+
+func (r *MockResult) validate() error {
+	if r.Error != "" && (len(r.Rows) > 0 || r.File != "") {
+		return fmt.Errorf("error excludes rows and file")
+	}
+	if len(r.Rows) > 0 && r.File != "" {
+		return fmt.Errorf("rows and file are mutually exclusive")
+	}
+	if r.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	var err error
+	if r.matchRE, err = regexp.Compile(r.Match); err != nil {
+		return fmt.Errorf("invalid match %q: %v", r.Match, err)
+	}
+	return nil
+}
+
+// setMocks validates the mocks, reads the rows of their files and replaces
+// the mock databases.
+func setMocks(databases map[string][]*MockResult) error {
+	for name, results := range databases {
+		for i, result := range results {
+			if result == nil {
+				continue
+			}
+			if err := result.validate(); err != nil {
+				return fmt.Errorf("mock %q: result %d: %v", name, i, err)
+			}
+			if result.File == "" {
+				continue
+			}
+			rows, err := readFixture(result.File)
+			if err != nil {
+				return fmt.Errorf("mock %q: %v", name, err)
+			}
+			result.Rows = rows
+		}
+	}
+	mocksMtx.Lock()
+	defer mocksMtx.Unlock()
+	mocks = databases
+	return nil
+}
+
+type mockDriver struct{}
+
+func (d *mockDriver) Open(dsn string) (driver.Conn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "mock" || u.Host == "" {
+		return nil, fmt.Errorf("mock connections must be of the form mock://name/database")
+	}
+	mocksMtx.RLock()
+	defer mocksMtx.RUnlock()
+	results, found := mocks[u.Host]
+	if !found {
+		return nil, fmt.Errorf("mock %q isn't defined", u.Host)
+	}
+	return &mockConn{results: results}, nil
+}
+
+type mockConn struct {
+	results []*MockResult
+}
+
+func (c *mockConn) Prepare(query string) (driver.Stmt, error) {
+	return &mockStmt{conn: c, query: query}, nil
+}
+
+func (c *mockConn) Close() error {
+	return nil
+}
+
+// Begin starts a transaction which does nothing, so queries with setup
+// statements can run on mocks.
+func (c *mockConn) Begin() (driver.Tx, error) {
+	return mockTx{}, nil
+}
+
+func (c *mockConn) Ping(context.Context) error {
+	return nil
+}
+
+// answer returns the first result matching the query after its delay, nil if
+// none matches.
+func (c *mockConn) answer(ctx context.Context, query string) (*MockResult, error) {
+	for _, result := range c.results {
+		if result == nil || result.matchRE == nil || !result.matchRE.MatchString(query) {
+			continue
+		}
+		if result.Delay > 0 {
+			select {
+			case <-time.After(result.Delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if result.Error != "" {
+			return nil, errors.New(result.Error)
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+func (c *mockConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.answer(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("mock: no result matches the query %q", query)
+	}
+	return newMockRows(result), nil
+}
+
+// ExecContext succeeds for statements without a matching result, e.g. the
+// startup and setup statements.
+func (c *mockConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, err := c.answer(ctx, query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type mockTx struct{}
+
+func (mockTx) Commit() error   { return nil }
+func (mockTx) Rollback() error { return nil }
+
+type mockStmt struct {
+	conn  *mockConn
+	query string
+}
+
+func (s *mockStmt) Close() error  { return nil }
+func (s *mockStmt) NumInput() int { return -1 }
+
+func (s *mockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *mockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+type mockRows struct {
+	columns []string
+	rows    []map[string]interface{}
+	next    int
+}
+
+// newMockRows returns the rows of the result, its columns default to the
+// sorted columns of all rows.
+func newMockRows(result *MockResult) *mockRows {
+	columns := result.Columns
+	if len(columns) == 0 {
+		seen := make(map[string]bool)
+		for _, row := range result.Rows {
+			for column := range row {
+				if !seen[column] {
+					seen[column] = true
+					columns = append(columns, column)
+				}
+			}
+		}
+		sort.Strings(columns)
+	}
+	return &mockRows{columns: columns, rows: result.Rows}
+}
+
+func (r *mockRows) Columns() []string {
+	return r.columns
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.next]
+	r.next++
+	for i, column := range r.columns {
+		dest[i] = mockValue(row[column])
+	}
+	return nil
+}
+
+// mockValue converts the values decoded from YAML and JSON which aren't
+// valid driver values.
+func mockValue(v interface{}) driver.Value {
+	switch val := v.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time:
+		return val
+	case int:
+		return int64(val)
+	case uint64:
+		return float64(val)
+	default:
+		return fmt.Sprint(val)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMockConfigYAML = `
+mocks:
+  app:
+  - match: "pg_stat_activity"
+    rows:
+    - {datname: "postgres", count: 3}
+    - {datname: "app", count: 12}
+  - match: "replication"
+    file: "replication.csv"
+  - match: "broken"
+    error: "relation does not exist"
+jobs:
+- name: "mocked"
+  connections:
+  - 'mock://app/postgres'
+  queries:
+  - name: "connections"
+    help: "Connections by database"
+    labels:
+      - "datname"
+    values:
+      - "count"
+    query: "SELECT datname, count(*) AS count FROM pg_stat_activity GROUP BY datname"
+  - name: "replication"
+    help: "Replication lag"
+    values:
+      - "lag"
+    query: "SELECT lag FROM replication"
+  - name: "broken"
+    help: "Fails"
+    values:
+      - "value"
+    query: "SELECT value FROM broken"
+  - name: "unmatched"
+    help: "Isn't mocked"
+    values:
+      - "value"
+    query: "SELECT value FROM unmatched"
+`
+
+func TestMockDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	for file, content := range map[string]string{
+		configFile:                            testMockConfigYAML,
+		filepath.Join(dir, "replication.csv"): "lag\n1.5\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := Read(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+
+	job := cfg.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), cfg.Queries); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range job.Queries {
+		err := q.Run(conn)
+		if failing := q.Name == "broken" || q.Name == "unmatched"; failing != (err != nil) {
+			t.Errorf("%s: unexpected error %v", q.Name, err)
+		}
+	}
+	expected := `
+# HELP sql_connections Connections by database
+# TYPE sql_connections gauge
+sql_connections{col="count",database="postgres",datname="app",driver="mock",host="app",sql_job="mocked",user=""} 12
+sql_connections{col="count",database="postgres",datname="postgres",driver="mock",host="app",sql_job="mocked",user=""} 3
+# HELP sql_replication Replication lag
+# TYPE sql_replication gauge
+sql_replication{col="lag",database="postgres",driver="mock",host="app",sql_job="mocked",user=""} 1.5
+`
+	if err := testutil.GatherAndCompare(job.gatherer(), strings.NewReader(expected), "sql_connections", "sql_replication"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMockResult_validate(t *testing.T) {
+	for _, tc := range []struct {
+		result MockResult
+		valid  bool
+	}{
+		{result: MockResult{Rows: []map[string]interface{}{{"value": 1}}}, valid: true},
+		{result: MockResult{Match: "^SELECT", File: "rows.csv"}, valid: true},
+		{result: MockResult{Error: "failed"}, valid: true},
+		{result: MockResult{Match: "("}},
+		{result: MockResult{Error: "failed", File: "rows.csv"}},
+		{result: MockResult{Rows: []map[string]interface{}{{"value": 1}}, File: "rows.csv"}},
+	} {
+		if err := tc.result.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: unexpected error %v", tc.result, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// the resolutions supported by native histograms
+const (
+	nativeSchemaMin = -4
+	nativeSchemaMax = 8
+)
+
+// nativeHistogram is a const histogram whose classic buckets are exported as
+// native histogram as well. Scrapers negotiating protobuf get both, the
+// text formats only carry the classic buckets.
+type nativeHistogram struct {
+	prometheus.Metric
+	schema        int32
+	zeroThreshold float64
+	zeroCount     uint64
+	spans         []*dto.BucketSpan
+	deltas        []int64
+}
+
+// newNativeHistogram converts the cumulative classic buckets to native
+// buckets. The observations of each classic bucket are counted in the native
+// bucket of its upper bound, so the native histogram is exact if the classic
+// bounds are native bucket bounds, e.g. powers of two for schema 0.
+// Observations below the zero threshold, including negative ones, are
+// counted in the zero bucket and the ones above the largest classic bucket
+// in the native bucket above it.
+func newNativeHistogram(m prometheus.Metric, native *NativeHistogram, count uint64, buckets map[float64]uint64) prometheus.Metric {
+	h := &nativeHistogram{Metric: m, schema: native.Schema, zeroThreshold: native.ZeroThreshold}
+	bounds := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		if !math.IsInf(bound, 0) && !math.IsNaN(bound) {
+			bounds = append(bounds, bound)
+		}
+	}
+	sort.Float64s(bounds)
+	counts := make(map[int]uint64)
+	var last uint64
+	for _, bound := range bounds {
+		cumulative := buckets[bound]
+		if cumulative < last {
+			// not cumulative, ignore the decrease
+			cumulative = last
+		}
+		observed := cumulative - last
+		last = cumulative
+		if bound <= h.zeroThreshold {
+			h.zeroCount += observed
+			continue
+		}
+		counts[nativeBucketIndex(bound, h.schema)] += observed
+	}
+	if count > last {
+		top := h.zeroThreshold
+		if len(bounds) > 0 {
+			top = math.Max(top, bounds[len(bounds)-1])
+		}
+		index := 0
+		if top > 0 {
+			index = nativeBucketIndex(top, h.schema) + 1
+		}
+		counts[index] += count - last
+	}
+	h.spans, h.deltas = nativeSpans(counts)
+	return h
+}
+
+// Write adds the native buckets to the classic histogram.
+func (h *nativeHistogram) Write(m *dto.Metric) error {
+	if err := h.Metric.Write(m); err != nil {
+		return err
+	}
+	m.Histogram.Schema = proto.Int32(h.schema)
+	m.Histogram.ZeroThreshold = proto.Float64(h.zeroThreshold)
+	m.Histogram.ZeroCount = proto.Uint64(h.zeroCount)
+	m.Histogram.PositiveSpan = h.spans
+	m.Histogram.PositiveDelta = h.deltas
+	return nil
+}
+
+// nativeBounds are the bucket bounds within [0.5, 1) by positive schema,
+// the bounds of other powers of two are scaled with the exponent.
+var nativeBounds = func() [nativeSchemaMax + 1][]float64 {
+	var bounds [nativeSchemaMax + 1][]float64
+	for schema := 1; schema <= nativeSchemaMax; schema++ {
+		n := 1 << uint(schema)
+		bounds[schema] = make([]float64, n)
+		for i := range bounds[schema] {
+			bounds[schema][i] = math.Exp2(float64(i)/float64(n)) / 2
+		}
+	}
+	return bounds
+}()
+
+// nativeBucketIndex returns the index of the native bucket holding the
+// positive value, i.e. with base^(index-1) < value <= base^index and
+// base = 2^(2^-schema).
+func nativeBucketIndex(value float64, schema int32) int {
+	frac, exp := math.Frexp(value)
+	if schema > 0 {
+		bounds := nativeBounds[schema]
+		return sort.SearchFloat64s(bounds, frac) + (exp-1)*len(bounds)
+	}
+	index := exp
+	if frac == 0.5 {
+		index--
+	}
+	// round up to the wider buckets of the schema
+	offset := (1 << uint(-schema)) - 1
+	return (index + offset) >> uint(-schema)
+}
+
+// nativeSpans encodes the bucket counts by index as spans of consecutive
+// buckets and the deltas between the counts of the buckets.
+func nativeSpans(counts map[int]uint64) ([]*dto.BucketSpan, []int64) {
+	indexes := make([]int, 0, len(counts))
+	for i, count := range counts {
+		if count > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	var spans []*dto.BucketSpan
+	deltas := make([]int64, 0, len(indexes))
+	var previous int64
+	for n, i := range indexes {
+		if n == 0 || i != indexes[n-1]+1 {
+			offset := i
+			if n > 0 {
+				offset = i - indexes[n-1] - 1
+			}
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(int32(offset)), Length: proto.Uint32(0)})
+		}
+		span := spans[len(spans)-1]
+		span.Length = proto.Uint32(span.GetLength() + 1)
+		count := int64(counts[i])
+		deltas = append(deltas, count-previous)
+		previous = count
+	}
+	return spans, deltas
+}
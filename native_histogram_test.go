@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_nativeBucketIndex(t *testing.T) {
+	for _, tc := range []struct {
+		value  float64
+		schema int32
+		index  int
+	}{
+		{value: 1, schema: 0, index: 0},
+		{value: 2, schema: 0, index: 1},
+		{value: 3, schema: 0, index: 2},
+		{value: 0.5, schema: 0, index: -1},
+		{value: 0.3, schema: 0, index: -1},
+		{value: 4, schema: 3, index: 16},
+		{value: math.Exp2(1.0 / 8), schema: 3, index: 1},
+		{value: math.Exp2(1.0/8) + 1e-9, schema: 3, index: 2},
+		{value: 1.1, schema: 3, index: 2},
+		{value: 0.6, schema: 2, index: -2},
+		{value: 16, schema: -2, index: 1},
+		{value: 17, schema: -2, index: 2},
+		{value: 0.25, schema: -1, index: -1},
+	} {
+		if index := nativeBucketIndex(tc.value, tc.schema); index != tc.index {
+			t.Errorf("value %v with schema %d: expected index %d, got %d", tc.value, tc.schema, tc.index, index)
+		}
+	}
+}
+
+func Test_nativeHistogram(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name: "latency_seconds",
+		Help: "Latency",
+		Type: metricTypeHist,
+		HistValues: []*HistValue{{
+			Count: "count",
+			Sum:   "sum",
+			Buckets: []*Bucket{
+				{Name: "le_0", Value: "0"},
+				{Name: "le_1", Value: "1"},
+				{Name: "le_2", Value: "2"},
+				{Name: "le_8", Value: "8"},
+			},
+			Native: &NativeHistogram{Schema: 0},
+		}},
+		Query: "SELECT 1 AS le_0, 3 AS le_1, 4 AS le_2, 7 AS le_8, 9 AS count, 30.5 AS sum",
+	})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hist *dto.Histogram
+	for _, mf := range families {
+		if mf.GetName() == "sql_latency_seconds" {
+			hist = mf.GetMetric()[0].GetHistogram()
+		}
+	}
+	if hist == nil {
+		t.Fatal("histogram sql_latency_seconds not found")
+	}
+	if len(hist.GetBucket()) != 4 {
+		t.Errorf("expected the classic buckets to be kept, got %v", hist.GetBucket())
+	}
+	type span struct {
+		Offset int32
+		Length uint32
+	}
+	var spans []span
+	for _, s := range hist.GetPositiveSpan() {
+		spans = append(spans, span{s.GetOffset(), s.GetLength()})
+	}
+	got := struct {
+		Schema    int32
+		ZeroCount uint64
+		Spans     []span
+		Deltas    []int64
+	}{hist.GetSchema(), hist.GetZeroCount(), spans, hist.GetPositiveDelta()}
+	// 2 in (0,1], 1 in (1,2], 3 in (4,8] and 2 above 8, in (8,16]
+	expected := struct {
+		Schema    int32
+		ZeroCount uint64
+		Spans     []span
+		Deltas    []int64
+	}{0, 1, []span{{0, 2}, {1, 2}}, []int64{2, -1, 2, -1}}
+	if diff := pretty.Compare(expected, got); diff != "" {
+		t.Errorf("unexpected native histogram: %s", diff)
+	}
+}
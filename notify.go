@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultNotificationFailures = 3
+	defaultNotificationTimeout  = 10 * time.Second
+
+	notificationFailing  = "failing"
+	notificationResolved = "resolved"
+)
+
+var notificationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sql_exporter_notification_failures_total",
+	Help: "Notifications which could not be sent to the webhook",
+})
+
+func init() {
+	prometheus.MustRegister(notificationFailures)
+}
+
+// notification is the JSON message posted to the webhook. Text is the
+// message shown by Slack compatible webhooks, the other fields are for
+// webhooks processing the failure.
+type notification struct {
+	Text     string `json:"text"`
+	Status   string `json:"status"` // failing or resolved
+	Job      string `json:"job"`
+	Query    string `json:"query"`
+	Driver   string `json:"driver"`
+	Host     string `json:"host"`
+	Database string `json:"database"`
+	Error    string `json:"error,omitempty"`
+	Failures int    `json:"failures"` // consecutive failures of the query
+}
+
+func (n *Notifications) validate() error {
+	if n.WebhookURL == "" {
+		return fmt.Errorf("webhook_url is required")
+	}
+	u, err := url.Parse(n.WebhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook_url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook_url must be an http or https url")
+	}
+	if n.Failures < 0 {
+		return fmt.Errorf("failures must not be negative")
+	}
+	if n.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+func (n *Notifications) threshold() int {
+	if n.Failures <= 0 {
+		return defaultNotificationFailures
+	}
+	return n.Failures
+}
+
+// trackFailures counts the consecutive failures of the query on the
+// connection of the run. The webhook is notified once the failures reach the
+// threshold, not on every further failure, and when the query succeeds again
+// if resolved notifications are enabled.
+func (q *Query) trackFailures(run queryRun) {
+	n := q.notify
+	if n == nil {
+		return
+	}
+	key := run.Driver + "\x00" + run.Host + "\x00" + run.Database
+	q.Lock()
+	if q.failures == nil {
+		q.failures = make(map[string]int)
+	}
+	previous := q.failures[key]
+	if run.Error == "" {
+		delete(q.failures, key)
+	} else {
+		q.failures[key] = previous + 1
+	}
+	failures := q.failures[key]
+	q.Unlock()
+
+	msg := notification{
+		Job:      q.jobName,
+		Query:    q.Name,
+		Driver:   run.Driver,
+		Host:     run.Host,
+		Database: run.Database,
+		Error:    run.Error,
+		Failures: failures,
+	}
+	switch {
+	case run.Error != "" && failures == n.threshold():
+		msg.Status = notificationFailing
+		msg.Text = fmt.Sprintf("Query %s of job %s failed %d times in a row on %s %s/%s: %s",
+			q.Name, q.jobName, failures, run.Driver, run.Host, run.Database, run.Error)
+	case run.Error == "" && previous >= n.threshold() && n.SendResolved:
+		msg.Status = notificationResolved
+		msg.Failures = previous
+		msg.Text = fmt.Sprintf("Query %s of job %s succeeded again on %s %s/%s after %d failures",
+			q.Name, q.jobName, run.Driver, run.Host, run.Database, previous)
+	default:
+		return
+	}
+	go n.send(q.log, msg)
+}
+
+// send posts the notification to the webhook, failures are logged.
+func (n *Notifications) send(logger log.Logger, msg notification) {
+	if err := n.post(msg); err != nil {
+		notificationFailures.Inc()
+		level.Warn(logger).Log("msg", "Failed to send notification", "status", msg.Status, "err", err)
+	}
+}
+
+func (n *Notifications) post(msg notification) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotificationTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, n.WebhookURL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestQuery_trackFailures(t *testing.T) {
+	received := make(chan notification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("expected the configured header, got %q", r.Header.Get("Authorization"))
+		}
+		msg := notification{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("failed to decode notification: %v", err)
+		}
+		received <- msg
+	}))
+	defer srv.Close()
+
+	q := &Query{
+		Name:   "broken",
+		Help:   "Broken",
+		Values: Values{{Column: "value"}},
+		Query:  "SELECT value FROM missing",
+	}
+	job := &Job{
+		Name:        "notify",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+		Notifications: &Notifications{
+			WebhookURL:   srv.URL,
+			Failures:     2,
+			Headers:      map[string]string{"Authorization": "Bearer secret"},
+			SendResolved: true,
+		},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() *notification {
+		select {
+		case msg := <-received:
+			return &msg
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+	q.Run(conn)
+	if msg := next(); msg != nil {
+		t.Fatalf("expected no notification after the first failure, got %+v", msg)
+	}
+	q.Run(conn)
+	msg := next()
+	if msg == nil {
+		t.Fatal("expected a notification after the second failure")
+	}
+	if msg.Status != notificationFailing || msg.Job != "notify" || msg.Query != "broken" || msg.Failures != 2 ||
+		!strings.Contains(msg.Error, "no such table: missing") || msg.Text == "" {
+		t.Errorf("unexpected notification %+v", msg)
+	}
+	q.Run(conn)
+	if msg := next(); msg != nil {
+		t.Fatalf("expected a single notification per failure streak, got %+v", msg)
+	}
+
+	q.Query = "SELECT 1 AS value"
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	msg = next()
+	if msg == nil {
+		t.Fatal("expected a resolved notification")
+	}
+	if msg.Status != notificationResolved || msg.Failures != 3 || msg.Error != "" {
+		t.Errorf("unexpected notification %+v", msg)
+	}
+}
+
+func TestNotifications_validate(t *testing.T) {
+	for _, tc := range []struct {
+		n   Notifications
+		err string
+	}{
+		{n: Notifications{WebhookURL: "https://hooks.slack.com/services/T0/B0/X"}},
+		{n: Notifications{}, err: "webhook_url is required"},
+		{n: Notifications{WebhookURL: "hooks.slack.com"}, err: "webhook_url must be an http or https url"},
+		{n: Notifications{WebhookURL: "http://hook", Failures: -1}, err: "failures must not be negative"},
+	} {
+		err := tc.n.validate()
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestNotifications_read(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	config := "notifications:\n  webhook_url: 'http://hook'\n" + strings.TrimPrefix(testPostgresGuageConfigYAML, "\n")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Read(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Notifications == nil || f.Notifications.WebhookURL != "http://hook" {
+		t.Fatalf("expected the notifications of the config file, got %+v", f.Notifications)
+	}
+	if f.Jobs[0].Notifications != f.Notifications {
+		t.Errorf("expected the notifications to apply to the job")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+)
+
+// RunOnce runs all queries of the jobs once, e.g. as Kubernetes CronJob. If a
+// Pushgateway URL is given, the resulting metrics are pushed to it. It returns
+// an error if any query failed, so the run is retried. All enabled jobs are
+// run if no job names are given.
+func RunOnce(logger log.Logger, configFile string, jobs []string, pushGatewayURL, pushJob string) error {
+	registry, failed, err := runJobsOnce(logger, configFile, jobs)
+	if err != nil {
+		return err
+	}
+	for _, m := range exporterMetrics {
+		registry.MustRegister(m)
+	}
+	if pushGatewayURL != "" {
+		if err := push.New(pushGatewayURL, pushJob).Gatherer(registry).Push(); err != nil {
+			return fmt.Errorf("failed to push metrics: %v", err)
+		}
+		level.Info(logger).Log("msg", "Pushed metrics", "url", pushGatewayURL)
+	}
+	return failedJobsError(failed)
+}
+
+// DryRun runs all queries of the jobs once and writes the resulting metrics
+// in the text exposition format to w, which is handy while writing queries.
+func DryRun(logger log.Logger, configFile string, jobs []string, w io.Writer) error {
+	registry, failed, err := runJobsOnce(logger, configFile, jobs)
+	if err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return failedJobsError(failed)
+}
+
+// runJobsOnce runs all queries of the jobs of the config file once. It
+// returns a registry with the metrics of the jobs along with the names of the
+// jobs with failed queries.
+func runJobsOnce(logger log.Logger, configFile string, jobs []string) (*prometheus.Registry, []string, error) {
+	if configFile == "" {
+		configFile = "config.yml"
+	}
+	cfg, err := ReadJobs(configFile, jobs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := configureExporterMetrics(cfg.ExporterMetrics); err != nil {
+		return nil, nil, err
+	}
+	trackedSeries.setLimit(cfg.SeriesLimit)
+
+	registry := prometheus.NewRegistry()
+	var failed []string
+	for _, job := range cfg.Jobs {
+		if job == nil {
+			continue
+		}
+		if err := job.Init(logger, cfg.Queries); err != nil {
+			return nil, nil, fmt.Errorf("failed to initialize job %q: %v", job.Name, err)
+		}
+		start := time.Now()
+		job.initConnections()
+		if err := job.runOnce(); err != nil || !job.allQueriesSucceeded(start) {
+			level.Warn(job.log).Log("msg", "Job failed", "err", err)
+			failed = append(failed, job.Name)
+		}
+		job.closeConnections()
+		// the queries already ran, the job must not run them again on collection
+		job.Mode = jobModeInterval
+		if err := job.register(registry); err != nil {
+			return nil, nil, fmt.Errorf("failed to register metrics of job %q: %v", job.Name, err)
+		}
+	}
+	return registry, failed, nil
+}
+
+func failedJobsError(failed []string) error {
+	if len(failed) > 0 {
+		return fmt.Errorf("queries of jobs %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testOnceConfigYAML = `
+jobs:
+- name: "batch"
+  connections:
+  - 'sqlite://:memory:'
+  queries:
+  - name: "answer"
+    help: "The answer"
+    values:
+      - "value"
+    query: "SELECT 42 AS value"
+`
+
+func Test_RunOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(testOnceConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(buf)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	if err := RunOnce(log.NewNopLogger(), configFile, nil, server.URL, "nightly"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if path != "/metrics/job/nightly" {
+		t.Errorf("unexpected push path %q", path)
+	}
+	if !strings.Contains(body, "sql_answer") {
+		t.Errorf("expected the query metrics to be pushed")
+	}
+
+	broken := strings.Replace(testOnceConfigYAML, "SELECT 42 AS value", "SELECT value FROM missing", 1)
+	if err := ioutil.WriteFile(configFile, []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunOnce(log.NewNopLogger(), configFile, nil, "", ""); err == nil {
+		t.Errorf("expected error for failed query")
+	}
+}
+
+func Test_DryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(testOnceConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := DryRun(log.NewNopLogger(), configFile, nil, &out); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	expected := `sql_answer{col="value",database=":memory:",driver="sqlite",host=":memory:",sql_job="batch",user=""} 42`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output to contain %s, got:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpProtocolHTTP = "http"
+	otlpProtocolGRPC = "grpc"
+
+	// otlpMetricsPath is the default path of the OTLP/HTTP metrics endpoint
+	otlpMetricsPath = "/v1/metrics"
+	// otlpExportMethod is the gRPC method of the OTLP metrics service
+	otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	// otlpTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpTemporalityCumulative = 2
+)
+
+var (
+	otlpDataPoints = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sql_exporter_otlp_data_points_total",
+		Help: "Data points sent to the OTLP endpoint",
+	})
+	otlpFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sql_exporter_otlp_failures_total",
+		Help: "Failed pushes to the OTLP endpoint",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(otlpDataPoints, otlpFailures)
+}
+
+// otlpWriter periodically pushes all metrics of the exporter as
+// OpenTelemetry metrics, over OTLP/HTTP with protobuf encoding or OTLP/gRPC.
+type otlpWriter struct {
+	cfg      *OTLP
+	client   *http.Client
+	conn     *grpc.ClientConn
+	timeout  time.Duration
+	gatherer prometheus.Gatherer
+	log      log.Logger
+	started  time.Time // start time of the cumulative sums
+	cancel   context.CancelFunc
+}
+
+// newOTLPWriter returns an OTLP writer for the config, call start to push
+// the metrics.
+func newOTLPWriter(logger log.Logger, cfg *OTLP, gatherer prometheus.Gatherer) (*otlpWriter, error) {
+	w := &otlpWriter{
+		cfg:      cfg,
+		timeout:  cfg.Timeout,
+		gatherer: gatherer,
+		log:      log.With(logger, "component", "otlp"),
+		started:  time.Now(),
+	}
+	if w.timeout <= 0 {
+		w.timeout = defaultRemoteWriteTimeout
+	}
+	if cfg.Protocol == otlpProtocolGRPC {
+		opts := []grpc.DialOption{grpc.WithInsecure()}
+		if !cfg.Insecure {
+			tlsConfig := &TLSConfig{}
+			if cfg.TLS != nil {
+				tlsConfig = cfg.TLS
+			}
+			host, _, err := net.SplitHostPort(cfg.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid otlp endpoint: %v", err)
+			}
+			c, err := tlsConfig.clientConfig(host)
+			if err != nil {
+				return nil, err
+			}
+			opts = []grpc.DialOption{grpc.WithTransportCredentials(grpccredentials.NewTLS(c))}
+		}
+		// the connection is established lazily on the first push
+		conn, err := grpc.Dial(cfg.Endpoint, opts...)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+		return w, nil
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint: %v", err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.TLS != nil {
+		if transport.TLSClientConfig, err = cfg.TLS.clientConfig(u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: w.timeout}
+	return w, nil
+}
+
+// start pushes the metrics at the configured interval until stop is called.
+func (w *otlpWriter) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	interval := w.cfg.Interval
+	if interval <= 0 {
+		interval = defaultRemoteWriteInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if w.conn != nil {
+					w.conn.Close()
+				}
+				return
+			case <-ticker.C:
+			}
+			if err := w.push(ctx); err != nil && ctx.Err() == nil {
+				otlpFailures.Inc()
+				level.Warn(w.log).Log("msg", "Failed to push metrics", "err", err)
+			}
+		}
+	}()
+}
+
+// stop stops pushing, a running push is cancelled.
+func (w *otlpWriter) stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// push gathers the metrics and sends them to the OTLP endpoint.
+func (w *otlpWriter) push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		// the metrics which could be gathered are pushed anyway
+		level.Warn(w.log).Log("msg", "Failed to gather some metrics", "err", err)
+	}
+	body, points := encodeOTLPRequest(families, w.resourceAttributes(), w.started, time.Now())
+	if points == 0 {
+		return nil
+	}
+	if w.conn != nil {
+		err = w.pushGRPC(ctx, body)
+	} else {
+		err = w.pushHTTP(ctx, body)
+	}
+	if err != nil {
+		return err
+	}
+	otlpDataPoints.Add(float64(points))
+	return nil
+}
+
+// pushHTTP posts the request to the OTLP/HTTP endpoint. The default path is
+// added to endpoints without path.
+func (w *otlpWriter) pushHTTP(ctx context.Context, body []byte) error {
+	endpoint := w.cfg.Endpoint
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = otlpMetricsPath
+		endpoint = u.String()
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "sql_exporter")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// pushGRPC calls the Export method of the OTLP metrics service with the
+// encoded request.
+func (w *otlpWriter) pushGRPC(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	for k, v := range w.cfg.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+	req, resp := rawMessage(body), rawMessage(nil)
+	return w.conn.Invoke(ctx, otlpExportMethod, &req, &resp, grpc.ForceCodec(rawCodec{}))
+}
+
+// resourceAttributes returns the configured resource attributes, with
+// service.name defaulting to sql_exporter.
+func (w *otlpWriter) resourceAttributes() map[string]string {
+	attrs := map[string]string{"service.name": "sql_exporter"}
+	for k, v := range w.cfg.ResourceAttributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// rawMessage is an already encoded protobuf message.
+type rawMessage []byte
+
+// rawCodec passes encoded messages through, so the OTLP messages don't
+// require generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *m, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// encodeOTLPRequest encodes the metric families as
+// ExportMetricsServiceRequest protobuf message, see
+// github.com/open-telemetry/opentelemetry-proto. Counters are exported as
+// cumulative monotonic sums, gauges and untyped metrics as gauges. It returns
+// the message along with the number of data points.
+func encodeOTLPRequest(families []*dto.MetricFamily, resource map[string]string, start, now time.Time) ([]byte, int) {
+	points := 0
+	var metrics []byte
+	for _, mf := range families {
+		var data []byte
+		var field protowire.Number
+		for _, m := range mf.GetMetric() {
+			ts := uint64(now.UnixNano())
+			if m.TimestampMs != nil {
+				ts = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+			}
+			var point []byte
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				field = 7
+				point = encodeNumberDataPoint(m, uint64(start.UnixNano()), ts, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				field = 5
+				point = encodeNumberDataPoint(m, 0, ts, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				field = 5
+				point = encodeNumberDataPoint(m, 0, ts, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				field = 9
+				point = encodeHistogramDataPoint(m, uint64(start.UnixNano()), ts)
+			case dto.MetricType_SUMMARY:
+				field = 11
+				point = encodeSummaryDataPoint(m, uint64(start.UnixNano()), ts)
+			default:
+				continue
+			}
+			data = protowire.AppendTag(data, 1, protowire.BytesType)
+			data = protowire.AppendBytes(data, point)
+			points++
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch field {
+		case 7:
+			data = protowire.AppendTag(data, 2, protowire.VarintType)
+			data = protowire.AppendVarint(data, otlpTemporalityCumulative)
+			data = protowire.AppendTag(data, 3, protowire.VarintType)
+			data = protowire.AppendVarint(data, 1)
+		case 9:
+			data = protowire.AppendTag(data, 2, protowire.VarintType)
+			data = protowire.AppendVarint(data, otlpTemporalityCumulative)
+		}
+		var metric []byte
+		metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+		metric = protowire.AppendString(metric, mf.GetName())
+		metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+		metric = protowire.AppendString(metric, mf.GetHelp())
+		metric = protowire.AppendTag(metric, field, protowire.BytesType)
+		metric = protowire.AppendBytes(metric, data)
+		metrics = protowire.AppendTag(metrics, 2, protowire.BytesType)
+		metrics = protowire.AppendBytes(metrics, metric)
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "sql_exporter")
+	scopeMetrics := protowire.AppendTag(nil, 1, protowire.BytesType)
+	scopeMetrics = protowire.AppendBytes(scopeMetrics, scope)
+	scopeMetrics = append(scopeMetrics, metrics...)
+
+	var res []byte
+	keys := make([]string, 0, len(resource))
+	for k := range resource {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res = protowire.AppendTag(res, 1, protowire.BytesType)
+		res = protowire.AppendBytes(res, encodeKeyValue(k, resource[k]))
+	}
+	resourceMetrics := protowire.AppendTag(nil, 1, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, res)
+	resourceMetrics = protowire.AppendTag(resourceMetrics, 2, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, scopeMetrics)
+
+	req := protowire.AppendTag(nil, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, resourceMetrics)
+	return req, points
+}
+
+// encodeKeyValue encodes a KeyValue message with a string value.
+func encodeKeyValue(key, value string) []byte {
+	var v []byte
+	v = protowire.AppendTag(v, 1, protowire.BytesType)
+	v = protowire.AppendString(v, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, v)
+	return kv
+}
+
+// appendAttributes appends the labels of the metric as attributes with the
+// given field number.
+func appendAttributes(b []byte, field protowire.Number, m *dto.Metric) []byte {
+	for _, lp := range m.GetLabel() {
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeKeyValue(lp.GetName(), lp.GetValue()))
+	}
+	return b
+}
+
+// appendTimes appends the start and end time of a data point, a start time
+// of 0 is omitted.
+func appendTimes(b []byte, start, ts uint64) []byte {
+	if start > 0 {
+		b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, start)
+	}
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, ts)
+}
+
+func encodeNumberDataPoint(m *dto.Metric, start, ts uint64, value float64) []byte {
+	var p []byte
+	p = appendTimes(p, start, ts)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(value))
+	return appendAttributes(p, 7, m)
+}
+
+// encodeHistogramDataPoint converts the cumulative buckets of Prometheus to
+// the counts per bucket of OpenTelemetry.
+func encodeHistogramDataPoint(m *dto.Metric, start, ts uint64) []byte {
+	h := m.GetHistogram()
+	var p []byte
+	p = appendTimes(p, start, ts)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, h.GetSampleCount())
+	p = protowire.AppendTag(p, 5, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(h.GetSampleSum()))
+	var counts, bounds []byte
+	previous := uint64(0)
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-previous)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+		previous = b.GetCumulativeCount()
+	}
+	// the last bucket counts the observations above the highest bound
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-previous)
+	p = protowire.AppendTag(p, 6, protowire.BytesType)
+	p = protowire.AppendBytes(p, counts)
+	if len(bounds) > 0 {
+		p = protowire.AppendTag(p, 7, protowire.BytesType)
+		p = protowire.AppendBytes(p, bounds)
+	}
+	return appendAttributes(p, 9, m)
+}
+
+func encodeSummaryDataPoint(m *dto.Metric, start, ts uint64) []byte {
+	s := m.GetSummary()
+	var p []byte
+	p = appendTimes(p, start, ts)
+	p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, s.GetSampleCount())
+	p = protowire.AppendTag(p, 5, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, math.Float64bits(s.GetSampleSum()))
+	for _, q := range s.GetQuantile() {
+		var v []byte
+		v = protowire.AppendTag(v, 1, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(q.GetQuantile()))
+		v = protowire.AppendTag(v, 2, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(q.GetValue()))
+		p = protowire.AppendTag(p, 6, protowire.BytesType)
+		p = protowire.AppendBytes(p, v)
+	}
+	return appendAttributes(p, 7, m)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoFields returns the raw values of the field of the protobuf message,
+// fixed64 values as 8 bytes in little endian.
+func protoFields(t *testing.T, b []byte, field protowire.Number) [][]byte {
+	var values [][]byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			value, n = b[:8], 8
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			value = protowire.AppendVarint(nil, v)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field: %v", protowire.ParseError(n))
+		}
+		if num == field {
+			values = append(values, value)
+		}
+		b = b[n:]
+	}
+	return values
+}
+
+func Test_encodeOTLPRequest(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_duration_seconds",
+		Help:    "Test",
+		Buckets: []float64{0.5},
+	})
+	hist.Observe(0.25)
+	hist.Observe(2)
+	registry.MustRegister(hist)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, points := encodeOTLPRequest(families, map[string]string{"service.name": "db"}, time.Unix(1000, 0), time.Unix(1500, 0))
+	if points != 1 {
+		t.Fatalf("expected 1 data point, got %d", points)
+	}
+	resourceMetrics := protoFields(t, req, 1)[0]
+	resource := protoFields(t, resourceMetrics, 1)[0]
+	if !bytes.Contains(resource, []byte("service.name")) {
+		t.Errorf("expected the resource attributes, got %q", resource)
+	}
+	scopeMetrics := protoFields(t, resourceMetrics, 2)[0]
+	metric := protoFields(t, scopeMetrics, 2)[0]
+	if name := string(protoFields(t, metric, 1)[0]); name != "test_duration_seconds" {
+		t.Errorf("unexpected metric name %q", name)
+	}
+	histogram := protoFields(t, metric, 9)
+	if len(histogram) != 1 {
+		t.Fatalf("expected the metric to be a histogram")
+	}
+	point := protoFields(t, histogram[0], 1)[0]
+	if start := binary.LittleEndian.Uint64(protoFields(t, point, 2)[0]); start != uint64(time.Unix(1000, 0).UnixNano()) {
+		t.Errorf("unexpected start time %d", start)
+	}
+	if count := binary.LittleEndian.Uint64(protoFields(t, point, 4)[0]); count != 2 {
+		t.Errorf("expected count 2, got %d", count)
+	}
+	counts := protoFields(t, point, 6)[0]
+	if len(counts) != 16 || binary.LittleEndian.Uint64(counts) != 1 || binary.LittleEndian.Uint64(counts[8:]) != 1 {
+		t.Errorf("expected one observation per bucket, got %v", counts)
+	}
+	bounds := protoFields(t, point, 7)[0]
+	if len(bounds) != 8 || math.Float64frombits(binary.LittleEndian.Uint64(bounds)) != 0.5 {
+		t.Errorf("expected the bound 0.5, got %v", bounds)
+	}
+}
+
+func Test_otlpWriterPush(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test"})
+	gauge.Set(42)
+	registry.MustRegister(gauge)
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpMetricsPath || r.Header.Get("Api-Key") != "secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	cfg := &OTLP{
+		Endpoint:           server.URL,
+		Headers:            map[string]string{"Api-Key": "secret"},
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+	}
+	w, err := newOTLPWriter(log.NewNopLogger(), cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.push(context.Background()); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	for _, expected := range []string{"test_gauge", "service.name", "sql_exporter", "deployment.environment"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("expected %s to be pushed, got %q", expected, body)
+		}
+	}
+
+	cfg.Headers = nil
+	if w, err = newOTLPWriter(log.NewNopLogger(), cfg, registry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.push(context.Background()); err == nil {
+		t.Errorf("expected error for rejected push")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// packsDir holds query packs, <name>.yml files which take precedence over
+// the bundled packs of the same name.
+var packsDir string
+
+// bundledPacks are the query packs shipped with the exporter. A pack lists
+// queries like a job does.
+var bundledPacks = map[string]string{
+	"postgres_standard": `
+queries:
+- name: pg_database_size_bytes
+  help: Size of the database in bytes
+  labels: ['datname']
+  values: ['bytes']
+  query: |
+    SELECT datname::text, pg_database_size(datname)::float AS bytes
+    FROM pg_database WHERE datallowconn
+- name: pg_connections
+  help: Number of connections by database and state
+  labels: ['datname', 'state']
+  values: ['count']
+  query: |
+    SELECT datname::text, COALESCE(state, 'unknown')::text AS state, COUNT(*)::float AS count
+    FROM pg_stat_activity WHERE datname IS NOT NULL GROUP BY datname, state
+- name: pg_max_connections
+  help: Maximum number of connections
+  values: ['max_connections']
+  query: "SELECT setting::float AS max_connections FROM pg_settings WHERE name = 'max_connections'"
+- name: pg_transactions_total
+  help: Number of committed and rolled back transactions by database
+  type: counter
+  labels: ['datname']
+  values: ['xact_commit', 'xact_rollback']
+  query: |
+    SELECT datname::text, xact_commit::float, xact_rollback::float
+    FROM pg_stat_database WHERE datname IS NOT NULL
+- name: pg_deadlocks_total
+  help: Number of deadlocks by database
+  type: counter
+  labels: ['datname']
+  values: ['deadlocks']
+  query: "SELECT datname::text, deadlocks::float FROM pg_stat_database WHERE datname IS NOT NULL"
+- name: pg_locks
+  help: Number of locks by mode
+  labels: ['mode']
+  values: ['count']
+  query: "SELECT mode::text, COUNT(*)::float AS count FROM pg_locks GROUP BY mode"
+- name: pg_replication_lag_seconds
+  help: Time since the last transaction replayed on the replica
+  run_on: replica
+  values: ['lag']
+  query: "SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)::float AS lag"
+`,
+	"mysql_innodb": `
+queries:
+- name: mysql_innodb_status
+  help: InnoDB status variables
+  metric_name_column: Variable_name
+  value_column: Value
+  query: "SHOW GLOBAL STATUS LIKE 'Innodb\\_%'"
+- name: mysql_threads
+  help: Number of threads by state
+  metric_name_column: Variable_name
+  value_column: Value
+  query: "SHOW GLOBAL STATUS LIKE 'Threads\\_%'"
+- name: mysql_innodb_buffer_pool_pages
+  help: Pages of the InnoDB buffer pool by state
+  labels: ['pool_id']
+  values: ['data', 'free', 'dirty']
+  query: |
+    SELECT CAST(POOL_ID AS CHAR) AS pool_id, DATABASE_PAGES AS data, FREE_BUFFERS AS free,
+      MODIFIED_DATABASE_PAGES AS dirty
+    FROM information_schema.INNODB_BUFFER_POOL_STATS
+- name: mysql_table_size_bytes
+  help: Size of the data and indexes of the largest tables
+  labels: ['schema_name', 'table_name']
+  values: ['data', 'index']
+  query: |
+    SELECT TABLE_SCHEMA AS schema_name, TABLE_NAME AS table_name, DATA_LENGTH AS data,
+      INDEX_LENGTH AS 'index'
+    FROM information_schema.TABLES
+    WHERE TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')
+    ORDER BY DATA_LENGTH + INDEX_LENGTH DESC LIMIT 50
+- name: mysql_replication_lag_seconds
+  help: Seconds the replica is behind the source
+  run_on: replica
+  values: ['Seconds_Behind_Master']
+  query: "SHOW SLAVE STATUS"
+`,
+}
+
+// pack is a query pack, the queries are kept as YAML so the queries of the
+// job override them field by field.
+type pack struct {
+	Queries []interface{} `yaml:"queries"`
+}
+
+// readPack returns the query pack from packsDir or the bundled ones.
+func readPack(name string) (pack, error) {
+	p := pack{}
+	buf, err := packSource(name)
+	if err != nil {
+		return p, err
+	}
+	if err := yaml.Unmarshal(buf, &p); err != nil {
+		return p, fmt.Errorf("query pack %q: %v", name, err)
+	}
+	return p, nil
+}
+
+func packSource(name string) ([]byte, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid query pack name %q", name)
+	}
+	if packsDir != "" {
+		for _, ext := range []string{".yml", ".yaml"} {
+			buf, err := ioutil.ReadFile(filepath.Join(packsDir, name+ext))
+			if err == nil {
+				return buf, nil
+			}
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	if src, found := bundledPacks[name]; found {
+		return []byte(src), nil
+	}
+	names := make([]string, 0, len(bundledPacks))
+	for n := range bundledPacks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown query pack %q, bundled packs are %s", name, strings.Join(names, ", "))
+}
+
+// includePacks adds the queries of the packs included by the jobs and
+// modules to their queries. Queries of the job with the name of a pack query
+// override its fields, e.g. the interval or enabled. Documents without
+// includes are returned as is.
+func includePacks(buf []byte) ([]byte, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		// the error is reported by the decoding of the config
+		return buf, nil
+	}
+	var jobs []map[interface{}]interface{}
+	if list, ok := doc["jobs"].([]interface{}); ok {
+		for _, item := range list {
+			if job, ok := item.(map[interface{}]interface{}); ok {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	if modules, ok := doc["modules"].(map[interface{}]interface{}); ok {
+		for _, item := range modules {
+			if module, ok := item.(map[interface{}]interface{}); ok {
+				jobs = append(jobs, module)
+			}
+		}
+	}
+	included := false
+	for _, job := range jobs {
+		includes, found := job["include"]
+		if !found {
+			continue
+		}
+		delete(job, "include")
+		included = true
+		names, ok := includes.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("job %v: include must be a list of query packs", job["name"])
+		}
+		var queries []interface{}
+		for _, name := range names {
+			p, err := readPack(fmt.Sprint(name))
+			if err != nil {
+				return nil, fmt.Errorf("job %v: %v", job["name"], err)
+			}
+			queries = append(queries, p.Queries...)
+		}
+		if own, found := job["queries"]; found && own != nil {
+			job["queries"] = mergeYAML(queries, own)
+		} else {
+			job["queries"] = queries
+		}
+	}
+	if !included {
+		return buf, nil
+	}
+	return yaml.Marshal(doc)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_bundledPacks(t *testing.T) {
+	for name := range bundledPacks {
+		t.Run(name, func(t *testing.T) {
+			config := fmt.Sprintf("jobs:\n- name: packs\n  interval: 1m\n  connections: ['postgres://localhost/postgres']\n  include: [%s]\n", name)
+			if problems := checkConfig(strings.NewReader(config)); len(problems) > 0 {
+				t.Errorf("unexpected problems: %v", problems)
+			}
+		})
+	}
+}
+
+func Test_includePacks(t *testing.T) {
+	config := `
+jobs:
+- name: postgres
+  interval: 1m
+  connections: ['postgres://localhost/postgres']
+  include: [postgres_standard]
+  queries:
+  - name: pg_locks
+    enabled: false
+  - name: pg_database_size_bytes
+    timeout: 30s
+  - name: app_users
+    help: Users of the app
+    values: ['count']
+    query: 'SELECT COUNT(*) AS count FROM users'
+`
+	f, err := parseConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := make(map[string]*Query)
+	for _, q := range f.Jobs[0].Queries {
+		queries[q.Name] = q
+	}
+	if _, found := queries["pg_locks"]; found {
+		t.Error("expected the disabled pack query to be dropped")
+	}
+	size := queries["pg_database_size_bytes"]
+	if size == nil || size.Timeout.String() != "30s" || !strings.Contains(size.Query, "pg_database_size") || size.Help == "" {
+		t.Errorf("expected the pack query with the overridden timeout, got %+v", size)
+	}
+	if queries["pg_connections"] == nil || queries["app_users"] == nil {
+		t.Errorf("expected the other pack queries and the own queries, got %v", queries)
+	}
+}
+
+func Test_includePacks_dir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pack := "queries:\n- name: custom\n  help: Custom\n  values: ['count']\n  query: 'SELECT 1 AS count'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "postgres_standard.yml"), []byte(pack), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packsDir = dir
+	defer func() { packsDir = "" }()
+
+	f, err := parseConfig(strings.NewReader("jobs:\n- name: custom\n  interval: 1m\n  connections: ['postgres://localhost/postgres']\n  include: [postgres_standard]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Jobs[0].Queries) != 1 || f.Jobs[0].Queries[0].Name != "custom" {
+		t.Errorf("expected the pack of the directory to take precedence, got %v", f.Jobs[0].Queries)
+	}
+
+	_, err = parseConfig(strings.NewReader("jobs:\n- name: missing\n  interval: 1m\n  include: [oracle_standard]\n"))
+	if err == nil || !strings.Contains(err.Error(), `unknown query pack "oracle_standard"`) {
+		t.Errorf("expected an unknown query pack error, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// strictPolicy refuses to load a config with statements violating the
+// policy, instead of skipping the violating queries and jobs.
+var strictPolicy bool
+
+// policyKeywordRE matches a keyword of a policy rule
+var policyKeywordRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (r *PolicyRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var keyword string
+	if err := unmarshal(&keyword); err == nil {
+		*r = PolicyRule{Keyword: keyword}
+		return nil
+	}
+	type plain PolicyRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return fmt.Errorf("policy rule must be a keyword or a map with keyword or regex: %v", err)
+	}
+	return nil
+}
+
+// validate checks the rules and compiles their regexes.
+func (p *Policy) validate() error {
+	for _, rules := range [][]*PolicyRule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			if r == nil {
+				continue
+			}
+			if (r.Keyword == "") == (r.Regex == "") {
+				return fmt.Errorf("rule must have either a keyword or a regex")
+			}
+			if r.Keyword != "" && !policyKeywordRE.MatchString(r.Keyword) {
+				return fmt.Errorf("invalid keyword %q, must be a single word", r.Keyword)
+			}
+			if r.Regex != "" {
+				re, err := regexp.Compile(r.Regex)
+				if err != nil {
+					return fmt.Errorf("invalid regex %q: %v", r.Regex, err)
+				}
+				r.re = re
+			}
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) String() string {
+	if r.Regex != "" {
+		return fmt.Sprintf("regex %q", r.Regex)
+	}
+	return "keyword " + strings.ToUpper(r.Keyword)
+}
+
+// matches returns whether the rule matches the statement. Keywords are
+// looked up like the writes of read only connections.
+func (r *PolicyRule) matches(statement string) bool {
+	if r.re != nil {
+		return r.re.MatchString(statement)
+	}
+	keyword := strings.ToUpper(r.Keyword)
+	for _, backslash := range []bool{false, true} {
+		for _, word := range sqlWords(statement, backslash) {
+			if word == keyword {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns an error if the statement violates the policy.
+func (p *Policy) check(statement string) error {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.Deny {
+		if r != nil && r.matches(statement) {
+			return fmt.Errorf("denied by %s", r)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, r := range p.Allow {
+		if r != nil && r.matches(statement) {
+			return nil
+		}
+	}
+	return fmt.Errorf("not matched by any allow rule")
+}
+
+// jobViolations returns the violations of the statements the job runs
+// besides its queries.
+func (p *Policy) jobViolations(j *Job) []error {
+	var violations []error
+	add := func(what, statement string) {
+		if err := p.check(statement); err != nil {
+			violations = append(violations, fmt.Errorf("%s: %v", what, err))
+		}
+	}
+	for _, st := range j.StartupSQL {
+		if st != nil {
+			add(fmt.Sprintf("startup_sql %q", st.SQL), st.SQL)
+		}
+	}
+	for _, cc := range j.Connections {
+		if cc != nil && cc.PrimaryCheckSQL != "" {
+			add("primary_check_sql", cc.PrimaryCheckSQL)
+		}
+	}
+	if j.TargetsQuery != nil && j.TargetsQuery.Query != "" {
+		add("targets_query", j.TargetsQuery.Query)
+	}
+	return violations
+}
+
+// queryViolations returns the violations of the statements of the query. A
+// procedure is checked as CALL of its name.
+func (p *Policy) queryViolations(q *Query, queries map[string]string) []error {
+	var violations []error
+	add := func(what, statement string) {
+		if err := p.check(statement); err != nil {
+			violations = append(violations, fmt.Errorf("%s: %v", what, err))
+		}
+	}
+	query := q.Query
+	if query == "" && q.QueryRef != "" {
+		query = queries[q.QueryRef]
+	}
+	if query != "" {
+		add("query", query)
+	}
+	for _, stmt := range q.SetupSQL {
+		add(fmt.Sprintf("setup_sql %q", stmt), stmt)
+	}
+	for _, param := range q.Params {
+		if param != nil && param.Query != "" {
+			add(fmt.Sprintf("param %q", param.Name), param.Query)
+		}
+	}
+	if q.Procedure != nil {
+		add("procedure", "CALL "+q.Procedure.Name)
+	}
+	return violations
+}
+
+// violations returns the violations of the job and its queries.
+func (p *Policy) violations(j *Job, queries map[string]string) []error {
+	violations := p.jobViolations(j)
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		for _, err := range p.queryViolations(q, queries) {
+			violations = append(violations, fmt.Errorf("query %q: %v", q.Name, err))
+		}
+	}
+	return violations
+}
+
+// policyViolations returns the violations of the policy by all jobs and
+// modules.
+func (f File) policyViolations() []error {
+	if f.Policy == nil {
+		return nil
+	}
+	var violations []error
+	for _, job := range f.Jobs {
+		if job == nil {
+			continue
+		}
+		for _, err := range f.Policy.violations(job, f.Queries) {
+			violations = append(violations, fmt.Errorf("job %q: %v", job.Name, err))
+		}
+	}
+	for name, module := range f.Modules {
+		if module == nil {
+			continue
+		}
+		for _, err := range f.Policy.violations(module, f.Queries) {
+			violations = append(violations, fmt.Errorf("module %q: %v", name, err))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testPolicyConfigYAML = `
+policy:
+  deny:
+  - 'DELETE'
+  - regex: '(?i)pg_sleep'
+jobs:
+- name: "policy"
+  interval: '5m'
+  connections:
+  - 'sqlite://:memory:'
+  queries:
+  - name: "allowed"
+    help: "Allowed"
+    values: ["value"]
+    query: "SELECT 1 AS value -- delete me later"
+  - name: "cleanup"
+    help: "Cleanup"
+    values: ["value"]
+    setup_sql: ["DELETE FROM t"]
+    query: "SELECT 1 AS value"
+  - name: "slow"
+    help: "Slow"
+    values: ["value"]
+    query: "SELECT PG_SLEEP(10), 1 AS value"
+`
+
+func TestPolicy(t *testing.T) {
+	f, err := parseConfig(strings.NewReader(testPolicyConfigYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := f.Jobs[0]
+	if err := job.Init(log.NewNopLogger(), f.Queries); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range job.Queries {
+		if skipped := q.desc == nil; skipped != (q.Name != "allowed") {
+			t.Errorf("query %q: expected skipped to be %v", q.Name, !skipped)
+		}
+	}
+
+	problems := checkConfig(strings.NewReader(testPolicyConfigYAML))
+	expected := []string{
+		`job "policy": query "cleanup": setup_sql "DELETE FROM t": denied by keyword DELETE`,
+		`job "policy": query "slow": query: denied by regex "(?i)pg_sleep"`,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("expected problem %q, got %q", expected[i], problem)
+		}
+	}
+
+	strictPolicy = true
+	defer func() { strictPolicy = false }()
+	if _, err := parseConfig(strings.NewReader(testPolicyConfigYAML)); err == nil || !strings.HasPrefix(err.Error(), "policy violated: ") {
+		t.Errorf("expected the strict policy to refuse the config, got %v", err)
+	}
+}
+
+func TestPolicy_read(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(testPolicyConfigYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Read(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Policy == nil || len(f.Policy.Deny) != 2 {
+		t.Fatalf("expected the policy of the config file, got %+v", f.Policy)
+	}
+	if f.Jobs[0].policy != f.Policy {
+		t.Errorf("expected the policy to apply to the job")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.yml"), []byte("policy:\n  deny: ['INSERT']\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(dir); err == nil || !strings.Contains(err.Error(), "policy is set more than once") {
+		t.Errorf("expected an error for a policy in two files, got %v", err)
+	}
+}
+
+func TestPolicy_check(t *testing.T) {
+	for _, tc := range []struct {
+		policy    string
+		statement string
+		err       string
+	}{
+		{policy: "deny: ['DROP']", statement: "SELECT 'drop'"},
+		{policy: "deny: ['drop']", statement: "drop table t", err: "denied by keyword DROP"},
+		{policy: "allow: [{regex: '^\\s*(SELECT|SHOW)\\b'}]", statement: "  SHOW STATUS"},
+		{policy: "allow: [{regex: '^\\s*(SELECT|SHOW)\\b'}]", statement: "CALL p()", err: "not matched by any allow rule"},
+		{policy: "allow: ['SELECT']\ndeny: ['INTO']", statement: "SELECT * INTO b FROM a", err: "denied by keyword INTO"},
+	} {
+		f, err := parseConfig(strings.NewReader("policy:\n  " + strings.Replace(tc.policy, "\n", "\n  ", -1)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.policy, err)
+		}
+		err = f.Policy.check(tc.statement)
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("%s: %s: expected error %q, got %v", tc.policy, tc.statement, tc.err, err)
+		}
+	}
+
+	for _, policy := range []string{
+		"deny: [{keyword: 'DROP', regex: 'DROP'}]",
+		"deny: ['DROP TABLE']",
+		"allow: [{regex: '('}]",
+	} {
+		if _, err := parseConfig(strings.NewReader("policy:\n  " + policy)); err == nil {
+			t.Errorf("%s: expected an invalid policy", policy)
+		}
+	}
+}
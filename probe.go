@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+// ProbeHandler runs the queries of a module against the target DSN given in
+// the request and returns the resulting metrics, like the blackbox exporter
+// does for its probes.
+func (e *Exporter) ProbeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("module")
+
+	e.RLock()
+	job, err := e.probeJob(name, target)
+	queries := e.cfg.Queries
+	e.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := job.Init(e.logger, queries); err != nil {
+		http.Error(w, fmt.Sprintf("failed to initialize module %q: %s", name, err), http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		job.Stop()
+		job.closeConnections()
+	}()
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sql_exporter_probe_success",
+		Help: "Whether all queries of the probe succeeded",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sql_exporter_probe_duration_seconds",
+		Help: "Duration of the probe in seconds",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess, probeDuration)
+
+	start := time.Now()
+	job.initConnections()
+	if err := job.runOnce(); err != nil || !job.allQueriesSucceeded(start) {
+		level.Warn(job.log).Log("msg", "Probe failed", "err", err)
+	} else {
+		probeSuccess.Set(1)
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+
+	// the queries already ran, the job must not run them again on collection
+	job.Mode = jobModeInterval
+	if err := job.register(registry); err != nil {
+		http.Error(w, fmt.Sprintf("failed to register metrics: %s", err), http.StatusInternalServerError)
+		return
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeJob returns a copy of the module with the target as its only
+// connection. Must be called with the read lock held.
+func (e *Exporter) probeJob(name, target string) (*Job, error) {
+	if name == "" && len(e.cfg.Modules) == 1 {
+		for n := range e.cfg.Modules {
+			name = n
+		}
+	}
+	module, found := e.cfg.Modules[name]
+	if !found || module == nil {
+		return nil, fmt.Errorf("unknown module %q", name)
+	}
+	// copy the module so concurrent probes don't share any state
+	buf, err := yaml.Marshal(module)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := yaml.Unmarshal(buf, job); err != nil {
+		return nil, err
+	}
+	if job.Name == "" {
+		job.Name = name
+	}
+	job.Connections = []*ConnectionConfig{{URL: target}}
+	// the target comes from the request, so it must not read files
+	if err := job.resolveConnections(false); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// allQueriesSucceeded returns whether every query of the job ran successfully
+// on every connection since the given time.
+func (j *Job) allQueriesSucceeded(since time.Time) bool {
+	for _, q := range j.Queries {
+		if q == nil || q.desc == nil {
+			continue
+		}
+		for _, conn := range j.conns {
+			if !q.succeededSince(conn, since) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// succeededSince returns whether the query was skipped on the connection or
+// its last run on the connection succeeded since the given time.
+func (q *Query) succeededSince(conn *connection, since time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+	if !q.skipped[conn].Before(since) {
+		return true
+	}
+	for i := len(q.history) - 1; i >= 0; i-- {
+		run := q.history[i]
+		if run.Driver == conn.driver && run.Host == conn.host && run.Database == conn.database {
+			return run.Error == "" && !run.Time.Before(since)
+		}
+	}
+	return false
+}
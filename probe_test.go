@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExporter_ProbeHandler(t *testing.T) {
+	if err := setMocks(map[string][]*MockResult{
+		"app":    {{Match: "answer", Rows: []map[string]interface{}{{"value": 42}}}},
+		"broken": {{Match: "answer", Error: "relation does not exist"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+	module := func() *Job {
+		return &Job{Queries: []*Query{{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT value FROM answer"}}}
+	}
+	e := &Exporter{logger: log.NewNopLogger()}
+	e.cfg.Modules = map[string]*Job{"mocked": module()}
+
+	probe := func(params url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ProbeHandler(rec, httptest.NewRequest("GET", "/probe?"+params.Encode(), nil))
+		return rec
+	}
+
+	// the only module is used by default
+	rec := probe(url.Values{"target": {"mock://app/db"}})
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the probe to succeed, got %d: %s", rec.Code, body)
+	}
+	for _, expected := range []string{
+		"sql_exporter_probe_success 1",
+		"sql_exporter_probe_duration_seconds ",
+		`sql_answer{col="value",database="db",driver="mock",host="app",sql_job="mocked",user=""} 42`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in the probe result, got:\n%s", expected, body)
+		}
+	}
+
+	rec = probe(url.Values{"module": {"mocked"}, "target": {"mock://broken/db"}})
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, "sql_exporter_probe_success 0") || strings.Contains(body, "sql_answer") {
+		t.Errorf("expected the failed probe without query metrics, got %d:\n%s", rec.Code, body)
+	}
+
+	// the target comes from the request, its templates must not read files
+	target := `postgres://monitor:{{ file "/etc/hostname" }}@db/postgres`
+	job, err := e.probeJob("mocked", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := job.Connections[0].URL; got != target {
+		t.Errorf("expected the template of the target not to be rendered, got %q", got)
+	}
+
+	e.cfg.Modules["other"] = module()
+	for _, params := range []url.Values{
+		{"module": {"mocked"}},
+		{"module": {"missing"}, "target": {"mock://app/db"}},
+		// the module must be given if there are several
+		{"target": {"mock://app/db"}},
+	} {
+		if rec := probe(params); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected a bad request, got %d: %s", params, rec.Code, rec.Body.String())
+		}
+	}
+}
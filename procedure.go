@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// procedureNameRE matches the names of stored procedures, optionally
+// qualified by schema or package, which are put into the call as is
+var procedureNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_$#]*(\.[a-zA-Z_][a-zA-Z0-9_$#]*){0,2}$`)
+
+func (p *Procedure) validate() error {
+	if !procedureNameRE.MatchString(p.Name) {
+		return fmt.Errorf("has invalid name %q", p.Name)
+	}
+	for _, out := range p.Out {
+		if !validLabelNameRE.MatchString(out) {
+			return fmt.Errorf("has invalid out parameter %q", out)
+		}
+	}
+	return nil
+}
+
+// callProcedure calls the stored procedure of the query with the syntax of
+// the driver. OUT parameters are bound as output parameters on SQL Server
+// and Oracle, read from session variables on MySQL and from the row
+// returned by CALL on PostgreSQL.
+func (q *Query) callProcedure(ctx context.Context, conn *connection) (resultRows, func(), error) {
+	p := q.Procedure
+	args, err := q.paramValues(ctx, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = paramPlaceholder(conn.driver, i+1)
+	}
+	db := q.db(conn)
+	switch conn.driver {
+	case "postgres":
+		// INOUT parameters are passed as NULL and returned as a row
+		for range p.Out {
+			placeholders = append(placeholders, "NULL")
+		}
+		rows, err := db.QueryxContext(ctx, fmt.Sprintf("CALL %s(%s)", p.Name, strings.Join(placeholders, ", ")), args...)
+		return rows, func() {}, err
+	case "mysql":
+		if len(p.Out) == 0 {
+			rows, err := db.QueryxContext(ctx, fmt.Sprintf("CALL %s(%s)", p.Name, strings.Join(placeholders, ", ")), args...)
+			return rows, func() {}, err
+		}
+		// the session variables are only visible on the same connection
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		vars := make([]string, len(p.Out))
+		for i, out := range p.Out {
+			vars[i] = fmt.Sprintf("@sql_exporter_%s AS %s", out, out)
+			placeholders = append(placeholders, "@sql_exporter_"+out)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("CALL %s(%s)", p.Name, strings.Join(placeholders, ", ")), args...); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		rows, err := tx.QueryxContext(ctx, "SELECT "+strings.Join(vars, ", "))
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		return rows, func() { tx.Rollback() }, nil
+	case "sqlserver", "oracle":
+		if len(p.Out) == 0 {
+			if conn.driver == "oracle" {
+				return nil, nil, fmt.Errorf("procedures without out parameters are not supported on oracle")
+			}
+			rows, err := db.QueryxContext(ctx, fmt.Sprintf("EXEC %s %s", p.Name, strings.Join(placeholders, ", ")), args...)
+			return rows, func() {}, err
+		}
+		values := make([]sql.NullString, len(p.Out))
+		for i, out := range p.Out {
+			if conn.driver == "sqlserver" {
+				placeholders = append(placeholders, "@"+out+" OUTPUT")
+				args = append(args, sql.Named(out, sql.Out{Dest: &values[i]}))
+			} else {
+				placeholders = append(placeholders, paramPlaceholder(conn.driver, len(args)+1))
+				args = append(args, sql.Out{Dest: &values[i]})
+			}
+		}
+		call := fmt.Sprintf("EXEC %s %s", p.Name, strings.Join(placeholders, ", "))
+		if conn.driver == "oracle" {
+			call = fmt.Sprintf("BEGIN %s(%s); END;", p.Name, strings.Join(placeholders, ", "))
+		}
+		if _, err := db.ExecContext(ctx, call, args...); err != nil {
+			return nil, nil, err
+		}
+		row := make(map[string]cachedColumn, len(p.Out))
+		for i, out := range p.Out {
+			var value interface{}
+			if values[i].Valid {
+				value = values[i].String
+			}
+			row[out] = encodeColumn(value)
+		}
+		return &cachedRows{rows: []map[string]cachedColumn{row}}, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("stored procedures are not supported on %s", conn.driver)
+	}
+}
+
+// paramPlaceholder returns the placeholder of the nth parameter in the syntax
+// of the driver.
+func paramPlaceholder(driver string, n int) string {
+	switch driver {
+	case "postgres":
+		return fmt.Sprintf("$%d", n)
+	case "sqlserver":
+		return fmt.Sprintf("@p%d", n)
+	case "oracle":
+		return fmt.Sprintf(":%d", n)
+	default:
+		return "?"
+	}
+}
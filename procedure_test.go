@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestProcedure_validate(t *testing.T) {
+	for _, tc := range []struct {
+		p   Procedure
+		err string
+	}{
+		{p: Procedure{Name: "dbo.monitoring_stats", Out: []string{"sessions", "blocked"}}},
+		{p: Procedure{Name: "monitoring_pkg.stats$v2"}},
+		{p: Procedure{Name: "stats; DROP TABLE users"}, err: `has invalid name "stats; DROP TABLE users"`},
+		{p: Procedure{Name: "stats", Out: []string{"@count"}}, err: `has invalid out parameter "@count"`},
+	} {
+		err := tc.p.validate()
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func Test_paramPlaceholder(t *testing.T) {
+	for driver, expected := range map[string]string{
+		"postgres":  "$2",
+		"sqlserver": "@p2",
+		"oracle":    ":2",
+		"mysql":     "?",
+	} {
+		if got := paramPlaceholder(driver, 2); got != expected {
+			t.Errorf("%s: expected %q, got %q", driver, expected, got)
+		}
+	}
+}
+
+func TestQuery_callProcedureUnsupported(t *testing.T) {
+	q := &Query{
+		Name:      "stats",
+		Help:      "Stats",
+		Values:    Values{{Column: "sessions"}},
+		Procedure: &Procedure{Name: "monitoring_stats", Out: []string{"sessions"}},
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	err := q.Run(conn)
+	if err == nil || err.Error() != "stored procedures are not supported on sqlite" {
+		t.Errorf("expected the procedure to be unsupported on sqlite, got %v", err)
+	}
+}
@@ -1,19 +1,125 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	// mysqlSelectRE matches the leading SELECT keyword of a statement
+	mysqlSelectRE = regexp.MustCompile(`(?i)^\s*SELECT\b`)
+)
+
+const (
+	// maxQueryHistory is the number of runs remembered per query
+	maxQueryHistory = 10
+	// defaultRetryBackoff is the delay of the first retry of a failed query
+	defaultRetryBackoff = time.Second
+
+	metricTypeGauge   = "gauge"
+	metricTypeCounter = "counter"
+	metricTypeHist    = "histogram"
+	metricTypeSummary = "summary"
+	metricTypeExists  = "exists"
+	metricTypeAuto    = "auto"
+	metricTypeState   = "stateset"
+	metricTypeInfo    = "info"
+)
+
+// metricTypes are the recognized values of Query.Type
+var metricTypes = []string{metricTypeGauge, metricTypeCounter, metricTypeHist, metricTypeSummary, metricTypeExists, metricTypeAuto, metricTypeState, metricTypeInfo}
+
+// actions of queries exceeding max_rows or max_series
 const (
-	metricTypeGauge = "gauge"
-	metricTypeHist  = "histogram"
+	onLimitTruncate = "truncate"
+	onLimitError    = "error"
+)
+
+// onLimitActions are the recognized values of Query.OnLimit
+var onLimitActions = []string{onLimitTruncate, onLimitError}
+
+// policies of NULL values and labels
+const (
+	nullSkip  = "skip"
+	nullZero  = "zero"
+	nullNaN   = "nan"
+	nullError = "error"
+	nullEmpty = "empty"
+)
+
+var (
+	// onNullValues are the recognized values of Query.OnNullValue
+	onNullValues = []string{nullSkip, nullZero, nullNaN, nullError}
+	// onNullLabels are the recognized values of Query.OnNullLabel
+	onNullLabels = []string{nullEmpty, nullSkip, nullError}
+	// errNullSkipped is returned for values and labels skipped due to NULL
+	errNullSkipped = errors.New("NULL column skipped")
 )
 
+// conversions of value columns
+const (
+	asBool        = "bool"
+	asUnixSeconds = "unix_seconds"
+	asUnixMillis  = "unix_millis"
+	asDuration    = "duration"
+)
+
+// valueConversions are the recognized values of Value.As
+var valueConversions = []string{asBool, asUnixSeconds, asUnixMillis, asDuration}
+
+// intervalUnits are the seconds of the units of PostgreSQL intervals, months
+// and years are converted like EXTRACT(EPOCH FROM interval) does
+var intervalUnits = map[string]float64{
+	"year":   365.25 * 86400,
+	"mon":    30 * 86400,
+	"month":  30 * 86400,
+	"week":   7 * 86400,
+	"day":    86400,
+	"hour":   3600,
+	"min":    60,
+	"minute": 60,
+	"sec":    1,
+	"second": 1,
+}
+
+// timestampLayouts are the layouts of timestamps returned as text, e.g. by
+// SQLite or MySQL without parseTime
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// nullColumnError is returned for NULL values and labels with the error
+// policy, it fails the row.
+type nullColumnError string
+
+func (e nullColumnError) Error() string {
+	return fmt.Sprintf("Column '%s' is NULL", string(e))
+}
+
 // Run executes a single Query on a single connection
 func (q *Query) Run(conn *connection) error {
 	if q.log == nil {
@@ -22,72 +128,559 @@ func (q *Query) Run(conn *connection) error {
 	if q.desc == nil {
 		return fmt.Errorf("metrics descriptor is nil")
 	}
-	if q.Query == "" {
+	if q.Query == "" && q.Procedure == nil {
 		return fmt.Errorf("query is empty")
 	}
-	if conn == nil || conn.conn == nil {
+	if conn == nil {
 		return fmt.Errorf("db connection not initialized (should not happen)")
 	}
+	// fixtures don't need a database
+	if q.fixture == nil {
+		if conn.conn == nil {
+			return fmt.Errorf("db connection not initialized (should not happen)")
+		}
+		if q.db(conn) == nil {
+			return fmt.Errorf("session of user %q not connected", q.User)
+		}
+	}
+	start := time.Now()
+	rows, err := q.runWithRetries(conn)
+	q.recordRun(conn, start, rows, err)
+	return err
+}
+
+// runWithRetries runs the query and retries executions failed due to
+// connection errors or timeouts with an exponential backoff. Permanent
+// errors, e.g. of the SQL, and results which can't be parsed aren't retried.
+func (q *Query) runWithRetries(conn *connection) (int, error) {
+	backoff := q.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		final := attempt >= q.retries
+		rows, err := q.run(conn, final)
+		retry, ok := err.(retryableError)
+		if !ok {
+			return rows, err
+		}
+		level.Debug(q.log).Log("msg", "Retrying query", "attempt", attempt+1, "backoff", backoff, "err", retry.error)
+		queryRetries.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Inc()
+		if q.ctx != nil {
+			select {
+			case <-q.ctx.Done():
+				return rows, retry.error
+			case <-time.After(backoff):
+			}
+		} else {
+			time.Sleep(backoff)
+		}
+		backoff *= 2
+	}
+}
+
+// retryableError is a failed query execution which is retried.
+type retryableError struct {
+	error
+}
+
+// isTransientError returns whether the error is caused by the connection to
+// the database, e.g. a dropped connection or a network timeout, so running
+// the query again may succeed.
+func isTransientError(err error) bool {
+	for _, transient := range []error{driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// run executes the query and updates the metrics cache. It returns the
+// number of rows processed. Failed executions are returned as retryableError
+// unless it's the final attempt.
+func (q *Query) run(conn *connection, final bool) (int, error) {
+	ctx := q.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// the server timeout is enforced on the client side as well, in case
+	// the server doesn't support statement timeouts
+	timeout := q.Timeout
+	if q.ServerTimeout > 0 && (timeout <= 0 || q.ServerTimeout < timeout) {
+		timeout = q.ServerTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if q.MaximumBytesBilled > 0 {
+		ctx = withMaximumBytesBilled(ctx, q.MaximumBytesBilled)
+	}
 	// execute query
-	rows, err := conn.conn.Queryx(q.Query)
+	var rows resultRows
+	var release func()
+	// done is told whether the whole result was processed, only complete
+	// results are stored in the result cache
+	done := func(complete bool) { release() }
+	var err error
+	if q.fixture != nil {
+		rows, release = &fixtureRows{sets: q.fixture}, func() {}
+	} else if cache, ttl := sharedResultCache(); cache != nil && len(q.ResultSets) == 0 {
+		rows, done, err = q.cachedResultRows(ctx, cache, ttl, conn)
+	} else if q.CacheTTL > 0 {
+		rows, release, err = q.localResultRows(ctx, conn)
+	} else {
+		rows, release, err = q.queryRows(ctx, conn)
+	}
 	if err != nil {
-		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
-		return err
+		var limitErr memoryLimitError
+		if errors.As(err, &limitErr) {
+			// the rows of the local result cache are read upfront
+			q.memoryLimitExceeded(conn)
+			return 0, err
+		}
+		return 0, q.checkTimeout(ctx, conn, timeout, err, final)
 	}
+	complete := false
+	defer func() { done(complete) }()
 	defer rows.Close()
 
 	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.metrics))
+	// the metrics of the last run are a good guess of the size of this one
+	q.Lock()
+	previous := len(q.metrics[conn])
+	q.Unlock()
+	metrics := make([]prometheus.Metric, 0, previous)
+	var auto *autoColumns
+	read := 0
+	// rows checked by the assertions on column values
+	var checked []map[string]interface{}
+	perRow := q.perRowAssertions()
+	started := time.Now()
+	// the row is scanned into the same map unless the assertions keep it
+	res := make(map[string]interface{})
+	// the rows left out by the limits aren't read
+	limited := false
 	for rows.Next() {
-		res := make(map[string]interface{})
+		read++
+		if q.MaxRows > 0 && read > q.MaxRows {
+			if err := q.limitExceeded(conn, "rows", q.MaxRows); err != nil {
+				return 0, err
+			}
+			limited = true
+			break
+		}
+		if err := checkMemory(read); err != nil {
+			q.memoryLimitExceeded(conn)
+			return 0, err
+		}
+		if perRow {
+			res = make(map[string]interface{}, len(res))
+		} else {
+			for k := range res {
+				delete(res, k)
+			}
+		}
 		err := rows.MapScan(res)
 		if err != nil {
 			level.Error(q.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
-			failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+			q.markFailed(conn, scrapeErrorParse)
 			continue
 		}
-		var m []prometheus.Metric
-		switch q.Type {
-		case metricTypeGauge:
-			m, err = q.updateConstMetrics(conn, res)
-		case metricTypeHist:
-			m, err = q.updateHistMetrics(conn, res)
-		default:
-			// backward compatible: default to const gauge metric
-			m, err = q.updateConstMetrics(conn, res)
+		if perRow {
+			checked = append(checked, res)
 		}
+		m, err := q.rowMetrics(conn, res, &auto)
 		if err != nil {
 			level.Error(q.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
-			failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+			q.markFailed(conn, scrapeErrorParse)
 			continue
 		}
+		if q.MaxSeries > 0 && len(metrics)+len(m) > q.MaxSeries {
+			if err := q.limitExceeded(conn, "series", q.MaxSeries); err != nil {
+				return 0, err
+			}
+			metrics = append(metrics, m[:q.MaxSeries-len(metrics)]...)
+			updated++
+			limited = true
+			break
+		}
 		metrics = append(metrics, m...)
 		updated++
 		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(0.0)
+		if q.Type == metricTypeExists {
+			// only the first row is relevant for existence checks
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, q.checkTimeout(ctx, conn, timeout, err, final)
+	}
+	if len(q.ResultSets) > 0 {
+		if err := q.readResultSets(conn, rows); err != nil {
+			return 0, q.checkTimeout(ctx, conn, timeout, err, final)
+		}
+	}
+	if len(q.Expect) > 0 {
+		if q.MaxRows > 0 && read > q.MaxRows {
+			read = q.MaxRows
+		}
+		q.checkAssertions(conn, read, checked)
 	}
 
 	if updated < 1 {
-		return fmt.Errorf("zero rows returned")
+		if q.Type != metricTypeExists {
+			return 0, fmt.Errorf("zero rows returned")
+		}
+		// an empty result is a valid answer for an existence check
+		m, err := q.updateExistsMetric(conn, nil, 0.0)
+		if err != nil {
+			q.markFailed(conn, scrapeErrorParse)
+			return 0, err
+		}
+		metrics = append(metrics, m...)
+		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(0.0)
 	}
 
+	q.pruneComputed(conn, started)
+
 	// update the metrics cache
+	metrics = trackedSeries.track(seriesOwner{q, conn}, metrics)
 	q.Lock()
 	q.metrics[conn] = metrics
+	q.updated[conn] = time.Now()
 	q.Unlock()
+	staleQueries.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(0.0)
 
+	complete = !limited
+	return updated, nil
+}
+
+// rowMetrics returns the metrics of a result row by the type of the query.
+// The columns of auto and info queries are classified by the first row, so
+// all metrics of the result have the same labels.
+func (q *Query) rowMetrics(conn *connection, res map[string]interface{}, auto **autoColumns) ([]prometheus.Metric, error) {
+	q.localizeTimes(conn, res)
+	switch q.Type {
+	case metricTypeExists:
+		return q.updateExistsMetric(conn, res, 1.0)
+	case metricTypeGauge:
+		return q.updateConstMetrics(conn, res)
+	case metricTypeCounter:
+		return q.updateCounterMetrics(conn, res)
+	case metricTypeHist:
+		return q.updateHistMetrics(conn, res)
+	case metricTypeSummary:
+		return q.updateSummaryMetrics(conn, res)
+	case metricTypeAuto:
+		if *auto == nil {
+			*auto = q.autoColumns(res)
+		}
+		return q.updateAutoMetrics(conn, res, *auto)
+	case metricTypeState:
+		return q.updateStateSetMetrics(conn, res)
+	case metricTypeInfo:
+		if *auto == nil {
+			*auto = q.infoColumns(res)
+		}
+		return q.updateInfoMetric(conn, res, *auto)
+	default:
+		// backward compatible: default to const gauge metric
+		return q.updateConstMetrics(conn, res)
+	}
+}
+
+// dropMetrics removes the cached metrics of the connection from the export.
+func (q *Query) dropMetrics(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.metrics, conn)
+	delete(q.updated, conn)
+	trackedSeries.forget(seriesOwner{q, conn})
+	for _, rs := range q.ResultSets {
+		rs.dropMetrics(conn)
+	}
+}
+
+// freshMetrics returns the cached metrics of the connection, unless they are
+// older than the max age of the query. Must be called with the lock held.
+func (q *Query) freshMetrics(conn *connection) []prometheus.Metric {
+	if q.MaxAge <= 0 {
+		return q.metrics[conn]
+	}
+	if time.Since(q.updated[conn]) > q.MaxAge {
+		staleQueries.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+		return nil
+	}
+	return q.metrics[conn]
+}
+
+// checkTimeout marks the failed query and returns a more helpful error for
+// queries cancelled because they hit the timeout. Timeouts and connection
+// errors are returned as retryableError unless it's the final attempt.
+func (q *Query) checkTimeout(ctx context.Context, conn *connection, timeout time.Duration, err error, final bool) error {
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	retry := !final && (timedOut || isTransientError(err))
+	if timedOut {
+		queryTimeouts.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Inc()
+		err = fmt.Errorf("query timed out after %s: %v", timeout, err)
+	}
+	switch {
+	case retry:
+		return retryableError{err}
+	case timedOut:
+		q.markFailed(conn, scrapeErrorTimeout)
+	default:
+		q.markFailed(conn, scrapeErrorQuery)
+	}
+	return err
+}
+
+// limitExceeded counts a result exceeding max_rows or max_series. It returns
+// an error if the query must fail, otherwise the result is truncated.
+func (q *Query) limitExceeded(conn *connection, limit string, max int) error {
+	queryLimits.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name, limit).Inc()
+	if q.OnLimit == onLimitError {
+		q.markFailed(conn, scrapeErrorLimit)
+		return fmt.Errorf("query exceeded max_%s of %d", limit, max)
+	}
+	level.Warn(q.log).Log("msg", "Truncating result of query", "limit", "max_"+limit, "max", max, "host", conn.host, "db", conn.database)
 	return nil
 }
 
+// memoryLimitExceeded counts a query aborted because the heap exceeds
+// max-memory.
+func (q *Query) memoryLimitExceeded(conn *connection) {
+	queryLimits.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name, "memory").Inc()
+	q.markFailed(conn, scrapeErrorLimit)
+}
+
+// markFailed flags the last scrape of the query as failed and counts the
+// error by its type.
+func (q *Query) markFailed(conn *connection, errType string) {
+	failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+	scrapeErrors.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name, errType).Inc()
+}
+
+// recordRun adds the outcome of a query execution to the run history, the
+// query meta-metrics and the failure notifications.
+func (q *Query) recordRun(conn *connection, start time.Time, rows int, err error) {
+	run := queryRun{
+		Time:     start,
+		Driver:   conn.driver,
+		Host:     conn.host,
+		Database: conn.database,
+		Duration: time.Since(start).Seconds(),
+		Rows:     rows,
+	}
+	queryDuration.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Observe(run.Duration)
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		queryRows.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(float64(rows))
+	}
+	q.Lock()
+	if len(q.history) >= maxQueryHistory {
+		q.history = append(q.history[:0], q.history[1:]...)
+	}
+	q.history = append(q.history, run)
+	q.Unlock()
+	q.trackFailures(run)
+}
+
+// resultRows iterates over the rows of a query result, either fetched from
+// the database or read from the result cache.
+type resultRows interface {
+	Next() bool
+	MapScan(dest map[string]interface{}) error
+	Err() error
+	Close() error
+}
+
+// queryRows executes the query on the connection. If a server side timeout is
+// configured it is translated to the mechanism supported by the driver. The
+// setup SQL runs before the query within the same transaction. The returned
+// function must be called after the rows have been closed.
+func (q *Query) queryRows(ctx context.Context, conn *connection) (resultRows, func(), error) {
+	if q.Procedure != nil {
+		if conn.readOnly {
+			// the writes of a procedure can't be told from its call
+			return nil, nil, fmt.Errorf("read only connection, refusing to call procedure %s", q.Procedure.Name)
+		}
+		return q.callProcedure(ctx, conn)
+	}
+	query, err := q.text(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.readOnly {
+		for _, stmt := range append([]string{query}, q.SetupSQL...) {
+			if err := checkReadOnly(stmt); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	args, err := q.paramValues(ctx, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.LimitPushdown && q.MaxRows > 0 {
+		// one more row than max_rows, so exceeding it is still detected
+		query = limitQuery(conn.driver, query, q.MaxRows+1)
+	}
+	var setup []string
+	if q.ServerTimeout > 0 {
+		ms := int64(q.ServerTimeout / time.Millisecond)
+		switch conn.driver {
+		case "postgres":
+			// SET LOCAL only lasts until the end of the transaction, so the
+			// timeout doesn't leak into other queries on this session
+			setup = append(setup, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms))
+		case "mysql":
+			query = mysqlExecutionTimeHint(query, ms)
+		case "clickhouse":
+			// max_execution_time has a resolution of seconds
+			seconds := int64(math.Ceil(q.ServerTimeout.Seconds()))
+			query = fmt.Sprintf("%s SETTINGS max_execution_time = %d", strings.TrimRight(strings.TrimSpace(query), ";"), seconds)
+		}
+		// other drivers, e.g. sqlserver, rely on the context deadline to
+		// cancel the query on the server
+	}
+	setup = append(setup, q.SetupSQL...)
+	if len(setup) == 0 {
+		rows, err := q.db(conn).QueryxContext(ctx, query, args...)
+		return rows, func() {}, err
+	}
+	// the transaction keeps the setup and the query on the same session
+	var opts *sql.TxOptions
+	if conn.readOnly && readOnlySessionSQL[conn.driver] != "" {
+		opts = &sql.TxOptions{ReadOnly: true}
+	}
+	tx, err := q.db(conn).BeginTxx(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, stmt := range setup {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return nil, nil, fmt.Errorf("setup failed: %v", err)
+		}
+	}
+	rows, err := tx.QueryxContext(ctx, query, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	// the changes of the setup are discarded, nothing is committed
+	return rows, func() { tx.Rollback() }, nil
+}
+
+// db returns the database the query runs on, the session of its user if it
+// has one.
+func (q *Query) db(conn *connection) *sqlx.DB {
+	if q.User == "" {
+		return conn.conn
+	}
+	if session := conn.sessions[q.User]; session != nil {
+		return session.conn
+	}
+	return nil
+}
+
+// paramValues returns the values of the params in order. Values of params
+// backed by a query are fetched from the connection.
+func (q *Query) paramValues(ctx context.Context, conn *connection) ([]interface{}, error) {
+	if len(q.Params) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, 0, len(q.Params))
+	for _, p := range q.Params {
+		switch {
+		case p.Env != "":
+			value, found := os.LookupEnv(p.Env)
+			if !found {
+				return nil, fmt.Errorf("param %q: environment variable %s is not set", p.Name, p.Env)
+			}
+			args = append(args, value)
+		case p.Query != "":
+			var value interface{}
+			if err := q.db(conn).QueryRowxContext(ctx, p.Query).Scan(&value); err != nil {
+				return nil, fmt.Errorf("param %q: %v", p.Name, err)
+			}
+			// drivers return text columns as bytes, which would be bound
+			// as binary value
+			if buf, ok := value.([]byte); ok {
+				value = string(buf)
+			}
+			args = append(args, value)
+		default:
+			args = append(args, p.Value)
+		}
+	}
+	return args, nil
+}
+
+// mysqlExecutionTimeHint adds a MAX_EXECUTION_TIME optimizer hint to SELECT
+// statements. Other statements don't support the hint and are left alone.
+func mysqlExecutionTimeHint(query string, ms int64) string {
+	loc := mysqlSelectRE.FindStringIndex(query)
+	if loc == nil {
+		return query
+	}
+	return fmt.Sprintf("%s /*+ MAX_EXECUTION_TIME(%d) */%s", query[:loc[1]], ms, query[loc[1]:])
+}
+
+// limitQuery wraps the query so the server returns at most limit rows. The
+// query is returned as is for drivers without a known dialect.
+func limitQuery(driver, query string, limit int) string {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	switch driver {
+	case "postgres", "mysql", "sqlite", "clickhouse", "snowflake", "bigquery", "athena":
+		return fmt.Sprintf("SELECT * FROM (\n%s\n) sql_exporter_limited LIMIT %d", query, limit)
+	case "sqlserver":
+		return fmt.Sprintf("SELECT TOP (%d) * FROM (\n%s\n) AS sql_exporter_limited", limit, query)
+	case "oracle":
+		return fmt.Sprintf("SELECT * FROM (\n%s\n) WHERE ROWNUM <= %d", query, limit)
+	}
+	return query
+}
+
 // updateConstMetrics parses the result set and returns a slice of const metrics.
 func (q *Query) updateConstMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
-	updated := 0
+	return q.updateValueMetrics(conn, res, prometheus.GaugeValue)
+}
+
+// updateCounterMetrics parses the result set and returns a slice of const
+// counter metrics. The value columns must be monotonically increasing.
+func (q *Query) updateCounterMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
+	return q.updateValueMetrics(conn, res, prometheus.CounterValue)
+}
+
+// updateValueMetrics returns a const metric of the given type for each of the
+// value columns.
+func (q *Query) updateValueMetrics(conn *connection, res map[string]interface{}, valueType prometheus.ValueType) ([]prometheus.Metric, error) {
+	if q.MetricNameColumn != "" {
+		return q.updatePivotMetric(conn, res, valueType)
+	}
+	updated, skipped := 0, 0
 	metrics := make([]prometheus.Metric, 0, len(q.Values))
-	for _, valueName := range q.Values {
-		m, err := q.updateConstMetric(conn, res, valueName)
+	for _, value := range q.Values {
+		m, err := q.updateConstMetric(conn, res, value, valueType)
+		if err == errNullSkipped {
+			skipped++
+			continue
+		}
+		if _, ok := err.(nullColumnError); ok {
+			return nil, err
+		}
 		if err != nil {
 			level.Error(q.log).Log(
 				"msg", "Failed to update metric",
-				"value", valueName,
+				"value", value.Column,
 				"err", err,
 				"host", conn.host,
 				"db", conn.database,
@@ -97,18 +690,294 @@ func (q *Query) updateConstMetrics(conn *connection, res map[string]interface{})
 		metrics = append(metrics, m)
 		updated++
 	}
-	if updated < 1 {
+	if updated < 1 && skipped == 0 {
+		return nil, fmt.Errorf("zero values found")
+	}
+	return metrics, nil
+}
+
+// updatePivotMetric returns a metric named after the metric name column with the
+// value of the value column, or a metric named after the query with the name
+// in the metric name label. Rows without a numeric value, e.g. the text
+// variables of SHOW GLOBAL STATUS, are skipped.
+func (q *Query) updatePivotMetric(conn *connection, res map[string]interface{}, valueType prometheus.ValueType) ([]prometheus.Metric, error) {
+	var name string
+	switch v := res[q.MetricNameColumn].(type) {
+	case string:
+		name = v
+	case []uint8:
+		name = string(v)
+	default:
+		return nil, fmt.Errorf("Column '%s' must be type text (string)", q.MetricNameColumn)
+	}
+	value, err := q.parseValue(res, q.ValueColumn)
+	if _, ok := err.(nullColumnError); ok {
+		return nil, err
+	}
+	if err != nil {
+		level.Debug(q.log).Log("msg", "Skipping row without numeric value", "name", name, "err", err)
+		return nil, nil
+	}
+	labels, err := q.buildLabels(conn, res, q.ValueColumn, q.Labels)
+	if err == errNullSkipped {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.MetricNameLabel != "" {
+		// the name label follows the labels of the query, before the built-in ones
+		n := len(q.Labels)
+		labels = append(labels[:n], append([]string{name}, labels[n:]...)...)
+		m, err := prometheus.NewConstMetric(q.desc, valueType, value, labels...)
+		if err != nil {
+			return nil, err
+		}
+		return []prometheus.Metric{m}, nil
+	}
+	desc := q.newDesc(q.Name+"_"+strings.ToLower(name), q.Labels.Names())
+	m, err := prometheus.NewConstMetric(desc, valueType, value, labels...)
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{m}, nil
+}
+
+// unchecked reports whether the metrics of the query are named after its
+// rows, so they can't be described before the query ran.
+func (q *Query) unchecked() bool {
+	return q.MetricNameColumn != "" && q.MetricNameLabel == ""
+}
+
+// builtinLabelNames returns the built-in labels of the query. Pivot queries
+// have a single value column, so they leave out the col label.
+func (q *Query) builtinLabelNames(keys, names []string) ([]string, []string) {
+	if q.MetricNameColumn == "" {
+		return keys, names
+	}
+	var queryKeys, queryNames []string
+	for i, key := range keys {
+		if key == "col" {
+			continue
+		}
+		queryKeys = append(queryKeys, key)
+		queryNames = append(queryNames, names[i])
+	}
+	return queryKeys, queryNames
+}
+
+// autoColumns are the label and value columns of a query of type auto.
+type autoColumns struct {
+	labels Labels
+	values []string
+	desc   *prometheus.Desc
+}
+
+// autoColumns classifies the columns of the row. Columns configured as labels
+// and text columns become labels, numeric columns become values.
+func (q *Query) autoColumns(res map[string]interface{}) *autoColumns {
+	auto := &autoColumns{labels: append(Labels{}, q.Labels...)}
+	configured := make(map[string]bool, len(q.Labels))
+	for _, label := range q.Labels {
+		configured[label.Column] = true
+	}
+	columns := make([]string, 0, len(res))
+	for column := range res {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		if configured[column] {
+			continue
+		}
+		switch v := res[column].(type) {
+		case bool, int, int32, int64, uint, uint32, uint64, float32, float64, time.Time, *big.Int, *big.Float, *big.Rat:
+			auto.values = append(auto.values, column)
+		case string:
+			auto.labels = append(auto.labels, &Label{Name: column, Column: column})
+		case []uint8:
+			// some drivers, e.g. MySQL, return numbers as text
+			if _, err := strconv.ParseFloat(string(v), 64); err == nil {
+				auto.values = append(auto.values, column)
+				continue
+			}
+			auto.labels = append(auto.labels, &Label{Name: column, Column: column})
+		default:
+			level.Debug(q.log).Log("msg", "Skipping column of unsupported type", "column", column, "type", fmt.Sprintf("%T", v))
+		}
+	}
+	auto.desc = q.newDesc(q.Name, auto.labels.Names())
+	return auto
+}
+
+// updateAutoMetrics returns a const gauge metric for each of the value
+// columns of the row.
+func (q *Query) updateAutoMetrics(conn *connection, res map[string]interface{}, auto *autoColumns) ([]prometheus.Metric, error) {
+	metrics := make([]prometheus.Metric, 0, len(auto.values))
+	skipped := 0
+	for _, valueName := range auto.values {
+		value, err := q.parseValue(res, valueName)
+		if err == errNullSkipped {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		labels, err := q.buildLabels(conn, res, valueName, auto.labels)
+		if err == errNullSkipped {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m, err := prometheus.NewConstMetric(auto.desc, prometheus.GaugeValue, value, labels...)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	if len(metrics) < 1 && skipped == 0 {
 		return nil, fmt.Errorf("zero values found")
 	}
 	return metrics, nil
 }
 
+// infoName returns the metric name of a query of type info, which gets the
+// _info suffix if it doesn't end with it already.
+func infoName(name string) string {
+	if strings.HasSuffix(name, "_info") {
+		return name
+	}
+	return name + "_info"
+}
+
+// infoColumns returns the label columns of a query of type info, the
+// configured labels or else all columns of the row in alphabetical order.
+func (q *Query) infoColumns(res map[string]interface{}) *autoColumns {
+	if len(q.Labels) > 0 {
+		return &autoColumns{labels: q.Labels, desc: q.desc}
+	}
+	info := &autoColumns{}
+	columns := make([]string, 0, len(res))
+	for column := range res {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		info.labels = append(info.labels, &Label{Name: column, Column: column})
+	}
+	info.desc = q.newDesc(infoName(q.Name), info.labels.Names())
+	return info
+}
+
+// updateInfoMetric returns a const metric with the value 1 and the columns
+// of the row as labels. Non-text columns like version numbers are exported
+// in their string representation.
+func (q *Query) updateInfoMetric(conn *connection, res map[string]interface{}, info *autoColumns) ([]prometheus.Metric, error) {
+	text := make(map[string]interface{}, len(res))
+	for column, i := range res {
+		switch v := i.(type) {
+		case nil, string, []uint8:
+			text[column] = v
+		default:
+			text[column] = fmt.Sprint(v)
+		}
+	}
+	labels, err := q.buildLabels(conn, text, metricTypeInfo, info.labels)
+	if err == errNullSkipped {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := prometheus.NewConstMetric(info.desc, prometheus.GaugeValue, 1.0, labels...)
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{m}, nil
+}
+
+// updateExistsMetric returns a single const metric with the given value. The
+// labels are taken from the first row, if any.
+func (q *Query) updateExistsMetric(conn *connection, res map[string]interface{}, value float64) ([]prometheus.Metric, error) {
+	labels, err := q.buildLabels(conn, res, metricTypeExists, q.Labels)
+	if err == errNullSkipped {
+		// the row exists nevertheless, skipping it would export neither 1
+		// nor 0, so the NULL labels are left empty
+		labels, err = q.buildLabelsOnNull(conn, res, metricTypeExists, q.Labels, nullEmpty)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := prometheus.NewConstMetric(q.desc, prometheus.GaugeValue, value, labels...)
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{m}, nil
+}
+
+// updateStateSetMetrics returns one metric per configured state, 1 for the
+// state in the state column of the row and 0 for all others. The state is
+// exported in a label named after the query, following the Prometheus
+// state set convention.
+func (q *Query) updateStateSetMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
+	labels, err := q.buildLabels(conn, res, q.StateColumn, q.Labels)
+	if err == errNullSkipped {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state string
+	switch v := res[q.StateColumn].(type) {
+	case nil:
+		switch q.OnNullValue {
+		case nullSkip:
+			return nil, nil
+		case nullError:
+			return nil, nullColumnError(q.StateColumn)
+		}
+	case []uint8:
+		state = string(v)
+	default:
+		state = fmt.Sprint(v)
+	}
+	// the state label follows the labels of the query, before the built-in ones
+	n := len(q.Labels)
+	stateLabels := make([]string, 0, len(labels)+1)
+	stateLabels = append(append(stateLabels, labels[:n]...), "")
+	stateLabels = append(stateLabels, labels[n:]...)
+	metrics := make([]prometheus.Metric, 0, len(q.States))
+	for _, s := range q.States {
+		value := 0.0
+		if s == state {
+			value = 1.0
+		}
+		stateLabels[n] = s
+		m, err := prometheus.NewConstMetric(q.desc, prometheus.GaugeValue, value, stateLabels...)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
 // updateHistMetrics parses the result set and returns a slice of histogram metrics.
 func (q *Query) updateHistMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
-	updated := 0
+	updated, skipped := 0, 0
 	metrics := make([]prometheus.Metric, 0, len(q.Values))
 	for _, histValue := range q.HistValues {
 		m, err := q.updateHistogramMetric(conn, res, histValue)
+		if err == errNullSkipped {
+			skipped++
+			continue
+		}
+		if _, ok := err.(nullColumnError); ok {
+			return nil, err
+		}
 		if err != nil {
 			level.Error(q.log).Log(
 				"msg", "Failed to update metric",
@@ -122,16 +991,88 @@ func (q *Query) updateHistMetrics(conn *connection, res map[string]interface{})
 		metrics = append(metrics, m)
 		updated++
 	}
-	if updated < 1 {
+	if updated < 1 && skipped == 0 {
 		return nil, fmt.Errorf("zero values found")
 	}
 	return metrics, nil
 }
 
-func parseValue(res map[string]interface{}, valueName string) (float64, error) {
+// updateSummaryMetrics parses the result set and returns a slice of summary metrics.
+func (q *Query) updateSummaryMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
+	updated, skipped := 0, 0
+	metrics := make([]prometheus.Metric, 0, len(q.SummaryValues))
+	for _, summaryValue := range q.SummaryValues {
+		m, err := q.updateSummaryMetric(conn, res, summaryValue)
+		if err == errNullSkipped {
+			skipped++
+			continue
+		}
+		if _, ok := err.(nullColumnError); ok {
+			return nil, err
+		}
+		if err != nil {
+			level.Error(q.log).Log(
+				"msg", "Failed to update metric",
+				"value", summaryValue.Name,
+				"err", err,
+				"host", conn.host,
+				"db", conn.database,
+			)
+			continue
+		}
+		metrics = append(metrics, m)
+		updated++
+	}
+	if updated < 1 && skipped == 0 {
+		return nil, fmt.Errorf("zero values found")
+	}
+	return metrics, nil
+}
+
+// parseValue extracts the named column from the result row as float. NULL
+// and missing columns are handled by the on_null_value policy of the query.
+func (q *Query) parseValue(res map[string]interface{}, valueName string) (float64, error) {
+	return q.parseValueAs(res, valueName, "")
+}
+
+// parseValueAs extracts the named column from the result row as float using
+// the given conversion, e.g. timestamps as unix_millis.
+func (q *Query) parseValueAs(res map[string]interface{}, valueName, as string) (float64, error) {
+	if i, ok := res[valueName]; ok && i != nil {
+		switch as {
+		case asBool:
+			return parseBool(valueName, i)
+		case asUnixSeconds, asUnixMillis:
+			t, err := q.parseTime(valueName, i)
+			if err != nil {
+				return 0.0, err
+			}
+			if as == asUnixMillis {
+				return float64(t.UnixNano() / int64(time.Millisecond)), nil
+			}
+			return float64(t.Unix()), nil
+		case asDuration:
+			return parseDuration(valueName, i)
+		}
+	}
 	var value float64
-	if i, ok := res[valueName]; ok {
+	if i, ok := res[valueName]; (!ok || i == nil) && q.OnNullValue != "" {
+		switch q.OnNullValue {
+		case nullSkip:
+			return 0.0, errNullSkipped
+		case nullNaN:
+			return math.NaN(), nil
+		case nullError:
+			return 0.0, nullColumnError(valueName)
+		}
+	} else if ok {
 		switch f := i.(type) {
+		case time.Time:
+			value = float64(f.Unix())
+		case bool:
+			if f {
+				value = 1
+			}
 		case int:
 			value = float64(f)
 		case int32:
@@ -148,15 +1089,29 @@ func parseValue(res map[string]interface{}, valueName string) (float64, error) {
 			value = float64(f)
 		case float64:
 			value = float64(f)
+		case *big.Int:
+			value, _ = new(big.Float).SetInt(f).Float64()
+		case *big.Float:
+			value, _ = f.Float64()
+		case *big.Rat:
+			value, _ = f.Float64()
 		case []uint8:
+			// drivers like Snowflake return decimals as text, PostgreSQL
+			// intervals and MySQL TIME columns are converted to seconds
 			val, err := strconv.ParseFloat(string(f), 64)
 			if err != nil {
+				if seconds, ok := parseInterval(string(f)); ok {
+					return seconds, nil
+				}
 				return 0.0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
 			}
 			value = val
 		case string:
 			val, err := strconv.ParseFloat(f, 64)
 			if err != nil {
+				if seconds, ok := parseInterval(f); ok {
+					return seconds, nil
+				}
 				return 0.0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
 			}
 			value = val
@@ -167,91 +1122,406 @@ func parseValue(res map[string]interface{}, valueName string) (float64, error) {
 	return value, nil
 }
 
-func buildLabels(conn *connection, res map[string]interface{}, valueName string, inLabels []string) ([]string, error) {
-	// make space for all defined variable label columns and the "static" labels
-	// added below
-	labels := make([]string, 0, len(inLabels)+5)
+// parseBool converts booleans, numbers and boolean text like t, true, yes or
+// on to 0 or 1.
+func parseBool(column string, i interface{}) (float64, error) {
+	var b bool
+	switch v := i.(type) {
+	case bool:
+		b = v
+	case int64:
+		b = v != 0
+	case int:
+		b = v != 0
+	case float64:
+		b = v != 0
+	case []uint8, string:
+		switch strings.ToLower(strings.TrimSpace(fmt.Sprintf("%s", v))) {
+		case "1", "t", "true", "y", "yes", "on":
+			b = true
+		case "0", "f", "false", "n", "no", "off":
+		default:
+			return 0.0, fmt.Errorf("Column '%s' must be a boolean, is '%T' (val: %s)", column, i, v)
+		}
+	default:
+		return 0.0, fmt.Errorf("Column '%s' must be a boolean, is '%T' (val: %v)", column, i, v)
+	}
+	if b {
+		return 1.0, nil
+	}
+	return 0.0, nil
+}
+
+// parseDuration converts intervals and durations to seconds. Numbers are
+// taken as seconds, text as PostgreSQL interval, MySQL TIME or Go duration
+// like 1m30s.
+func parseDuration(column string, i interface{}) (float64, error) {
+	var text string
+	switch v := i.(type) {
+	case time.Duration:
+		return v.Seconds(), nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case []uint8:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return 0.0, fmt.Errorf("Column '%s' must be a duration, is '%T' (val: %v)", column, i, v)
+	}
+	if seconds, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+		return seconds, nil
+	}
+	if seconds, ok := parseInterval(text); ok {
+		return seconds, nil
+	}
+	if d, err := time.ParseDuration(strings.TrimSpace(text)); err == nil {
+		return d.Seconds(), nil
+	}
+	return 0.0, fmt.Errorf("Column '%s' must be a duration, is '%T' (val: %s)", column, i, text)
+}
+
+// parseInterval parses PostgreSQL intervals in the postgres and
+// postgres_verbose styles, e.g. 1 day 02:03:04.5 or @ 1 day 2 hours ago, and
+// MySQL TIME values like -838:59:59 into seconds.
+func parseInterval(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	var seconds float64
+	clock := false
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "@":
+			continue
+		case field == "ago" && i == len(fields)-1:
+			seconds = -seconds
+		case strings.Contains(field, ":"):
+			if clock {
+				return 0, false
+			}
+			v, ok := parseClock(field)
+			if !ok {
+				return 0, false
+			}
+			seconds += v
+			clock = true
+		default:
+			// a number followed by its unit
+			n, err := strconv.ParseFloat(field, 64)
+			if err != nil || i+1 >= len(fields) {
+				return 0, false
+			}
+			i++
+			unit, found := intervalUnits[strings.TrimSuffix(fields[i], "s")]
+			if !found {
+				return 0, false
+			}
+			seconds += n * unit
+		}
+	}
+	return seconds, true
+}
+
+// parseClock parses [-]H:MM[:SS[.fraction]] into seconds.
+func parseClock(s string) (float64, bool) {
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var seconds float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || (i < len(parts)-1 && strings.Contains(part, ".")) {
+			return 0, false
+		}
+		seconds = seconds*60 + v
+	}
+	return sign * seconds, true
+}
+
+// parseTime converts timestamp and date columns, including ones returned as
+// text, to a time. Text without zone is in the timezone of the job, see
+// localizeTimes for the timestamps returned by the drivers.
+func (q *Query) parseTime(column string, i interface{}) (time.Time, error) {
+	var text string
+	switch v := i.(type) {
+	case time.Time:
+		return v, nil
+	case []uint8:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return time.Time{}, fmt.Errorf("Column '%s' must be a timestamp, is '%T' (val: %v)", column, i, v)
+	}
+	loc := q.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(text), loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Column '%s' must be a timestamp, is '%T' (val: %s)", column, i, text)
+}
+
+// localizeTimes interprets the timestamps of the row which the driver
+// returned without zone information as wall clock time in the timezone of
+// the job.
+func (q *Query) localizeTimes(conn *connection, res map[string]interface{}) {
+	if q.location == nil {
+		return
+	}
+	for column, v := range res {
+		if t, ok := v.(time.Time); ok && naiveTimestamp(conn, t) {
+			res[column] = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), q.location)
+		}
+	}
+}
+
+// naiveTimestamp returns whether the driver of the connection returned the
+// timestamp without zone information. lib/pq returns timestamp columns in an
+// unnamed fixed zone and timestamptz columns in the timezone of the session.
+// The drivers of mysql (unless given a loc), sqlserver and sqlite return them
+// in UTC and timestamps with zone in a fixed zone. Other drivers may return
+// real UTC instants, so their timestamps are kept as returned.
+func naiveTimestamp(conn *connection, t time.Time) bool {
+	if _, offset := t.Zone(); offset != 0 {
+		return false
+	}
+	if conn.driver == "postgres" {
+		return t.Location() != time.UTC && t.Location().String() == ""
+	}
+	return conn.naiveUTC && t.Location() == time.UTC
+}
+
+// buildLabels returns the label values of the row followed by the built-in
+// labels. NULL label columns are handled by the on_null_label policy of the
+// query.
+func (q *Query) buildLabels(conn *connection, res map[string]interface{}, valueName string, inLabels Labels) ([]string, error) {
+	return q.buildLabelsOnNull(conn, res, valueName, inLabels, q.OnNullLabel)
+}
+
+// buildLabelsOnNull is buildLabels with the given on_null_label policy
+// instead of the one of the query.
+func (q *Query) buildLabelsOnNull(conn *connection, res map[string]interface{}, valueName string, inLabels Labels, onNull string) ([]string, error) {
+	// make space for all defined variable label columns and the built-in
+	// labels added below
+	labels := make([]string, 0, len(inLabels)+len(q.builtin))
 	for _, label := range inLabels {
 		// we need to fill every spot in the slice or the key->value mapping
 		// won't match up in the end.
 		//
 		// ORDER MATTERS!
 		lv := ""
-		if i, ok := res[label]; ok {
+		if label.tmpl != nil {
+			var err error
+			if lv, err = renderLabel(label, res); err != nil {
+				return nil, err
+			}
+		} else if i, ok := res[label.Column]; (!ok || i == nil) && res != nil && onNull != "" {
+			switch onNull {
+			case nullSkip:
+				return nil, errNullSkipped
+			case nullError:
+				return nil, nullColumnError(label.Column)
+			}
+		} else if ok {
 			switch str := i.(type) {
 			case string:
 				lv = str
 			case []uint8:
 				lv = string(str)
 			default:
-				return nil, fmt.Errorf("Column '%s' must be type text (string)", label)
+				return nil, fmt.Errorf("Column '%s' must be type text (string)", label.Column)
 			}
 		}
-		labels = append(labels, lv)
+		labels = append(labels, label.transform(lv))
+	}
+	for _, key := range q.builtin {
+		switch key {
+		case "driver":
+			labels = append(labels, conn.driver)
+		case "host":
+			labels = append(labels, conn.host)
+		case "database":
+			labels = append(labels, conn.database)
+		case "user":
+			labels = append(labels, conn.user)
+		case "col":
+			labels = append(labels, valueName)
+		}
 	}
-	labels = append(labels, conn.driver)
-	labels = append(labels, conn.host)
-	labels = append(labels, conn.database)
-	labels = append(labels, conn.user)
-	labels = append(labels, valueName)
 	return labels, nil
 }
 
-// updateMetrics parses a single row and returns a const metric.
-func (q *Query) updateConstMetric(conn *connection, res map[string]interface{}, valueName string) (prometheus.Metric, error) {
+// renderLabel builds a label value by executing the label template with the
+// string representation of every column of the row.
+func renderLabel(label *Label, res map[string]interface{}) (string, error) {
+	data := make(map[string]string, len(res))
+	for column, i := range res {
+		switch v := i.(type) {
+		case nil:
+			data[column] = ""
+		case []uint8:
+			data[column] = string(v)
+		default:
+			data[column] = fmt.Sprint(v)
+		}
+	}
+	var buf strings.Builder
+	if err := label.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("Failed to render label '%s': %v", label.Name, err)
+	}
+	return buf.String(), nil
+}
+
+// updateMetrics parses a single row and returns a const metric. The name,
+// help and type of the value override the ones of the query.
+func (q *Query) updateConstMetric(conn *connection, res map[string]interface{}, v *Value, valueType prometheus.ValueType) (prometheus.Metric, error) {
 	// parse value from result
-	value, err := parseValue(res, valueName)
+	value, err := q.parseValueAs(res, v.Column, v.As)
 	if err != nil {
 		return nil, err
 	}
 
 	// build user defined labels along with pre-defined "static" labels
-	labels, err := buildLabels(conn, res, valueName, q.Labels)
+	labels, err := q.buildLabels(conn, res, v.Column, q.Labels)
 	if err != nil {
 		return nil, err
 	}
 
+	desc := q.desc
+	if v.desc != nil {
+		desc = v.desc
+	}
+	switch v.Type {
+	case metricTypeGauge:
+		valueType = prometheus.GaugeValue
+	case metricTypeCounter:
+		valueType = prometheus.CounterValue
+	}
+	if v.Compute != "" {
+		var ok bool
+		if value, ok = q.compute(conn, v, labels, value); !ok {
+			// the first run of the series has nothing to compare to
+			return nil, errNullSkipped
+		}
+		valueType = prometheus.GaugeValue
+	}
 	// create a new immutable const metric that can be cached and returned on
 	// every scrape. Remember that the order of the lable values in the labels
 	// slice must match the order of the label names in the descriptor!
-	return prometheus.NewConstMetric(q.desc, prometheus.GaugeValue, value, labels...)
+	m, err := prometheus.NewConstMetric(desc, valueType, value, labels...)
+	if err != nil || valueType != prometheus.CounterValue {
+		return m, err
+	}
+	return q.withExemplar(m, res, value), nil
 }
 
 // updateHistogramMetric parses rows to return a histogram metric.
 func (q *Query) updateHistogramMetric(conn *connection, res map[string]interface{}, histValue *HistValue) (prometheus.Metric, error) {
 	// parse hist count
-	countValue, err := parseValue(res, histValue.Count)
+	countValue, err := q.parseValue(res, histValue.Count)
 	if err != nil {
 		return nil, err
 	}
 
 	// parse hist sum
-	sumVal, err := parseValue(res, histValue.Sum)
+	sumVal, err := q.parseValue(res, histValue.Sum)
 	if err != nil {
 		return nil, err
 	}
 
 	// parse hist buckets
 	bucketVals := make(map[float64]uint64, len(histValue.Buckets))
-	for _, bucket := range histValue.Buckets {
+	for _, bucket := range histValue.buckets(res) {
 		b, err := strconv.ParseFloat(bucket.Value, 64)
 		if err != nil {
 			return nil, err
 		}
-		bVal, err := parseValue(res, bucket.Name)
+		bVal, err := q.parseValue(res, bucket.Name)
 		if err != nil {
 			return nil, err
 		}
 		bucketVals[b] = uint64(bVal)
 	}
+	if histValue.BucketsCumulative != nil && !*histValue.BucketsCumulative {
+		accumulateBuckets(bucketVals)
+	}
 
 	// build user defined labels along with pre-defined "static" labels
-	labels, err := buildLabels(conn, res, histValue.Name, q.Labels)
+	labels, err := q.buildLabels(conn, res, histValue.Name, q.Labels)
 	if err != nil {
 		return nil, err
 	}
 
 	// create a new immutable const histogram that can be cached and returned on
 	// every scrape
-	return prometheus.NewConstHistogram(q.desc, uint64(countValue), sumVal, bucketVals, labels...)
+	m, err := prometheus.NewConstHistogram(q.desc, uint64(countValue), sumVal, bucketVals, labels...)
+	if err != nil {
+		return nil, err
+	}
+	if histValue.Native != nil {
+		m = newNativeHistogram(m, histValue.Native, uint64(countValue), bucketVals)
+	}
+	// without a value column the exemplar is the mean of the observations
+	mean := math.NaN()
+	if countValue > 0 {
+		mean = sumVal / float64(countValue)
+	}
+	return q.withExemplar(m, res, mean), nil
+}
+
+// updateSummaryMetric parses rows to return a summary metric.
+func (q *Query) updateSummaryMetric(conn *connection, res map[string]interface{}, summaryValue *SummaryValue) (prometheus.Metric, error) {
+	// parse summary count
+	countValue, err := q.parseValue(res, summaryValue.Count)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse summary sum
+	sumVal, err := q.parseValue(res, summaryValue.Sum)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse summary quantiles
+	quantileVals := make(map[float64]float64, len(summaryValue.Quantiles))
+	for _, quantile := range summaryValue.Quantiles {
+		qt, err := strconv.ParseFloat(quantile.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		qVal, err := q.parseValue(res, quantile.Name)
+		if err != nil {
+			return nil, err
+		}
+		quantileVals[qt] = qVal
+	}
+
+	// build user defined labels along with pre-defined "static" labels
+	labels, err := q.buildLabels(conn, res, summaryValue.Name, q.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a new immutable const summary that can be cached and returned on
+	// every scrape
+	return prometheus.NewConstSummary(q.desc, uint64(countValue), sumVal, quantileVals, labels...)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// queryTemplateData is available to query templates, e.g.
+// {{.Vars.shard}} or {{.Database}}.
+type queryTemplateData struct {
+	Job      string
+	Driver   string
+	Host     string
+	Database string
+	User     string
+	Vars     map[string]string
+}
+
+// parseQueryTemplate parses the query along with the entries of the queries
+// map it references as named templates, so shared snippets are included with
+// {{template "name" .}}. Missing variables fail the rendering.
+func parseQueryTemplate(name, query string, queries map[string]string) (*template.Template, error) {
+	tmpl, err := template.New("query " + name).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	// snippets can reference further snippets, so parse until all references
+	// are defined
+	parsed := make(map[string]bool)
+	for {
+		missing := undefinedTemplates(tmpl)
+		if len(missing) == 0 {
+			return tmpl, nil
+		}
+		for _, n := range missing {
+			snippet, found := queries[n]
+			if !found || parsed[n] {
+				return nil, fmt.Errorf("template %q isn't defined in queries", n)
+			}
+			parsed[n] = true
+			if _, err := tmpl.New(n).Parse(snippet); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// undefinedTemplates returns the sorted names of the templates referenced
+// but not defined in the template.
+func undefinedTemplates(tmpl *template.Template) []string {
+	refs := make(map[string]bool)
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			templateRefs(t.Tree.Root, refs)
+		}
+	}
+	var missing []string
+	for n := range refs {
+		if tmpl.Lookup(n) == nil {
+			missing = append(missing, n)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// templateRefs adds the names of the templates referenced by the node.
+func templateRefs(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateRefs(child, refs)
+		}
+	case *parse.TemplateNode:
+		refs[n.Name] = true
+	case *parse.IfNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		templateRefs(n.List, refs)
+		templateRefs(n.ElseList, refs)
+	}
+}
+
+// text returns the query run on the connection, rendering its template.
+func (q *Query) text(conn *connection) (string, error) {
+	if q.tmpl == nil {
+		return q.Query, nil
+	}
+	var buf strings.Builder
+	err := q.tmpl.Execute(&buf, queryTemplateData{
+		Job:      q.jobName,
+		Driver:   conn.driver,
+		Host:     conn.host,
+		Database: conn.database,
+		User:     conn.user,
+		Vars:     q.vars,
+	})
+	return buf.String(), err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestQuery_text(t *testing.T) {
+	queries := map[string]string{
+		"shard_filter": "shard = '{{.Vars.shard}}'",
+		"users":        "SELECT count(*) FROM users WHERE {{template \"shard_filter\" .}}",
+		// snippets which aren't referenced are never parsed
+		"arrays": "SELECT '{{1,2},{3,4}}'::int[]",
+	}
+	for _, tc := range []struct {
+		name     string
+		q        *Query
+		vars     map[string]string
+		expected string
+		err      string
+	}{
+		{
+			name:     "plain",
+			q:        &Query{Name: "plain", Query: "SELECT 1"},
+			expected: "SELECT 1",
+		},
+		{
+			name:     "variables",
+			q:        &Query{Name: "vars", Template: true, Query: "SELECT '{{.Job}}', '{{.Driver}}', '{{.Database}}', {{.Vars.shard}}"},
+			vars:     map[string]string{"shard": "3"},
+			expected: "SELECT 'templates', 'sqlite', ':memory:', 3",
+		},
+		{
+			name:     "snippet",
+			q:        &Query{Name: "snippet", Template: true, Query: "SELECT id FROM orders WHERE {{template \"shard_filter\" .}}"},
+			vars:     map[string]string{"shard": "eu"},
+			expected: "SELECT id FROM orders WHERE shard = 'eu'",
+		},
+		{
+			name:     "query_ref",
+			q:        &Query{Name: "ref", Template: true, QueryRef: "users"},
+			vars:     map[string]string{"shard": "us"},
+			expected: "SELECT count(*) FROM users WHERE shard = 'us'",
+		},
+		{
+			name:     "nested snippet",
+			q:        &Query{Name: "nested", Template: true, Query: "{{template \"users\" .}} AND active"},
+			vars:     map[string]string{"shard": "us"},
+			expected: "SELECT count(*) FROM users WHERE shard = 'us' AND active",
+		},
+		{
+			name:     "not a template",
+			q:        &Query{Name: "array", Query: "SELECT '{{1,2},{3,4}}'::int[]"},
+			expected: "SELECT '{{1,2},{3,4}}'::int[]",
+		},
+		{
+			name: "missing variable",
+			q:    &Query{Name: "missing", Template: true, Query: "SELECT {{.Vars.shard}}"},
+			err:  `map has no entry for key "shard"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			job := &Job{
+				Name:        "templates",
+				Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+				Queries:     []*Query{tc.q},
+				Vars:        tc.vars,
+			}
+			if err := job.Init(log.NewNopLogger(), queries); err != nil {
+				t.Fatal(err)
+			}
+			job.initConnections()
+			defer job.closeConnections()
+			text, err := tc.q.text(job.conns[0])
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, text)
+			}
+		})
+	}
+}
+
+func TestJob_Init_invalidQueryTemplate(t *testing.T) {
+	job := &Job{
+		Name:    "templates",
+		Queries: []*Query{{Name: "broken", Template: true, Query: "SELECT {{.Vars.shard"}},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err == nil || !strings.Contains(err.Error(), `invalid template of query "broken"`) {
+		t.Errorf("expected an invalid template error, got %v", err)
+	}
+}
+
+func Test_parseQueryTemplate_undefinedSnippet(t *testing.T) {
+	_, err := parseQueryTemplate("orders", `SELECT id FROM orders WHERE {{template "shard_filter" .}}`, nil)
+	if err == nil || !strings.Contains(err.Error(), `template "shard_filter" isn't defined`) {
+		t.Errorf("expected an undefined template error, got %v", err)
+	}
+}
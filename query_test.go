@@ -0,0 +1,884 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_mysqlExecutionTimeHint(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "SELECT COUNT(*) AS count FROM t",
+			out: "SELECT /*+ MAX_EXECUTION_TIME(1500) */ COUNT(*) AS count FROM t",
+		},
+		{
+			in:  "\n  select 1",
+			out: "\n  select /*+ MAX_EXECUTION_TIME(1500) */ 1",
+		},
+		{
+			in:  "SHOW GLOBAL STATUS",
+			out: "SHOW GLOBAL STATUS",
+		},
+	}
+	for _, tt := range tests {
+		if got := mysqlExecutionTimeHint(tt.in, 1500); got != tt.out {
+			t.Errorf("expected %q, got %q", tt.out, got)
+		}
+	}
+}
+
+// runSQLiteQuery runs the query on an in-memory SQLite database and returns a
+// registry with the resulting metrics.
+func runSQLiteQuery(t *testing.T, q *Query) *prometheus.Registry {
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{&ConnectionConfig{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	if err := job.register(registry); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func Test_autoQuery(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:  "stats",
+		Help:  "Table statistics",
+		Type:  metricTypeAuto,
+		Query: "SELECT 'users' AS tablename, 10 AS live_rows, 2.5 AS dead_ratio",
+	})
+	expected := `
+# HELP sql_stats Table statistics
+# TYPE sql_stats gauge
+sql_stats{col="dead_ratio",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",tablename="users",user=""} 2.5
+sql_stats{col="live_rows",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",tablename="users",user=""} 10
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_stats"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_pivotQuery(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:             "status",
+		Help:             "Server status",
+		MetricNameColumn: "variable_name",
+		ValueColumn:      "value",
+		Query:            "SELECT 'Uptime' AS variable_name, '42' AS value UNION ALL SELECT 'Ssl_cipher', 'none'",
+	})
+	expected := `
+# HELP sql_status_uptime Server status
+# TYPE sql_status_uptime gauge
+sql_status_uptime{database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 42
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_status_uptime", "sql_status_ssl_cipher"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_pivotQueryLabel(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:             "status",
+		Help:             "Server status",
+		MetricNameColumn: "variable_name",
+		ValueColumn:      "value",
+		MetricNameLabel:  "variable",
+		Labels:           Labels{{Name: "server", Column: "server"}},
+		Query:            "SELECT 'db1' AS server, 'Uptime' AS variable_name, '42' AS value UNION ALL SELECT 'db1', 'Threads_running', '3'",
+	})
+	expected := `
+# HELP sql_status Server status
+# TYPE sql_status gauge
+sql_status{database=":memory:",driver="sqlite",host=":memory:",server="db1",sql_job="test",user="",variable="Threads_running"} 3
+sql_status{database=":memory:",driver="sqlite",host=":memory:",server="db1",sql_job="test",user="",variable="Uptime"} 42
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_valueMetricFamilies(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:   "user_tables",
+		Help:   "Table statistics",
+		Labels: Labels{{Name: "relname", Column: "relname"}},
+		Values: Values{
+			{Column: "seq_scan", Name: "user_tables_seq_scan_total", Help: "Sequential scans", Type: metricTypeCounter},
+			{Column: "n_live_tup", Name: "user_tables_live_rows"},
+		},
+		Query: "SELECT 'users' AS relname, 7 AS seq_scan, 10 AS n_live_tup",
+	})
+	expected := `
+# HELP sql_user_tables_live_rows Table statistics
+# TYPE sql_user_tables_live_rows gauge
+sql_user_tables_live_rows{col="n_live_tup",database=":memory:",driver="sqlite",host=":memory:",relname="users",sql_job="test",user=""} 10
+# HELP sql_user_tables_seq_scan_total Sequential scans
+# TYPE sql_user_tables_seq_scan_total counter
+sql_user_tables_seq_scan_total{col="seq_scan",database=":memory:",driver="sqlite",host=":memory:",relname="users",sql_job="test",user=""} 7
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_user_tables_live_rows", "sql_user_tables_seq_scan_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_nullPolicies(t *testing.T) {
+	const query = "SELECT 'a' AS name, 1 AS value UNION ALL SELECT NULL, 2 UNION ALL SELECT 'c', NULL"
+	tests := []struct {
+		onNullValue string
+		onNullLabel string
+		expected    string
+	}{
+		{
+			onNullValue: nullSkip,
+			onNullLabel: nullEmpty,
+			expected: `
+sql_nulls{col="value",database=":memory:",driver="sqlite",host=":memory:",name="",sql_job="test",user=""} 2
+sql_nulls{col="value",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="test",user=""} 1
+`,
+		},
+		{
+			onNullValue: nullZero,
+			onNullLabel: nullSkip,
+			expected: `
+sql_nulls{col="value",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="test",user=""} 1
+sql_nulls{col="value",database=":memory:",driver="sqlite",host=":memory:",name="c",sql_job="test",user=""} 0
+`,
+		},
+	}
+	for _, tt := range tests {
+		registry := runSQLiteQuery(t, &Query{
+			Name:        "nulls",
+			Help:        "Nulls",
+			Labels:      Labels{{Name: "name", Column: "name"}},
+			Values:      Values{{Column: "value"}},
+			Query:       query,
+			OnNullValue: tt.onNullValue,
+			OnNullLabel: tt.onNullLabel,
+		})
+		expected := "# HELP sql_nulls Nulls\n# TYPE sql_nulls gauge" + tt.expected
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_nulls"); err != nil {
+			t.Errorf("on_null_value %s, on_null_label %s: %v", tt.onNullValue, tt.onNullLabel, err)
+		}
+	}
+
+	res := map[string]interface{}{"value": nil}
+	q := &Query{}
+	if _, err := q.parseValue(res, "value"); err == nil {
+		t.Errorf("expected error for NULL value without policy")
+	}
+	if value, err := q.parseValue(res, "missing"); err != nil || value != 0 {
+		t.Errorf("expected missing columns to be zero without policy, got %v, %v", value, err)
+	}
+	q.OnNullValue = nullNaN
+	if value, err := q.parseValue(res, "value"); err != nil || !math.IsNaN(value) {
+		t.Errorf("expected NaN, got %v, %v", value, err)
+	}
+	q.OnNullValue = nullError
+	if _, err := q.parseValue(res, "missing"); err != nullColumnError("missing") {
+		t.Errorf("expected NULL column error, got %v", err)
+	}
+}
+
+func Test_labelTransforms(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name: "states",
+		Help: "Orders by state",
+		Labels: Labels{
+			{Name: "state", Column: "state", Lowercase: true, Map: map[string]string{"new york": "ny"}},
+			{Name: "region", Column: "region", Regex: `^region-(\w+)$`, Replacement: "$1"},
+		},
+		Values: Values{{Column: "value"}},
+		Query:  "SELECT 'New York' AS state, 'region-east' AS region, 1 AS value UNION ALL SELECT 'Ohio', 'west', 2",
+	})
+	expected := `
+# HELP sql_states Orders by state
+# TYPE sql_states gauge
+sql_states{col="value",database=":memory:",driver="sqlite",host=":memory:",region="east",sql_job="test",state="ny",user=""} 1
+sql_states{col="value",database=":memory:",driver="sqlite",host=":memory:",region="west",sql_job="test",state="ohio",user=""} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_states"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_stateSetQuery(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:        "role",
+		Help:        "Cluster role",
+		Type:        metricTypeState,
+		Labels:      Labels{{Name: "node", Column: "node"}},
+		StateColumn: "role",
+		States:      []string{"primary", "replica"},
+		Query:       "SELECT 'a' AS node, 'primary' AS role UNION ALL SELECT 'b', 'unknown'",
+	})
+	expected := `
+# HELP sql_role Cluster role
+# TYPE sql_role gauge
+sql_role{col="role",database=":memory:",driver="sqlite",host=":memory:",node="a",role="primary",sql_job="test",user=""} 1
+sql_role{col="role",database=":memory:",driver="sqlite",host=":memory:",node="a",role="replica",sql_job="test",user=""} 0
+sql_role{col="role",database=":memory:",driver="sqlite",host=":memory:",node="b",role="primary",sql_job="test",user=""} 0
+sql_role{col="role",database=":memory:",driver="sqlite",host=":memory:",node="b",role="replica",sql_job="test",user=""} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_role"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_infoQuery(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:  "server",
+		Help:  "Server version",
+		Type:  metricTypeInfo,
+		Query: "SELECT sqlite_version() AS version, 'main' AS cluster, 3 AS major",
+	})
+	version := ""
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "sql_server_info" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge().GetValue() != 1 {
+				t.Errorf("expected value 1, got %v", m.GetGauge().GetValue())
+			}
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["cluster"] != "main" || labels["major"] != "3" || labels["col"] != metricTypeInfo {
+				t.Errorf("unexpected labels %v", labels)
+			}
+			version = labels["version"]
+		}
+	}
+	if version == "" {
+		t.Errorf("expected sql_server_info with the version label")
+	}
+}
+
+func Test_parseValueAs(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	tests := []struct {
+		in       interface{}
+		as       string
+		expected float64
+		err      bool
+	}{
+		{in: true, expected: 1},
+		{in: false, as: asBool, expected: 0},
+		{in: []uint8("t"), as: asBool, expected: 1},
+		{in: "off", as: asBool, expected: 0},
+		{in: int64(3), as: asBool, expected: 1},
+		{in: "maybe", as: asBool, err: true},
+		{in: ts, expected: 1704164645},
+		{in: ts, as: asUnixSeconds, expected: 1704164645},
+		{in: ts, as: asUnixMillis, expected: 1704164645600},
+		{in: []uint8("2024-01-02 03:04:05"), as: asUnixSeconds, expected: 1704164645},
+		{in: "2024-01-02T03:04:05.6+00:00", as: asUnixMillis, expected: 1704164645600},
+		{in: "2024-01-02 05:04:05+02", as: asUnixSeconds, expected: 1704164645},
+		{in: "2024-01-02", as: asUnixSeconds, expected: 1704153600},
+		{in: "yesterday", as: asUnixSeconds, err: true},
+		{in: []uint8("00:00:01.5"), expected: 1.5},
+		{in: []uint8("1 day 02:03:04"), expected: 93784},
+		{in: "-00:00:10", expected: -10},
+		{in: "1 year 2 mons 3 days", expected: 31557600 + 60*86400 + 3*86400},
+		{in: "@ 1 hour 30 mins ago", expected: -5400},
+		{in: []uint8("838:59:59"), expected: 3020399},
+		{in: "1m30s", as: asDuration, expected: 90},
+		{in: int64(42), as: asDuration, expected: 42},
+		{in: 2 * time.Second, as: asDuration, expected: 2},
+		{in: "12:ab", err: true},
+		{in: "1 fortnight", as: asDuration, err: true},
+	}
+	q := &Query{}
+	for _, tt := range tests {
+		got, err := q.parseValueAs(map[string]interface{}{"value": tt.in}, "value", tt.as)
+		if (err != nil) != tt.err {
+			t.Errorf("%v as %q: unexpected error %v", tt.in, tt.as, err)
+			continue
+		}
+		if !tt.err && got != tt.expected {
+			t.Errorf("%v as %q: expected %v, got %v", tt.in, tt.as, tt.expected, got)
+		}
+	}
+}
+
+func TestQuery_localizeTimes(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wall := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	local := time.Date(2024, 1, 2, 3, 4, 5, 0, berlin)
+	for _, tc := range []struct {
+		name     string
+		url      string
+		in       time.Time
+		expected time.Time
+	}{
+		{name: "mysql", url: "mysql://app@tcp(db:3306)/app?parseTime=true", in: wall, expected: local},
+		{name: "mysql loc", url: "mysql://app@tcp(db:3306)/app?parseTime=true&loc=UTC", in: wall, expected: wall},
+		{name: "sqlserver datetime", url: "sqlserver://sa@db:1433?database=master", in: wall, expected: local},
+		{name: "fixed zone", url: "sqlserver://sa@db:1433?database=master", in: wall.In(time.FixedZone("", 0)), expected: wall},
+		{name: "offset", url: "sqlserver://sa@db:1433?database=master", in: wall.In(time.FixedZone("", 3600)), expected: wall},
+		{name: "sqlite", url: "sqlite://:memory:", in: wall, expected: local},
+		{name: "postgres timestamp", url: "postgres://app@db/app", in: wall.In(time.FixedZone("", 0)), expected: local},
+		{name: "postgres timestamptz", url: "postgres://app@db/app", in: wall, expected: wall},
+		{name: "unknown driver", url: "clickhouse://app@db:9000/app", in: wall, expected: wall},
+	} {
+		conn, err := newConnection(tc.url)
+		if err != nil {
+			t.Fatalf("%s: got unexpected error: %v", tc.name, err)
+		}
+		q := &Query{location: berlin}
+		res := map[string]interface{}{"ts": tc.in, "other": "text"}
+		q.localizeTimes(conn, res)
+		if got := res["ts"].(time.Time); !got.Equal(tc.expected) {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+		if res["other"] != "text" {
+			t.Errorf("%s: expected other columns to be kept, got %v", tc.name, res["other"])
+		}
+	}
+
+	// without timezone the timestamps are kept as returned
+	res := map[string]interface{}{"ts": wall}
+	(&Query{}).localizeTimes(&connection{driver: "mysql", naiveUTC: true}, res)
+	if got := res["ts"].(time.Time); got != wall {
+		t.Errorf("expected the timestamp to be kept, got %s", got)
+	}
+
+	// text without zone is in the timezone of the job
+	q := &Query{location: berlin}
+	if got, err := q.parseValueAs(map[string]interface{}{"ts": "2024-01-02 03:04:05"}, "ts", asUnixSeconds); err != nil || got != float64(local.Unix()) {
+		t.Errorf("expected %d, got %v, %v", local.Unix(), got, err)
+	}
+	if got, err := q.parseValueAs(map[string]interface{}{"ts": "2024-01-02T03:04:05Z"}, "ts", asUnixSeconds); err != nil || got != float64(wall.Unix()) {
+		t.Errorf("expected %d, got %v, %v", wall.Unix(), got, err)
+	}
+}
+
+func Test_queryRetries(t *testing.T) {
+	if err := setMocks(map[string][]*MockResult{"slow": {{Match: "slow", Delay: time.Second}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+	none := 0
+	for _, tc := range []struct {
+		q   *Query
+		url string
+	}{
+		{q: &Query{Name: "missing", Query: "SELECT value FROM missing"}, url: "sqlite://:memory:"},
+		{q: &Query{Name: "slow", Query: "SELECT value FROM slow", Timeout: 10 * time.Millisecond}, url: "mock://slow/db"},
+		{q: &Query{Name: "disabled", Query: "SELECT value FROM slow", Timeout: 10 * time.Millisecond, Retries: &none}, url: "mock://slow/db"},
+	} {
+		tc.q.Help = "Retried"
+		tc.q.Values = Values{{Column: "value"}}
+		job := &Job{
+			Name:         "retries",
+			Connections:  []*ConnectionConfig{{URL: tc.url}},
+			Queries:      []*Query{tc.q},
+			Retries:      2,
+			RetryBackoff: time.Millisecond,
+		}
+		if err := job.Init(log.NewNopLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+		job.initConnections()
+		defer job.closeConnections()
+		conn := job.conns[0]
+		if err := conn.connect(job); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.q.Run(conn); err == nil {
+			t.Fatalf("%s: expected error", tc.q.Name)
+		}
+		if got := len(tc.q.history); got != 1 {
+			t.Errorf("%s: expected the retries to be recorded as one run, got %d", tc.q.Name, got)
+		}
+	}
+	// neither the missing table nor the query overriding the retries of the
+	// job are retried
+	expected := `
+# HELP sql_exporter_query_retries_total Number of retries of failed query executions
+# TYPE sql_exporter_query_retries_total counter
+sql_exporter_query_retries_total{database="db",driver="mock",host="slow",query="slow",sql_job="retries",user=""} 2
+`
+	if err := testutil.CollectAndCompare(queryRetries, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuery_exists(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		onNull   string
+		expected string
+	}{
+		{
+			name:     "rows",
+			query:    "SELECT 'a' AS name UNION ALL SELECT 'b'",
+			expected: `sql_present{col="exists",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="exists",user=""} 1`,
+		},
+		{
+			name:     "empty",
+			query:    "SELECT 'a' AS name WHERE 1 = 0",
+			expected: `sql_present{col="exists",database=":memory:",driver="sqlite",host=":memory:",name="",sql_job="exists",user=""} 0`,
+		},
+		{
+			name:     "skip",
+			query:    "SELECT NULL AS name",
+			onNull:   nullSkip,
+			expected: `sql_present{col="exists",database=":memory:",driver="sqlite",host=":memory:",name="",sql_job="exists",user=""} 1`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &Query{Name: "present", Help: "Present", Type: metricTypeExists, Labels: Labels{{Name: "name", Column: "name"}}, Query: tc.query, OnNullLabel: tc.onNull}
+			job := &Job{
+				Name:        "exists",
+				Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+				Queries:     []*Query{q},
+			}
+			if err := job.Init(log.NewNopLogger(), nil); err != nil {
+				t.Fatal(err)
+			}
+			job.initConnections()
+			defer job.closeConnections()
+			conn := job.conns[0]
+			if err := conn.connect(job); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Run(conn); err != nil {
+				t.Fatal(err)
+			}
+			expected := "# HELP sql_present Present\n# TYPE sql_present gauge\n" + tc.expected + "\n"
+			if err := testutil.GatherAndCompare(job.gatherer(), strings.NewReader(expected), "sql_present"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestQuery_freshMetrics(t *testing.T) {
+	q := &Query{Name: "aged", Help: "Aged", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value", MaxAge: time.Minute}
+	job := &Job{
+		Name:        "max_age",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	stale := func() float64 {
+		key := strings.Join([]string{conn.driver, conn.host, conn.database, conn.user, job.Name, q.Name}, "\xff")
+		staleQueries.mtx.Lock()
+		defer staleQueries.mtx.Unlock()
+		if v := staleQueries.values[key]; v != nil {
+			return v.value
+		}
+		return -1
+	}
+	exported := func() bool {
+		families, err := job.gatherer().Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "sql_aged" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	if !exported() || stale() != 0 {
+		t.Errorf("expected the fresh metrics to be exported, stale is %v", stale())
+	}
+
+	// the last successful run is older than max_age
+	q.Lock()
+	q.updated[conn] = time.Now().Add(-2 * time.Minute)
+	q.Unlock()
+	if exported() || stale() != 1 {
+		t.Errorf("expected the aged metrics to be dropped, stale is %v", stale())
+	}
+
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	if !exported() || stale() != 0 {
+		t.Errorf("expected the metrics of the next run to be exported, stale is %v", stale())
+	}
+}
+
+func Test_isTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{err: driver.ErrBadConn, transient: true},
+		{err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), transient: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, transient: true},
+		{err: &net.DNSError{Err: "timeout", IsTimeout: true}, transient: true},
+		{err: errors.New("no such table: missing")},
+		{err: errors.New(`syntax error at or near "SELEC"`)},
+	} {
+		if got := isTransientError(tc.err); got != tc.transient {
+			t.Errorf("%v: expected transient %v, got %v", tc.err, tc.transient, got)
+		}
+	}
+}
+
+func Test_localResultCache(t *testing.T) {
+	newQuery := func(name string) *Query {
+		return &Query{
+			Name:     name,
+			Help:     "Random value",
+			Values:   Values{{Column: "value"}},
+			Query:    "SELECT random() AS value",
+			CacheTTL: time.Minute,
+		}
+	}
+	first, second := newQuery("first"), newQuery("second")
+	job := &Job{
+		Name:        "cache",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{first, second},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	values := make([]float64, 0, 2)
+	for _, q := range []*Query{first, second} {
+		rows, done, err := q.localResultRows(context.Background(), conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]interface{})
+		if !rows.Next() || rows.MapScan(res) != nil {
+			t.Fatalf("expected a row")
+		}
+		done()
+		values = append(values, float64(res["value"].(int64)))
+	}
+	if values[0] != values[1] {
+		t.Errorf("expected the second query to reuse the result, got %v", values)
+	}
+}
+
+func Test_localResultCacheLimits(t *testing.T) {
+	q := &Query{
+		Name:     "limited",
+		Help:     "Limited",
+		Labels:   Labels{{Name: "x", Column: "x"}},
+		Values:   Values{{Column: "value"}},
+		Query:    "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 20000) SELECT CAST(x AS TEXT) AS x, 1 AS value FROM c",
+		CacheTTL: time.Minute,
+		MaxRows:  2,
+	}
+	job := &Job{
+		Name:        "local",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	defer deleteExporterMetrics(func(labelValues []string) bool { return labelValues[4] == job.Name })
+	limits := func(limit string) float64 {
+		queryLimits.mtx.Lock()
+		defer queryLimits.mtx.Unlock()
+		if v, found := queryLimits.values[strings.Join([]string{conn.driver, conn.host, conn.database, conn.user, job.Name, q.Name, limit}, "\xff")]; found {
+			return v.value
+		}
+		return 0
+	}
+
+	// the rows beyond max_rows aren't read, but the limit is still noticed
+	rows, err := q.fetchRows(context.Background(), conn)
+	if err != nil || len(rows) != q.MaxRows+1 {
+		t.Fatalf("expected %d rows, got %d, %v", q.MaxRows+1, len(rows), err)
+	}
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(q.metrics[conn]); got != q.MaxRows {
+		t.Errorf("expected %d metrics, got %d", q.MaxRows, got)
+	}
+	if got := limits("rows"); got != 1 {
+		t.Errorf("expected the exceeded max_rows to be counted, got %v", got)
+	}
+
+	// nor are the rows read once the heap exceeds max-memory
+	q.MaxRows = 0
+	setMaxMemory(1)
+	defer setMaxMemory(0)
+	if _, err := q.fetchRows(context.Background(), conn); err == nil || !strings.Contains(err.Error(), "max-memory") {
+		t.Fatalf("expected the query to be aborted, got %v", err)
+	}
+	if err := q.Run(conn); err == nil {
+		t.Fatal("expected the query to be aborted")
+	}
+	if got := limits("memory"); got != 1 {
+		t.Errorf("expected the exceeded max-memory to be counted, got %v", got)
+	}
+}
+
+func Test_queryLimits(t *testing.T) {
+	const query = "SELECT 'a' AS name, 1 AS value UNION ALL SELECT 'b', 2 UNION ALL SELECT 'c', 3 ORDER BY name"
+	registry := runSQLiteQuery(t, &Query{
+		Name:    "limited",
+		Help:    "Limited",
+		Labels:  Labels{{Name: "name", Column: "name"}},
+		Values:  Values{{Column: "value"}},
+		Query:   query,
+		MaxRows: 2,
+	})
+	expected := `
+# HELP sql_limited Limited
+# TYPE sql_limited gauge
+sql_limited{col="value",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="test",user=""} 1
+sql_limited{col="value",database=":memory:",driver="sqlite",host=":memory:",name="b",sql_job="test",user=""} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_limited"); err != nil {
+		t.Error(err)
+	}
+
+	q := &Query{
+		Name:      "series",
+		Help:      "Too many series",
+		Labels:    Labels{{Name: "name", Column: "name"}},
+		Values:    Values{{Column: "value"}},
+		Query:     query,
+		MaxSeries: 2,
+		OnLimit:   onLimitError,
+	}
+	job := &Job{
+		Name:        "limits",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Run(conn); err == nil {
+		t.Fatalf("expected error for exceeding max_series")
+	}
+	expected = `
+# HELP sql_exporter_query_limit_exceeded_total Number of query executions exceeding max_rows, max_series or max-memory
+# TYPE sql_exporter_query_limit_exceeded_total counter
+sql_exporter_query_limit_exceeded_total{database=":memory:",driver="sqlite",host=":memory:",limit="rows",query="limited",sql_job="test",user=""} 1
+sql_exporter_query_limit_exceeded_total{database=":memory:",driver="sqlite",host=":memory:",limit="series",query="series",sql_job="limits",user=""} 1
+`
+	if err := testutil.CollectAndCompare(queryLimits, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_limitPushdown(t *testing.T) {
+	registry := runSQLiteQuery(t, &Query{
+		Name:          "pushed",
+		Help:          "Pushed",
+		Labels:        Labels{{Name: "name", Column: "name"}},
+		Values:        Values{{Column: "value"}},
+		Query:         "SELECT 'a' AS name, 1 AS value UNION ALL SELECT 'b', 2 UNION ALL SELECT 'c', 3 ORDER BY name -- all",
+		MaxRows:       2,
+		LimitPushdown: true,
+	})
+	expected := `
+# HELP sql_pushed Pushed
+# TYPE sql_pushed gauge
+sql_pushed{col="value",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="test",user=""} 1
+sql_pushed{col="value",database=":memory:",driver="sqlite",host=":memory:",name="b",sql_job="test",user=""} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_pushed"); err != nil {
+		t.Error(err)
+	}
+	// the extra row detects the exceeded limit
+	q := &Query{
+		Name:          "exceeded",
+		Help:          "Exceeded",
+		Values:        Values{{Column: "value"}},
+		Query:         "SELECT 1 AS value UNION ALL SELECT 2",
+		MaxRows:       1,
+		OnLimit:       onLimitError,
+		LimitPushdown: true,
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Run(conn); err == nil || err.Error() != "query exceeded max_rows of 1" {
+		t.Errorf("expected error for exceeding max_rows, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		driver   string
+		expected string
+	}{
+		{"postgres", "SELECT * FROM (\nSELECT 1\n) sql_exporter_limited LIMIT 10"},
+		{"sqlserver", "SELECT TOP (10) * FROM (\nSELECT 1\n) AS sql_exporter_limited"},
+		{"oracle", "SELECT * FROM (\nSELECT 1\n) WHERE ROWNUM <= 10"},
+		{"unknown", "SELECT 1"},
+	} {
+		if got := limitQuery(tc.driver, " SELECT 1;\n", 10); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.driver, tc.expected, got)
+		}
+	}
+}
+
+func Test_setupSQL(t *testing.T) {
+	q := &Query{
+		Name:   "staged",
+		Help:   "Staged",
+		Labels: Labels{{Name: "name", Column: "name"}},
+		Values: Values{{Column: "value"}},
+		SetupSQL: []string{
+			"CREATE TEMP TABLE staging (name TEXT, value INTEGER)",
+			"INSERT INTO staging VALUES ('a', 1), ('b', 2)",
+		},
+		Query: "SELECT name, value FROM staging",
+	}
+	registry := runSQLiteQuery(t, q)
+	expected := `
+# HELP sql_staged Staged
+# TYPE sql_staged gauge
+sql_staged{col="value",database=":memory:",driver="sqlite",host=":memory:",name="a",sql_job="test",user=""} 1
+sql_staged{col="value",database=":memory:",driver="sqlite",host=":memory:",name="b",sql_job="test",user=""} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_staged"); err != nil {
+		t.Error(err)
+	}
+
+	// the staging table is rolled back, so the next run can create it again
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Run(conn); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
+
+func Test_maxMemory(t *testing.T) {
+	q := &Query{
+		Name:   "wide",
+		Help:   "Wide",
+		Labels: Labels{{Name: "n", Column: "n"}},
+		Values: Values{{Column: "value"}},
+		Query:  "WITH RECURSIVE r(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM r WHERE n < 20000) SELECT CAST(n AS TEXT) AS n, n AS value FROM r",
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+
+	// any heap exceeds a single byte
+	setMaxMemory(1)
+	defer setMaxMemory(0)
+	err := q.Run(conn)
+	if err == nil || !strings.HasPrefix(err.Error(), "query aborted after 10000 rows") {
+		t.Errorf("expected the query to be aborted, got %v", err)
+	}
+
+	setMaxMemory(0)
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.metrics[conn]) != 20000 {
+		t.Errorf("expected 20000 metrics, got %d", len(q.metrics[conn]))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// readOnlySessionSQL makes the sessions of read only connections read only,
+// by driver. Other drivers rely on the statement check alone.
+var readOnlySessionSQL = map[string]string{
+	"postgres": "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY",
+	"mysql":    "SET SESSION TRANSACTION READ ONLY",
+	"sqlite":   "PRAGMA query_only = ON",
+}
+
+// writeKeywords modify data or schema wherever they appear in a statement,
+// they are reserved words in the supported dialects.
+var writeKeywords = map[string]bool{
+	"INSERT":   true,
+	"UPDATE":   true,
+	"DELETE":   true,
+	"MERGE":    true,
+	"INTO":     true,
+	"CREATE":   true,
+	"ALTER":    true,
+	"DROP":     true,
+	"TRUNCATE": true,
+	"GRANT":    true,
+	"REVOKE":   true,
+}
+
+// writeCommands modify data or run arbitrary code when they start a
+// statement. They aren't reserved everywhere, e.g. REPLACE is a function
+// as well.
+var writeCommands = map[string]bool{
+	"REPLACE": true,
+	"UPSERT":  true,
+	"COPY":    true,
+	"LOAD":    true,
+	"RENAME":  true,
+	"COMMENT": true,
+	"LOCK":    true,
+	"VACUUM":  true,
+	"REINDEX": true,
+	"CLUSTER": true,
+	"REFRESH": true,
+	"CALL":    true,
+	"EXEC":    true,
+	"EXECUTE": true,
+	"DO":      true,
+}
+
+// checkReadOnly returns an error if the statements contain a write. It's a
+// simple check of the keywords outside of comments and quotes, not a full
+// parser, so it rather rejects too much than too little. Whether
+// backslashes escape quotes depends on the dialect and its settings, so the
+// query is checked both ways.
+func checkReadOnly(query string) error {
+	for _, backslash := range []bool{false, true} {
+		first := true
+		for _, word := range sqlWords(query, backslash) {
+			if word == ";" {
+				first = true
+				continue
+			}
+			if writeKeywords[word] || (first && writeCommands[word]) {
+				return fmt.Errorf("read only connection, refusing to run a statement containing %s", word)
+			}
+			first = false
+		}
+	}
+	return nil
+}
+
+// sqlWords returns the upper cased words of the statements and the
+// semicolons separating them, skipping comments, string literals and
+// quoted identifiers.
+func sqlWords(query string, backslash bool) []string {
+	var words []string
+	runes := []rune(query)
+	// skipTo returns the position after the next end from i on
+	skipTo := func(i int, end string) int {
+		n := len([]rune(end))
+		for ; i+n <= len(runes); i++ {
+			if string(runes[i:i+n]) == end {
+				return i + n
+			}
+		}
+		return len(runes)
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			i = skipTo(i, "\n")
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i = skipTo(i+2, "*/")
+		case r == '\'' || r == '"' || r == '`':
+			i = skipQuoted(runes, i, backslash)
+		case r == '[':
+			i = skipTo(i+1, "]")
+		case r == '$' && dollarTag(runes, i) != "":
+			tag := dollarTag(runes, i)
+			i = skipTo(i+len([]rune(tag)), tag)
+		case r == ';':
+			words = append(words, ";")
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '$') {
+				j++
+			}
+			words = append(words, strings.ToUpper(string(runes[i:j])))
+			i = j
+		default:
+			i++
+		}
+	}
+	return words
+}
+
+// skipQuoted returns the position after the quoted string starting at i,
+// doubled quotes and, with backslash, backslash escaped quotes don't end it.
+func skipQuoted(runes []rune, i int, backslash bool) int {
+	quote := runes[i]
+	for i++; i < len(runes); i++ {
+		switch {
+		case backslash && runes[i] == '\\':
+			i++
+		case runes[i] == quote && i+1 < len(runes) && runes[i+1] == quote:
+			i++
+		case runes[i] == quote:
+			return i + 1
+		}
+	}
+	return len(runes)
+}
+
+// dollarTag returns the tag of the postgres dollar quoted string starting
+// at i, e.g. $$ or $body$, or an empty string if it isn't one.
+func dollarTag(runes []rune, i int) string {
+	for j := i + 1; j < len(runes); j++ {
+		switch {
+		case runes[j] == '$':
+			return string(runes[i : j+1])
+		case unicode.IsLetter(runes[j]) || runes[j] == '_' || (j > i+1 && unicode.IsDigit(runes[j])):
+		default:
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_checkReadOnly(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{query: "SELECT datname, pg_database_size(datname) FROM pg_database"},
+		{query: "select updated_at, replace(name, 'a', 'b') from t -- delete later"},
+		{query: "SELECT 'DROP TABLE t', \"insert\" FROM t /* UPDATE t */"},
+		{query: "SELECT 1; SHOW STATUS"},
+		{query: "SELECT $$DELETE FROM t$$, $body$TRUNCATE$body$, $1"},
+		{query: "SELECT [delete] FROM t"},
+		{query: "DELETE FROM t", err: "DELETE"},
+		{query: "  update t set a = 1", err: "UPDATE"},
+		{query: "SELECT 1; DROP TABLE t", err: "DROP"},
+		{query: "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", err: "DELETE"},
+		{query: "SELECT * INTO backup FROM t", err: "INTO"},
+		{query: "REPLACE INTO t VALUES (1)", err: "REPLACE"},
+		{query: "SELECT 1; CALL cleanup()", err: "CALL"},
+		{query: "SELECT 'a\\'; DELETE FROM t; --'", err: "DELETE"},
+		{query: "SELECT 'a\\''; DELETE FROM t", err: "DELETE"},
+		{query: "SELECT 'unterminated /* DELETE", err: ""},
+	} {
+		err := checkReadOnly(tc.query)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.query, err)
+		}
+		if tc.err != "" && (err == nil || !strings.HasSuffix(err.Error(), " "+tc.err)) {
+			t.Errorf("%s: expected the write %s to be rejected, got %v", tc.query, tc.err, err)
+		}
+	}
+}
+
+func TestQuery_ReadOnly(t *testing.T) {
+	q := &Query{
+		Name:   "query_only",
+		Help:   "Query only",
+		Values: Values{{Column: "query_only"}},
+		Query:  "SELECT query_only FROM pragma_query_only",
+	}
+	write := &Query{
+		Name:     "write",
+		Help:     "Write",
+		Values:   Values{{Column: "value"}},
+		SetupSQL: []string{"CREATE TEMP TABLE staging (value INTEGER)"},
+		Query:    "SELECT value FROM staging",
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:", ReadOnly: true}},
+		Queries:     []*Query{q, write},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Run(conn); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(job)
+	expected := `
+# HELP sql_query_only Query only
+# TYPE sql_query_only gauge
+sql_query_only{col="query_only",database=":memory:",driver="sqlite",host=":memory:",sql_job="test",user=""} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_query_only"); err != nil {
+		t.Error(err)
+	}
+	err := write.Run(conn)
+	if err == nil || !strings.Contains(err.Error(), "refusing to run a statement containing CREATE") {
+		t.Errorf("expected the setup to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var collectFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_collect_failures_total",
+	Help: "Collections of the metrics of a job which failed, e.g. by a panic or inconsistent metrics",
+}, []string{"sql_job"})
+
+func init() {
+	prometheus.MustRegister(collectFailures)
+}
+
+// jobCollector collects the metrics of a job into the registry of the job.
+// A panic while collecting drops the remaining metrics of the job only.
+type jobCollector struct {
+	job *Job
+}
+
+func (c jobCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.job.Describe(ch)
+}
+
+func (c jobCollector) Collect(ch chan<- prometheus.Metric) {
+	defer c.job.recoverCollect()
+	c.job.Collect(ch)
+}
+
+// uncheckedCollector collects the metrics of the pivot queries of a job,
+// which are named after the rows and can't be described upfront. It
+// describes nothing, so the registry collects them unchecked.
+type uncheckedCollector struct {
+	job *Job
+}
+
+func (c uncheckedCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c uncheckedCollector) Collect(ch chan<- prometheus.Metric) {
+	defer c.job.recoverCollect()
+	c.job.collectQueries(ch, true)
+}
+
+// recoverCollect recovers from a panic while collecting the metrics of the
+// job. It must be deferred.
+func (j *Job) recoverCollect() {
+	if r := recover(); r != nil {
+		level.Error(j.log).Log("msg", "Collecting the metrics panicked", "err", r)
+		collectFailures.WithLabelValues(j.Name).Inc()
+	}
+}
+
+// register registers the collectors of the job, including the unchecked one
+// if the job has pivot queries.
+func (j *Job) register(r prometheus.Registerer) error {
+	if err := r.Register(jobCollector{job: j}); err != nil {
+		return err
+	}
+	for _, query := range j.Queries {
+		if query == nil {
+			continue
+		}
+		for _, q := range append([]*Query{query}, query.ResultSets...) {
+			if q != nil && q.unchecked() {
+				return r.Register(uncheckedCollector{job: j})
+			}
+		}
+	}
+	return nil
+}
+
+// initRegistry creates the registry of the job. The descriptors of the
+// queries are checked on registration, so a job with inconsistent metrics
+// fails to initialize instead of failing the scrapes of all jobs.
+func (j *Job) initRegistry() error {
+	registry := prometheus.NewRegistry()
+	if err := j.register(registry); err != nil {
+		return fmt.Errorf("failed to register the metrics: %v", err)
+	}
+	j.registry = registry
+	return nil
+}
+
+// gather returns the metrics of the job, jobs in pull mode run their queries
+// first. Metrics failing the checks of the registry are dropped and logged,
+// the valid ones are still returned.
+func (j *Job) gather() []*dto.MetricFamily {
+	if j.registry == nil {
+		return nil
+	}
+	if j.Mode == jobModePull {
+		j.Scrape()
+	}
+	families, err := j.registry.Gather()
+	if err != nil {
+		level.Error(j.log).Log("msg", "Failed to gather the metrics", "err", err)
+		collectFailures.WithLabelValues(j.Name).Inc()
+	}
+	return families
+}
+
+// gatherer returns a gatherer of the metrics of the job which never fails.
+func (j *Job) gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return j.gather(), nil
+	})
+}
+
+// Gather implements prometheus.Gatherer. The metrics of each job are
+// gathered from its own registry and merged, so a misbehaving job only
+// loses its own metrics.
+func (e *Exporter) Gather() ([]*dto.MetricFamily, error) {
+	return e.jobGatherers(nil).Gather()
+}
+
+// gatherer returns the metrics of the exporter itself and of all jobs.
+func (e *Exporter) gatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{prometheus.DefaultGatherer, e}
+}
+
+// metricsGatherer returns the metrics served on the metrics path, which
+// leave out the jobs exposed on a port or path of their own and, if they are
+// only pushed, all jobs.
+func (e *Exporter) metricsGatherer() prometheus.Gatherer {
+	jobs := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if e.scrapeDisabled() {
+			return nil, nil
+		}
+		return e.jobGatherers(func(j *Job) bool { return j.Expose == nil }).Gather()
+	})
+	return prometheus.Gatherers{prometheus.DefaultGatherer, jobs}
+}
+
+// scrapeDisabled returns whether the metrics of the jobs are only pushed to
+// the remote_write endpoint.
+func (e *Exporter) scrapeDisabled() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.cfg.RemoteWrite != nil && e.cfg.RemoteWrite.DisableScrape
+}
+
+// JobMetricsHandler serves the metrics of a single job on
+// <metrics path>/{job}, e.g. for sharding the scrapes of the jobs across
+// Prometheus servers. The metrics of the exporter itself and jobs exposed on
+// a port or path of their own aren't included, nothing is
+// served if the metrics of the jobs are only pushed.
+func (e *Exporter) JobMetricsHandler(prefix string, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if name == "" || strings.Contains(name, "/") || e.scrapeDisabled() {
+			http.NotFound(w, r)
+			return
+		}
+		gatherers := e.jobGatherers(func(j *Job) bool { return j.Name == name && j.Expose == nil })
+		if len(gatherers) == 0 {
+			http.Error(w, fmt.Sprintf("job %q not found", name), http.StatusNotFound)
+			return
+		}
+		promhttp.HandlerFor(gatherers, opts).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExporter_Gather(t *testing.T) {
+	var jobs []*Job
+	for _, name := range []string{"healthy", "panicking"} {
+		job := &Job{
+			Name:        name,
+			Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+			Queries:     []*Query{{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT 42 AS value"}},
+		}
+		if err := job.Init(log.NewNopLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+		job.initConnections()
+		defer job.closeConnections()
+		conn := job.conns[0]
+		if err := conn.connect(job); err != nil {
+			t.Fatal(err)
+		}
+		job.Queries[0].Run(conn)
+		jobs = append(jobs, job)
+	}
+	// collecting the target_info of a nil connection panics
+	jobs[1].conns = append(jobs[1].conns, nil)
+	defer func() { jobs[1].conns = jobs[1].conns[:1] }()
+
+	e := &Exporter{jobs: jobs, logger: log.NewNopLogger()}
+	families, err := e.Gather()
+	if err != nil {
+		t.Fatalf("expected the panicking job not to fail the others, got %v", err)
+	}
+	found := false
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "sql_job" && l.GetValue() == "healthy" && mf.GetName() == "sql_answer" {
+					found = true
+				}
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected the metrics of the healthy job")
+	}
+	if got := testutil.ToFloat64(collectFailures.WithLabelValues("panicking")); got < 1 {
+		t.Errorf("expected the panic to be counted, got %v", got)
+	}
+
+	handler := e.JobMetricsHandler("/metrics/", promhttp.HandlerOpts{})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/healthy", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, `sql_job="healthy"`) || strings.Contains(body, `sql_job="panicking"`) {
+		t.Errorf("expected the metrics of the healthy job only, got %d:\n%s", rec.Code, body)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected unknown jobs not to be found, got %d", rec.Code)
+	}
+
+	e.cfg.RemoteWrite = &RemoteWrite{URL: "http://prometheus/api/v1/write", DisableScrape: true}
+	if families, err = e.metricsGatherer().Gather(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "sql_answer" {
+			t.Errorf("expected the metrics of the jobs to be only pushed, got %v", mf)
+		}
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/healthy", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected the metrics of the jobs to be only pushed, got %d", rec.Code)
+	}
+}
+
+func TestExporter_GatherTargetLabels(t *testing.T) {
+	// the target_info series of jobs with different target_labels are
+	// gathered from their own registries
+	var jobs []*Job
+	for name, labels := range map[string]map[string]string{
+		"primary": {"region": "eu-central-1"},
+		"replica": {"region": "eu-west-1", "tier": "replica"},
+		"plain":   nil,
+	} {
+		job := &Job{Name: name, TargetLabels: labels, Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}}}
+		if err := job.Init(log.NewNopLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+		job.initConnections()
+		defer job.closeConnections()
+		jobs = append(jobs, job)
+	}
+	e := &Exporter{jobs: jobs, logger: log.NewNopLogger()}
+	expected := `
+# HELP sql_exporter_target_info Target metadata of each connection
+# TYPE sql_exporter_target_info gauge
+sql_exporter_target_info{db_name=":memory:",db_system="sqlite",server_address=":memory:",server_port="",sql_job="plain"} 1
+sql_exporter_target_info{db_name=":memory:",db_system="sqlite",region="eu-central-1",server_address=":memory:",server_port="",sql_job="primary"} 1
+sql_exporter_target_info{db_name=":memory:",db_system="sqlite",region="eu-west-1",server_address=":memory:",server_port="",sql_job="replica",tier="replica"} 1
+`
+	if err := testutil.GatherAndCompare(e, strings.NewReader(expected), "sql_exporter_target_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJob_initRegistry(t *testing.T) {
+	job := &Job{
+		Name:        "duplicate",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{
+			{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT 42 AS value"},
+			{Name: "answer", Help: "Another answer", Values: Values{{Column: "value"}}, Query: "SELECT 43 AS value"},
+		},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err == nil || !strings.Contains(err.Error(), "failed to register") {
+		t.Errorf("expected the inconsistent metrics to fail the job, got %v", err)
+	}
+}
+
+func TestJob_Scrape(t *testing.T) {
+	result := &MockResult{Match: "answer", Rows: []map[string]interface{}{{"value": 1}}, Delay: 100 * time.Millisecond}
+	if err := setMocks(map[string][]*MockResult{"pull": {result}}); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+	job := &Job{
+		Name:        "pull",
+		Mode:        jobModePull,
+		Interval:    time.Millisecond,
+		Connections: []*ConnectionConfig{{URL: "mock://pull/db"}},
+		Queries:     []*Query{{Name: "answer", Help: "The answer", Values: Values{{Column: "value"}}, Query: "SELECT value FROM answer"}},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.Stop()
+	key := strings.Join([]string{"mock", "pull", "db", "", "pull", "answer"}, "\xff")
+	defer func() {
+		queryDuration.mtx.Lock()
+		delete(queryDuration.values, key)
+		queryDuration.mtx.Unlock()
+	}()
+	runs := func() uint64 {
+		queryDuration.mtx.Lock()
+		defer queryDuration.mtx.Unlock()
+		if v, found := queryDuration.values[key]; found {
+			return v.count
+		}
+		return 0
+	}
+	expected := func(value int) string {
+		return fmt.Sprintf(`
+# HELP sql_answer The answer
+# TYPE sql_answer gauge
+sql_answer{col="value",database="db",driver="mock",host="pull",sql_job="pull",user=""} %d
+`, value)
+	}
+
+	// the queries aren't run by the job itself
+	job.Run()
+	time.Sleep(20 * time.Millisecond)
+	if got := runs(); got != 0 {
+		t.Fatalf("expected no runs before the first scrape, got %d", got)
+	}
+
+	// but on every scrape, with the current results
+	for i, value := range []int{1, 2} {
+		result.Rows[0]["value"] = value
+		if err := testutil.GatherAndCompare(job.gatherer(), strings.NewReader(expected(value)), "sql_answer"); err != nil {
+			t.Error(err)
+		}
+		if got := runs(); got != uint64(i+1) {
+			t.Errorf("expected %d runs, got %d", i+1, got)
+		}
+	}
+
+	// scrapes arriving while a scrape is running share its results
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		job.gather()
+	}()
+	for running := false; !running; time.Sleep(time.Millisecond) {
+		job.Lock()
+		running = job.scraping != nil
+		job.Unlock()
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job.gather()
+		}()
+	}
+	wg.Wait()
+	if got := runs(); got != 3 {
+		t.Errorf("expected the concurrent scrapes to run the queries once, got %d runs", got-2)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultRemoteWriteInterval = time.Minute
+	defaultRemoteWriteTimeout  = 30 * time.Second
+)
+
+var (
+	remoteWriteSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sql_exporter_remote_write_samples_total",
+		Help: "Samples sent to the remote_write endpoint",
+	})
+	remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sql_exporter_remote_write_failures_total",
+		Help: "Failed pushes to the remote_write endpoint",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteSamples, remoteWriteFailures)
+}
+
+// remoteWriter periodically pushes all metrics of the exporter to a
+// Prometheus remote_write endpoint, for exporters Prometheus can't scrape.
+type remoteWriter struct {
+	cfg      *RemoteWrite
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	log      log.Logger
+	password string
+	cancel   context.CancelFunc
+}
+
+// newRemoteWriter returns a remote writer for the config, call start to push
+// the metrics.
+func newRemoteWriter(logger log.Logger, cfg *RemoteWrite, gatherer prometheus.Gatherer) (*remoteWriter, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote_write url: %v", err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.TLS != nil {
+		if transport.TLSClientConfig, err = cfg.TLS.clientConfig(u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultRemoteWriteTimeout
+	}
+	w := &remoteWriter{
+		cfg:      cfg,
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+		gatherer: gatherer,
+		log:      log.With(logger, "component", "remote_write"),
+	}
+	if cfg.BasicAuth != nil {
+		w.password = cfg.BasicAuth.Password
+		if cfg.BasicAuth.PasswordFile != "" {
+			if w.password, err = readSecretFile(cfg.BasicAuth.PasswordFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w, nil
+}
+
+// start pushes the metrics at the configured interval until stop is called.
+func (w *remoteWriter) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	interval := w.cfg.Interval
+	if interval <= 0 {
+		interval = defaultRemoteWriteInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := w.push(ctx); err != nil && ctx.Err() == nil {
+				remoteWriteFailures.Inc()
+				level.Warn(w.log).Log("msg", "Failed to push metrics", "err", err)
+			}
+		}
+	}()
+}
+
+// stop stops pushing, a running push is cancelled. It doesn't wait for the
+// push, which may be gathering the metrics of the exporter being reloaded.
+func (w *remoteWriter) stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// push gathers the metrics and sends them to the remote_write endpoint.
+func (w *remoteWriter) push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		// the metrics which could be gathered are pushed anyway
+		level.Warn(w.log).Log("msg", "Failed to gather some metrics", "err", err)
+	}
+	series := toTimeSeries(families, w.cfg.ExternalLabels, time.Now())
+	if len(series) == 0 {
+		return nil
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "sql_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.cfg.BasicAuth != nil {
+		req.SetBasicAuth(w.cfg.BasicAuth.Username, w.password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	remoteWriteSamples.Add(float64(len(series)))
+	return nil
+}
+
+// timeSeries is a single sample along with its sorted labels, including the
+// metric name as __name__ label.
+type timeSeries struct {
+	labels    []labelPair
+	value     float64
+	timestamp int64
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// toTimeSeries flattens the metric families into samples. Histograms and
+// summaries are split into their series like on exposition. The external
+// labels are added to all series which don't have the label already.
+func toTimeSeries(families []*dto.MetricFamily, external map[string]string, now time.Time) []timeSeries {
+	series := make([]timeSeries, 0, len(families))
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			labels := make(map[string]string, len(external)+len(m.GetLabel()))
+			for k, v := range external {
+				labels[k] = v
+			}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			add := func(name string, value float64, extra ...string) {
+				s := timeSeries{value: value, timestamp: ts}
+				s.labels = append(s.labels, labelPair{"__name__", name})
+				for k, v := range labels {
+					s.labels = append(s.labels, labelPair{k, v})
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					s.labels = append(s.labels, labelPair{extra[i], extra[i+1]})
+				}
+				sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+				series = append(series, s)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m.GetSummary().GetSampleSum())
+				add(name+"_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				inf := false
+				for _, b := range m.GetHistogram().GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), +1)
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !inf {
+					add(name+"_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m.GetHistogram().GetSampleSum())
+				add(name+"_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// formatFloat formats bucket bounds and quantiles like the text exposition
+// format does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the series as prometheus.WriteRequest protobuf
+// message, see github.com/prometheus/prometheus/prompb/remote.proto.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var buf []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
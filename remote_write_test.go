@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/snappy"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_toTimeSeries(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_duration_seconds",
+		Help:    "Test",
+		Buckets: []float64{0.5},
+	}, []string{"instance"})
+	hist.WithLabelValues("db").Observe(0.25)
+	registry.MustRegister(hist)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500, 0)
+	got := toTimeSeries(families, map[string]string{"instance": "exporter", "region": "eu"}, now)
+	labels := func(name string, extra ...labelPair) []labelPair {
+		return append(append([]labelPair{{"__name__", name}, {"instance", "db"}}, extra...), labelPair{"region", "eu"})
+	}
+	expected := []timeSeries{
+		{labels: labels("test_duration_seconds_bucket", labelPair{"le", "0.5"}), value: 1, timestamp: 1500000},
+		{labels: labels("test_duration_seconds_bucket", labelPair{"le", "+Inf"}), value: 1, timestamp: 1500000},
+		{labels: labels("test_duration_seconds_sum"), value: 0.25, timestamp: 1500000},
+		{labels: labels("test_duration_seconds_count"), value: 1, timestamp: 1500000},
+	}
+	if diff := pretty.Compare(expected, got); diff != "" {
+		t.Errorf("unexpected series (-want +got):\n\n%s", diff)
+	}
+}
+
+func Test_remoteWriterPush(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test"})
+	gauge.Set(42)
+	registry.MustRegister(gauge)
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, buf)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := &RemoteWrite{
+		URL:       server.URL,
+		BasicAuth: &BasicAuth{Username: "user", Password: "secret"},
+	}
+	w, err := newRemoteWriter(log.NewNopLogger(), cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.push(context.Background()); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(body) == 0 || !bytes.Contains(body, []byte("test_gauge")) {
+		t.Errorf("expected the gauge to be pushed, got %q", body)
+	}
+
+	cfg.BasicAuth.Password = "wrong"
+	if w, err = newRemoteWriter(log.NewNopLogger(), cfg, registry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.push(context.Background()); err == nil {
+		t.Errorf("expected error for rejected push")
+	}
+}
+
+func TestRemoteWrite_validate(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"region": true,
+		"_dc":    true,
+		"0zone":  false,
+		"a-b":    false,
+		"__name": false,
+	} {
+		cfg := &RemoteWrite{URL: "http://prometheus/api/v1/write", ExternalLabels: map[string]string{name: "x"}}
+		if err := cfg.validate(); (err == nil) != valid {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+}
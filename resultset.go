@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// multiResultRows are results with multiple result sets, e.g. of procedures
+// on SQL Server or multi-statement queries on MySQL
+type multiResultRows interface {
+	resultRows
+	NextResultSet() bool
+}
+
+// validateResultSets checks the metric definitions of the result sets of the
+// query.
+func (q *Query) validateResultSets() error {
+	if q.CacheTTL > 0 {
+		return fmt.Errorf("result_sets can't be used with cache_ttl")
+	}
+	for i, rs := range q.ResultSets {
+		if rs == nil {
+			continue
+		}
+		if rs.Name == "" {
+			return fmt.Errorf("result set %d has no name", i+2)
+		}
+		if rs.Query != "" || rs.QueryRef != "" || rs.Procedure != nil || len(rs.SetupSQL) > 0 {
+			return fmt.Errorf("result set %q must not have its own query", rs.Name)
+		}
+		if len(rs.ResultSets) > 0 {
+			return fmt.Errorf("result set %q must not have result sets", rs.Name)
+		}
+		if rs.Type != "" && !isMetricType(rs.Type) {
+			return fmt.Errorf("result set %q has unknown type %q, must be one of %s", rs.Name, rs.Type, strings.Join(metricTypes, ", "))
+		}
+		for _, v := range rs.Values {
+			if v.Column == "" {
+				return fmt.Errorf("result set %q has a value without column", rs.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// readResultSets reads the result sets following the first one into the
+// metrics of the result set definitions of the query.
+func (q *Query) readResultSets(conn *connection, rows resultRows) error {
+	multi, ok := rows.(multiResultRows)
+	if !ok {
+		return fmt.Errorf("cached results have no further result sets")
+	}
+	for i, rs := range q.ResultSets {
+		if !multi.NextResultSet() {
+			if err := multi.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("expected %d result sets, got %d", len(q.ResultSets)+1, i+1)
+		}
+		if rs == nil {
+			continue
+		}
+		var metrics []prometheus.Metric
+		var auto *autoColumns
+		for multi.Next() {
+			res := make(map[string]interface{})
+			if err := multi.MapScan(res); err != nil {
+				level.Error(rs.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
+				q.markFailed(conn, scrapeErrorParse)
+				continue
+			}
+			m, err := rs.rowMetrics(conn, res, &auto)
+			if err != nil {
+				level.Error(rs.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
+				q.markFailed(conn, scrapeErrorParse)
+				continue
+			}
+			metrics = append(metrics, m...)
+		}
+		if err := multi.Err(); err != nil {
+			return err
+		}
+		metrics = trackedSeries.track(seriesOwner{rs, conn}, metrics)
+		rs.Lock()
+		rs.metrics[conn] = metrics
+		rs.updated[conn] = time.Now()
+		rs.Unlock()
+	}
+	return nil
+}
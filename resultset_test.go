@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeResultSets are rows with multiple result sets
+type fakeResultSets struct {
+	sets [][]map[string]interface{}
+	set  int
+	next int
+}
+
+func (r *fakeResultSets) Next() bool {
+	r.next++
+	return r.next <= len(r.sets[r.set])
+}
+
+func (r *fakeResultSets) NextResultSet() bool {
+	r.set++
+	r.next = 0
+	return r.set < len(r.sets)
+}
+
+func (r *fakeResultSets) MapScan(dest map[string]interface{}) error {
+	for k, v := range r.sets[r.set][r.next-1] {
+		dest[k] = v
+	}
+	return nil
+}
+
+func (r *fakeResultSets) Err() error   { return nil }
+func (r *fakeResultSets) Close() error { return nil }
+
+func TestQuery_readResultSets(t *testing.T) {
+	q := &Query{
+		Name:   "first",
+		Help:   "First result set",
+		Values: Values{{Column: "a"}},
+		Query:  "SELECT 1 AS a",
+		ResultSets: []*Query{{
+			Name:   "second",
+			Help:   "Second result set",
+			Labels: Labels{{Name: "name", Column: "name"}},
+			Values: Values{{Column: "b"}},
+		}},
+	}
+	job := &Job{
+		Name:        "test",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+
+	rows := &fakeResultSets{sets: [][]map[string]interface{}{
+		{{"a": int64(1)}},
+		{{"name": "x", "b": int64(2)}, {"name": "y", "b": int64(3)}},
+	}}
+	// the first result set is read by the query itself
+	for rows.Next() {
+	}
+	if err := q.readResultSets(conn, rows); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(job)
+	expected := `
+# HELP sql_second Second result set
+# TYPE sql_second gauge
+sql_second{col="b",database=":memory:",driver="sqlite",host=":memory:",name="x",sql_job="test",user=""} 2
+sql_second{col="b",database=":memory:",driver="sqlite",host=":memory:",name="y",sql_job="test",user=""} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sql_second"); err != nil {
+		t.Error(err)
+	}
+
+	missing := &fakeResultSets{sets: [][]map[string]interface{}{{{"a": int64(1)}}}}
+	if err := q.readResultSets(conn, missing); err == nil || err.Error() != "expected 2 result sets, got 1" {
+		t.Errorf("expected an error for the missing result set, got %v", err)
+	}
+	if err := q.readResultSets(conn, &cachedRows{}); err == nil {
+		t.Error("expected an error for cached rows")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	runOnAny     = "any"
+	runOnMaster  = "master"
+	runOnReplica = "replica"
+)
+
+// runOnRoles are the recognized values of Query.RunOn
+var runOnRoles = []string{runOnAny, runOnMaster, runOnReplica}
+
+type replicaQuery struct {
+	query  string
+	isRows bool
+}
+
+// replicaQueries detect whether the server is a replica, by driver. The
+// queries either return true on replicas or, like SHOW SLAVE STATUS, rows
+// only on replicas. SQL Server databases are replicas on the secondaries of
+// their availability group, databases outside of one are masters.
+var replicaQueries = map[string]replicaQuery{
+	"postgres":  {query: "SELECT pg_is_in_recovery()"},
+	"mysql":     {query: "SHOW SLAVE STATUS", isRows: true},
+	"sqlserver": {query: "SELECT CASE WHEN EXISTS (SELECT 1 FROM sys.dm_hadr_database_replica_states WHERE database_id = DB_ID() AND is_local = 1 AND is_primary_replica = 0) THEN 1 ELSE 0 END"},
+	"oracle":    {query: "SELECT CASE WHEN database_role = 'PRIMARY' THEN 0 ELSE 1 END FROM v$database"},
+}
+
+// needsRole returns whether any query of the job depends on the role of the
+// server.
+func (j *Job) needsRole() bool {
+	for _, q := range j.Queries {
+		if q != nil && q.RunOn != "" && q.RunOn != runOnAny {
+			return true
+		}
+	}
+	return false
+}
+
+// role detects whether the connected server is the master or a replica.
+func (c *connection) role(job *Job) (string, error) {
+	rq, found := replicaQueries[c.driver]
+	if !found {
+		return "", fmt.Errorf("role detection isn't supported for driver %s", c.driver)
+	}
+	ctx := job.queryContext()
+	if job.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.QueryTimeout)
+		defer cancel()
+	}
+	replica := false
+	if rq.isRows {
+		rows, err := c.conn.QueryContext(ctx, rq.query)
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+		replica = rows.Next()
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+	} else if err := c.conn.QueryRowContext(ctx, rq.query).Scan(&replica); err != nil {
+		return "", err
+	}
+	if replica {
+		return runOnReplica, nil
+	}
+	return runOnMaster, nil
+}
+
+// runsOn returns whether the query runs on a server with the given role, an
+// empty role means the role is unknown.
+func (q *Query) runsOn(role string) bool {
+	return q.RunOn == "" || q.RunOn == runOnAny || q.RunOn == role
+}
+
+// skip drops the metrics of the connection from the export of a query which
+// doesn't run on the role of the server, e.g. after a failover.
+func (q *Query) skip(conn *connection) {
+	q.dropMetrics(conn)
+	q.Lock()
+	defer q.Unlock()
+	if q.skipped == nil {
+		q.skipped = make(map[*connection]time.Time)
+	}
+	q.skipped[conn] = time.Now()
+}
+
+// runsOnDriver returns whether the query runs on connections of the driver.
+func (q *Query) runsOnDriver(driver string) bool {
+	return q.WhenDriver == "" || q.WhenDriver == driver
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/go-kit/kit/log/level"
+)
+
+// jobScheduler runs the jobs on a fixed number of workers if --max-workers
+// is set, otherwise every job runs in a goroutine of its own.
+var jobScheduler *scheduler
+
+// scheduler runs the jobs in interval mode on a pool of workers, instead of a
+// goroutine per job sleeping between its runs. Jobs due while all workers are
+// busy wait for the next free worker in the order they became due.
+type scheduler struct {
+	sync.Mutex
+	queue   scheduleQueue
+	entries map[*Job]*scheduledJob
+	wake    chan struct{}
+	due     chan *scheduledJob
+}
+
+// scheduledJob is a job waiting for its next run
+type scheduledJob struct {
+	job     *Job
+	next    time.Time
+	planned time.Time                   // planned start of the run, next without the jitter
+	offset  time.Duration               // offset of the runs by the splay
+	retry   *backoff.ExponentialBackOff // retries of a failed run, if any
+	index   int                         // position in the queue, -1 while running
+}
+
+func newScheduler(workers int) *scheduler {
+	s := &scheduler{
+		entries: make(map[*Job]*scheduledJob),
+		wake:    make(chan struct{}, 1),
+		due:     make(chan *scheduledJob),
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go s.loop()
+	return s
+}
+
+// add schedules the first run of the job, planned at first and shifted by
+// the offset of its splay.
+func (s *scheduler) add(j *Job, first time.Time, offset time.Duration) {
+	s.Lock()
+	if j.ctx.Err() != nil {
+		// stopped before it was scheduled
+		s.Unlock()
+		j.finish()
+		return
+	}
+	e := &scheduledJob{job: j, next: first.Add(randDuration(j.Jitter)), planned: first, offset: offset}
+	s.entries[j] = e
+	heap.Push(&s.queue, e)
+	s.Unlock()
+	s.notify()
+}
+
+// remove unschedules a stopped job. A running job is finished by its worker
+// once the run returned.
+func (s *scheduler) remove(j *Job) {
+	s.Lock()
+	e, found := s.entries[j]
+	if !found || e.index < 0 {
+		s.Unlock()
+		return
+	}
+	heap.Remove(&s.queue, e.index)
+	delete(s.entries, j)
+	s.Unlock()
+	j.finish()
+}
+
+// notify wakes up the loop to look at the next due job again.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop hands the due jobs to the workers.
+func (s *scheduler) loop() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		wait := time.Hour
+		s.Lock()
+		if len(s.queue) > 0 {
+			wait = time.Until(s.queue[0].next)
+		}
+		if wait <= 0 {
+			e := heap.Pop(&s.queue).(*scheduledJob)
+			s.Unlock()
+			s.due <- e
+			continue
+		}
+		s.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// work runs the due jobs and schedules their next run.
+func (s *scheduler) work() {
+	for e := range s.due {
+		j := e.job
+		if j.ctx.Err() == nil {
+			e.next = j.runScheduled(e)
+		}
+		s.Lock()
+		if j.ctx.Err() != nil {
+			delete(s.entries, j)
+			s.Unlock()
+			j.finish()
+			continue
+		}
+		heap.Push(&s.queue, e)
+		s.Unlock()
+		s.notify()
+	}
+}
+
+// runScheduled runs the job once and returns the time of its next run.
+// Failed runs are retried with a backoff until the next regular run, like
+// the run loop of the job does.
+func (j *Job) runScheduled(e *scheduledJob) time.Time {
+	err := j.runOnce()
+	if err != nil {
+		if e.retry == nil {
+			e.retry = backoff.NewExponentialBackOff()
+			e.retry.MaxElapsedTime = j.retryWindow(e.planned, e.offset)
+		}
+		if d := e.retry.NextBackOff(); d != backoff.Stop {
+			return time.Now().Add(d)
+		}
+		level.Error(j.log).Log("msg", "Failed to run", "err", err)
+	}
+	e.retry = nil
+	e.planned = j.plannedAfter(e.planned, e.offset)
+	return e.planned.Add(randDuration(j.Jitter))
+}
+
+// scheduleQueue is a heap of the scheduled jobs by their next run
+type scheduleQueue []*scheduledJob
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduledJob)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// driverQuotas limit the connections of a driver queried at once, by driver
+var driverQuotas = map[string]chan struct{}{}
+
+// setDriverQuotas sets the number of connections of each driver which are
+// queried at once, across all jobs.
+func setDriverQuotas(limits map[string]int) {
+	driverQuotas = make(map[string]chan struct{}, len(limits))
+	for driver, limit := range limits {
+		driverQuotas[driver] = make(chan struct{}, limit)
+	}
+}
+
+// acquireDriverQuota waits for the quota of the driver. It returns false if
+// the context is done first.
+func acquireDriverQuota(ctx context.Context, driver string) bool {
+	quota := driverQuotas[driver]
+	if quota == nil {
+		return true
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case quota <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseDriverQuota(driver string) {
+	if quota := driverQuotas[driver]; quota != nil {
+		<-quota
+	}
+}
+
+// parseDriverQuotas parses quotas like postgres=10,mysql=5.
+func parseDriverQuotas(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid quota %q, must be like postgres=10", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid quota %q, must be a positive number", item)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(1)
+	jobScheduler = s
+	defer func() { jobScheduler = nil }()
+
+	var jobs []*Job
+	for _, name := range []string{"a", "b", "c"} {
+		job := &Job{
+			Name:        name,
+			Interval:    10 * time.Millisecond,
+			Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+			Queries:     []*Query{{Name: "one", Help: "One", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value"}},
+		}
+		if err := job.Init(log.NewNopLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+		// returns once the job is scheduled
+		job.Run()
+		jobs = append(jobs, job)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, job := range jobs {
+		if runs := len(job.Queries[0].lastRuns()); runs != 1 {
+			t.Errorf("job %s: expected the query to run on one connection, got %d", job.Name, runs)
+		}
+		job.Queries[0].Lock()
+		history := len(job.Queries[0].history)
+		job.Queries[0].Unlock()
+		if history < 2 {
+			t.Errorf("job %s: expected several runs on the single worker, got %d", job.Name, history)
+		}
+	}
+
+	for _, job := range jobs {
+		job.Stop()
+		select {
+		case <-job.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("job %s: expected the stopped job to be done", job.Name)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) != 0 || len(s.queue) != 0 {
+		t.Errorf("expected the stopped jobs to be unscheduled, got %d", len(s.entries))
+	}
+}
+
+func Test_driverQuotas(t *testing.T) {
+	limits, err := parseDriverQuotas("postgres=1, mysql=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["postgres"] != 1 || limits["mysql"] != 2 {
+		t.Errorf("unexpected quotas %v", limits)
+	}
+	for _, invalid := range []string{"postgres", "postgres=0", "postgres=many"} {
+		if _, err := parseDriverQuotas(invalid); err == nil {
+			t.Errorf("%s: expected an invalid quota", invalid)
+		}
+	}
+
+	setDriverQuotas(limits)
+	defer setDriverQuotas(nil)
+	if !acquireDriverQuota(context.Background(), "postgres") {
+		t.Fatalf("expected the quota to be free")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if acquireDriverQuota(ctx, "postgres") {
+		t.Errorf("expected the quota to be exhausted")
+	}
+	releaseDriverQuota("postgres")
+	if !acquireDriverQuota(ctx, "sqlite") {
+		t.Errorf("expected drivers without quota not to be limited")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jmoiron/sqlx"
+)
+
+// openDB opens a connection pool which executes the startup statements on
+// every new session. Executing them once after connecting only configures a
+// single session, which is lost as soon as the pool replaces it.
+func openDB(logger log.Logger, driverName, dsn string, startupSQL []string, dial Dial) (*sqlx.DB, error) {
+	if driverName == "mysql" {
+		var err error
+		if dsn, err = dial.mysqlDSN(dsn); err != nil {
+			return nil, err
+		}
+	}
+	// sql.Open doesn't connect, it's only used to look up the driver
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	var connector driver.Connector
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	} else {
+		connector = &dsnConnector{dsn: dsn, driver: drv}
+	}
+	if connector, err = dial.connector(driverName, dsn, connector); err != nil {
+		return nil, err
+	}
+	if len(startupSQL) > 0 {
+		connector = &startupConnector{Connector: connector, log: logger, statements: startupSQL}
+	}
+	return sqlx.NewDb(sql.OpenDB(connector), driverName), nil
+}
+
+// dsnConnector is the connector of drivers which don't provide one.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// startupConnector executes the startup statements on every new session.
+type startupConnector struct {
+	driver.Connector
+	log        log.Logger
+	statements []string
+}
+
+func (c *startupConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range c.statements {
+		level.Debug(c.log).Log("msg", "StartupSQL", "Query:", statement)
+		if err := execSession(ctx, conn, statement); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("startup sql %q failed: %v", statement, err)
+		}
+	}
+	return conn, nil
+}
+
+// execSession executes the statement on the driver connection, using a
+// prepared statement if the driver doesn't support direct execution.
+func execSession(ctx context.Context, conn driver.Conn, statement string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, statement, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	stmt, err := conn.Prepare(statement)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if sc, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = sc.ExecContext(ctx, nil)
+		return err
+	}
+	_, err = stmt.Exec(nil)
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func Test_openDB(t *testing.T) {
+	// foreign keys are a setting of the SQLite session, so each connection
+	// of the pool must run the startup statement
+	db, err := openDB(log.NewNopLogger(), "sqlite", ":memory:", []string{"PRAGMA foreign_keys = ON"}, Dial{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		// the held connections force the pool to open a new one
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var enabled int
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enabled); err != nil {
+			t.Fatal(err)
+		}
+		if enabled != 1 {
+			t.Errorf("connection %d: expected the startup statement to run", i)
+		}
+	}
+	if stats := db.Stats(); stats.OpenConnections != 2 {
+		t.Errorf("expected 2 open connections, got %d", stats.OpenConnections)
+	}
+}
+
+func Test_startupConnector(t *testing.T) {
+	if err := setMocks(map[string][]*MockResult{
+		"app": {{Match: "SET statement_timeout", Error: "permission denied"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer setMocks(nil)
+
+	var buf bytes.Buffer
+	// the mock driver has no connector of its own
+	db, err := openDB(log.NewLogfmtLogger(&buf), "mock", "mock://app/db", []string{"SET search_path = app", "SET statement_timeout = 1000"}, Dial{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err == nil || !strings.Contains(err.Error(), `startup sql "SET statement_timeout = 1000" failed: permission denied`) {
+		t.Errorf("expected the failing startup statement to fail the connection, got %v", err)
+	}
+	if stats := db.Stats(); stats.OpenConnections != 0 {
+		t.Errorf("expected the failed session to be closed, got %d open connections", stats.OpenConnections)
+	}
+	if !strings.Contains(buf.String(), "SET search_path = app") {
+		t.Errorf("expected the statements to be logged, got %q", buf.String())
+	}
+
+	db, err = openDB(log.NewNopLogger(), "mock", "mock://app/db", []string{"SET search_path = app"}, Dial{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Errorf("got unexpected error: %v", err)
+	}
+}
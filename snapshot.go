@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "REDACTED"
+
+var (
+	// secretKeyRE matches config keys whose values must not be included in
+	// the snapshot
+	secretKeyRE = regexp.MustCompile(`(?i)(password|secret|token)`)
+	// dsnPasswordRE matches the password of MySQL style DSNs, e.g.
+	// user:password@tcp(host:3306)/db. Like the driver it splits at the last
+	// @ before the slash of the database, so the password may contain @.
+	dsnPasswordRE = regexp.MustCompile(`^([^:@/]*):(.*)@([^@]*/[^/]*)$`)
+	// dsnPasswordParamRE matches passwords given as URL parameter, e.g.
+	// ?user=u&password=p, or as key=value pair of libpq and ADO connection
+	// strings, e.g. host=db password=p or server=db;pwd={p}
+	dsnPasswordParamRE = regexp.MustCompile(`(?i)(^|[\s;?&])(password|pwd)(\s*=\s*)('[^']*'|"[^"]*"|\{[^}]*\}|[^\s;&]*)`)
+)
+
+// snapshotQuery is the run history of a single query
+type snapshotQuery struct {
+	Job     string     `json:"job"`
+	Query   string     `json:"query"`
+	History []queryRun `json:"history"`
+}
+
+// snapshotPool are the pool statistics of a single connection
+type snapshotPool struct {
+	Job                string  `json:"job"`
+	Driver             string  `json:"driver"`
+	Host               string  `json:"host"`
+	Database           string  `json:"database"`
+	Connected          bool    `json:"connected"`
+	MaxOpenConnections int     `json:"max_open_connections"`
+	OpenConnections    int     `json:"open_connections"`
+	InUse              int     `json:"in_use"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"wait_count"`
+	WaitDuration       float64 `json:"wait_duration_seconds"`
+	MaxIdleClosed      int64   `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64   `json:"max_lifetime_closed"`
+}
+
+// SnapshotHandler writes a diagnostics bundle containing the current
+// exposition output, the query run history, the redacted config and the
+// connection pool statistics as tar.gz.
+func (e *Exporter) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	if err := e.WriteSnapshot(&buf); err != nil {
+		level.Error(e.logger).Log("msg", "Failed to create snapshot", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=sql_exporter-snapshot-%s.tar.gz", time.Now().UTC().Format("20060102-150405")))
+	w.Write(buf.Bytes())
+}
+
+// WriteSnapshot writes the diagnostics bundle to w.
+func (e *Exporter) WriteSnapshot(w io.Writer) error {
+	metrics, err := snapshotMetrics(e.gatherer())
+	if err != nil {
+		return err
+	}
+	history, err := json.MarshalIndent(e.snapshotHistory(), "", "  ")
+	if err != nil {
+		return err
+	}
+	pools, err := json.MarshalIndent(e.snapshotPools(), "", "  ")
+	if err != nil {
+		return err
+	}
+	e.RLock()
+	cfg := e.cfg
+	e.RUnlock()
+	config, err := redactConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"metrics.txt", metrics},
+		{"history.json", history},
+		{"config.yml", config},
+		{"pools.json", pools},
+	} {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// FetchSnapshot requests a snapshot from a running exporter and writes it
+// to the given file.
+func FetchSnapshot(address, file string) error {
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	resp, err := http.Post("http://"+address+"/api/snapshot", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("snapshot failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// snapshotMetrics renders the current exposition output in text format.
+func snapshotMetrics(gatherer prometheus.Gatherer) ([]byte, error) {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *Exporter) snapshotHistory() []snapshotQuery {
+	e.RLock()
+	defer e.RUnlock()
+	queries := make([]snapshotQuery, 0)
+	for _, job := range e.jobs {
+		if job == nil {
+			continue
+		}
+		for _, q := range job.Queries {
+			if q == nil {
+				continue
+			}
+			q.Lock()
+			history := append([]queryRun(nil), q.history...)
+			q.Unlock()
+			queries = append(queries, snapshotQuery{Job: job.Name, Query: q.Name, History: history})
+		}
+	}
+	return queries
+}
+
+func (e *Exporter) snapshotPools() []snapshotPool {
+	e.RLock()
+	defer e.RUnlock()
+	pools := make([]snapshotPool, 0)
+	for _, job := range e.jobs {
+		if job == nil {
+			continue
+		}
+		job.Lock()
+		for _, conn := range job.conns {
+			pool := snapshotPool{
+				Job:      job.Name,
+				Driver:   conn.driver,
+				Host:     conn.host,
+				Database: conn.database,
+			}
+			if db := conn.conn; db != nil {
+				stats := db.Stats()
+				pool.Connected = true
+				pool.MaxOpenConnections = stats.MaxOpenConnections
+				pool.OpenConnections = stats.OpenConnections
+				pool.InUse = stats.InUse
+				pool.Idle = stats.Idle
+				pool.WaitCount = stats.WaitCount
+				pool.WaitDuration = stats.WaitDuration.Seconds()
+				pool.MaxIdleClosed = stats.MaxIdleClosed
+				pool.MaxLifetimeClosed = stats.MaxLifetimeClosed
+			}
+			pools = append(pools, pool)
+		}
+		job.Unlock()
+	}
+	return pools
+}
+
+// redactConfig renders the config with all credentials removed.
+func redactConfig(cfg File) ([]byte, error) {
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(buf, &tree); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactValue(tree))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range val {
+			if key, ok := k.(string); ok && secretKeyRE.MatchString(key) {
+				val[k] = redacted
+				continue
+			}
+			val[k] = redactValue(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = redactValue(item)
+		}
+	case string:
+		return redactDSN(val)
+	}
+	return v
+}
+
+// redactDSN removes the password from URL, MySQL style and key=value DSNs.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			dsn = u.String()
+		}
+	} else {
+		// the scheme of URLs which fail to parse, e.g. mysql://
+		prefix := ""
+		if i := strings.Index(dsn, "://"); i >= 0 {
+			prefix, dsn = dsn[:i+3], dsn[i+3:]
+		}
+		dsn = prefix + dsnPasswordRE.ReplaceAllString(dsn, "${1}:"+redacted+"@${3}")
+	}
+	return dsnPasswordParamRE.ReplaceAllString(dsn, "${1}${2}${3}"+redacted)
+}
+
+// redactError removes the DSN from errors of parsing it, url.Error includes
+// the DSN with its password. The callers add the redacted DSN instead.
+func redactError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
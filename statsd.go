@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	statsDFormatDogStatsD = "dogstatsd"
+	statsDFormatStatsD    = "statsd"
+
+	defaultStatsDAddress = "localhost:8125"
+	// statsDMaxPacketSize keeps the packets below the usual MTU
+	statsDMaxPacketSize = 1432
+)
+
+var (
+	// statsDFormats are the recognized values of StatsD.Format
+	statsDFormats = []string{statsDFormatDogStatsD, statsDFormatStatsD}
+
+	// statsDNameReplacer replaces the characters with a meaning in the
+	// StatsD protocol
+	statsDNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_")
+)
+
+func (s *StatsD) validate() error {
+	if s.Format != "" && !containsString(statsDFormats, s.Format) {
+		return fmt.Errorf("unknown format %q, must be one of %s", s.Format, strings.Join(statsDFormats, ", "))
+	}
+	if s.Address != "" {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("invalid address %q: %v", s.Address, err)
+		}
+	}
+	return nil
+}
+
+// emitStatsD sends the current metrics of all queries of the job to the
+// StatsD agent, each value as gauge. Histograms and summaries are sent as
+// their sum and count.
+func (j *Job) emitStatsD() {
+	s := j.StatsD
+	if s == nil {
+		return
+	}
+	address := s.Address
+	if address == "" {
+		address = defaultStatsDAddress
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		level.Warn(j.log).Log("msg", "Failed to connect to StatsD", "address", address, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	var packet []byte
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := conn.Write(packet); err != nil {
+			level.Warn(j.log).Log("msg", "Failed to send metrics to StatsD", "address", address, "err", err)
+		}
+		packet = packet[:0]
+	}
+	for _, m := range j.currentMetrics() {
+		for _, line := range s.lines(m) {
+			if len(packet) > 0 && len(packet)+1+len(line) > statsDMaxPacketSize {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	flush()
+}
+
+// currentMetrics returns the metrics of all queries of the job which aren't
+// older than their max age, aggregated like the exported ones.
+func (j *Job) currentMetrics() []prometheus.Metric {
+	var metrics []prometheus.Metric
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		metrics = append(metrics, j.queryMetrics(q, nil)...)
+	}
+	return metrics
+}
+
+// metricSample returns the name of the metric family along with the metric
+// in its protobuf representation.
+func metricSample(m prometheus.Metric) (string, *dto.Metric, bool) {
+	match := descNameRE.FindStringSubmatch(m.Desc().String())
+	if match == nil {
+		return "", nil, false
+	}
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return "", nil, false
+	}
+	return match[1], &pb, true
+}
+
+// sampleValues returns the values of a metric by name suffix. Histograms and
+// summaries are reduced to their sum and count.
+func sampleValues(pb *dto.Metric) map[string]float64 {
+	switch {
+	case pb.Gauge != nil:
+		return map[string]float64{"": pb.GetGauge().GetValue()}
+	case pb.Counter != nil:
+		return map[string]float64{"": pb.GetCounter().GetValue()}
+	case pb.Untyped != nil:
+		return map[string]float64{"": pb.GetUntyped().GetValue()}
+	case pb.Histogram != nil:
+		return map[string]float64{
+			"_sum":   pb.GetHistogram().GetSampleSum(),
+			"_count": float64(pb.GetHistogram().GetSampleCount()),
+		}
+	case pb.Summary != nil:
+		return map[string]float64{
+			"_sum":   pb.GetSummary().GetSampleSum(),
+			"_count": float64(pb.GetSummary().GetSampleCount()),
+		}
+	}
+	return nil
+}
+
+// lines formats the metric as StatsD gauges. With the dogstatsd format the
+// labels of the metric and the configured tags are sent as tags.
+func (s *StatsD) lines(m prometheus.Metric) []string {
+	family, pb, ok := metricSample(m)
+	if !ok {
+		return nil
+	}
+	name := statsDNameReplacer.Replace(s.Prefix + family)
+	var tags string
+	if s.Format != statsDFormatStatsD {
+		tagList := make([]string, 0, len(pb.GetLabel())+len(s.Tags))
+		for _, l := range pb.GetLabel() {
+			tagList = append(tagList, statsDNameReplacer.Replace(l.GetName())+":"+statsDNameReplacer.Replace(l.GetValue()))
+		}
+		for k, v := range s.Tags {
+			tagList = append(tagList, statsDNameReplacer.Replace(k)+":"+statsDNameReplacer.Replace(v))
+		}
+		sort.Strings(tagList)
+		if len(tagList) > 0 {
+			tags = "|#" + strings.Join(tagList, ",")
+		}
+	}
+	var lines []string
+	for suffix, value := range sampleValues(pb) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		lines = append(lines, name+suffix+":"+strconv.FormatFloat(value, 'g', -1, 64)+"|g"+tags)
+	}
+	sort.Strings(lines)
+	return lines
+}
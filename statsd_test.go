@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestJob_emitStatsD(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	job := &Job{
+		Name:        "statsd",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{{
+			Name:   "users",
+			Help:   "Users",
+			Labels: Labels{{Name: "state", Column: "state"}},
+			Values: Values{{Column: "value"}},
+			Query:  "SELECT 'active' AS state, 42 AS value",
+		}},
+		BuiltinLabels: map[string]string{"driver": "", "host": "", "database": "", "user": ""},
+		StatsD: &StatsD{
+			Address: listener.LocalAddr().String(),
+			Prefix:  "db.",
+			Tags:    map[string]string{"env": "test"},
+		},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	if err := job.runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	// the metrics are sent in the background
+	job.sinks.Wait()
+
+	buf := make([]byte, statsDMaxPacketSize)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "db.sql_users:42|g|#col:value,env:test,sql_job:statsd,state:active"
+	if got := strings.TrimSpace(string(buf[:n])); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	job.StatsD.Format = statsDFormatStatsD
+	job.emitStatsD()
+	if n, _, err = listener.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "db.sql_users:42|g" {
+		t.Errorf("expected the tags to be dropped, got %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// statusTemplate renders the status page
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+}).Parse(`<html>
+<head>
+<title>SQL Exporter Status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>SQL Exporter Status</h1>
+{{range .}}
+<h2>Job {{.Name}}</h2>
+<p>Mode: {{.Mode}}, schedule: {{.Schedule}}</p>
+<h3>Connections</h3>
+<table>
+<tr><th>Driver</th><th>Host</th><th>Database</th><th>Connected</th></tr>
+{{range .Connections}}<tr><td>{{.Driver}}</td><td>{{.Host}}</td><td>{{.Database}}</td><td>{{.Connected}}</td></tr>
+{{else}}<tr><td colspan="4">No connections</td></tr>
+{{end}}</table>
+<h3>Queries</h3>
+<table>
+<tr><th>Query</th><th>Host</th><th>Database</th><th>Last run</th><th>Duration</th><th>Rows</th><th>Error</th></tr>
+{{range .Queries}}<tr><td>{{.Query}}</td>{{with .LastRun}}<td>{{.Host}}</td><td>{{.Database}}</td><td>{{ago .Time}}</td><td>{{printf "%.3fs" .Duration}}</td><td>{{.Rows}}</td><td class="error">{{.Error}}</td>{{else}}<td colspan="6">Not run yet</td>{{end}}</tr>
+{{end}}</table>
+{{else}}
+<p>No jobs configured.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// statusJob is the status of a job on the status page
+type statusJob struct {
+	Name        string
+	Mode        string
+	Schedule    string
+	Connections []snapshotPool
+	Queries     []statusQuery
+}
+
+// statusQuery is the last run of a query on a connection
+type statusQuery struct {
+	Query   string
+	LastRun *queryRun
+}
+
+// StatusHandler renders an HTML page with the jobs, their connections and
+// the last run of every query on every connection, to debug missing
+// metrics without digging through the logs.
+func (e *Exporter) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := statusTemplate.Execute(&buf, e.status()); err != nil {
+		level.Error(e.logger).Log("msg", "Failed to render status page", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (e *Exporter) status() []statusJob {
+	pools := e.snapshotPools()
+	e.RLock()
+	defer e.RUnlock()
+	jobs := make([]statusJob, 0, len(e.jobs))
+	for _, job := range e.jobs {
+		if job == nil {
+			continue
+		}
+		s := statusJob{Name: job.Name, Mode: job.Mode, Schedule: job.Interval.String()}
+		if s.Mode == "" {
+			s.Mode = jobModeInterval
+		}
+		if job.Cron != "" {
+			s.Schedule = job.Cron
+		} else if job.Mode == jobModePull {
+			s.Schedule = "on scrape"
+		}
+		for _, pool := range pools {
+			if pool.Job == job.Name {
+				s.Connections = append(s.Connections, pool)
+			}
+		}
+		for _, q := range job.Queries {
+			if q == nil {
+				continue
+			}
+			runs := q.lastRuns()
+			if len(runs) == 0 {
+				s.Queries = append(s.Queries, statusQuery{Query: q.Name})
+			}
+			for i := range runs {
+				s.Queries = append(s.Queries, statusQuery{Query: q.Name, LastRun: &runs[i]})
+			}
+		}
+		jobs = append(jobs, s)
+	}
+	return jobs
+}
+
+// lastRuns returns the last run of the query on every connection, in the
+// order of the connections' first run.
+func (q *Query) lastRuns() []queryRun {
+	q.Lock()
+	defer q.Unlock()
+	var runs []queryRun
+	index := make(map[string]int)
+	for _, run := range q.history {
+		key := run.Driver + "\x00" + run.Host + "\x00" + run.Database
+		if i, found := index[key]; found {
+			runs[i] = run
+			continue
+		}
+		index[key] = len(runs)
+		runs = append(runs, run)
+	}
+	return runs
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExporter_StatusHandler(t *testing.T) {
+	q := &Query{
+		Name:   "broken",
+		Help:   "Broken",
+		Values: Values{{Column: "value"}},
+		Query:  "SELECT value FROM missing",
+	}
+	job := &Job{
+		Name:        "status",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q, {Name: "pending", Query: "SELECT 1"}},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	job.initConnections()
+	defer job.closeConnections()
+	conn := job.conns[0]
+	if err := conn.connect(job); err != nil {
+		t.Fatal(err)
+	}
+	q.Run(conn)
+
+	e := &Exporter{jobs: []*Job{job}, logger: log.NewNopLogger()}
+	rec := httptest.NewRecorder()
+	e.StatusHandler(rec, httptest.NewRequest("GET", "/status", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{"Job status", "broken", "no such table: missing", "pending", "Not run yet"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the status page to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// triggerResult is the response of an on-demand query run
+type triggerResult struct {
+	Job   string     `json:"job"`
+	Query string     `json:"query"`
+	Runs  []queryRun `json:"runs"`
+}
+
+// TriggerHandler runs a query of a job immediately on all connections of
+// the job, out of its schedule, on POST /jobs/{job}/queries/{query}/run. The
+// request must carry the token as bearer token. The runs are returned as JSON,
+// the status is 500 if any of them failed. A query already running on demand
+// isn't run again concurrently.
+func (e *Exporter) TriggerHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.trigger(w, r, token)
+	})
+}
+
+func (e *Exporter) trigger(w http.ResponseWriter, r *http.Request, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 5 || parts[0] != "jobs" || parts[2] != "queries" || parts[4] != "run" {
+		http.NotFound(w, r)
+		return
+	}
+	job, q := e.findQuery(parts[1], parts[3])
+	if q == nil {
+		http.Error(w, fmt.Sprintf("query %q of job %q not found", parts[3], parts[1]), http.StatusNotFound)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&q.triggered, 0, 1) {
+		http.Error(w, fmt.Sprintf("query %q of job %q is already running", q.Name, job.Name), http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&q.triggered, 0)
+	level.Info(job.log).Log("msg", "Running query on demand", "query", q.Name)
+	res := triggerResult{Job: job.Name, Query: q.Name, Runs: job.runQuery(q)}
+	status := http.StatusOK
+	for _, run := range res.Runs {
+		if run.Error != "" {
+			status = http.StatusInternalServerError
+		}
+	}
+	buf, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// findQuery returns the running job and its query by name.
+func (e *Exporter) findQuery(jobName, queryName string) (*Job, *Query) {
+	e.RLock()
+	defer e.RUnlock()
+	for _, job := range e.jobs {
+		if job == nil || job.Name != jobName {
+			continue
+		}
+		for _, q := range job.Queries {
+			if q != nil && q.Name == queryName && q.desc != nil {
+				return job, q
+			}
+		}
+	}
+	return nil, nil
+}
+
+// runQuery runs the query once on every connection of the job and returns
+// the runs. Queries limited to a server role are skipped on other servers.
+func (j *Job) runQuery(q *Query) []queryRun {
+	j.initConnections()
+	j.Lock()
+	conns := append([]*connection{}, j.conns...)
+	j.Unlock()
+	runs := make([]queryRun, 0, len(conns))
+	for _, conn := range conns {
+		if !q.runsOnDriver(conn.driver) {
+			continue
+		}
+		failed := func(err error) {
+			runs = append(runs, queryRun{
+				Time:     time.Now(),
+				Driver:   conn.driver,
+				Host:     conn.host,
+				Database: conn.database,
+				Error:    err.Error(),
+			})
+		}
+		if err := conn.connect(j); err != nil {
+			failed(fmt.Errorf("failed to connect: %v", err))
+			continue
+		}
+		if q.RunOn != "" && q.RunOn != runOnAny {
+			role, err := conn.role(j)
+			if err != nil {
+				failed(fmt.Errorf("failed to detect the server role: %v", err))
+				continue
+			}
+			if !q.runsOn(role) {
+				failed(fmt.Errorf("skipped, the query runs on %s servers only but the server is %s", q.RunOn, role))
+				continue
+			}
+		}
+		if q.User != "" {
+			if err := conn.connectSession(j, q); err != nil {
+				failed(fmt.Errorf("failed to connect session: %v", err))
+				continue
+			}
+		}
+		if err := q.Run(conn); err != nil {
+			level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+		}
+		if last := q.lastRun(conn); last != nil {
+			runs = append(runs, *last)
+		}
+	}
+	return runs
+}
+
+// lastRun returns the most recent run of the query on the connection.
+func (q *Query) lastRun(conn *connection) *queryRun {
+	q.Lock()
+	defer q.Unlock()
+	for i := len(q.history) - 1; i >= 0; i-- {
+		run := q.history[i]
+		if run.Driver == conn.driver && run.Host == conn.host && run.Database == conn.database {
+			return &run
+		}
+	}
+	return nil
+}
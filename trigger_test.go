@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExporter_TriggerHandler(t *testing.T) {
+	job := &Job{
+		Name:        "trigger",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries: []*Query{
+			{Name: "ok", Help: "OK", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value"},
+			{Name: "broken", Help: "Broken", Values: Values{{Column: "value"}}, Query: "SELECT value FROM missing"},
+		},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.closeConnections()
+	e := &Exporter{jobs: []*Job{job}, logger: log.NewNopLogger()}
+
+	handler := e.TriggerHandler("s3cr3t")
+	for _, tc := range []struct {
+		method string
+		path   string
+		token  string
+		status int
+		rows   int
+		err    bool
+	}{
+		{method: "POST", path: "/jobs/trigger/queries/ok/run", status: http.StatusOK, rows: 1},
+		{method: "POST", path: "/jobs/trigger/queries/ok/run", token: "-", status: http.StatusUnauthorized},
+		{method: "POST", path: "/jobs/trigger/queries/ok/run", token: "wrong", status: http.StatusUnauthorized},
+		{method: "POST", path: "/jobs/trigger/queries/broken/run", status: http.StatusInternalServerError, err: true},
+		{method: "GET", path: "/jobs/trigger/queries/ok/run", status: http.StatusMethodNotAllowed},
+		{method: "POST", path: "/jobs/trigger/queries/missing/run", status: http.StatusNotFound},
+		{method: "POST", path: "/jobs/missing/queries/ok/run", status: http.StatusNotFound},
+		{method: "POST", path: "/jobs/trigger/queries/ok", status: http.StatusNotFound},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			switch tc.token {
+			case "":
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+			case "-":
+			default:
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK && tc.status != http.StatusInternalServerError {
+				return
+			}
+			var res triggerResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Runs) != 1 {
+				t.Fatalf("expected one run, got %+v", res.Runs)
+			}
+			run := res.Runs[0]
+			if run.Driver != "sqlite" || run.Rows != tc.rows || (run.Error != "") != tc.err {
+				t.Errorf("unexpected run %+v", run)
+			}
+		})
+	}
+}
+
+func TestExporter_TriggerHandler_concurrent(t *testing.T) {
+	q := &Query{Name: "ok", Help: "OK", Values: Values{{Column: "value"}}, Query: "SELECT 1 AS value"}
+	job := &Job{
+		Name:        "trigger",
+		Connections: []*ConnectionConfig{{URL: "sqlite://:memory:"}},
+		Queries:     []*Query{q},
+	}
+	if err := job.Init(log.NewNopLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer job.closeConnections()
+	e := &Exporter{jobs: []*Job{job}, logger: log.NewNopLogger()}
+	handler := e.TriggerHandler("s3cr3t")
+	run := func() int {
+		req := httptest.NewRequest("POST", "/jobs/trigger/queries/ok/run", nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the query is still running on demand
+	q.triggered = 1
+	if status := run(); status != http.StatusConflict {
+		t.Errorf("expected status %d while the query runs, got %d", http.StatusConflict, status)
+	}
+	q.triggered = 0
+	if status := run(); status != http.StatusOK {
+		t.Errorf("expected status %d once the query finished, got %d", http.StatusOK, status)
+	}
+	if q.triggered != 0 {
+		t.Errorf("expected the query to be released after the run")
+	}
+}
+
+func TestExporter_TriggerHandler_disabled(t *testing.T) {
+	e := &Exporter{logger: log.NewNopLogger()}
+	req := httptest.NewRequest("POST", "/jobs/trigger/queries/ok/run", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	e.TriggerHandler("").ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVaultKubernetesMount = "kubernetes"
+	defaultVaultTimeout         = 30 * time.Second
+)
+
+// vaultProvider reads the credentials of connections from a Vault secret.
+type vaultProvider struct {
+	cfg     *VaultAuth
+	address string
+	ttl     time.Duration
+	client  *http.Client
+
+	mtx         sync.Mutex
+	loginToken  string // issued by the Kubernetes login
+	loginExpiry time.Time
+}
+
+func newVaultProvider(cfg *VaultAuth, ttl time.Duration) (*vaultProvider, error) {
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("vault address is required, set address or VAULT_ADDR")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault address: %v", err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.TLS != nil {
+		if cfg.TLS.Mode != "" && cfg.TLS.Mode != "require" && cfg.TLS.Mode != "verify-full" {
+			return nil, fmt.Errorf("vault tls mode %q is not supported, must be require or verify-full", cfg.TLS.Mode)
+		}
+		if transport.TLSClientConfig, err = cfg.TLS.clientConfig(u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	return &vaultProvider{
+		cfg:     cfg,
+		address: strings.TrimRight(address, "/"),
+		ttl:     ttl,
+		client:  &http.Client{Transport: transport, Timeout: defaultVaultTimeout},
+	}, nil
+}
+
+// key shares the credentials between all connections using the same secret.
+func (p *vaultProvider) key(conn *connection) string {
+	return strings.Join([]string{authTypeVault, p.address, p.cfg.Path}, "\xff")
+}
+
+// vaultSecret is a secret or login returned by Vault.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+func (p *vaultProvider) token(conn *connection) (credentials, time.Time, error) {
+	var secret vaultSecret
+	if err := p.request(http.MethodGet, p.cfg.Path, nil, &secret); err != nil {
+		return credentials{}, time.Time{}, err
+	}
+	data := secret.Data
+	// version 2 of the KV secrets engine nests the secret
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	user, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if password == "" {
+		return credentials{}, time.Time{}, fmt.Errorf("vault secret %s has no password", p.cfg.Path)
+	}
+	creds := credentials{user: user, password: password}
+	if secret.Renewable {
+		creds.lease = secret.LeaseID
+	}
+	ttl := time.Duration(secret.LeaseDuration) * time.Second
+	if ttl <= 0 {
+		// static secrets are read again after the token_ttl, so rotated
+		// passwords are picked up
+		ttl = p.ttl
+		if ttl <= 0 {
+			ttl = defaultTokenTTL
+		}
+	}
+	return creds, time.Now().Add(ttl), nil
+}
+
+func (p *vaultProvider) renew(creds credentials) (time.Time, error) {
+	var secret vaultSecret
+	if err := p.request(http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": creds.lease}, &secret); err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second), nil
+}
+
+// request sends an authenticated request to the Vault API.
+func (p *vaultProvider) request(method, path string, body, v interface{}) error {
+	token, err := p.clientToken()
+	if err != nil {
+		return err
+	}
+	return p.do(method, path, token, body, v)
+}
+
+func (p *vaultProvider) do(method, path, token string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, p.address+"/v1/"+strings.TrimLeft(path, "/"), r)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("vault %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// clientToken returns the Vault token. The token file is read on every
+// request, so tokens renewed by the Vault agent are picked up. With the
+// Kubernetes auth method the exporter logs in with its service account and
+// logs in again halfway through the lease of the token.
+func (p *vaultProvider) clientToken() (string, error) {
+	if p.cfg.KubernetesRole == "" {
+		if p.cfg.TokenFile != "" {
+			return readSecretFile(p.cfg.TokenFile)
+		}
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("no vault token, set token_file, VAULT_TOKEN or kubernetes_role")
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.loginToken != "" && time.Now().Before(p.loginExpiry) {
+		return p.loginToken, nil
+	}
+	jwt, err := readSecretFile(kubernetesServiceAccountDir + "/token")
+	if err != nil {
+		return "", err
+	}
+	mount := p.cfg.KubernetesMount
+	if mount == "" {
+		mount = defaultVaultKubernetesMount
+	}
+	var secret vaultSecret
+	login := map[string]string{"role": p.cfg.KubernetesRole, "jwt": jwt}
+	if err := p.do(http.MethodPost, "auth/"+mount+"/login", "", login, &secret); err != nil {
+		return "", fmt.Errorf("vault login failed: %v", err)
+	}
+	if secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault login returned no token")
+	}
+	p.loginToken = secret.Auth.ClientToken
+	p.loginExpiry = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second / 2)
+	return p.loginToken, nil
+}
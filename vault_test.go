@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_vaultProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s.secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	issued, renewed := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.secret" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/database/creds/readonly":
+			issued++
+			fmt.Fprintf(w, `{"lease_id": "database/creds/readonly/%d", "renewable": true, "lease_duration": 3600, "data": {"username": "v-readonly-%d", "password": "pw"}}`, issued, issued)
+		case "/v1/secret/data/db":
+			fmt.Fprint(w, `{"lease_duration": 0, "data": {"data": {"username": "monitor", "password": "static"}, "metadata": {"version": 1}}}`)
+		case "/v1/sys/leases/renew":
+			var body map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["lease_id"] != "database/creds/readonly/1" {
+				http.Error(w, `{"errors":["lease not found"]}`, http.StatusBadRequest)
+				return
+			}
+			renewed++
+			fmt.Fprintf(w, `{"lease_id": %q, "renewable": true, "lease_duration": 3600}`, body["lease_id"])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p, err := newTokenProvider(&Auth{Type: "vault", Vault: &VaultAuth{Address: server.URL, Path: "database/creds/readonly", TokenFile: tokenFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &connection{driver: "postgres", address: "db", user: "monitor"}
+	cached := &cachedToken{}
+	if err := cached.refresh(p, conn, time.Minute); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer cached.timer.Stop()
+	expected := credentials{user: "v-readonly-1", password: "pw", lease: "database/creds/readonly/1"}
+	if cached.value != expected {
+		t.Errorf("expected credentials %+v, got %+v", expected, cached.value)
+	}
+	if time.Until(cached.expiry) < 59*time.Minute {
+		t.Errorf("expected the lease duration as expiry, got %v", cached.expiry)
+	}
+	// the lease is renewed instead of issuing new credentials
+	if err := cached.refresh(p, conn, time.Minute); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if issued != 1 || renewed != 1 || cached.value != expected {
+		t.Errorf("expected the lease to be renewed, got %d issued and %d renewed credentials", issued, renewed)
+	}
+
+	p, err = newTokenProvider(&Auth{Type: "vault", TokenTTL: time.Minute, Vault: &VaultAuth{Address: server.URL, Path: "secret/data/db", TokenFile: tokenFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, expiry, err := p.token(conn)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if creds != (credentials{user: "monitor", password: "static"}) || time.Until(expiry) > time.Minute {
+		t.Errorf("unexpected KV credentials %+v expiring at %v", creds, expiry)
+	}
+
+	dsn, err := withCredentials("postgres", "postgres://monitor@db/app?sslmode=disable", expected.user, expected.password, false)
+	if err != nil || dsn != "postgres://v-readonly-1:pw@db/app?sslmode=disable" {
+		t.Errorf("unexpected DSN %q, err %v", dsn, err)
+	}
+}